@@ -0,0 +1,89 @@
+package admin
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence"
+)
+
+type AccountTable interface {
+	ExportUser(ctx context.Context, id int32) (*persistence.UserExport, error)
+	DeleteUser(ctx context.Context, id int32, reason string) error
+}
+
+// AccountAdmin serves the admin api for exporting and deleting a user's data, e.g. to
+// answer a request sent by email
+type AccountAdmin struct {
+	accountTable AccountTable
+	cache        AuthStateCache
+}
+
+func NewAccountAdmin(accountTable AccountTable, cache AuthStateCache) *AccountAdmin {
+	return &AccountAdmin{
+		accountTable: accountTable,
+		cache:        cache,
+	}
+}
+
+func (aa *AccountAdmin) HandleExportUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := parseUserID(r)
+	if err != nil {
+		log.Printf("Failed to parse user id: %v", err)
+		http.Error(w, "Invalid user id", http.StatusBadRequest)
+		return
+	}
+
+	export, err := aa.accountTable.ExportUser(r.Context(), userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to export user: %v", err)
+		http.Error(w, "Failed to export user", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, export)
+}
+
+// HandleDeleteUser anonymizes the user and deletes the rest of their data. The body may
+// give a reason, which is kept as the user's status reason.
+func (aa *AccountAdmin) HandleDeleteUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := parseUserID(r)
+	if err != nil {
+		log.Printf("Failed to parse user id: %v", err)
+		http.Error(w, "Invalid user id", http.StatusBadRequest)
+		return
+	}
+
+	request := struct {
+		Reason string `json:"reason"`
+	}{Reason: "deleted by admin"}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil && !errors.Is(err, io.EOF) {
+		log.Printf("Failed to decode delete request: %v", err)
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	err = aa.accountTable.DeleteUser(r.Context(), userID, request.Reason)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to delete user: %v", err)
+		http.Error(w, "Failed to delete user", http.StatusInternalServerError)
+		return
+	}
+	aa.cache.Invalidate(userID)
+	log.Printf("User %d deleted: %s", userID, request.Reason)
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,82 @@
+package admin
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence"
+)
+
+// fakeAccountTable keeps the exports of users not yet deleted, and the reasons given
+// for deletions
+type fakeAccountTable struct {
+	exports map[int32]*persistence.UserExport
+	reasons map[int32]string
+}
+
+func (f *fakeAccountTable) ExportUser(ctx context.Context, id int32) (*persistence.UserExport, error) {
+	export, ok := f.exports[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return export, nil
+}
+
+func (f *fakeAccountTable) DeleteUser(ctx context.Context, id int32, reason string) error {
+	if _, ok := f.exports[id]; !ok {
+		return sql.ErrNoRows
+	}
+	delete(f.exports, id)
+	f.reasons[id] = reason
+	return nil
+}
+
+func TestAccountAdmin(t *testing.T) {
+	accounts := &fakeAccountTable{
+		exports: map[int32]*persistence.UserExport{
+			7: {User: &persistence.UserActivity{UserInfo: persistence.UserInfo{ID: 7, LoginName: "octocat"}}},
+			8: {User: &persistence.UserActivity{UserInfo: persistence.UserInfo{ID: 8, LoginName: "hubot"}}},
+		},
+		reasons: map[int32]string{},
+	}
+	cache := &fakeAuthStateCache{}
+	accountAdmin := NewAccountAdmin(accounts, cache)
+
+	serve := func(handler http.HandlerFunc, method, userID, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/admin/users/"+userID, strings.NewReader(body))
+		req.SetPathValue("id", userID)
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+
+	t.Run("Test exporting a user", func(t *testing.T) {
+		rec := serve(accountAdmin.HandleExportUser, "GET", "7", "")
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		var export persistence.UserExport
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&export))
+		assert.Equal(t, "octocat", export.User.LoginName)
+
+		assert.Equal(t, http.StatusNotFound, serve(accountAdmin.HandleExportUser, "GET", "9", "").Code)
+		assert.Equal(t, http.StatusBadRequest, serve(accountAdmin.HandleExportUser, "GET", "x", "").Code)
+	})
+
+	t.Run("Test deleting users", func(t *testing.T) {
+		assert.Equal(t, http.StatusNoContent, serve(accountAdmin.HandleDeleteUser, "POST", "7", "").Code)
+		assert.Equal(t, "deleted by admin", accounts.reasons[7])
+		assert.Equal(t, http.StatusNoContent, serve(accountAdmin.HandleDeleteUser, "POST", "8", `{"reason":"requested by email"}`).Code)
+		assert.Equal(t, "requested by email", accounts.reasons[8])
+		assert.Equal(t, fakeAuthStateCache{7, 8}, *cache)
+
+		assert.Equal(t, http.StatusNotFound, serve(accountAdmin.HandleDeleteUser, "POST", "7", "").Code)
+		assert.Equal(t, http.StatusBadRequest, serve(accountAdmin.HandleDeleteUser, "POST", "9", "{").Code)
+	})
+}
@@ -0,0 +1,138 @@
+package admin
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/auth"
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence"
+)
+
+type ClientTable interface {
+	GetClients(ctx context.Context) ([]*persistence.Client, error)
+	SaveClient(ctx context.Context, client *persistence.Client) error
+	SetClientSecret(ctx context.Context, clientID string, secretHash []byte) error
+	DeleteClient(ctx context.Context, clientID string) error
+}
+
+// ClientCache is told when clients change so the change applies right away
+type ClientCache interface {
+	Invalidate()
+}
+
+// ClientAdmin serves the admin api for the applications logging in through Zuul
+type ClientAdmin struct {
+	clientTable ClientTable
+	cache       ClientCache
+}
+
+func NewClientAdmin(clientTable ClientTable, cache ClientCache) *ClientAdmin {
+	return &ClientAdmin{
+		clientTable: clientTable,
+		cache:       cache,
+	}
+}
+
+func (ca *ClientAdmin) HandleGetClients(w http.ResponseWriter, r *http.Request) {
+	clients, err := ca.clientTable.GetClients(r.Context())
+	if err != nil {
+		log.Printf("Failed to get clients: %v", err)
+		http.Error(w, "Failed to get clients", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, clients)
+}
+
+// HandleSaveClient creates or replaces a client's settings. Its secret, if any, is kept.
+func (ca *ClientAdmin) HandleSaveClient(w http.ResponseWriter, r *http.Request) {
+	var client persistence.Client
+	if err := json.NewDecoder(r.Body).Decode(&client); err != nil {
+		log.Printf("Failed to decode client request: %v", err)
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	client.ClientID = r.PathValue("id")
+	for _, redirectURI := range client.RedirectURIs {
+		parsed, err := url.Parse(redirectURI)
+		if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+			http.Error(w, "Invalid redirect uri: "+redirectURI, http.StatusBadRequest)
+			return
+		}
+	}
+	if slices.Contains(client.AllowedOrigins, "*") {
+		http.Error(w, "Clients can't allow any origin", http.StatusBadRequest)
+		return
+	}
+	if client.TokenLifetimeSeconds < 0 {
+		http.Error(w, "Invalid token lifetime", http.StatusBadRequest)
+		return
+	}
+	if client.TokenPath == "" {
+		client.TokenPath = "/"
+	}
+
+	err := ca.clientTable.SaveClient(r.Context(), &client)
+	if err != nil {
+		log.Printf("Failed to save client: %v", err)
+		http.Error(w, "Failed to save client", http.StatusInternalServerError)
+		return
+	}
+	ca.cache.Invalidate()
+	log.Printf("Client %s saved", client.ClientID)
+
+	writeJSON(w, client)
+}
+
+// HandleRotateSecret gives the client a new secret, returned only in this response
+func (ca *ClientAdmin) HandleRotateSecret(w http.ResponseWriter, r *http.Request) {
+	clientID := r.PathValue("id")
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		log.Printf("Failed to generate client secret: %v", err)
+		http.Error(w, "Failed to generate secret", http.StatusInternalServerError)
+		return
+	}
+	secret := base64.RawURLEncoding.EncodeToString(raw)
+
+	err := ca.clientTable.SetClientSecret(r.Context(), clientID, auth.HashClientSecret(secret))
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Client not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to set client secret: %v", err)
+		http.Error(w, "Failed to set client secret", http.StatusInternalServerError)
+		return
+	}
+	ca.cache.Invalidate()
+	log.Printf("Secret rotated for client %s", clientID)
+
+	writeJSON(w, map[string]string{"client_id": clientID, "client_secret": secret})
+}
+
+func (ca *ClientAdmin) HandleDeleteClient(w http.ResponseWriter, r *http.Request) {
+	clientID := r.PathValue("id")
+	err := ca.clientTable.DeleteClient(r.Context(), clientID)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Client not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to delete client: %v", err)
+		http.Error(w, "Failed to delete client", http.StatusInternalServerError)
+		return
+	}
+	ca.cache.Invalidate()
+	log.Printf("Client %s deleted", clientID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
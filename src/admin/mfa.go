@@ -0,0 +1,89 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence"
+)
+
+type MFATable interface {
+	ResetSecondFactors(ctx context.Context, userID int32) error
+}
+
+type OrgPolicyTable interface {
+	GetOrgPolicy(ctx context.Context, orgID string) (*persistence.OrgPolicy, error)
+	SetOrgPolicy(ctx context.Context, policy *persistence.OrgPolicy) error
+}
+
+// MFAAdmin serves the admin api for second factors and the org policies requiring them
+type MFAAdmin struct {
+	mfaTable       MFATable
+	orgPolicyTable OrgPolicyTable
+	cache          AuthStateCache
+}
+
+func NewMFAAdmin(mfaTable MFATable, orgPolicyTable OrgPolicyTable, cache AuthStateCache) *MFAAdmin {
+	return &MFAAdmin{
+		mfaTable:       mfaTable,
+		orgPolicyTable: orgPolicyTable,
+		cache:          cache,
+	}
+}
+
+// HandleResetSecondFactors removes all of a user's second factors, e.g. after they lose
+// their phone and recovery codes. Their existing sessions end.
+func (ma *MFAAdmin) HandleResetSecondFactors(w http.ResponseWriter, r *http.Request) {
+	userID, err := parseUserID(r)
+	if err != nil {
+		log.Printf("Failed to parse user id: %v", err)
+		http.Error(w, "Invalid user id", http.StatusBadRequest)
+		return
+	}
+
+	err = ma.mfaTable.ResetSecondFactors(r.Context(), userID)
+	if err != nil {
+		log.Printf("Failed to reset second factors: %v", err)
+		http.Error(w, "Failed to reset second factors", http.StatusInternalServerError)
+		return
+	}
+	ma.cache.Invalidate(userID)
+	log.Printf("Second factors reset for user %d", userID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (ma *MFAAdmin) HandleGetOrgPolicy(w http.ResponseWriter, r *http.Request) {
+	policy, err := ma.orgPolicyTable.GetOrgPolicy(r.Context(), r.PathValue("org"))
+	if err != nil {
+		log.Printf("Failed to get org policy: %v", err)
+		http.Error(w, "Failed to get org policy", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, policy)
+}
+
+func (ma *MFAAdmin) HandleSetOrgPolicy(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Require2FA bool `json:"require_2fa"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		log.Printf("Failed to decode org policy request: %v", err)
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	orgID := r.PathValue("org")
+	err := ma.orgPolicyTable.SetOrgPolicy(r.Context(), &persistence.OrgPolicy{OrgID: orgID, Require2FA: request.Require2FA})
+	if err != nil {
+		log.Printf("Failed to set org policy: %v", err)
+		http.Error(w, "Failed to set org policy", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Org %s now requires 2fa: %t", orgID, request.Require2FA)
+
+	ma.HandleGetOrgPolicy(w, r)
+}
@@ -0,0 +1,156 @@
+package admin
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence"
+)
+
+type PermissionTable interface {
+	GetUserPermissions(ctx context.Context, userID int32) ([]*persistence.OrgPermission, error)
+	GetOrgPermissions(ctx context.Context, orgID string) ([]*persistence.OrgPermission, error)
+	GetPermissionsForUsers(ctx context.Context, userIDs []int32) ([]*persistence.UserPermission, error)
+	GrantPermission(ctx context.Context, userID int32, orgID, permission string) error
+	RevokePermission(ctx context.Context, userID int32, orgID string) error
+}
+
+// PermissionAdmin serves the admin api for granting and revoking org permissions
+type PermissionAdmin struct {
+	permissionTable PermissionTable
+	cache           AuthStateCache
+}
+
+func NewPermissionAdmin(permissionTable PermissionTable, cache AuthStateCache) *PermissionAdmin {
+	return &PermissionAdmin{
+		permissionTable: permissionTable,
+		cache:           cache,
+	}
+}
+
+func (pa *PermissionAdmin) HandleGetUserPermissions(w http.ResponseWriter, r *http.Request) {
+	userID, err := parseUserID(r)
+	if err != nil {
+		log.Printf("Failed to parse user id: %v", err)
+		http.Error(w, "Invalid user id", http.StatusBadRequest)
+		return
+	}
+
+	permissions, err := pa.permissionTable.GetUserPermissions(r.Context(), userID)
+	if err != nil {
+		log.Printf("Failed to get user permissions: %v", err)
+		http.Error(w, "Failed to get permissions", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, permissions)
+}
+
+// HandleFindPermissions lists the grants on an org (?org_id=) or of several users
+// (?user_id=1&user_id=2)
+func (pa *PermissionAdmin) HandleFindPermissions(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if orgID := query.Get("org_id"); orgID != "" {
+		permissions, err := pa.permissionTable.GetOrgPermissions(r.Context(), orgID)
+		if err != nil {
+			log.Printf("Failed to get org permissions: %v", err)
+			http.Error(w, "Failed to get permissions", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, permissions)
+		return
+	}
+
+	userIDs := []int32{}
+	for _, value := range query["user_id"] {
+		userID, err := strconv.ParseInt(value, 10, 32)
+		if err != nil {
+			http.Error(w, "Invalid user id: "+value, http.StatusBadRequest)
+			return
+		}
+		userIDs = append(userIDs, int32(userID))
+	}
+	if len(userIDs) == 0 {
+		http.Error(w, "Either org_id or user_id is required", http.StatusBadRequest)
+		return
+	}
+
+	permissions, err := pa.permissionTable.GetPermissionsForUsers(r.Context(), userIDs)
+	if err != nil {
+		log.Printf("Failed to get permissions for users: %v", err)
+		http.Error(w, "Failed to get permissions", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, permissions)
+}
+
+// HandleGrantPermission sets the user's permission on the org in the path, which may be
+// an org/team. Changing an existing grant ends the user's sessions.
+func (pa *PermissionAdmin) HandleGrantPermission(w http.ResponseWriter, r *http.Request) {
+	userID, err := parseUserID(r)
+	if err != nil {
+		log.Printf("Failed to parse user id: %v", err)
+		http.Error(w, "Invalid user id", http.StatusBadRequest)
+		return
+	}
+	orgID := r.PathValue("org")
+
+	var request struct {
+		Permission string `json:"permission"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		log.Printf("Failed to decode permission request: %v", err)
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if request.Permission == "" {
+		http.Error(w, "Invalid permission", http.StatusBadRequest)
+		return
+	}
+
+	err = pa.permissionTable.GrantPermission(r.Context(), userID, orgID, request.Permission)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to grant permission: %v", err)
+		http.Error(w, "Failed to grant permission", http.StatusInternalServerError)
+		return
+	}
+	pa.cache.Invalidate(userID)
+	log.Printf("User %d granted %s on %s", userID, request.Permission, orgID)
+
+	writeJSON(w, persistence.OrgPermission{UserID: userID, OrgID: orgID, Permission: request.Permission})
+}
+
+// HandleRevokePermission removes the user's grant on the org and ends their sessions
+func (pa *PermissionAdmin) HandleRevokePermission(w http.ResponseWriter, r *http.Request) {
+	userID, err := parseUserID(r)
+	if err != nil {
+		log.Printf("Failed to parse user id: %v", err)
+		http.Error(w, "Invalid user id", http.StatusBadRequest)
+		return
+	}
+	orgID := r.PathValue("org")
+
+	err = pa.permissionTable.RevokePermission(r.Context(), userID, orgID)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Permission not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to revoke permission: %v", err)
+		http.Error(w, "Failed to revoke permission", http.StatusInternalServerError)
+		return
+	}
+	pa.cache.Invalidate(userID)
+	log.Printf("User %d lost their permission on %s", userID, orgID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,80 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence"
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence/memory"
+)
+
+// fakeAuthStateCache records the users whose cached state was invalidated
+type fakeAuthStateCache []int32
+
+func (f *fakeAuthStateCache) Invalidate(id int32) {
+	*f = append(*f, id)
+}
+
+func TestPermissionAdmin(t *testing.T) {
+	ctx := context.Background()
+	store := memory.NewStore()
+	require.NoError(t, store.UpdateUser(ctx, &persistence.UserInfo{ID: 7, LoginName: "octocat"}))
+	cache := &fakeAuthStateCache{}
+	permissionAdmin := NewPermissionAdmin(store, cache)
+
+	serve := func(handler http.HandlerFunc, method, target, userID, org, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.SetPathValue("id", userID)
+		req.SetPathValue("org", org)
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+
+	t.Run("Test granting a permission", func(t *testing.T) {
+		rec := serve(permissionAdmin.HandleGrantPermission, "PUT", "/admin/users/7/permissions/coopstools/ops", "7", "coopstools/ops", `{"permission": "write"}`)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		assert.Equal(t, fakeAuthStateCache{7}, *cache)
+
+		rec = serve(permissionAdmin.HandleGetUserPermissions, "GET", "/admin/users/7/permissions", "7", "", "")
+		var permissions []*persistence.OrgPermission
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&permissions))
+		assert.Equal(t, []*persistence.OrgPermission{{UserID: 7, OrgID: "coopstools/ops", Permission: "write"}}, permissions)
+
+		rec = serve(permissionAdmin.HandleFindPermissions, "GET", "/admin/permissions?user_id=7", "", "", "")
+		var userPermissions []*persistence.UserPermission
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&userPermissions))
+		require.Len(t, userPermissions, 1)
+		assert.Equal(t, "octocat", userPermissions[0].LoginName)
+	})
+
+	t.Run("Test refusing bad grants", func(t *testing.T) {
+		rec := serve(permissionAdmin.HandleGrantPermission, "PUT", "/admin/users/8/permissions/coopstools", "8", "coopstools", `{"permission": "read"}`)
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+		rec = serve(permissionAdmin.HandleGrantPermission, "PUT", "/admin/users/7/permissions/coopstools", "7", "coopstools", `{}`)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		rec = serve(permissionAdmin.HandleFindPermissions, "GET", "/admin/permissions?user_id=x", "", "", "")
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+
+	t.Run("Test revoking a permission", func(t *testing.T) {
+		rec := serve(permissionAdmin.HandleRevokePermission, "DELETE", "/admin/users/7/permissions/coopstools/ops", "7", "coopstools/ops", "")
+		assert.Equal(t, http.StatusNoContent, rec.Code)
+		state, err := store.GetAuthState(ctx, 7)
+		require.NoError(t, err)
+		assert.NotNil(t, state.TokensNotBefore)
+
+		rec = serve(permissionAdmin.HandleFindPermissions, "GET", "/admin/permissions?org_id=coopstools/ops", "", "", "")
+		assert.JSONEq(t, `[]`, rec.Body.String())
+
+		rec = serve(permissionAdmin.HandleRevokePermission, "DELETE", "/admin/users/7/permissions/coopstools/ops", "7", "coopstools/ops", "")
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	})
+}
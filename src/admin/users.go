@@ -0,0 +1,174 @@
+package admin
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence"
+)
+
+type UserTable interface {
+	GetUserStatus(ctx context.Context, id int32) (*persistence.UserStatus, error)
+	SetUserStatus(ctx context.Context, id int32, status, reason string) error
+	GetInactiveUsers(ctx context.Context, since time.Time) ([]*persistence.UserActivity, error)
+	GetLoginEvents(ctx context.Context, userID int32, limit int) ([]*persistence.LoginEvent, error)
+}
+
+const (
+	defaultInactiveDays = 90
+	defaultLoginLimit   = 50
+	maxLoginLimit       = 500
+)
+
+// AuthStateCache is notified of status changes so they apply to this instance immediately
+type AuthStateCache interface {
+	Invalidate(id int32)
+}
+
+// UserAdmin serves the admin api for managing users
+type UserAdmin struct {
+	userTable UserTable
+	cache     AuthStateCache
+}
+
+func NewUserAdmin(userTable UserTable, cache AuthStateCache) *UserAdmin {
+	return &UserAdmin{
+		userTable: userTable,
+		cache:     cache,
+	}
+}
+
+func parseUserID(r *http.Request) (int32, error) {
+	userID, err := strconv.ParseInt(r.PathValue("id"), 10, 32)
+	return int32(userID), err
+}
+
+// parsePositiveInt reads an optional positive query parameter
+func parsePositiveInt(r *http.Request, name string, defaultValue int) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	number, err := strconv.Atoi(value)
+	if err == nil && number <= 0 {
+		err = errors.New(name + " must be positive")
+	}
+	return number, err
+}
+
+func writeJSON(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(data)
+}
+
+func (ua *UserAdmin) HandleGetUserStatus(w http.ResponseWriter, r *http.Request) {
+	userID, err := parseUserID(r)
+	if err != nil {
+		log.Printf("Failed to parse user id: %v", err)
+		http.Error(w, "Invalid user id", http.StatusBadRequest)
+		return
+	}
+
+	status, err := ua.userTable.GetUserStatus(r.Context(), userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to get user status: %v", err)
+		http.Error(w, "Failed to get user status", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, status)
+}
+
+func (ua *UserAdmin) HandleSetUserStatus(w http.ResponseWriter, r *http.Request) {
+	userID, err := parseUserID(r)
+	if err != nil {
+		log.Printf("Failed to parse user id: %v", err)
+		http.Error(w, "Invalid user id", http.StatusBadRequest)
+		return
+	}
+
+	var request struct {
+		Status string `json:"status"`
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		log.Printf("Failed to decode status request: %v", err)
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !persistence.IsValidUserStatus(request.Status) {
+		http.Error(w, "Invalid status", http.StatusBadRequest)
+		return
+	}
+
+	err = ua.userTable.SetUserStatus(r.Context(), userID, request.Status, request.Reason)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to set user status: %v", err)
+		http.Error(w, "Failed to set user status", http.StatusInternalServerError)
+		return
+	}
+	ua.cache.Invalidate(userID)
+	log.Printf("User %d is now %s: %s", userID, request.Status, request.Reason)
+
+	ua.HandleGetUserStatus(w, r)
+}
+
+// HandleGetInactiveUsers lists the users who haven't logged in for ?days (default 90),
+// those who never logged in first
+func (ua *UserAdmin) HandleGetInactiveUsers(w http.ResponseWriter, r *http.Request) {
+	days, err := parsePositiveInt(r, "days", defaultInactiveDays)
+	if err != nil {
+		log.Printf("Failed to parse days: %v", err)
+		http.Error(w, "Invalid days", http.StatusBadRequest)
+		return
+	}
+
+	users, err := ua.userTable.GetInactiveUsers(r.Context(), time.Now().AddDate(0, 0, -days))
+	if err != nil {
+		log.Printf("Failed to get inactive users: %v", err)
+		http.Error(w, "Failed to get inactive users", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, users)
+}
+
+// HandleGetLoginHistory lists the user's most recent logins, newest first, up to ?limit
+// (default 50, at most 500)
+func (ua *UserAdmin) HandleGetLoginHistory(w http.ResponseWriter, r *http.Request) {
+	userID, err := parseUserID(r)
+	if err != nil {
+		log.Printf("Failed to parse user id: %v", err)
+		http.Error(w, "Invalid user id", http.StatusBadRequest)
+		return
+	}
+	limit, err := parsePositiveInt(r, "limit", defaultLoginLimit)
+	if err != nil {
+		log.Printf("Failed to parse limit: %v", err)
+		http.Error(w, "Invalid limit", http.StatusBadRequest)
+		return
+	}
+
+	events, err := ua.userTable.GetLoginEvents(r.Context(), userID, min(limit, maxLoginLimit))
+	if err != nil {
+		log.Printf("Failed to get login history: %v", err)
+		http.Error(w, "Failed to get login history", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, events)
+}
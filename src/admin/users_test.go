@@ -0,0 +1,56 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence"
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence/memory"
+)
+
+func TestUserActivity(t *testing.T) {
+	ctx := context.Background()
+	store := memory.NewStore()
+	require.NoError(t, store.UpdateUser(ctx, &persistence.UserInfo{ID: 7, LoginName: "octocat"}))
+	for _, agent := range []string{"first", "second", "third"} {
+		require.NoError(t, store.RecordLogin(ctx, &persistence.LoginEvent{UserID: 7, UserAgent: agent, Provider: "github"}))
+	}
+	userAdmin := NewUserAdmin(store, &fakeAuthStateCache{})
+
+	serve := func(handler http.HandlerFunc, target, userID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		req.SetPathValue("id", userID)
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+
+	t.Run("Test listing login history", func(t *testing.T) {
+		rec := serve(userAdmin.HandleGetLoginHistory, "/admin/users/7/logins?limit=2", "7")
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		var events []*persistence.LoginEvent
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&events))
+		require.Len(t, events, 2)
+		assert.Equal(t, "third", events[0].UserAgent)
+		assert.Equal(t, "second", events[1].UserAgent)
+
+		assert.Equal(t, http.StatusBadRequest, serve(userAdmin.HandleGetLoginHistory, "/admin/users/7/logins?limit=0", "7").Code)
+		assert.Equal(t, http.StatusBadRequest, serve(userAdmin.HandleGetLoginHistory, "/admin/users/x/logins", "x").Code)
+	})
+
+	t.Run("Test listing inactive users", func(t *testing.T) {
+		rec := serve(userAdmin.HandleGetInactiveUsers, "/admin/users/inactive", "")
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		var users []*persistence.UserActivity
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&users))
+		assert.Empty(t, users, "octocat just logged in")
+
+		assert.Equal(t, http.StatusBadRequest, serve(userAdmin.HandleGetInactiveUsers, "/admin/users/inactive?days=-3", "").Code)
+	})
+}
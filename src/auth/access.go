@@ -0,0 +1,54 @@
+package auth
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/config"
+	"github.com/coopstools-homebrew/I-am-zuul/src/verifier"
+)
+
+// AccessPolicy finds the rule governing a request made behind Zuul
+type AccessPolicy struct {
+	rules []config.AccessRule
+}
+
+func NewAccessPolicy(rules []config.AccessRule) *AccessPolicy {
+	return &AccessPolicy{rules: rules}
+}
+
+// Match returns the rule with the longest path prefix matching the request, or nil if
+// none do, in which case any authenticated user is let through
+func (p *AccessPolicy) Match(host, method, path string) *config.AccessRule {
+	i := p.MatchIndex(host, method, path)
+	if i < 0 {
+		return nil
+	}
+	return &p.rules[i]
+}
+
+// MatchIndex is Match returning the index of the rule, or -1
+func (p *AccessPolicy) MatchIndex(host, method, path string) int {
+	match := -1
+	for i := range p.rules {
+		rule := &p.rules[i]
+		if rule.Host != "" && !strings.EqualFold(rule.Host, host) {
+			continue
+		}
+		if len(rule.Methods) > 0 && !slices.ContainsFunc(rule.Methods, func(m string) bool { return strings.EqualFold(m, method) }) {
+			continue
+		}
+		if !verifier.PathInScope(rule.PathPrefix, path) {
+			continue
+		}
+		if match < 0 || len(rule.PathPrefix) > len(p.rules[match].PathPrefix) {
+			match = i
+		}
+	}
+	return match
+}
+
+// Allows reports whether the caller satisfies the rule's permission requirement
+func Allows(rule *config.AccessRule, claims *verifier.Claims) bool {
+	return rule == nil || rule.OrgID == "" || claims.HasPermission(rule.OrgID, rule.Permission)
+}
@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence"
+	"github.com/coopstools-homebrew/I-am-zuul/src/verifier"
+)
+
+// AccountTable exports and deletes everything stored about a user
+type AccountTable interface {
+	ExportUser(ctx context.Context, id int32) (*persistence.UserExport, error)
+	DeleteUser(ctx context.Context, id int32, reason string) error
+}
+
+// AccountHandler lets users download their data and delete their account
+type AccountHandler struct {
+	accounts AccountTable
+	cache    *AuthStateCache
+}
+
+func NewAccountHandler(accounts AccountTable, cache *AuthStateCache) *AccountHandler {
+	return &AccountHandler{
+		accounts: accounts,
+		cache:    cache,
+	}
+}
+
+// HandleExport returns the caller's data as a json download
+func (h *AccountHandler) HandleExport(w http.ResponseWriter, r *http.Request) {
+	claims, ok := verifier.FromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	export, err := h.accounts.ExportUser(r.Context(), claims.UserID)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to export user %d: %v", claims.UserID, err)
+		http.Error(w, "Failed to export user", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="zuul-export-%d.json"`, claims.UserID))
+	writeJSON(w, http.StatusOK, export)
+}
+
+// HandleDelete deletes the caller's account. The request has to be json naming the
+// caller's login, so a form posted from another site can't delete it.
+func (h *AccountHandler) HandleDelete(w http.ResponseWriter, r *http.Request) {
+	claims, ok := verifier.FromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		http.Error(w, "Unsupported Media Type - Expected application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+	var request struct {
+		Confirm string `json:"confirm"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Bad Request - Invalid body", http.StatusBadRequest)
+		return
+	}
+	if request.Confirm != claims.Username {
+		http.Error(w, "Bad Request - confirm must be your login", http.StatusBadRequest)
+		return
+	}
+
+	err := h.accounts.DeleteUser(r.Context(), claims.UserID, "deleted by user")
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to delete user %d: %v", claims.UserID, err)
+		http.Error(w, "Failed to delete user", http.StatusInternalServerError)
+		return
+	}
+	h.cache.Invalidate(claims.UserID)
+	log.Printf("User %d deleted their account", claims.UserID)
+
+	ClearCookie(w)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,116 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence"
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence/memory"
+	"github.com/coopstools-homebrew/I-am-zuul/src/verifier"
+)
+
+// fakeAccountTable exports and deletes the users in a memory.Store, which keeps no
+// second factors
+type fakeAccountTable struct {
+	*memory.Store
+}
+
+func (f fakeAccountTable) ExportUser(ctx context.Context, id int32) (*persistence.UserExport, error) {
+	user, err := f.GetUserByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	export := &persistence.UserExport{User: &persistence.UserActivity{UserInfo: *user}, ExportedAt: time.Now().UTC()}
+	if export.Permissions, err = f.GetUserPermissions(ctx, id); err != nil {
+		return nil, err
+	}
+	export.Logins, err = f.GetLoginEvents(ctx, id, math.MaxInt32)
+	return export, err
+}
+
+func (f fakeAccountTable) DeleteUser(ctx context.Context, id int32, reason string) error {
+	permissions, err := f.GetUserPermissions(ctx, id)
+	if err != nil {
+		return err
+	}
+	for _, permission := range permissions {
+		if err = f.RevokePermission(ctx, id, permission.OrgID); err != nil {
+			return err
+		}
+	}
+	placeholder := fmt.Sprintf("deleted-%d", id)
+	if err = f.UpdateUser(ctx, &persistence.UserInfo{ID: id, LoginName: placeholder, Email: placeholder}); err != nil {
+		return err
+	}
+	return f.SetUserStatus(ctx, id, persistence.UserStatusDeleted, reason)
+}
+
+func TestAccountHandler(t *testing.T) {
+	ctx := context.Background()
+	store := memory.NewStore()
+	require.NoError(t, store.UpdateUser(ctx, &persistence.UserInfo{ID: 8, LoginName: "leaver"}))
+	require.NoError(t, store.GrantPermission(ctx, 8, "org", "read"))
+	cache := NewAuthStateCache(store, time.Hour)
+	handler := NewAccountHandler(fakeAccountTable{store}, cache)
+	claims := &verifier.Claims{UserID: 8, Username: "leaver"}
+
+	serve := func(handlerFunc http.HandlerFunc, method, contentType, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/me", strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		req = req.WithContext(verifier.NewContext(req.Context(), claims))
+		rec := httptest.NewRecorder()
+		handlerFunc(rec, req)
+		return rec
+	}
+
+	t.Run("Test exporting the caller's data", func(t *testing.T) {
+		rec := serve(handler.HandleExport, "GET", "", "")
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		assert.Contains(t, rec.Header().Get("Content-Disposition"), "zuul-export-8.json")
+		var export persistence.UserExport
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&export))
+		assert.Equal(t, "leaver", export.User.LoginName)
+		assert.Len(t, export.Permissions, 1)
+	})
+
+	t.Run("Test deleting needs a json confirmation", func(t *testing.T) {
+		assert.Equal(t, http.StatusUnsupportedMediaType, serve(handler.HandleDelete, "POST", "text/plain", `{"confirm":"leaver"}`).Code)
+		assert.Equal(t, http.StatusBadRequest, serve(handler.HandleDelete, "POST", "application/json", `{"confirm":"someone"}`).Code)
+		status, err := store.GetUserStatus(ctx, 8)
+		require.NoError(t, err)
+		assert.Equal(t, persistence.UserStatusActive, status.Status)
+	})
+
+	t.Run("Test deleting the caller's account", func(t *testing.T) {
+		_, err := cache.GetAuthState(ctx, 8)
+		require.NoError(t, err)
+
+		rec := serve(handler.HandleDelete, "POST", "application/json; charset=utf-8", `{"confirm":"leaver"}`)
+		require.Equal(t, http.StatusNoContent, rec.Code, rec.Body.String())
+		cookies := rec.Result().Cookies()
+		require.Len(t, cookies, 1)
+		assert.Equal(t, "auth_token", cookies[0].Name)
+		assert.Negative(t, cookies[0].MaxAge)
+
+		state, err := cache.GetAuthState(ctx, 8)
+		require.NoError(t, err)
+		assert.Equal(t, persistence.UserStatusDeleted, state.Status, "the cached state should be dropped")
+
+		rec = serve(handler.HandleExport, "GET", "", "")
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		var export persistence.UserExport
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&export))
+		assert.Equal(t, "deleted-8", export.User.LoginName, "only the anonymized user is left")
+		assert.Empty(t, export.Permissions)
+	})
+}
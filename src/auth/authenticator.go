@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence"
+	"github.com/coopstools-homebrew/I-am-zuul/src/verifier"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrUnknownUser  = errors.New("unknown user")
+	ErrTokenRevoked = errors.New("token revoked")
+	// The token is fine but its state could not be checked
+	ErrAuthStateUnavailable = fmt.Errorf("failed to get auth state: %w", verifier.ErrUnavailable)
+)
+
+type AuthStateTable interface {
+	GetAuthState(ctx context.Context, id int32) (*persistence.AuthState, error)
+}
+
+// Authenticator validates tokens and checks them against the user's current auth state.
+// It is shared by the http middleware and the grpc interceptors.
+type Authenticator struct {
+	publicKey      interface{}
+	parser         *jwt.Parser
+	authStateTable AuthStateTable
+}
+
+func NewAuthenticator(publicKeyString string, authStateTable AuthStateTable) *Authenticator {
+	publicKey, err := jwt.ParseRSAPublicKeyFromPEM([]byte(publicKeyString))
+	if err != nil {
+		log.Fatalf("Failed to parse public key: %v", err)
+	}
+	return &Authenticator{
+		publicKey:      publicKey,
+		parser:         jwt.NewParser(jwt.WithValidMethods([]string{"RS256"})),
+		authStateTable: authStateTable,
+	}
+}
+
+// Verify returns the token's claims. Tokens of suspended or deleted users fail with
+// verifier.ErrPermissionDenied, and those issued before the user's access was revoked, or
+// in the same second, with ErrTokenRevoked.
+func (a *Authenticator) Verify(ctx context.Context, tokenString string) (*verifier.Claims, error) {
+	if tokenString == "" {
+		return nil, verifier.ErrNoToken
+	}
+
+	claims := &verifier.Claims{}
+	_, err := a.parser.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		return a.publicKey, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidToken, err)
+	}
+
+	state, err := a.authStateTable.GetAuthState(ctx, claims.UserID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownUser, claims.UserID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrAuthStateUnavailable, err)
+	}
+	if state.Status != persistence.UserStatusActive {
+		return nil, fmt.Errorf("%w: user %d is %s", verifier.ErrPermissionDenied, claims.UserID, state.Status)
+	}
+	if state.TokensNotBefore != nil && !claims.IssuedAt.After(*state.TokensNotBefore) {
+		return nil, fmt.Errorf("%w: user %d", ErrTokenRevoked, claims.UserID)
+	}
+	return claims, nil
+}
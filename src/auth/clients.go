@@ -0,0 +1,242 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence"
+	"github.com/coopstools-homebrew/I-am-zuul/src/verifier"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	ErrUnknownClient     = errors.New("unknown client")
+	ErrRedirectForbidden = errors.New("redirect_uri not registered for client")
+	ErrScopeForbidden    = errors.New("scope not allowed for client")
+)
+
+// ClientTable lists the registered relying-party applications
+type ClientTable interface {
+	GetClients(ctx context.Context) ([]*persistence.Client, error)
+}
+
+type registeredClient struct {
+	*persistence.Client
+	origins []originMatcher
+}
+
+// ClientRegistry resolves the settings of the applications logging users in through
+// Zuul. Clients are read from the db at most once per ttl, so new rows take effect
+// without a restart. The default client, built from the service's own config, stands in
+// for requests that name no client.
+type ClientRegistry struct {
+	table         ClientTable
+	defaultClient *persistence.Client
+	ttl           time.Duration
+
+	mu       sync.Mutex
+	clients  map[string]*registeredClient
+	loadedAt time.Time
+}
+
+func NewClientRegistry(table ClientTable, defaultClient *persistence.Client, ttl time.Duration) *ClientRegistry {
+	return &ClientRegistry{
+		table:         table,
+		defaultClient: defaultClient,
+		ttl:           ttl,
+	}
+}
+
+// current returns the registered clients, reloading them once they are older than the
+// ttl. If the db can't be read, the last known clients are kept until the next ttl.
+func (cr *ClientRegistry) current() map[string]*registeredClient {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if cr.clients != nil && time.Since(cr.loadedAt) < cr.ttl {
+		return cr.clients
+	}
+	cr.loadedAt = time.Now()
+
+	// The reload serves every waiting request, so it isn't tied to one of their contexts
+	clients, err := cr.table.GetClients(context.Background())
+	if err != nil {
+		log.Printf("Failed to load clients: %v", err)
+		return cr.clients
+	}
+	registered := map[string]*registeredClient{}
+	for _, client := range clients {
+		entry := &registeredClient{Client: client}
+		for _, pattern := range client.AllowedOrigins {
+			// Client origins pass the credentialed CORS policy, so any origin would be any site
+			if pattern == "*" {
+				log.Printf("Ignoring origin * of client %s", client.ClientID)
+				continue
+			}
+			matcher, err := newOriginMatcher(pattern)
+			if err != nil {
+				log.Printf("Ignoring origin of client %s: %v", client.ClientID, err)
+				continue
+			}
+			entry.origins = append(entry.origins, matcher)
+		}
+		registered[client.ClientID] = entry
+	}
+	cr.clients = registered
+	return registered
+}
+
+// Invalidate makes the next lookup read the clients from the db
+func (cr *ClientRegistry) Invalidate() {
+	cr.mu.Lock()
+	cr.clients = nil
+	cr.mu.Unlock()
+}
+
+// Get returns the client, or the default client for an empty id
+func (cr *ClientRegistry) Get(clientID string) (*persistence.Client, error) {
+	if clientID == "" {
+		return cr.defaultClient, nil
+	}
+	client, ok := cr.current()[clientID]
+	if !ok {
+		return nil, ErrUnknownClient
+	}
+	return client.Client, nil
+}
+
+// Authenticate returns the client if the secret is the one issued to it. Clients without
+// a secret can't authenticate.
+func (cr *ClientRegistry) Authenticate(clientID, secret string) (*persistence.Client, bool) {
+	client, ok := cr.current()[clientID]
+	if !ok || client.SecretHash == nil {
+		return nil, false
+	}
+	if subtle.ConstantTimeCompare(HashClientSecret(secret), client.SecretHash) != 1 {
+		return nil, false
+	}
+	return client.Client, true
+}
+
+// OriginAllowed reports whether any registered client allows the origin, letting the
+// CORS middleware accept the origins of clients added after startup
+func (cr *ClientRegistry) OriginAllowed(origin string) bool {
+	scheme, host, ok := parseOrigin(origin)
+	if !ok {
+		return false
+	}
+	for _, client := range cr.current() {
+		for _, matches := range client.origins {
+			if matches(scheme, host) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RedirectAllowed reports whether the uri is one of the default or registered clients'
+// redirect uris
+func (cr *ClientRegistry) RedirectAllowed(uri string) bool {
+	if slices.Contains(cr.defaultClient.RedirectURIs, uri) {
+		return true
+	}
+	for _, client := range cr.current() {
+		if slices.Contains(client.RedirectURIs, uri) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveLogin checks a login request from a client, returning the client along with
+// where to send the user afterwards and the scopes their token will be limited to
+func (cr *ClientRegistry) resolveLogin(clientID, redirectURI, scope string) (*persistence.Client, string, []string, error) {
+	client, err := cr.Get(clientID)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	redirectURI, ok := redirectFor(client, redirectURI)
+	if !ok {
+		return nil, "", nil, ErrRedirectForbidden
+	}
+	scopes, ok := grantScopes(client, strings.Fields(scope))
+	if !ok {
+		return nil, "", nil, ErrScopeForbidden
+	}
+	return client, redirectURI, scopes, nil
+}
+
+// HashClientSecret is how client secrets are stored. Secrets are random, so a plain hash
+// is enough.
+func HashClientSecret(secret string) []byte {
+	hash := sha256.Sum256([]byte(secret))
+	return hash[:]
+}
+
+// redirectFor picks where to send the user after logging in for the client: the
+// requested uri if the client registered it, or else the client's first redirect uri
+func redirectFor(client *persistence.Client, requested string) (string, bool) {
+	if requested == "" {
+		if len(client.RedirectURIs) == 0 {
+			return "", false
+		}
+		return client.RedirectURIs[0], true
+	}
+	return requested, slices.Contains(client.RedirectURIs, requested)
+}
+
+// grantScopes narrows the requested scopes to what the client may have. Clients without
+// allowed scopes get whatever they ask for; asking for nothing gets everything allowed.
+func grantScopes(client *persistence.Client, requested []string) ([]string, bool) {
+	if len(requested) == 0 {
+		return client.AllowedScopes, true
+	}
+	if len(client.AllowedScopes) == 0 {
+		return requested, true
+	}
+	for _, scope := range requested {
+		if !slices.Contains(client.AllowedScopes, scope) {
+			return nil, false
+		}
+	}
+	return requested, true
+}
+
+// scopePermissions keeps the permissions on the scoped orgs. An org's scope covers its
+// "<org>/<team>" grants, and no scopes at all keeps everything.
+func scopePermissions(permissions map[string]string, scopes []string) map[string]string {
+	if len(scopes) == 0 {
+		return permissions
+	}
+	scoped := map[string]string{}
+	for orgID, permission := range permissions {
+		org, _, _ := strings.Cut(orgID, "/")
+		if slices.Contains(scopes, orgID) || slices.Contains(scopes, org) {
+			scoped[orgID] = permission
+		}
+	}
+	return scoped
+}
+
+// forClient applies the client's token settings to claims about to be issued
+func forClient(claims verifier.Claims, client *persistence.Client, scopes []string) verifier.Claims {
+	claims.Path = client.TokenPath
+	claims.Permissions = scopePermissions(claims.Permissions, scopes)
+	claims.Scope = strings.Join(scopes, " ")
+	claims.Audience = nil
+	if client.Audience != "" {
+		claims.Audience = jwt.ClaimStrings{client.Audience}
+	}
+	claims.ExpiresAt = nil
+	if client.TokenLifetimeSeconds > 0 {
+		claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(time.Duration(client.TokenLifetimeSeconds) * time.Second))
+	}
+	return claims
+}
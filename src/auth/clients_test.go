@@ -0,0 +1,169 @@
+package auth
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence"
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence/memory"
+	"github.com/coopstools-homebrew/I-am-zuul/src/verifier"
+)
+
+type fakeClientTable []*persistence.Client
+
+func (f fakeClientTable) GetClients(ctx context.Context) ([]*persistence.Client, error) {
+	return f, nil
+}
+
+func TestClientRegistry(t *testing.T) {
+	table := fakeClientTable{
+		{ClientID: "resume", AllowedOrigins: []string{"https://*.resume.example.com"}},
+		{ClientID: "careless", AllowedOrigins: []string{"*"}},
+	}
+	registry := NewClientRegistry(table, &persistence.Client{RedirectURIs: []string{"https://ui.example.com"}}, time.Hour)
+
+	t.Run("Test registered origins pass CORS", func(t *testing.T) {
+		handler := NewCORSMiddleware(CORSPolicy{
+			AllowedOrigins: []string{"https://ui.example.com"},
+			AllowedMethods: []string{"GET"},
+			OriginSource:   registry,
+		})(func(w http.ResponseWriter, r *http.Request) {})
+
+		for origin, allowed := range map[string]bool{
+			"https://ui.example.com":         true,
+			"https://app.resume.example.com": true,
+			"https://evil.example.com":       false,
+		} {
+			req := httptest.NewRequest("GET", "/data", nil)
+			req.Header.Set("Origin", origin)
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+			assert.Equal(t, allowed, rec.Header().Get("Access-Control-Allow-Origin") == origin, origin)
+		}
+	})
+
+	t.Run("Test clients are reloaded once invalidated", func(t *testing.T) {
+		_, err := registry.Get("blog")
+		assert.ErrorIs(t, err, ErrUnknownClient)
+
+		registry.table = append(table, &persistence.Client{ClientID: "blog"})
+		_, err = registry.Get("blog")
+		assert.ErrorIs(t, err, ErrUnknownClient, "expected the cached clients")
+
+		registry.Invalidate()
+		client, err := registry.Get("blog")
+		require.NoError(t, err)
+		assert.Equal(t, "blog", client.ClientID)
+	})
+}
+
+func TestTokenExchange(t *testing.T) {
+	privateKey, publicKey := newTestKey(t)
+	privateKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
+	issuer := NewTokenIssuer(string(privateKeyPEM), time.Hour)
+	store := memory.NewStore()
+	require.NoError(t, store.UpdateUser(context.Background(), &persistence.UserInfo{ID: 7, LoginName: "octo"}))
+	authenticator := NewAuthenticator(publicKey, store)
+	registry := NewClientRegistry(fakeClientTable{
+		{ClientID: "resume", SecretHash: HashClientSecret("s3cret"), AllowedScopes: []string{"resume", "blog"}, Audience: "resume-api"},
+		{ClientID: "public"},
+	}, &persistence.Client{}, time.Hour)
+	exchange := NewTokenExchange(authenticator, issuer, registry)
+
+	subject, _, err := issuer.Issue(verifier.Claims{
+		UserID:      7,
+		Username:    "octocat",
+		Path:        "/",
+		Permissions: map[string]string{"resume": "read", "blog": "write", "coopstools": "admin"},
+		AMR:         []string{verifier.AMRGitHub},
+	})
+	require.NoError(t, err)
+
+	serve := func(clientID, secret string, form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/oauth/token", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(clientID, secret)
+		rec := httptest.NewRecorder()
+		exchange.HandleToken(rec, req)
+		return rec
+	}
+	exchangeForm := func(subjectToken, scope string) url.Values {
+		return url.Values{
+			"grant_type":         {grantTypeTokenExchange},
+			"subject_token":      {subjectToken},
+			"subject_token_type": {tokenTypeJWT},
+			"scope":              {scope},
+		}
+	}
+
+	t.Run("Test exchanging a token for a client", func(t *testing.T) {
+		rec := serve("resume", "s3cret", exchangeForm(subject, "resume"))
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		var body struct {
+			AccessToken string `json:"access_token"`
+			Scope       string `json:"scope"`
+		}
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&body))
+		assert.Equal(t, "resume", body.Scope)
+
+		claims := &verifier.Claims{}
+		_, err := jwt.ParseWithClaims(body.AccessToken, claims, func(token *jwt.Token) (interface{}, error) {
+			return &privateKey.PublicKey, nil
+		}, jwt.WithAudience("resume-api"))
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{"resume": "read"}, claims.Permissions)
+		assert.Equal(t, []string{verifier.AMRGitHub}, claims.AMR)
+
+		// The exchanged token is the client's, and can't be exchanged again
+		rec = serve("resume", "s3cret", exchangeForm(body.AccessToken, "blog"))
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Contains(t, rec.Body.String(), "invalid_grant")
+	})
+
+	t.Run("Test only exchanging sessions", func(t *testing.T) {
+		restricted, _, err := issuer.Issue(verifier.Claims{UserID: 7, Username: "octocat", Path: "/nowhere"})
+		require.NoError(t, err)
+		rec := serve("resume", "s3cret", exchangeForm(restricted, ""))
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Contains(t, rec.Body.String(), "invalid_grant")
+
+		scoped, _, err := issuer.Issue(verifier.Claims{UserID: 7, Username: "octocat", Path: "/", Scope: "resume", Permissions: map[string]string{"resume": "read"}})
+		require.NoError(t, err)
+		rec = serve("resume", "s3cret", exchangeForm(scoped, "blog"))
+		assert.Contains(t, rec.Body.String(), "invalid_scope", "scoped sessions can't be widened")
+	})
+
+	t.Run("Test refusing bad client credentials", func(t *testing.T) {
+		for _, credentials := range [][2]string{{"resume", "wrong"}, {"public", ""}, {"nobody", "s3cret"}} {
+			rec := serve(credentials[0], credentials[1], exchangeForm(subject, ""))
+			assert.Equal(t, http.StatusUnauthorized, rec.Code, credentials[0])
+		}
+	})
+
+	t.Run("Test refusing bad requests", func(t *testing.T) {
+		rec := serve("resume", "s3cret", exchangeForm(subject, "coopstools"))
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Contains(t, rec.Body.String(), "invalid_scope")
+
+		rec = serve("resume", "s3cret", exchangeForm("not-a-token", ""))
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Contains(t, rec.Body.String(), "invalid_grant")
+
+		form := exchangeForm(subject, "")
+		form.Set("grant_type", "client_credentials")
+		rec = serve("resume", "s3cret", form)
+		assert.Contains(t, rec.Body.String(), "unsupported_grant_type")
+	})
+}
@@ -1,28 +1,237 @@
 package auth
 
 import (
+	"fmt"
+	"log"
 	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 )
 
-func NewCORSMiddleware(allowedOrigins ...string) func(http.HandlerFunc) http.HandlerFunc {
+// CORSPolicy describes which cross-origin requests a route accepts.
+//
+// AllowedOrigins entries may be an exact origin ("https://example.com"), a subdomain
+// wildcard ("https://*.example.com", which does not match the bare domain), a regular
+// expression that must match the whole origin ("regex:^https://pr-[0-9]+\.example\.com$"),
+// or "*" to allow any origin. "*" can't be combined with AllowCredentials, which would let
+// any site make requests with the user's cookies.
+type CORSPolicy struct {
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	ExposedHeaders   []string
+	AllowCredentials bool
+	// How long browsers may cache a preflight response; zero leaves it to the browser
+	MaxAge time.Duration
+	// Allows further origins that can change at runtime, such as registered clients'
+	OriginSource OriginSource
+}
+
+// OriginSource decides on origins outside of a policy's AllowedOrigins
+type OriginSource interface {
+	OriginAllowed(origin string) bool
+}
+
+// WithMethods returns a copy of the policy allowing only the given methods, for routes
+// that need a narrower or wider set than the default
+func (p CORSPolicy) WithMethods(methods ...string) CORSPolicy {
+	p.AllowedMethods = methods
+	return p
+}
+
+// WithHeaders returns a copy of the policy with the given allowed request headers
+func (p CORSPolicy) WithHeaders(headers ...string) CORSPolicy {
+	p.AllowedHeaders = headers
+	return p
+}
+
+type originMatcher func(scheme, host string) bool
+
+func newOriginMatcher(pattern string) (originMatcher, error) {
+	if pattern == "*" {
+		return func(scheme, host string) bool { return true }, nil
+	}
+
+	if expr, found := strings.CutPrefix(pattern, "regex:"); found {
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid origin regex %q: %w", expr, err)
+		}
+		return func(scheme, host string) bool { return re.MatchString(scheme + "://" + host) }, nil
+	}
+
+	allowed, err := url.Parse(strings.ToLower(pattern))
+	if err != nil || allowed.Scheme == "" || allowed.Host == "" {
+		return nil, fmt.Errorf("invalid origin %q", pattern)
+	}
+	if suffix, found := strings.CutPrefix(allowed.Host, "*."); found {
+		suffix = "." + suffix
+		return func(scheme, host string) bool {
+			return scheme == allowed.Scheme && strings.HasSuffix(host, suffix) && len(host) > len(suffix)
+		}, nil
+	}
+	return func(scheme, host string) bool {
+		return scheme == allowed.Scheme && host == allowed.Host
+	}, nil
+}
+
+// parseOrigin splits an Origin header into its lowercased scheme and host
+func parseOrigin(origin string) (string, string, bool) {
+	parsed, err := url.Parse(strings.ToLower(origin))
+	if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+		return "", "", false
+	}
+	return parsed.Scheme, parsed.Host, true
+}
+
+type corsEngine struct {
+	origins          []originMatcher
+	originSource     OriginSource
+	allowedMethods   map[string]bool
+	allowedHeaders   map[string]bool
+	methods          string
+	headers          string
+	exposedHeaders   string
+	allowCredentials bool
+	maxAge           string
+}
+
+func newCORSEngine(policy CORSPolicy) (*corsEngine, error) {
+	if policy.AllowCredentials && slices.Contains(policy.AllowedOrigins, "*") {
+		return nil, fmt.Errorf("origin \"*\" can't be allowed with credentials")
+	}
+	engine := &corsEngine{
+		allowedMethods:   map[string]bool{},
+		allowedHeaders:   map[string]bool{},
+		exposedHeaders:   strings.Join(policy.ExposedHeaders, ", "),
+		allowCredentials: policy.AllowCredentials,
+		originSource:     policy.OriginSource,
+	}
+
+	for _, pattern := range policy.AllowedOrigins {
+		matcher, err := newOriginMatcher(pattern)
+		if err != nil {
+			return nil, err
+		}
+		engine.origins = append(engine.origins, matcher)
+	}
+
+	methods := []string{}
+	for _, method := range policy.AllowedMethods {
+		method = strings.ToUpper(method)
+		engine.allowedMethods[method] = true
+		methods = append(methods, method)
+	}
+	engine.methods = strings.Join(methods, ", ")
+
+	for _, header := range policy.AllowedHeaders {
+		engine.allowedHeaders[http.CanonicalHeaderKey(header)] = true
+	}
+	engine.headers = strings.Join(policy.AllowedHeaders, ", ")
+
+	if policy.MaxAge > 0 {
+		engine.maxAge = strconv.Itoa(int(policy.MaxAge.Seconds()))
+	}
+	return engine, nil
+}
+
+func (e *corsEngine) originAllowed(origin string) bool {
+	scheme, host, ok := parseOrigin(origin)
+	if !ok {
+		return false
+	}
+	for _, matches := range e.origins {
+		if matches(scheme, host) {
+			return true
+		}
+	}
+	return e.originSource != nil && e.originSource.OriginAllowed(origin)
+}
+
+func (e *corsEngine) headersAllowed(requested string) bool {
+	for _, header := range strings.Split(requested, ",") {
+		header = strings.TrimSpace(header)
+		if header != "" && !e.allowedHeaders[http.CanonicalHeaderKey(header)] {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *corsEngine) setOriginHeaders(w http.ResponseWriter, origin string) {
+	// The origin is echoed rather than "*" so credentials keep working with subdomain wildcards
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	if e.allowCredentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// handlePreflight answers a preflight request, rejecting it outright if the origin,
+// method or any requested header is not allowed
+func (e *corsEngine) handlePreflight(w http.ResponseWriter, r *http.Request, origin string) {
+	w.Header().Add("Vary", "Access-Control-Request-Method")
+	w.Header().Add("Vary", "Access-Control-Request-Headers")
+
+	method := strings.ToUpper(r.Header.Get("Access-Control-Request-Method"))
+	requestedHeaders := r.Header.Get("Access-Control-Request-Headers")
+	switch {
+	case !e.originAllowed(origin):
+		log.Printf("Rejected preflight from origin %s", origin)
+	case !e.allowedMethods[method]:
+		log.Printf("Rejected preflight for method %s from %s", method, origin)
+	case !e.headersAllowed(requestedHeaders):
+		log.Printf("Rejected preflight for headers %s from %s", requestedHeaders, origin)
+	default:
+		e.setOriginHeaders(w, origin)
+		w.Header().Set("Access-Control-Allow-Methods", e.methods)
+		if e.headers != "" {
+			w.Header().Set("Access-Control-Allow-Headers", e.headers)
+		}
+		if e.maxAge != "" {
+			w.Header().Set("Access-Control-Max-Age", e.maxAge)
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	http.Error(w, "CORS preflight rejected", http.StatusForbidden)
+}
+
+// NewCORSMiddleware applies the policy to a route. Preflight requests are answered
+// directly; other requests pass through, with CORS headers only for allowed origins.
+func NewCORSMiddleware(policy CORSPolicy) func(http.HandlerFunc) http.HandlerFunc {
+	engine, err := newCORSEngine(policy)
+	if err != nil {
+		log.Fatalf("Failed to parse CORS policy: %v", err)
+	}
+
 	return func(next http.HandlerFunc) http.HandlerFunc {
 		return func(w http.ResponseWriter, r *http.Request) {
+			// Responses differ by origin, so caches must key on it even when no CORS headers are set
+			w.Header().Add("Vary", "Origin")
+
 			origin := r.Header.Get("Origin")
-			for _, allowed := range allowedOrigins {
-				if origin == allowed {
-					w.Header().Set("Access-Control-Allow-Origin", origin)
-					w.Header().Set("Access-Control-Allow-Methods", "GET")
-					w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-					w.Header().Set("Access-Control-Allow-Credentials", "true")
-					break
-				}
+			if origin == "" {
+				next.ServeHTTP(w, r)
+				return
 			}
 
 			// Handle preflight OPTIONS request
-			if r.Method == "OPTIONS" {
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				engine.handlePreflight(w, r, origin)
 				return
 			}
 
+			if engine.originAllowed(origin) {
+				engine.setOriginHeaders(w, origin)
+				if engine.exposedHeaders != "" {
+					w.Header().Set("Access-Control-Expose-Headers", engine.exposedHeaders)
+				}
+			}
+
 			next.ServeHTTP(w, r)
 		}
 	}
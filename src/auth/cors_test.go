@@ -0,0 +1,180 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOriginMatching(t *testing.T) {
+	engine, err := newCORSEngine(CORSPolicy{
+		AllowedOrigins: []string{
+			"https://coopstools.com",
+			"https://*.example.com",
+			"http://*.local.test:8080",
+			`regex:https://pr-[0-9]+\.preview\.dev`,
+		},
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		origin  string
+		allowed bool
+	}{
+		{"https://coopstools.com", true},
+		{"HTTPS://CoopsTools.com", true},
+		{"http://coopstools.com", false},
+		{"https://coopstools.com.evil.com", false},
+		{"https://app.example.com", true},
+		{"https://a.b.example.com", true},
+		{"https://example.com", false},
+		{"https://evilexample.com", false},
+		{"http://app.example.com", false},
+		{"http://ui.local.test:8080", true},
+		{"http://ui.local.test", false},
+		{"https://pr-42.preview.dev", true},
+		{"https://pr-42.preview.dev.evil.com", false},
+		{"https://pr-x.preview.dev", false},
+		{"null", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.allowed, engine.originAllowed(tt.origin), tt.origin)
+	}
+}
+
+func TestAnyOrigin(t *testing.T) {
+	engine, err := newCORSEngine(CORSPolicy{AllowedOrigins: []string{"*"}})
+	require.NoError(t, err)
+	assert.True(t, engine.originAllowed("https://anything.example"))
+	assert.False(t, engine.originAllowed("null"))
+}
+
+func TestInvalidPolicy(t *testing.T) {
+	_, err := newCORSEngine(CORSPolicy{AllowedOrigins: []string{"regex:("}})
+	assert.Error(t, err)
+
+	_, err = newCORSEngine(CORSPolicy{AllowedOrigins: []string{"coopstools.com"}})
+	assert.Error(t, err)
+
+	_, err = newCORSEngine(CORSPolicy{AllowedOrigins: []string{"*"}, AllowCredentials: true})
+	assert.Error(t, err, "any origin with credentials lets any site use the user's cookies")
+}
+
+func TestCORSMiddleware(t *testing.T) {
+	policy := CORSPolicy{
+		AllowedOrigins:   []string{"https://coopstools.com"},
+		AllowedMethods:   []string{"GET", "put"},
+		AllowedHeaders:   []string{"Content-Type", "X-Requested-With"},
+		ExposedHeaders:   []string{"X-Request-Id"},
+		AllowCredentials: true,
+		MaxAge:           10 * time.Minute,
+	}
+	called := false
+	handler := NewCORSMiddleware(policy)(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	})
+
+	serve := func(method, origin string, headers map[string]string) *httptest.ResponseRecorder {
+		called = false
+		req := httptest.NewRequest(method, "/data", nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+
+	t.Run("Test request without origin", func(t *testing.T) {
+		rec := serve("GET", "", nil)
+		assert.True(t, called)
+		assert.Empty(t, rec.Header().Get("Access-Control-Allow-Origin"))
+		assert.Equal(t, []string{"Origin"}, rec.Header().Values("Vary"))
+	})
+
+	t.Run("Test allowed origin", func(t *testing.T) {
+		rec := serve("GET", "https://coopstools.com", nil)
+		assert.True(t, called)
+		assert.Equal(t, "https://coopstools.com", rec.Header().Get("Access-Control-Allow-Origin"))
+		assert.Equal(t, "true", rec.Header().Get("Access-Control-Allow-Credentials"))
+		assert.Equal(t, "X-Request-Id", rec.Header().Get("Access-Control-Expose-Headers"))
+		assert.Empty(t, rec.Header().Get("Access-Control-Allow-Methods"))
+		assert.Contains(t, rec.Header().Values("Vary"), "Origin")
+	})
+
+	t.Run("Test disallowed origin", func(t *testing.T) {
+		rec := serve("GET", "https://evil.com", nil)
+		assert.True(t, called)
+		assert.Empty(t, rec.Header().Get("Access-Control-Allow-Origin"))
+		assert.Empty(t, rec.Header().Get("Access-Control-Allow-Credentials"))
+		assert.Contains(t, rec.Header().Values("Vary"), "Origin")
+	})
+
+	t.Run("Test allowed preflight", func(t *testing.T) {
+		rec := serve("OPTIONS", "https://coopstools.com", map[string]string{
+			"Access-Control-Request-Method":  "PUT",
+			"Access-Control-Request-Headers": "content-type, x-requested-with",
+		})
+		assert.False(t, called)
+		assert.Equal(t, http.StatusNoContent, rec.Code)
+		assert.Equal(t, "https://coopstools.com", rec.Header().Get("Access-Control-Allow-Origin"))
+		assert.Equal(t, "GET, PUT", rec.Header().Get("Access-Control-Allow-Methods"))
+		assert.Equal(t, "Content-Type, X-Requested-With", rec.Header().Get("Access-Control-Allow-Headers"))
+		assert.Equal(t, "600", rec.Header().Get("Access-Control-Max-Age"))
+		assert.ElementsMatch(t, []string{"Origin", "Access-Control-Request-Method", "Access-Control-Request-Headers"}, rec.Header().Values("Vary"))
+	})
+
+	t.Run("Test preflight from disallowed origin", func(t *testing.T) {
+		rec := serve("OPTIONS", "https://evil.com", map[string]string{"Access-Control-Request-Method": "GET"})
+		assert.False(t, called)
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+		assert.Empty(t, rec.Header().Get("Access-Control-Allow-Origin"))
+	})
+
+	t.Run("Test preflight for disallowed method", func(t *testing.T) {
+		rec := serve("OPTIONS", "https://coopstools.com", map[string]string{"Access-Control-Request-Method": "DELETE"})
+		assert.False(t, called)
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+		assert.Empty(t, rec.Header().Get("Access-Control-Allow-Origin"))
+	})
+
+	t.Run("Test preflight for disallowed header", func(t *testing.T) {
+		rec := serve("OPTIONS", "https://coopstools.com", map[string]string{
+			"Access-Control-Request-Method":  "GET",
+			"Access-Control-Request-Headers": "Authorization",
+		})
+		assert.False(t, called)
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+	})
+
+	t.Run("Test plain OPTIONS request is passed through", func(t *testing.T) {
+		serve("OPTIONS", "https://coopstools.com", nil)
+		assert.True(t, called)
+	})
+}
+
+func TestCORSPolicyWithoutCredentialsOrMaxAge(t *testing.T) {
+	policy := CORSPolicy{AllowedOrigins: []string{"https://*.coopstools.com"}}
+	handler := NewCORSMiddleware(policy.WithMethods("POST").WithHeaders())(func(w http.ResponseWriter, r *http.Request) {})
+
+	req := httptest.NewRequest("OPTIONS", "/data", nil)
+	req.Header.Set("Origin", "https://ui.coopstools.com")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Equal(t, "https://ui.coopstools.com", rec.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "POST", rec.Header().Get("Access-Control-Allow-Methods"))
+	assert.Empty(t, rec.Header().Get("Access-Control-Allow-Credentials"))
+	assert.Empty(t, rec.Header().Get("Access-Control-Allow-Headers"))
+	assert.Empty(t, rec.Header().Get("Access-Control-Max-Age"))
+}
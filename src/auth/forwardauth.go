@@ -0,0 +1,139 @@
+package auth
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/verifier"
+)
+
+// ForwardAuth lets reverse proxies delegate authentication to Zuul. It works as an nginx
+// auth_request target, a Traefik forwardAuth address and an Envoy http ext_authz service.
+type ForwardAuth struct {
+	authenticator *Authenticator
+	policy        *AccessPolicy
+	loginURL      string
+}
+
+func NewForwardAuth(authenticator *Authenticator, policy *AccessPolicy, loginURL string) *ForwardAuth {
+	return &ForwardAuth{
+		authenticator: authenticator,
+		policy:        policy,
+		loginURL:      loginURL,
+	}
+}
+
+const verifyPath = "/auth/verify"
+
+// originalRequest works out which request the proxy is asking about. nginx and Traefik
+// pass it in headers; Envoy sends the original method with the original path appended
+// to the verify path.
+func originalRequest(r *http.Request) (method, host, uri string) {
+	method = firstHeader(r, "X-Forwarded-Method", "X-Original-Method")
+	if method == "" {
+		method = r.Method
+	}
+
+	uri = firstHeader(r, "X-Forwarded-Uri", "X-Original-URI")
+	if uri == "" {
+		uri = strings.TrimPrefix(r.URL.RequestURI(), verifyPath)
+	}
+	if !strings.HasPrefix(uri, "/") {
+		uri = "/" + uri
+	}
+
+	host = firstHeader(r, "X-Forwarded-Host", "X-Original-Host")
+	if host == "" {
+		host = r.Host
+	}
+	return method, host, uri
+}
+
+func firstHeader(r *http.Request, names ...string) string {
+	for _, name := range names {
+		if value := r.Header.Get(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// SetIdentityHeaders describes the caller to the service behind the proxy
+func SetIdentityHeaders(header http.Header, claims *verifier.Claims) {
+	permissions := []string{}
+	for orgID, permission := range claims.Permissions {
+		permissions = append(permissions, orgID+":"+permission)
+	}
+	slices.Sort(permissions)
+
+	header.Set("X-Zuul-User", strconv.Itoa(int(claims.UserID)))
+	header.Set("X-Zuul-Login", claims.Username)
+	header.Set("X-Zuul-Permissions", strings.Join(permissions, ","))
+}
+
+// loginRedirect builds the login url, asking to return to the original request afterwards
+func (fa *ForwardAuth) loginRedirect(r *http.Request, host, uri string) string {
+	proto := r.Header.Get("X-Forwarded-Proto")
+	if proto == "" {
+		proto = "https"
+	}
+	separator := "?"
+	if strings.Contains(fa.loginURL, "?") {
+		separator = "&"
+	}
+	return fa.loginURL + separator + "rd=" + url.QueryEscape(proto+"://"+host+uri)
+}
+
+// HandleVerify answers 200 with identity headers when the caller may make the original
+// request. Otherwise it answers 401 or 403 with the login url in X-Zuul-Login-URL, or, when
+// called with ?redirect=true (for proxies that pass responses straight to the browser),
+// redirects unauthenticated callers to the login page.
+func (fa *ForwardAuth) HandleVerify(w http.ResponseWriter, r *http.Request) {
+	method, host, uri := originalRequest(r)
+	path, _, _ := strings.Cut(uri, "?")
+	rule := fa.policy.Match(host, method, path)
+	if rule != nil && rule.Public {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	claims, err := fa.authenticator.Verify(r.Context(), verifier.TokenFromRequest(r))
+	if err == nil && !claims.ForService("", path) {
+		err = ErrInvalidToken
+	}
+	if err != nil {
+		log.Printf("Forward auth refused %s %s%s: %v", method, host, uri, err)
+		if errors.Is(err, ErrAuthStateUnavailable) {
+			http.Error(w, "Failed to get auth state", http.StatusInternalServerError)
+			return
+		}
+
+		loginURL := fa.loginRedirect(r, host, uri)
+		w.Header().Set("X-Zuul-Login-URL", loginURL)
+		if errors.Is(err, verifier.ErrPermissionDenied) {
+			http.Error(w, "Forbidden - Account disabled", http.StatusForbidden)
+			return
+		}
+		if r.URL.Query().Get("redirect") == "true" {
+			http.Redirect(w, r, loginURL, http.StatusFound)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if !Allows(rule, claims) {
+		log.Printf("Forward auth: user %d lacks %s on %s for %s %s%s", claims.UserID, rule.Permission, rule.OrgID, method, host, uri)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	SetIdentityHeaders(w.Header(), claims)
+	w.WriteHeader(http.StatusOK)
+}
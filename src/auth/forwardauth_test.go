@@ -0,0 +1,136 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/config"
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence"
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence/memory"
+	"github.com/coopstools-homebrew/I-am-zuul/src/verifier"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestForwardAuth(t *testing.T) {
+	privateKey, publicKey := newTestKey(t)
+	ctx := context.Background()
+	store := memory.NewStore()
+	require.NoError(t, store.UpdateUser(ctx, &persistence.UserInfo{ID: 1, LoginName: "octo"}))
+	require.NoError(t, store.UpdateUser(ctx, &persistence.UserInfo{ID: 2, LoginName: "suspended"}))
+	require.NoError(t, store.SetUserStatus(ctx, 2, persistence.UserStatusSuspended, "testing"))
+	policy := NewAccessPolicy([]config.AccessRule{
+		{PathPrefix: "/public", Public: true},
+		{PathPrefix: "/admin", OrgID: "coopstools", Permission: "admin"},
+		{Host: "grafana.example.com", PathPrefix: "/", OrgID: "coopstools", Permission: "ops"},
+		{PathPrefix: "/admin/readonly", Methods: []string{"GET"}},
+	})
+	forwardAuth := NewForwardAuth(NewAuthenticator(publicKey, store), policy, "https://zuul.example.com/login")
+
+	token := func(userID int32, permissions map[string]string, audience ...string) string {
+		tokenString, err := jwt.NewWithClaims(jwt.SigningMethodRS256, &verifier.Claims{
+			UserID:      userID,
+			Username:    "octo",
+			Path:        "/",
+			Permissions: permissions,
+			RegisteredClaims: jwt.RegisteredClaims{
+				Audience:  audience,
+				IssuedAt:  jwt.NewNumericDate(time.Now()),
+				ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+			},
+		}).SignedString(privateKey)
+		require.NoError(t, err)
+		return tokenString
+	}
+	admin := token(1, map[string]string{"coopstools": "admin", "coopstools/team": "read"})
+	member := token(1, nil)
+
+	// nginx style: original request in X-Original-* headers
+	nginx := func(method, uri, tokenString string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/auth/verify", nil)
+		req.Host = "app.example.com"
+		req.Header.Set("X-Original-Method", method)
+		req.Header.Set("X-Original-URI", uri)
+		if tokenString != "" {
+			req.AddCookie(&http.Cookie{Name: "auth_token", Value: "ghsso_" + tokenString})
+		}
+		rec := httptest.NewRecorder()
+		forwardAuth.HandleVerify(rec, req)
+		return rec
+	}
+
+	t.Run("Test authenticated request", func(t *testing.T) {
+		rec := nginx("GET", "/docs", admin)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "1", rec.Header().Get("X-Zuul-User"))
+		assert.Equal(t, "octo", rec.Header().Get("X-Zuul-Login"))
+		assert.Equal(t, "coopstools/team:read,coopstools:admin", rec.Header().Get("X-Zuul-Permissions"))
+	})
+
+	t.Run("Test missing token", func(t *testing.T) {
+		rec := nginx("GET", "/docs?page=2", "")
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+		assert.Equal(t, "https://zuul.example.com/login?rd="+url.QueryEscape("https://app.example.com/docs?page=2"), rec.Header().Get("X-Zuul-Login-URL"))
+		assert.Empty(t, rec.Header().Get("X-Zuul-User"))
+	})
+
+	t.Run("Test public path", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, nginx("GET", "/public/logo.png", "").Code)
+	})
+
+	t.Run("Test permission rule", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, nginx("POST", "/admin/users", admin).Code)
+		assert.Equal(t, http.StatusForbidden, nginx("POST", "/admin/users", member).Code)
+	})
+
+	t.Run("Test method specific rule", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, nginx("GET", "/admin/readonly/report", member).Code)
+		assert.Equal(t, http.StatusForbidden, nginx("DELETE", "/admin/readonly/report", member).Code)
+	})
+
+	t.Run("Test tokens made for a client are refused", func(t *testing.T) {
+		rec := nginx("POST", "/admin/users", token(1, map[string]string{"coopstools": "admin"}, "resume"))
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+		assert.NotEmpty(t, rec.Header().Get("X-Zuul-Login-URL"))
+		assert.Empty(t, rec.Header().Get("X-Zuul-User"))
+	})
+
+	t.Run("Test suspended user", func(t *testing.T) {
+		assert.Equal(t, http.StatusForbidden, nginx("GET", "/docs", token(2, nil)).Code)
+	})
+
+	t.Run("Test traefik headers and redirect", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/auth/verify?redirect=true", nil)
+		req.Header.Set("X-Forwarded-Method", "GET")
+		req.Header.Set("X-Forwarded-Proto", "http")
+		req.Header.Set("X-Forwarded-Host", "grafana.example.com")
+		req.Header.Set("X-Forwarded-Uri", "/d/home")
+		rec := httptest.NewRecorder()
+		forwardAuth.HandleVerify(rec, req)
+		assert.Equal(t, http.StatusFound, rec.Code)
+		assert.Equal(t, "https://zuul.example.com/login?rd="+url.QueryEscape("http://grafana.example.com/d/home"), rec.Header().Get("Location"))
+
+		req.Header.Set("Authorization", "Bearer "+admin)
+		rec = httptest.NewRecorder()
+		forwardAuth.HandleVerify(rec, req)
+		assert.Equal(t, http.StatusForbidden, rec.Code, "host rule requires ops")
+	})
+
+	t.Run("Test envoy style request", func(t *testing.T) {
+		req := httptest.NewRequest("DELETE", "/auth/verify/admin/users/3", nil)
+		req.Header.Set("Authorization", "Bearer "+member)
+		rec := httptest.NewRecorder()
+		forwardAuth.HandleVerify(rec, req)
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+
+		req.Header.Set("Authorization", "Bearer "+admin)
+		rec = httptest.NewRecorder()
+		forwardAuth.HandleVerify(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+	})
+}
@@ -1,56 +1,148 @@
 package auth
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
-	"os"
-	"strconv"
+	"net/url"
+	"strings"
 	"time"
 
-	"crypto/rsa"
-
+	"github.com/coopstools-homebrew/I-am-zuul/src/config"
 	"github.com/coopstools-homebrew/I-am-zuul/src/persistence"
+	"github.com/coopstools-homebrew/I-am-zuul/src/verifier"
 	"github.com/golang-jwt/jwt/v5"
 )
 
+// How long a user has to get through GitHub's login
+const loginStateLifetime = 10 * time.Minute
+
+// loginNonceCookie ties the OAuth state to the browser that started the login, so a
+// callback link with someone else's code and state can't log the victim in as them
+const loginNonceCookie = "login_nonce"
+
 // This is the interface for the UserTable
 type UserTable interface {
-	UpdateUser(user *persistence.UserInfo) error
+	UpdateUser(ctx context.Context, user *persistence.UserInfo) error
+	GetAuthState(ctx context.Context, id int32) (*persistence.AuthState, error)
+	LoginRecorder
 }
 
 // GitHubCallback handles the OAuth callback flow
 type GitHubCallback struct {
-	client     *http.Client
-	privateKey *rsa.PrivateKey
-	userTable  UserTable
+	client          *http.Client
+	issuer          *TokenIssuer
+	userTable       UserTable
+	permissionTable PermissionTable
+	clients         *ClientRegistry
+	config          *config.Config
+
+	secondFactorGate
 }
 
 // NewGitHubCallback creates a new GitHubCallback handler
-func NewGitHubCallback(privateKeyString string, userTable UserTable) *GitHubCallback {
-	privateKey, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(privateKeyString))
+func NewGitHubCallback(config *config.Config, issuer *TokenIssuer, userTable UserTable, permissionTable PermissionTable, clients *ClientRegistry) *GitHubCallback {
+	return &GitHubCallback{
+		client:          &http.Client{},
+		issuer:          issuer,
+		userTable:       userTable,
+		permissionTable: permissionTable,
+		clients:         clients,
+		config:          config,
+	}
+}
+
+// loginState carries a client's login request through GitHub in the OAuth state
+type loginState struct {
+	ClientID    string   `json:"client_id"`
+	RedirectURI string   `json:"redirect_uri"`
+	Scopes      []string `json:"scopes,omitempty"`
+	// Matches the login_nonce cookie of the browser that started the login
+	Nonce string `json:"nonce"`
+	jwt.RegisteredClaims
+}
+
+// setLoginNonce sets (or, with an empty nonce, clears) the login_nonce cookie. It is
+// sent on the redirect back from GitHub, so it can't be SameSite strict, and it is only
+// left insecure when the callback is explicitly plain http, as in local development.
+func (gh *GitHubCallback) setLoginNonce(w http.ResponseWriter, nonce string) {
+	maxAge := int(loginStateLifetime.Seconds())
+	if nonce == "" {
+		maxAge = -1
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginNonceCookie,
+		Value:    nonce,
+		Path:     "/",
+		MaxAge:   maxAge,
+		Secure:   !strings.HasPrefix(gh.config.GitHubCallbackURL, "http://"),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// HandleLogin starts the OAuth flow by sending the user to GitHub's authorize page.
+// Applications other than the default front end pass their client_id, and optionally
+// one of their redirect_uris and a space separated scope.
+func (gh *GitHubCallback) HandleLogin(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	client, redirectURI, scopes, err := gh.clients.resolveLogin(query.Get("client_id"), query.Get("redirect_uri"), query.Get("scope"))
 	if err != nil {
-		log.Fatalf("Failed to parse private key: %v", err)
-		os.Exit(1)
+		log.Printf("Refusing login for client %q: %v", query.Get("client_id"), err)
+		http.Error(w, "Bad Request - "+err.Error(), http.StatusBadRequest)
+		return
 	}
-	return &GitHubCallback{
-		client:     &http.Client{},
-		privateKey: privateKey,
-		userTable:  userTable,
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		log.Printf("Failed to generate login nonce: %v", err)
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+	nonce := base64.RawURLEncoding.EncodeToString(raw)
+	state, err := gh.issuer.signState(&loginState{
+		ClientID:    client.ClientID,
+		RedirectURI: redirectURI,
+		Scopes:      scopes,
+		Nonce:       nonce,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(loginStateLifetime)),
+		},
+	})
+	if err != nil {
+		log.Printf("Failed to sign login state: %v", err)
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+
+	gh.setLoginNonce(w, nonce)
+
+	q := url.Values{}
+	q.Set("client_id", gh.config.GitHubClientID)
+	q.Set("scope", "read:user user:email")
+	q.Set("state", state)
+	if gh.config.GitHubCallbackURL != "" {
+		q.Set("redirect_uri", gh.config.GitHubCallbackURL)
 	}
+	http.Redirect(w, r, gh.config.GitHubBaseURL+"/login/oauth/authorize?"+q.Encode(), http.StatusFound)
 }
 
 // exchangeCodeForToken exchanges the OAuth code for an access token
 func (gh *GitHubCallback) exchangeCodeForToken(code string) (string, error) {
-	tokenURL := "https://github.com/login/oauth/access_token"
+	tokenURL := gh.config.GitHubBaseURL + "/login/oauth/access_token"
 	req, err := http.NewRequest("POST", tokenURL, nil)
 	if err != nil {
 		return "", err
 	}
 
 	q := req.URL.Query()
-	q.Add("client_id", os.Getenv("GITHUB_CLIENT_ID"))
-	q.Add("client_secret", os.Getenv("GITHUB_CLIENT_SECRET"))
+	q.Add("client_id", gh.config.GitHubClientID)
+	q.Add("client_secret", gh.config.GitHubClientSecret)
 	q.Add("code", code)
 	req.URL.RawQuery = q.Encode()
 	req.Header.Set("Accept", "application/json")
@@ -63,67 +155,96 @@ func (gh *GitHubCallback) exchangeCodeForToken(code string) (string, error) {
 
 	var tokenResp struct {
 		AccessToken string `json:"access_token"`
+		Error       string `json:"error"`
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
 		return "", err
 	}
+	if tokenResp.Error != "" {
+		return "", fmt.Errorf("github refused code: %s", tokenResp.Error)
+	}
 
 	return tokenResp.AccessToken, nil
 }
 
-func (gh *GitHubCallback) getUserInfo(accessToken string) (*persistence.UserInfo, error) {
-	userReq, err := http.NewRequest("GET", "https://api.github.com/user", nil)
+// getGitHubAPI decodes the json response of an authenticated GitHub api call
+func (gh *GitHubCallback) getGitHubAPI(accessToken, path string, target interface{}) error {
+	req, err := http.NewRequest("GET", gh.config.GitHubAPIURL+path, nil)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	userReq.Header.Set("Authorization", "Bearer "+accessToken)
-	userReq.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Accept", "application/json")
 
-	userResp, err := gh.client.Do(userReq)
+	resp, err := gh.client.Do(req)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer userResp.Body.Close()
+	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("github returned %d for %s", resp.StatusCode, path)
+	}
+	return json.NewDecoder(resp.Body).Decode(target)
+}
+
+func (gh *GitHubCallback) getUserInfo(accessToken string) (*persistence.UserInfo, error) {
 	var userInfo persistence.UserInfo
-	if err := json.NewDecoder(userResp.Body).Decode(&userInfo); err != nil {
+	if err := gh.getGitHubAPI(accessToken, "/user", &userInfo); err != nil {
 		return nil, err
 	}
+	if userInfo.Email != "" {
+		return &userInfo, nil
+	}
+
+	// Users with a private email only expose it through /user/emails
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	if err := gh.getGitHubAPI(accessToken, "/user/emails", &emails); err != nil {
+		log.Printf("Failed to get emails for %s: %v", userInfo.LoginName, err)
+		return &userInfo, nil
+	}
+	for _, email := range emails {
+		if email.Primary && email.Verified {
+			userInfo.Email = email.Email
+		}
+	}
 
 	return &userInfo, nil
 }
 
-// generateJWT creates a new JWT token with user claims
-func (gh *GitHubCallback) generateJWT(userID int32, username, path string) (string, error) {
-	token := jwt.New(jwt.SigningMethodRS256)
-	claims := token.Claims.(jwt.MapClaims)
-	claims["user_id"] = userID
-	claims["username"] = username
-	claims["exp"] = time.Now().Add(time.Hour * 2).Unix()
-	claims["path"] = path
-
-	return token.SignedString(gh.privateKey)
+// getPermissions returns the user's permissions keyed by org, as carried in tokens
+func (gh *GitHubCallback) getPermissions(ctx context.Context, userID int32) (map[string]string, error) {
+	return loadPermissions(ctx, gh.permissionTable, userID)
 }
 
-func (gh *GitHubCallback) HandleGenerateJWT(w http.ResponseWriter, r *http.Request) {
-	userIDStr := r.URL.Query().Get("user_id")
-	userID, err := strconv.ParseInt(userIDStr, 10, 32)
-	if err != nil {
-		log.Printf("Failed to parse user_id: %v", err)
-		http.Error(w, "Invalid user_id", http.StatusBadRequest)
-		return
+// readLoginState returns the login request the callback completes. The state has to
+// come back to the browser that started the login.
+func (gh *GitHubCallback) readLoginState(r *http.Request) (*persistence.Client, *loginState, error) {
+	encoded := r.URL.Query().Get("state")
+	if encoded == "" {
+		return nil, nil, errors.New("no state")
 	}
-	username := r.URL.Query().Get("username")
-
-	token, err := gh.generateJWT(int32(userID), username, "/nowhere")
+	state := &loginState{}
+	if err := gh.issuer.parseState(encoded, state); err != nil {
+		return nil, nil, err
+	}
+	cookie, err := r.Cookie(loginNonceCookie)
+	if err != nil || state.Nonce == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state.Nonce)) != 1 {
+		return nil, nil, errors.New("state was not issued to this browser")
+	}
+	client, err := gh.clients.Get(state.ClientID)
 	if err != nil {
-		log.Printf("Failed to generate token: %v", err)
-		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
-		return
+		return nil, nil, err
 	}
-
-	w.Write([]byte(token))
+	if state.RedirectURI == "" {
+		state.RedirectURI, _ = redirectFor(client, "")
+	}
+	return client, state, nil
 }
 
 func (gh *GitHubCallback) HandleGitHubCallback(w http.ResponseWriter, r *http.Request) {
@@ -135,6 +256,15 @@ func (gh *GitHubCallback) HandleGitHubCallback(w http.ResponseWriter, r *http.Re
 		return
 	}
 
+	// The nonce is single use, whatever the outcome
+	gh.setLoginNonce(w, "")
+	client, login, err := gh.readLoginState(r)
+	if err != nil {
+		log.Printf("Invalid login state: %v", err)
+		http.Error(w, "Bad Request - Invalid state", http.StatusBadRequest)
+		return
+	}
+
 	// Exchange code for access token
 	accessToken, err := gh.exchangeCodeForToken(code)
 	if err != nil {
@@ -151,34 +281,60 @@ func (gh *GitHubCallback) HandleGitHubCallback(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	err = gh.userTable.UpdateUser(userInfo)
+	err = gh.userTable.UpdateUser(r.Context(), userInfo)
 	if err != nil {
 		log.Printf("Failed to update user in db: %v", err)
 		http.Error(w, "Failed to update user in db", http.StatusInternalServerError)
 		return
 	}
+
+	state, err := gh.userTable.GetAuthState(r.Context(), userInfo.ID)
+	if err != nil {
+		log.Printf("Failed to get auth state: %v", err)
+		http.Error(w, "Failed to get auth state", http.StatusInternalServerError)
+		return
+	}
+	if state.Status != persistence.UserStatusActive {
+		log.Printf("Refusing login for %s user: %s", state.Status, userInfo.LoginName)
+		http.Error(w, "Account "+state.Status, http.StatusForbidden)
+		return
+	}
 	log.Printf("User onboarded: %s", userInfo.LoginName)
 
-	// Generate JWT
-	tokenString, err := gh.generateJWT(userInfo.ID, userInfo.LoginName, "/data")
+	permissions, err := gh.getPermissions(r.Context(), userInfo.ID)
+	if err != nil {
+		log.Printf("Failed to get permissions: %v", err)
+		http.Error(w, "Failed to get permissions", http.StatusInternalServerError)
+		return
+	}
+
+	permissions, challenge, err := gh.gate(r.Context(), userInfo.ID, scopePermissions(permissions, login.Scopes))
+	if err != nil {
+		log.Printf("Failed to apply second factor policy: %v", err)
+		http.Error(w, "Failed to apply second factor policy", http.StatusInternalServerError)
+		return
+	}
+	redirectURI := login.RedirectURI
+	if challenge {
+		redirectURI = gh.config.MFAChallengeURL + "?" + url.Values{"redirect_uri": {login.RedirectURI}}.Encode()
+	}
+
+	// Generate JWT with the client's path, audience, lifetime and scopes
+	tokenString, expiresAt, err := gh.issuer.Issue(forClient(verifier.Claims{
+		UserID:      userInfo.ID,
+		Username:    userInfo.LoginName,
+		Permissions: permissions,
+		AMR:         []string{verifier.AMRGitHub},
+	}, client, login.Scopes))
 	if err != nil {
 		log.Printf("Failed to generate token: %v", err)
 		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
 		return
 	}
-
-	redirectURI := os.Getenv("GITHUB_REDIRECT_URI")
+	recordLogin(r, gh.userTable, gh.config.TrustForwardedFor, userInfo.ID, "github")
 
 	// Set cookie
-	cookie := &http.Cookie{
-		Name:     "auth_token",
-		Value:    "ghsso_" + tokenString,
-		Secure:   true,
-		SameSite: http.SameSiteNoneMode,
-		Path:     "/",
-		MaxAge:   7200, // 2 hours in seconds
-	}
-	http.SetCookie(w, cookie)
+	SetCookie(w, tokenString, expiresAt)
 
 	// Redirect
 	http.Redirect(w, r, redirectURI, http.StatusFound)
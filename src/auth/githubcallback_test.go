@@ -0,0 +1,271 @@
+package auth
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/config"
+	"github.com/coopstools-homebrew/I-am-zuul/src/fakegithub"
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence"
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence/memory"
+	"github.com/coopstools-homebrew/I-am-zuul/src/verifier"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mustKid(t *testing.T, tokenString string) string {
+	token, _, err := jwt.NewParser().ParseUnverified(tokenString, jwt.MapClaims{})
+	require.NoError(t, err)
+	kid, _ := token.Header["kid"].(string)
+	return kid
+}
+
+type fakeSecondFactors map[int32]bool
+
+func (f fakeSecondFactors) HasSecondFactor(ctx context.Context, userID int32) (bool, error) {
+	return f[userID], nil
+}
+
+// authCookieClaims returns the claims of the auth_token cookie set on the response
+func authCookieClaims(t *testing.T, resp *http.Response, privateKey *rsa.PrivateKey) *verifier.Claims {
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == "auth_token" {
+			claims := &verifier.Claims{}
+			_, err := jwt.ParseWithClaims(strings.TrimPrefix(cookie.Value, "ghsso_"), claims, func(token *jwt.Token) (interface{}, error) {
+				return &privateKey.PublicKey, nil
+			})
+			require.NoError(t, err)
+			return claims
+		}
+	}
+	t.Fatal("No auth_token cookie set")
+	return nil
+}
+
+// login walks the OAuth flow against the fake GitHub and returns the callback's response
+func login(t *testing.T, zuul *httptest.Server, fakeGitHubURL, loginName string) *http.Response {
+	return loginFor(t, zuul, fakeGitHubURL, loginName, nil)
+}
+
+// loginFor logs in with the given query on /login, e.g. a client_id
+func loginFor(t *testing.T, zuul *httptest.Server, fakeGitHubURL, loginName string, query url.Values) *http.Response {
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	client := &http.Client{Jar: jar, CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		// Stop once the callback redirects to the front end
+		if !strings.HasPrefix(req.URL.String(), zuul.URL) && !strings.HasPrefix(req.URL.String(), fakeGitHubURL) {
+			return http.ErrUseLastResponse
+		}
+		if req.URL.Path == "/login/oauth/authorize" {
+			q := req.URL.Query()
+			q.Set("login", loginName)
+			req.URL.RawQuery = q.Encode()
+		}
+		return nil
+	}}
+	resp, err := client.Get(zuul.URL + "/login?" + query.Encode())
+	require.NoError(t, err)
+	return resp
+}
+
+// startLogin runs /login in a fresh browser, returning the browser and the state it was
+// sent to GitHub with
+func startLogin(t *testing.T, zuul *httptest.Server) (*http.Client, string) {
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	browser := &http.Client{Jar: jar, CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := browser.Get(zuul.URL + "/login")
+	require.NoError(t, err)
+	resp.Body.Close()
+	location, err := url.Parse(resp.Header.Get("Location"))
+	require.NoError(t, err)
+	state := location.Query().Get("state")
+	require.NotEmpty(t, state)
+	return browser, state
+}
+
+func TestGitHubCallbackAgainstFakeGitHub(t *testing.T) {
+	privateKey, publicKey := newTestKey(t)
+	privateKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
+
+	fakeGitHub := httptest.NewServer(fakegithub.NewServer(fakegithub.DefaultUsers, ""))
+	defer fakeGitHub.Close()
+
+	ctx := context.Background()
+	store := memory.NewStore()
+	require.NoError(t, store.UpdateUser(ctx, &persistence.UserInfo{ID: 1001, LoginName: "octo-admin"}))
+	require.NoError(t, store.GrantPermission(ctx, 1001, "coopstools-homebrew", "admin"))
+	require.NoError(t, store.GrantPermission(ctx, 1001, "resume", "read"))
+	mux := http.NewServeMux()
+	zuul := httptest.NewServer(mux)
+	defer zuul.Close()
+
+	callback := NewGitHubCallback(&config.Config{
+		GitHubClientID:     "id",
+		GitHubClientSecret: "secret",
+		GitHubCallbackURL:  zuul.URL + "/callback",
+		GitHubRedirectURI:  "https://ui.example.com/login",
+		GitHubBaseURL:      fakeGitHub.URL,
+		GitHubAPIURL:       fakeGitHub.URL,
+	}, NewTokenIssuer(string(privateKeyPEM), time.Hour), store, store, NewClientRegistry(fakeClientTable{{
+		ClientID:             "resume",
+		RedirectURIs:         []string{"https://resume.example.com/data", "https://resume.example.com/other"},
+		AllowedScopes:        []string{"resume"},
+		TokenLifetimeSeconds: 600,
+		TokenPath:            "/resume",
+		Audience:             "resume",
+	}}, &persistence.Client{RedirectURIs: []string{"https://ui.example.com/login"}, TokenPath: "/"}, time.Minute))
+	mux.HandleFunc("GET /login", callback.HandleLogin)
+	mux.HandleFunc("GET /callback", callback.HandleGitHubCallback)
+	mux.HandleFunc("/data", NewMiddleware(NewAuthenticator(publicKey, store), nil)(func(w http.ResponseWriter, r *http.Request) {}))
+
+	t.Run("Test logging in", func(t *testing.T) {
+		resp := login(t, zuul, fakeGitHub.URL, "octo-admin")
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusFound, resp.StatusCode)
+		assert.Equal(t, "https://ui.example.com/login", resp.Header.Get("Location"))
+		user, err := store.GetUserByID(ctx, 1001)
+		require.NoError(t, err)
+		assert.Equal(t, "admin@example.com", user.Email)
+		logins, err := store.GetLoginEvents(ctx, 1001, 10)
+		require.NoError(t, err)
+		require.Len(t, logins, 1)
+		assert.Equal(t, "github", logins[0].Provider)
+		assert.Equal(t, "127.0.0.1", logins[0].IP)
+
+		var authCookie *http.Cookie
+		for _, cookie := range resp.Cookies() {
+			if cookie.Name == "auth_token" {
+				authCookie = cookie
+			}
+		}
+		require.NotNil(t, authCookie)
+
+		claims := &verifier.Claims{}
+		_, err = jwt.ParseWithClaims(authCookie.Value[6:], claims, func(token *jwt.Token) (interface{}, error) {
+			return &privateKey.PublicKey, nil
+		})
+		require.NoError(t, err)
+		assert.Equal(t, "octo-admin", claims.Username)
+		assert.True(t, claims.HasPermission("coopstools-homebrew", "admin"))
+		assert.Equal(t, verifier.KeyID(&privateKey.PublicKey), mustKid(t, authCookie.Value[6:]))
+
+		req, _ := http.NewRequest("GET", zuul.URL+"/data", nil)
+		req.AddCookie(authCookie)
+		dataResp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		dataResp.Body.Close()
+		assert.Equal(t, http.StatusOK, dataResp.StatusCode)
+	})
+
+	t.Run("Test falling back to private email", func(t *testing.T) {
+		resp := login(t, zuul, fakeGitHub.URL, "private-email")
+		resp.Body.Close()
+		user, err := store.GetUserByID(ctx, 1002)
+		require.NoError(t, err)
+		assert.Equal(t, "hidden@example.com", user.Email)
+	})
+
+	t.Run("Test withholding privileged permissions until a second factor is used", func(t *testing.T) {
+		factors := fakeSecondFactors{}
+		callback.RequireSecondFactor(MFAPolicy{Privileged: []string{"admin"}}, factors)
+		defer func() { callback.mfaPolicy, callback.secondFactors = nil, nil }()
+
+		resp := login(t, zuul, fakeGitHub.URL, "octo-admin")
+		resp.Body.Close()
+		assert.Equal(t, "https://ui.example.com/login", resp.Header.Get("Location"))
+		claims := authCookieClaims(t, resp, privateKey)
+		assert.False(t, claims.HasPermission("coopstools-homebrew", "admin"))
+		assert.Equal(t, []string{verifier.AMRGitHub}, claims.AMR)
+
+		factors[1001] = true
+		callback.config.MFAChallengeURL = "https://zuul.example.com/mfa"
+		resp = login(t, zuul, fakeGitHub.URL, "octo-admin")
+		resp.Body.Close()
+		assert.Equal(t, "https://zuul.example.com/mfa?redirect_uri=https%3A%2F%2Fui.example.com%2Flogin", resp.Header.Get("Location"))
+		assert.False(t, authCookieClaims(t, resp, privateKey).HasPermission("coopstools-homebrew", "admin"))
+	})
+
+	t.Run("Test logging in for a client", func(t *testing.T) {
+		resp := loginFor(t, zuul, fakeGitHub.URL, "octo-admin", url.Values{
+			"client_id":    {"resume"},
+			"redirect_uri": {"https://resume.example.com/other"},
+		})
+		resp.Body.Close()
+		require.Equal(t, http.StatusFound, resp.StatusCode)
+		assert.Equal(t, "https://resume.example.com/other", resp.Header.Get("Location"))
+
+		claims := authCookieClaims(t, resp, privateKey)
+		assert.Equal(t, map[string]string{"resume": "read"}, claims.Permissions)
+		assert.Equal(t, "resume", claims.Scope)
+		assert.Equal(t, "/resume", claims.Path)
+		assert.Equal(t, jwt.ClaimStrings{"resume"}, claims.Audience)
+		assert.Equal(t, 10*time.Minute, claims.ExpiresAt.Sub(claims.IssuedAt.Time))
+	})
+
+	t.Run("Test refusing a bad client login", func(t *testing.T) {
+		for _, query := range []url.Values{
+			{"client_id": {"unknown"}},
+			{"client_id": {"resume"}, "redirect_uri": {"https://evil.example.com"}},
+			{"client_id": {"resume"}, "scope": {"coopstools-homebrew"}},
+		} {
+			resp, err := http.Get(zuul.URL + "/login?" + query.Encode())
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusBadRequest, resp.StatusCode, query.Encode())
+		}
+
+		resp, err := http.Get(zuul.URL + "/callback?code=abc&state=forged")
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("Test refusing a suspended user", func(t *testing.T) {
+		require.NoError(t, store.SetUserStatus(ctx, 1001, persistence.UserStatusSuspended, "testing"))
+		resp := login(t, zuul, fakeGitHub.URL, "octo-admin")
+		resp.Body.Close()
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	})
+
+	t.Run("Test requiring the state of this browser's login", func(t *testing.T) {
+		browser, state := startLogin(t, zuul)
+
+		resp, err := browser.Get(zuul.URL + "/callback?code=abc")
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "callbacks need a state")
+
+		// A victim sent to the attacker's callback link has no matching nonce cookie
+		victim, _ := startLogin(t, zuul)
+		resp, err = victim.Get(zuul.URL + "/callback?code=abc&state=" + url.QueryEscape(state))
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("Test rejecting a bad code", func(t *testing.T) {
+		browser, state := startLogin(t, zuul)
+		resp, err := browser.Get(zuul.URL + "/callback?code=" + url.QueryEscape("bogus") + "&state=" + url.QueryEscape(state))
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+
+		resp, err = browser.Get(zuul.URL + "/callback?code=" + url.QueryEscape("bogus") + "&state=" + url.QueryEscape(state))
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "the nonce is used up")
+	})
+}
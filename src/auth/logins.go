@@ -0,0 +1,45 @@
+package auth
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence"
+)
+
+// LoginRecorder counts logins on the user and keeps their login history
+type LoginRecorder interface {
+	RecordLogin(ctx context.Context, event *persistence.LoginEvent) error
+}
+
+// clientIP returns the address the request came from. Behind Heroku's router or a load
+// balancer that is the last X-Forwarded-For entry, which the proxy appended; earlier
+// entries come from the client and can't be trusted.
+func clientIP(r *http.Request, trustForwardedFor bool) string {
+	if forwarded := r.Header.Get("X-Forwarded-For"); trustForwardedFor && forwarded != "" {
+		entries := strings.Split(forwarded, ",")
+		return strings.TrimSpace(entries[len(entries)-1])
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// recordLogin adds the login to the user's history. The user is already logged in by
+// then, so failures are only logged.
+func recordLogin(r *http.Request, recorder LoginRecorder, trustForwardedFor bool, userID int32, provider string) {
+	err := recorder.RecordLogin(r.Context(), &persistence.LoginEvent{
+		UserID:    userID,
+		IP:        clientIP(r, trustForwardedFor),
+		UserAgent: r.UserAgent(),
+		Provider:  provider,
+	})
+	if err != nil {
+		log.Printf("Failed to record login of user %d: %v", userID, err)
+	}
+}
@@ -0,0 +1,20 @@
+package auth
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientIP(t *testing.T) {
+	req := httptest.NewRequest("GET", "/callback", nil)
+	req.RemoteAddr = "10.0.0.5:41234"
+	req.Header.Set("X-Forwarded-For", "203.0.113.9, 198.51.100.7")
+
+	assert.Equal(t, "10.0.0.5", clientIP(req, false), "the header is ignored unless a proxy sets it")
+	assert.Equal(t, "198.51.100.7", clientIP(req, true), "earlier entries come from the client")
+
+	req.Header.Del("X-Forwarded-For")
+	assert.Equal(t, "10.0.0.5", clientIP(req, true))
+}
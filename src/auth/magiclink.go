@@ -0,0 +1,247 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/config"
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence"
+	"github.com/coopstools-homebrew/I-am-zuul/src/verifier"
+)
+
+const (
+	magicLinkLifetime = 15 * time.Minute
+	// Links sent to one address within magicLinkWindow before requests are refused
+	maxMagicLinks   = 3
+	magicLinkWindow = 15 * time.Minute
+)
+
+type MagicLinkTable interface {
+	AddMagicLink(ctx context.Context, link *persistence.MagicLink) error
+	UseMagicLink(ctx context.Context, tokenHash []byte) (*persistence.MagicLink, error)
+}
+
+type EmailUserTable interface {
+	GetOrAddEmailUser(ctx context.Context, email string) (*persistence.UserInfo, error)
+	GetAuthState(ctx context.Context, id int32) (*persistence.AuthState, error)
+	LoginRecorder
+}
+
+// Mailer delivers mail to users
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// MagicLinkLogin logs in users without a GitHub account through a single-use link sent
+// to their email. Their tokens are limited to config.MagicLinkScopes.
+type MagicLinkLogin struct {
+	issuer          *TokenIssuer
+	links           MagicLinkTable
+	users           EmailUserTable
+	permissionTable PermissionTable
+	clients         *ClientRegistry
+	mailer          Mailer
+	config          *config.Config
+	limiter         *rateLimiter[string]
+
+	secondFactorGate
+}
+
+func NewMagicLinkLogin(config *config.Config, issuer *TokenIssuer, links MagicLinkTable, users EmailUserTable, permissionTable PermissionTable, clients *ClientRegistry, mailer Mailer) *MagicLinkLogin {
+	return &MagicLinkLogin{
+		issuer:          issuer,
+		links:           links,
+		users:           users,
+		permissionTable: permissionTable,
+		clients:         clients,
+		mailer:          mailer,
+		config:          config,
+		limiter:         newRateLimiter[string](maxMagicLinks, magicLinkWindow),
+	}
+}
+
+func hashMagicLinkToken(token string) []byte {
+	hash := sha256.Sum256([]byte(token))
+	return hash[:]
+}
+
+// HandleRequest emails a login link to the address in the body. Like /login it takes an
+// optional client_id, redirect_uri and scope, which the link completes.
+func (ml *MagicLinkLogin) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Email       string `json:"email"`
+		ClientID    string `json:"client_id"`
+		RedirectURI string `json:"redirect_uri"`
+		Scope       string `json:"scope"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Bad Request - Invalid request body", http.StatusBadRequest)
+		return
+	}
+	address, err := mail.ParseAddress(request.Email)
+	if err != nil || address.Address != strings.TrimSpace(request.Email) {
+		http.Error(w, "Bad Request - Invalid email", http.StatusBadRequest)
+		return
+	}
+	email := strings.ToLower(address.Address)
+
+	client, redirectURI, scopes, err := ml.clients.resolveLogin(request.ClientID, request.RedirectURI, request.Scope)
+	if err != nil {
+		log.Printf("Refusing email login for client %q: %v", request.ClientID, err)
+		http.Error(w, "Bad Request - "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	requested := scopes
+	scopes = narrowScopes(scopes, ml.config.MagicLinkScopes)
+	if len(requested) > 0 && len(scopes) == 0 {
+		http.Error(w, "Bad Request - "+ErrScopeForbidden.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !ml.limiter.allowed(email) {
+		http.Error(w, "Too many login links requested, try again later", http.StatusTooManyRequests)
+		return
+	}
+	ml.limiter.record(email)
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		log.Printf("Failed to generate magic link: %v", err)
+		http.Error(w, "Failed to create login link", http.StatusInternalServerError)
+		return
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	err = ml.links.AddMagicLink(r.Context(), &persistence.MagicLink{
+		TokenHash:   hashMagicLinkToken(token),
+		Email:       email,
+		ClientID:    client.ClientID,
+		RedirectURI: redirectURI,
+		Scopes:      scopes,
+		ExpiresAt:   time.Now().Add(magicLinkLifetime),
+	})
+	if err != nil {
+		log.Printf("Failed to save magic link: %v", err)
+		http.Error(w, "Failed to create login link", http.StatusInternalServerError)
+		return
+	}
+
+	link := ml.config.MagicLinkURL + "?" + url.Values{"token": {token}}.Encode()
+	body := fmt.Sprintf("Open this link to log in:\n\n%s\n\nIt works once, within %d minutes. If you didn't ask to log in, you can ignore this email.\n",
+		link, int(magicLinkLifetime.Minutes()))
+	if err := ml.mailer.Send(email, "Your login link", body); err != nil {
+		log.Printf("Failed to send magic link: %v", err)
+		http.Error(w, "Failed to send login link", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Sent magic link for client %q", client.ClientID)
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// Opening a link only shows a button, so mail scanners that fetch links don't use them up
+var magicLinkPage = template.Must(template.New("magiclink").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Log in</title></head>
+<body>
+<form method="POST">
+<input type="hidden" name="token" value="{{.}}">
+<button type="submit">Log in</button>
+</form>
+</body>
+</html>
+`))
+
+// HandleConfirmPage serves the page the emailed link opens
+func (ml *MagicLinkLogin) HandleConfirmPage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	err := magicLinkPage.Execute(w, r.URL.Query().Get("token"))
+	if err != nil {
+		log.Printf("Failed to render magic link page: %v", err)
+	}
+}
+
+// HandleVerify uses up the link, then logs the user in like the GitHub callback does
+func (ml *MagicLinkLogin) HandleVerify(w http.ResponseWriter, r *http.Request) {
+	link, err := ml.links.UseMagicLink(r.Context(), hashMagicLinkToken(r.PostFormValue("token")))
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "This login link is invalid, used or expired", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to use magic link: %v", err)
+		http.Error(w, "Failed to check login link", http.StatusInternalServerError)
+		return
+	}
+	client, err := ml.clients.Get(link.ClientID)
+	if err != nil {
+		log.Printf("Refusing magic link for client %q: %v", link.ClientID, err)
+		http.Error(w, "Bad Request - "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, err := ml.users.GetOrAddEmailUser(r.Context(), link.Email)
+	if err != nil {
+		log.Printf("Failed to get email user: %v", err)
+		http.Error(w, "Failed to get user", http.StatusInternalServerError)
+		return
+	}
+	state, err := ml.users.GetAuthState(r.Context(), user.ID)
+	if err != nil {
+		log.Printf("Failed to get auth state: %v", err)
+		http.Error(w, "Failed to get auth state", http.StatusInternalServerError)
+		return
+	}
+	if state.Status != persistence.UserStatusActive {
+		log.Printf("Refusing email login for %s user %d", state.Status, user.ID)
+		http.Error(w, "Account "+state.Status, http.StatusForbidden)
+		return
+	}
+
+	permissions, err := loadPermissions(r.Context(), ml.permissionTable, user.ID)
+	if err != nil {
+		log.Printf("Failed to get permissions: %v", err)
+		http.Error(w, "Failed to get permissions", http.StatusInternalServerError)
+		return
+	}
+	permissions, challenge, err := ml.gate(r.Context(), user.ID, scopePermissions(permissions, link.Scopes))
+	if err != nil {
+		log.Printf("Failed to apply second factor policy: %v", err)
+		http.Error(w, "Failed to apply second factor policy", http.StatusInternalServerError)
+		return
+	}
+	redirectURI := link.RedirectURI
+	if challenge {
+		redirectURI = ml.config.MFAChallengeURL + "?" + url.Values{"redirect_uri": {link.RedirectURI}}.Encode()
+	}
+
+	tokenString, expiresAt, err := ml.issuer.Issue(forClient(verifier.Claims{
+		UserID:      user.ID,
+		Username:    user.LoginName,
+		Permissions: permissions,
+		AMR:         []string{verifier.AMREmail},
+	}, client, link.Scopes))
+	if err != nil {
+		log.Printf("Failed to generate token: %v", err)
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Email user %d logged in", user.ID)
+	recordLogin(r, ml.users, ml.config.TrustForwardedFor, user.ID, "email")
+
+	SetCookie(w, tokenString, expiresAt)
+	http.Redirect(w, r, redirectURI, http.StatusSeeOther)
+}
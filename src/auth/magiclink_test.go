@@ -0,0 +1,125 @@
+package auth
+
+import (
+	"context"
+	"crypto/x509"
+	"database/sql"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/config"
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence"
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence/memory"
+	"github.com/coopstools-homebrew/I-am-zuul/src/verifier"
+)
+
+type fakeMagicLinkTable map[string]*persistence.MagicLink
+
+func (f fakeMagicLinkTable) AddMagicLink(ctx context.Context, link *persistence.MagicLink) error {
+	f[string(link.TokenHash)] = link
+	return nil
+}
+
+func (f fakeMagicLinkTable) UseMagicLink(ctx context.Context, tokenHash []byte) (*persistence.MagicLink, error) {
+	link, ok := f[string(tokenHash)]
+	if !ok || time.Now().After(link.ExpiresAt) {
+		return nil, sql.ErrNoRows
+	}
+	delete(f, string(tokenHash))
+	return link, nil
+}
+
+// fakeMailer keeps the last mail sent to each address
+type fakeMailer map[string]string
+
+func (f fakeMailer) Send(to, subject, body string) error {
+	f[to] = body
+	return nil
+}
+
+func TestMagicLinkLogin(t *testing.T) {
+	privateKey, _ := newTestKey(t)
+	privateKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
+	mailer := fakeMailer{}
+	ctx := context.Background()
+	store := memory.NewStore()
+	user, err := store.GetOrAddEmailUser(ctx, "reviewer@example.com")
+	require.NoError(t, err)
+	require.NoError(t, store.GrantPermission(ctx, user.ID, "guest", "read"))
+	require.NoError(t, store.GrantPermission(ctx, user.ID, "coopstools", "admin"))
+	login := NewMagicLinkLogin(&config.Config{
+		MagicLinkURL:    "https://zuul.example.com/login/email/verify",
+		MagicLinkScopes: []string{"guest"},
+	}, NewTokenIssuer(string(privateKeyPEM), time.Hour), fakeMagicLinkTable{}, store, store, NewClientRegistry(fakeClientTable{}, &persistence.Client{RedirectURIs: []string{"https://ui.example.com/login"}, TokenPath: "/"}, time.Hour), mailer)
+
+	request := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		login.HandleRequest(rec, httptest.NewRequest("POST", "/login/email", strings.NewReader(body)))
+		return rec
+	}
+	verify := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/login/email/verify", strings.NewReader(url.Values{"token": {token}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		login.HandleVerify(rec, req)
+		return rec
+	}
+
+	var token string
+	t.Run("Test requesting a link", func(t *testing.T) {
+		rec := request(`{"email": "Reviewer@Example.com"}`)
+		require.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+
+		match := regexp.MustCompile(`https://zuul\.example\.com/login/email/verify\?token=(\S+)`).FindStringSubmatch(mailer["reviewer@example.com"])
+		require.NotNil(t, match, "expected a link in the mail")
+		token = match[1]
+
+		rec = httptest.NewRecorder()
+		login.HandleConfirmPage(rec, httptest.NewRequest("GET", "/login/email/verify?token="+token, nil))
+		assert.Contains(t, rec.Body.String(), `value="`+token+`"`)
+	})
+
+	t.Run("Test opening the link logs in once", func(t *testing.T) {
+		rec := verify(token)
+		require.Equal(t, http.StatusSeeOther, rec.Code, rec.Body.String())
+		assert.Equal(t, "https://ui.example.com/login", rec.Header().Get("Location"))
+
+		claims := authCookieClaims(t, rec.Result(), privateKey)
+		assert.Equal(t, int32(-1), claims.UserID)
+		assert.Equal(t, "reviewer@example.com", claims.Username)
+		assert.Equal(t, []string{verifier.AMREmail}, claims.AMR)
+		assert.Equal(t, "guest", claims.Scope)
+		assert.Equal(t, map[string]string{"guest": "read"}, claims.Permissions)
+		logins, err := store.GetLoginEvents(ctx, -1, 10)
+		require.NoError(t, err)
+		require.Len(t, logins, 1)
+		assert.Equal(t, "192.0.2.1", logins[0].IP)
+		assert.Equal(t, "email", logins[0].Provider)
+
+		rec = verify(token)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+
+	t.Run("Test refusing bad requests", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, request(`{"email": "not an email"}`).Code)
+		assert.Equal(t, http.StatusBadRequest, request(`{"email": "Someone <a@example.com>"}`).Code)
+		assert.Equal(t, http.StatusBadRequest, request(`{"email": "a@example.com", "scope": "coopstools"}`).Code)
+		assert.Equal(t, http.StatusBadRequest, request(`{"email": "a@example.com", "client_id": "unknown"}`).Code)
+	})
+
+	t.Run("Test links per address are rate limited", func(t *testing.T) {
+		for i := 1; i < maxMagicLinks; i++ {
+			require.Equal(t, http.StatusAccepted, request(`{"email": "reviewer@example.com"}`).Code)
+		}
+		assert.Equal(t, http.StatusTooManyRequests, request(`{"email": "reviewer@example.com"}`).Code)
+	})
+}
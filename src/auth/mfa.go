@@ -0,0 +1,165 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/verifier"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// SecondFactors reports whether a user has enrolled a second factor they can step up with
+type SecondFactors interface {
+	HasSecondFactor(ctx context.Context, userID int32) (bool, error)
+}
+
+// OrgPolicyTable lists the orgs whose policy requires a second factor
+type OrgPolicyTable interface {
+	GetOrgsRequiring2FA(ctx context.Context) ([]string, error)
+}
+
+// MFAPolicy withholds privileged permissions from tokens until the user has used a
+// second factor. Tokens from the GitHub login alone carry everything else.
+type MFAPolicy struct {
+	// Permissions, on any org, that require a second factor
+	Privileged []string
+	// Orgs requiring a second factor for any of their permissions; may be nil
+	OrgPolicies OrgPolicyTable
+}
+
+// split returns the permissions that may be issued without a second factor, and
+// whether any were withheld
+func (p *MFAPolicy) split(ctx context.Context, permissions map[string]string) (map[string]string, bool, error) {
+	strictOrgs := []string{}
+	if p.OrgPolicies != nil {
+		var err error
+		strictOrgs, err = p.OrgPolicies.GetOrgsRequiring2FA(ctx)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	granted := map[string]string{}
+	withheld := false
+	for orgID, permission := range permissions {
+		// Team grants ("<org>/<team>") follow their org's policy
+		org, _, _ := strings.Cut(orgID, "/")
+		if slices.Contains(p.Privileged, permission) || slices.Contains(strictOrgs, org) {
+			withheld = true
+			continue
+		}
+		granted[orgID] = permission
+	}
+	return granted, withheld, nil
+}
+
+// secondFactorGate withholds privileged permissions from fresh logins until the user
+// steps up with a second factor
+type secondFactorGate struct {
+	mfaPolicy     *MFAPolicy
+	secondFactors SecondFactors
+}
+
+// RequireSecondFactor withholds the policy's privileged permissions from tokens issued at
+// login. Users with a second factor are sent to config.MFAChallengeURL to step up.
+func (g *secondFactorGate) RequireSecondFactor(policy MFAPolicy, factors SecondFactors) {
+	g.mfaPolicy = &policy
+	g.secondFactors = factors
+}
+
+// gate returns the permissions a fresh login gets, and whether the user should be sent
+// on to step up for the rest
+func (g *secondFactorGate) gate(ctx context.Context, userID int32, permissions map[string]string) (map[string]string, bool, error) {
+	if g.mfaPolicy == nil {
+		return permissions, false, nil
+	}
+	granted, withheld, err := g.mfaPolicy.split(ctx, permissions)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get org policies: %w", err)
+	}
+	if !withheld {
+		return permissions, false, nil
+	}
+	enrolled, err := g.secondFactors.HasSecondFactor(ctx, userID)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to check second factors: %w", err)
+	}
+	if !enrolled {
+		log.Printf("Withholding privileged permissions from user %d: no second factor enrolled", userID)
+	}
+	return granted, enrolled, nil
+}
+
+// usedSecondFactor reports whether the session went beyond the GitHub or email login
+func usedSecondFactor(claims *verifier.Claims) bool {
+	return claims.HasAMR(verifier.AMRWebAuthn) || claims.HasAMR(verifier.AMROTP) || claims.HasAMR(verifier.AMRRecoveryCode)
+}
+
+// mayChangeFactors reports whether the caller may add or remove second factors. Anyone
+// can enroll their first, but after that it takes a session that used one, so a GitHub
+// login alone can't be used to swap in an attacker's factor.
+func mayChangeFactors(w http.ResponseWriter, r *http.Request, factors SecondFactors, claims *verifier.Claims) bool {
+	if usedSecondFactor(claims) {
+		return true
+	}
+	enrolled, err := factors.HasSecondFactor(r.Context(), claims.UserID)
+	if err != nil {
+		log.Printf("Failed to check second factors: %v", err)
+		http.Error(w, "Failed to check second factors", http.StatusInternalServerError)
+		return false
+	}
+	if enrolled {
+		http.Error(w, "Forbidden - Use an existing second factor first", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// loadPermissions returns the user's permissions keyed by org, as carried in tokens
+func loadPermissions(ctx context.Context, table PermissionTable, userID int32) (map[string]string, error) {
+	orgPermissions, err := table.GetUserPermissions(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	permissions := map[string]string{}
+	for _, p := range orgPermissions {
+		permissions[p.OrgID] = p.Permission
+	}
+	return permissions, nil
+}
+
+// stepUp re-issues the caller's token with all of their permissions once they have
+// used a second factor, recording the method in amr. The session keeps its auth_time.
+func stepUp(ctx context.Context, w http.ResponseWriter, issuer *TokenIssuer, permissionTable PermissionTable, claims *verifier.Claims, method string) bool {
+	permissions, err := loadPermissions(ctx, permissionTable, claims.UserID)
+	if err != nil {
+		log.Printf("Failed to get permissions: %v", err)
+		http.Error(w, "Failed to get permissions", http.StatusInternalServerError)
+		return false
+	}
+
+	// The stepped up token keeps the client's scopes and token lifetime
+	stepped := *claims
+	stepped.Permissions = scopePermissions(permissions, claims.Scopes())
+	stepped.ExpiresAt = jwt.NewNumericDate(time.Now().Add(claims.ExpiresAt.Sub(claims.IssuedAt.Time)))
+	stepped.AMR = slices.Clone(claims.AMR)
+	if !slices.Contains(stepped.AMR, method) {
+		stepped.AMR = append(stepped.AMR, method)
+	}
+	tokenString, expiresAt, err := issuer.Issue(stepped)
+	if err != nil {
+		log.Printf("Failed to generate token: %v", err)
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return false
+	}
+
+	SetCookie(w, tokenString, expiresAt)
+	log.Printf("User %d stepped up with %s", claims.UserID, method)
+	return true
+}
@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+)
+
+// The challenge page runs the WebAuthn ceremonies in the browser or takes a code from an
+// authenticator app, then sends the user on to the front end
+var mfaPage = template.Must(template.New("mfa").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Confirm it's you</title></head>
+<body>
+<h1>Confirm it's you</h1>
+<p>Use your security key or authenticator app to unlock admin access.</p>
+<button id="login">Use security key</button>
+<button id="register">Register a new security key</button>
+<form id="code">
+<input name="code" autocomplete="one-time-code" placeholder="Code or recovery code">
+<button type="submit">Verify code</button>
+</form>
+<a href="{{.RedirectURI}}">Continue without admin access</a>
+<p id="status"></p>
+<script>
+const redirectURI = {{.RedirectURI}};
+const status = document.getElementById("status");
+const toBuffer = s => Uint8Array.from(atob(s.replace(/-/g, "+").replace(/_/g, "/")), c => c.charCodeAt(0));
+const toBase64 = b => b ? btoa(String.fromCharCode(...new Uint8Array(b))).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "") : undefined;
+
+async function ceremony(kind, prepare, encode) {
+	const begin = await fetch("/mfa/webauthn/" + kind + "/begin", {method: "POST"});
+	if (!begin.ok) throw new Error(await begin.text());
+	const options = (await begin.json()).publicKey;
+	options.challenge = toBuffer(options.challenge);
+	(options.allowCredentials || options.excludeCredentials || []).forEach(c => c.id = toBuffer(c.id));
+	const credential = await prepare(options);
+	const response = {id: credential.id, rawId: toBase64(credential.rawId), type: credential.type, response: encode(credential.response)};
+	const finish = await fetch("/mfa/webauthn/" + kind + "/finish", {method: "POST", body: JSON.stringify(response)});
+	if (!finish.ok) throw new Error(await finish.text());
+}
+
+document.getElementById("login").onclick = () => ceremony("login",
+	options => navigator.credentials.get({publicKey: options}),
+	r => ({clientDataJSON: toBase64(r.clientDataJSON), authenticatorData: toBase64(r.authenticatorData), signature: toBase64(r.signature), userHandle: toBase64(r.userHandle)}),
+).then(() => window.location = redirectURI, e => status.textContent = e.message);
+
+document.getElementById("register").onclick = () => ceremony("register",
+	options => { options.user.id = toBuffer(options.user.id); return navigator.credentials.create({publicKey: options}); },
+	r => ({clientDataJSON: toBase64(r.clientDataJSON), attestationObject: toBase64(r.attestationObject)}),
+).then(() => status.textContent = "Security key registered", e => status.textContent = e.message);
+
+document.getElementById("code").onsubmit = async event => {
+	event.preventDefault();
+	const code = event.target.code.value.trim();
+	// Recovery codes are the only codes with a dash in them
+	const path = code.includes("-") ? "/mfa/recovery" : "/mfa/totp/verify";
+	const resp = await fetch(path, {method: "POST", body: JSON.stringify({code})});
+	if (resp.ok) {
+		window.location = redirectURI;
+	} else {
+		status.textContent = await resp.text();
+	}
+};
+</script>
+</body>
+</html>
+`))
+
+// HandleChallengePage serves the page users with a second factor land on after GitHub.
+// The callback passes on where the user was headed in redirect_uri, which must belong to
+// a client.
+func HandleChallengePage(clients *ClientRegistry) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		redirectURI := r.URL.Query().Get("redirect_uri")
+		if !clients.RedirectAllowed(redirectURI) {
+			redirectURI, _ = redirectFor(clients.defaultClient, "")
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err := mfaPage.Execute(w, struct{ RedirectURI string }{redirectURI})
+		if err != nil {
+			log.Printf("Failed to render mfa page: %v", err)
+		}
+	}
+}
@@ -7,62 +7,57 @@ import (
 	"net/http"
 
 	"github.com/coopstools-homebrew/I-am-zuul/src/utils"
-	"github.com/golang-jwt/jwt/v5"
+	"github.com/coopstools-homebrew/I-am-zuul/src/verifier"
 )
 
-func NewMiddleware(publicKeyString string) func(http.HandlerFunc) http.HandlerFunc {
-	publicKey, err := jwt.ParseRSAPublicKeyFromPEM([]byte(publicKeyString))
-	if err != nil {
-		log.Fatalf("Failed to parse public key: %v", err)
-	}
-
+// NewMiddleware validates the auth_token cookie (or a bearer token). When renewal is not
+// nil, tokens past the renewal point are replaced with fresh ones as they are used.
+func NewMiddleware(authenticator *Authenticator, renewal *SessionRenewal) func(http.HandlerFunc) http.HandlerFunc {
 	return func(next http.HandlerFunc) http.HandlerFunc {
 		return func(w http.ResponseWriter, r *http.Request) {
 			log.Printf("Request received: %s %s", r.Method, r.URL.Path)
-			// Get JWT token from cookie
-			cookie, err := r.Cookie("auth_token")
+			// Get JWT token from cookie, without the "ghsso_" prefix
+			claims, err := authenticator.Verify(r.Context(), verifier.TokenFromRequest(r))
 			if err != nil {
-				log.Printf("No token found: %v", err)
-				http.Error(w, "Bad Request - No token found", http.StatusBadRequest)
-				return
-			}
-
-			// Remove "ghsso_" prefix
-			tokenString := cookie.Value[6:] // Skip "ghsso_" prefix
-
-			// Parse and validate token
-			token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-				if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
-					return nil, errors.New("unexpected signing method")
-				}
-				return publicKey, nil
-			})
-
-			if err != nil || !token.Valid {
-				log.Printf("Invalid token: %v", err)
-				http.Error(w, "Unauthorized - Invalid token", http.StatusUnauthorized)
+				writeAuthError(w, err)
 				return
 			}
 
-			// Verify path claim matches current path
-			claims, ok := token.Claims.(jwt.MapClaims)
-			if !ok {
-				log.Printf("Invalid claims: %v", err)
-				http.Error(w, "Unauthorized - Invalid claims", http.StatusUnauthorized)
+			// Only session tokens covering the path are accepted; tokens made for a client's
+			// audience are for that client's service, not Zuul's
+			if !claims.ForService("", r.URL.Path) {
+				log.Printf("Token not for this service: path %v, audience %v", claims.Path, claims.Audience)
+				http.Error(w, "Unauthorized - Invalid path", http.StatusUnauthorized)
 				return
 			}
 
-			if claims["path"] != r.URL.Path {
-				log.Printf("Invalid path: %v", claims["path"])
-				http.Error(w, "Unauthorized - Invalid path", http.StatusUnauthorized)
-				return
+			if renewal != nil {
+				renewal.renew(w, claims)
 			}
 
-			// pull user_id out of jwt claims and add it to request context
-			userID := claims["user_id"].(int32)
-			r = r.WithContext(context.WithValue(r.Context(), utils.UserIDKey, userID))
+			ctx := context.WithValue(r.Context(), utils.UserIDKey, claims.UserID)
+			r = r.WithContext(verifier.NewContext(ctx, claims))
 
 			next.ServeHTTP(w, r)
 		}
 	}
 }
+
+// writeAuthError maps an Authenticator error onto a response
+func writeAuthError(w http.ResponseWriter, err error) {
+	log.Printf("Authentication failed: %v", err)
+	switch {
+	case errors.Is(err, verifier.ErrNoToken):
+		http.Error(w, "Bad Request - No token found", http.StatusBadRequest)
+	case errors.Is(err, verifier.ErrPermissionDenied):
+		http.Error(w, "Forbidden - Account disabled", http.StatusForbidden)
+	case errors.Is(err, ErrAuthStateUnavailable):
+		http.Error(w, "Failed to get auth state", http.StatusInternalServerError)
+	case errors.Is(err, ErrTokenRevoked):
+		http.Error(w, "Unauthorized - Token revoked", http.StatusUnauthorized)
+	case errors.Is(err, ErrUnknownUser):
+		http.Error(w, "Unauthorized - Unknown user", http.StatusUnauthorized)
+	default:
+		http.Error(w, "Unauthorized - Invalid token", http.StatusUnauthorized)
+	}
+}
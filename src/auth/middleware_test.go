@@ -0,0 +1,275 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"database/sql"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence"
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence/memory"
+	"github.com/coopstools-homebrew/I-am-zuul/src/utils"
+	"github.com/coopstools-homebrew/I-am-zuul/src/verifier"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeAuthStateTable serves auth states set by hand, such as tokens revoked at a given
+// time, which memory.Store has no way to set up
+type fakeAuthStateTable map[int32]*persistence.AuthState
+
+func (f fakeAuthStateTable) GetAuthState(ctx context.Context, id int32) (*persistence.AuthState, error) {
+	state, ok := f[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return state, nil
+}
+
+func newTestKey(t *testing.T) (*rsa.PrivateKey, string) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err, "Failed to generate key")
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	require.NoError(t, err, "Failed to marshal public key")
+	return privateKey, string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKeyBytes}))
+}
+
+func newTestToken(t *testing.T, privateKey *rsa.PrivateKey, userID int32, path string, issuedAt time.Time) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"user_id":  userID,
+		"username": "tester",
+		"path":     path,
+		"iat":      issuedAt.Unix(),
+		"exp":      issuedAt.Add(time.Hour).Unix(),
+	})
+	tokenString, err := token.SignedString(privateKey)
+	require.NoError(t, err, "Failed to sign token")
+	return tokenString
+}
+
+func TestMiddleware(t *testing.T) {
+	privateKey, publicKey := newTestKey(t)
+	revokedAt := time.Now().Add(-time.Minute)
+	states := fakeAuthStateTable{
+		1: {Status: persistence.UserStatusActive},
+		2: {Status: persistence.UserStatusSuspended},
+		3: {Status: persistence.UserStatusActive, TokensNotBefore: &revokedAt},
+	}
+	middleware := NewMiddleware(NewAuthenticator(publicKey, states), nil)
+	handler := middleware(func(w http.ResponseWriter, r *http.Request) {
+		assert.NotNil(t, r.Context().Value(utils.UserIDKey))
+		claims, ok := verifier.FromContext(r.Context())
+		assert.True(t, ok)
+		assert.Equal(t, "tester", claims.Username)
+	})
+
+	serve := func(path, token string) int {
+		req := httptest.NewRequest("GET", path, nil)
+		req.AddCookie(&http.Cookie{Name: "auth_token", Value: "ghsso_" + token})
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec.Code
+	}
+
+	t.Run("Test bearer token", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/data", nil)
+		req.Header.Set("Authorization", "Bearer "+newTestToken(t, privateKey, 1, "/data", time.Now()))
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+	})
+
+	t.Run("Test missing token", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest("GET", "/data", nil))
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+
+	t.Run("Test tokens made for a client are refused", func(t *testing.T) {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+			"user_id":  1,
+			"username": "tester",
+			"path":     "/",
+			"aud":      "resume",
+			"iat":      time.Now().Unix(),
+			"exp":      time.Now().Add(time.Hour).Unix(),
+		}).SignedString(privateKey)
+		require.NoError(t, err)
+		for _, path := range []string{"/data", "/me/delete", "/admin/users"} {
+			assert.Equal(t, http.StatusUnauthorized, serve(path, token), path)
+		}
+	})
+
+	tests := []struct {
+		name     string
+		userID   int32
+		path     string
+		issuedAt time.Time
+		request  string
+		expected int
+	}{
+		{"active user", 1, "/data", time.Now(), "/data", http.StatusOK},
+		{"path beneath scope", 1, "/admin", time.Now(), "/admin/users/1/status", http.StatusOK},
+		{"root scope", 1, "/", time.Now(), "/data", http.StatusOK},
+		{"path outside scope", 1, "/data", time.Now(), "/database", http.StatusUnauthorized},
+		{"suspended user", 2, "/", time.Now(), "/data", http.StatusForbidden},
+		{"token issued before revocation", 3, "/", revokedAt.Add(-time.Minute), "/data", http.StatusUnauthorized},
+		{"token issued after revocation", 3, "/", revokedAt.Add(time.Second), "/data", http.StatusOK},
+		{"unknown user", 4, "/", time.Now(), "/data", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := newTestToken(t, privateKey, tt.userID, tt.path, tt.issuedAt)
+			assert.Equal(t, tt.expected, serve(tt.request, token))
+		})
+	}
+}
+
+func TestSuspensionRevokesTokens(t *testing.T) {
+	ctx := context.Background()
+	privateKey, publicKey := newTestKey(t)
+	store := memory.NewStore()
+	require.NoError(t, store.UpdateUser(ctx, &persistence.UserInfo{ID: 1, LoginName: "tester"}))
+	handler := NewMiddleware(NewAuthenticator(publicKey, store), nil)(func(w http.ResponseWriter, r *http.Request) {})
+	serve := func(token string) int {
+		req := httptest.NewRequest("GET", "/data", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec.Code
+	}
+
+	token := newTestToken(t, privateKey, 1, "/", time.Now().Add(-time.Minute))
+	require.Equal(t, http.StatusOK, serve(token))
+
+	require.NoError(t, store.SetUserStatus(ctx, 1, persistence.UserStatusSuspended, "testing"))
+	assert.Equal(t, http.StatusForbidden, serve(token))
+
+	require.NoError(t, store.SetUserStatus(ctx, 1, persistence.UserStatusActive, ""))
+	assert.Equal(t, http.StatusUnauthorized, serve(token), "tokens from before the suspension stay revoked")
+	assert.Equal(t, http.StatusOK, serve(newTestToken(t, privateKey, 1, "/", time.Now().Add(time.Second))))
+}
+
+func TestAuthStateCache(t *testing.T) {
+	ctx := context.Background()
+	states := fakeAuthStateTable{1: {Status: persistence.UserStatusActive}}
+	cache := NewAuthStateCache(states, time.Hour)
+
+	state, err := cache.GetAuthState(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, persistence.UserStatusActive, state.Status)
+
+	states[1] = &persistence.AuthState{Status: persistence.UserStatusSuspended}
+	state, err = cache.GetAuthState(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, persistence.UserStatusActive, state.Status, "expected the cached state")
+
+	cache.Invalidate(1)
+	state, err = cache.GetAuthState(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, persistence.UserStatusSuspended, state.Status)
+}
+
+func TestSessionRenewal(t *testing.T) {
+	privateKey, publicKey := newTestKey(t)
+	states := fakeAuthStateTable{1: {Status: persistence.UserStatusActive}}
+	renewal := &SessionRenewal{
+		Issuer:     &TokenIssuer{privateKey: privateKey, keyID: "test", lifetime: time.Hour},
+		RenewAfter: 0.5,
+		MaxAge:     12 * time.Hour,
+	}
+	handler := NewMiddleware(NewAuthenticator(publicKey, states), renewal)(func(w http.ResponseWriter, r *http.Request) {})
+
+	// serve returns the expiry of the renewed token, or nil if the token wasn't renewed
+	serve := func(issuedAt, authTime time.Time) *time.Time {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodRS256, &verifier.Claims{
+			UserID:   1,
+			Username: "tester",
+			Path:     "/",
+			AuthTime: jwt.NewNumericDate(authTime),
+			RegisteredClaims: jwt.RegisteredClaims{
+				IssuedAt:  jwt.NewNumericDate(issuedAt),
+				ExpiresAt: jwt.NewNumericDate(issuedAt.Add(time.Hour)),
+			},
+		}).SignedString(privateKey)
+		require.NoError(t, err)
+
+		req := httptest.NewRequest("GET", "/data", nil)
+		req.AddCookie(&http.Cookie{Name: "auth_token", Value: "ghsso_" + token})
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		for _, cookie := range rec.Result().Cookies() {
+			if cookie.Name != "auth_token" {
+				continue
+			}
+			renewed := &verifier.Claims{}
+			_, _, err := jwt.NewParser().ParseUnverified(cookie.Value[6:], renewed)
+			require.NoError(t, err)
+			assert.Equal(t, authTime.Unix(), renewed.AuthTime.Unix())
+			assert.Equal(t, "tester", renewed.Username)
+			return &renewed.ExpiresAt.Time
+		}
+		return nil
+	}
+
+	t.Run("Test fresh token is not renewed", func(t *testing.T) {
+		issuedAt := time.Now().Add(-10 * time.Minute)
+		assert.Nil(t, serve(issuedAt, issuedAt))
+	})
+
+	t.Run("Test token past renewal point is renewed", func(t *testing.T) {
+		issuedAt := time.Now().Add(-40 * time.Minute)
+		expiresAt := serve(issuedAt, issuedAt)
+		require.NotNil(t, expiresAt)
+		assert.WithinDuration(t, time.Now().Add(time.Hour), *expiresAt, 2*time.Second)
+	})
+
+	t.Run("Test renewal is capped by max age", func(t *testing.T) {
+		issuedAt := time.Now().Add(-40 * time.Minute)
+		authTime := time.Now().Add(-11*time.Hour - 30*time.Minute)
+		expiresAt := serve(issuedAt, authTime)
+		require.NotNil(t, expiresAt)
+		assert.WithinDuration(t, authTime.Add(12*time.Hour), *expiresAt, 2*time.Second)
+	})
+
+	t.Run("Test session at max age is not renewed", func(t *testing.T) {
+		issuedAt := time.Now().Add(-40 * time.Minute)
+		authTime := time.Now().Add(-11*time.Hour - 40*time.Minute)
+		assert.Nil(t, serve(issuedAt, authTime))
+	})
+}
+
+func TestPermissionMiddleware(t *testing.T) {
+	policy := MFAPolicy{Privileged: []string{"admin"}}
+	held := map[string]string{"coopstools": "admin"}
+	requireAdmin := NewPermissionMiddleware("coopstools", "admin")(func(w http.ResponseWriter, r *http.Request) {})
+
+	serve := func(claims *verifier.Claims) int {
+		req := httptest.NewRequest("GET", "/admin/users/1/status", nil)
+		if claims != nil {
+			req = req.WithContext(verifier.NewContext(req.Context(), claims))
+		}
+		rec := httptest.NewRecorder()
+		requireAdmin(rec, req)
+		return rec.Code
+	}
+
+	// The user holds admin in the db, but a GitHub login alone doesn't put it in the token
+	granted, withheld, err := policy.split(context.Background(), held)
+	require.NoError(t, err)
+	require.True(t, withheld)
+	assert.Equal(t, http.StatusForbidden, serve(&verifier.Claims{UserID: 1, Permissions: granted, AMR: []string{verifier.AMRGitHub}}))
+
+	steppedUp := &verifier.Claims{UserID: 1, Permissions: held, AMR: []string{verifier.AMRGitHub, verifier.AMRWebAuthn}}
+	assert.Equal(t, http.StatusOK, serve(steppedUp))
+	assert.Equal(t, http.StatusUnauthorized, serve(nil))
+}
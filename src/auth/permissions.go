@@ -0,0 +1,38 @@
+package auth
+
+import (
+	"context"
+	"log"
+	"net/http"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence"
+	"github.com/coopstools-homebrew/I-am-zuul/src/verifier"
+)
+
+type PermissionTable interface {
+	GetUserPermissions(ctx context.Context, userID int32) ([]*persistence.OrgPermission, error)
+}
+
+// NewPermissionMiddleware only lets through callers whose token holds the permission on
+// the org. It reads the verified token rather than the db, so permissions held back until
+// the user steps up with a second factor stay held back. It must run after the auth
+// middleware, which puts the claims in the request context.
+func NewPermissionMiddleware(orgID, permission string) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := verifier.FromContext(r.Context())
+			if !ok {
+				log.Printf("No claims in context for %s", r.URL.Path)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			if !claims.HasPermission(orgID, permission) {
+				log.Printf("User %d lacks %s on %s in their token", claims.UserID, permission, orgID)
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package auth
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/verifier"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// SessionRenewal lets the auth middleware re-issue tokens for active users
+type SessionRenewal struct {
+	Issuer *TokenIssuer
+	// Fraction of a token's lifetime after which it is renewed, e.g. 0.5
+	RenewAfter float64
+	// Time since the GitHub login after which the session can't be renewed any further
+	MaxAge time.Duration
+}
+
+// renew re-issues the cookie if the token is far enough through its lifetime. The new
+// token never outlives the session's max age, after which the user must log in again.
+func (sr *SessionRenewal) renew(w http.ResponseWriter, claims *verifier.Claims) {
+	now := time.Now()
+	issuedAt, expiresAt := claims.IssuedAt.Time, claims.ExpiresAt.Time
+	lifetime := expiresAt.Sub(issuedAt)
+	if now.Sub(issuedAt) < time.Duration(float64(lifetime)*sr.RenewAfter) {
+		return
+	}
+
+	// Tokens from before auth_time was added started their session when issued
+	authTime := issuedAt
+	if claims.AuthTime != nil {
+		authTime = claims.AuthTime.Time
+	}
+
+	// Renewed tokens keep the lifetime they were issued with, which may be a client's
+	newExpiresAt := now.Add(lifetime)
+	if sessionEnd := authTime.Add(sr.MaxAge); sessionEnd.Before(newExpiresAt) {
+		newExpiresAt = sessionEnd
+	}
+	if !newExpiresAt.After(expiresAt) {
+		return
+	}
+
+	renewed := *claims
+	renewed.ExpiresAt = jwt.NewNumericDate(newExpiresAt)
+	renewed.AuthTime = jwt.NewNumericDate(authTime)
+	tokenString, newExpiresAt, err := sr.Issuer.Issue(renewed)
+	if err != nil {
+		log.Printf("Failed to renew token for user %d: %v", claims.UserID, err)
+		return
+	}
+	SetCookie(w, tokenString, newExpiresAt)
+	log.Printf("Renewed session for user %d until %s", claims.UserID, newExpiresAt)
+}
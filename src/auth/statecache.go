@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence"
+)
+
+type cachedAuthState struct {
+	state     *persistence.AuthState
+	expiresAt time.Time
+}
+
+// AuthStateCache keeps auth states for a short time so the middleware can check every
+// request without a db round trip. Changes made elsewhere take effect within ttl.
+type AuthStateCache struct {
+	table AuthStateTable
+	ttl   time.Duration
+
+	mu     sync.Mutex
+	states map[int32]cachedAuthState
+}
+
+func NewAuthStateCache(table AuthStateTable, ttl time.Duration) *AuthStateCache {
+	return &AuthStateCache{
+		table:  table,
+		ttl:    ttl,
+		states: map[int32]cachedAuthState{},
+	}
+}
+
+func (c *AuthStateCache) GetAuthState(ctx context.Context, id int32) (*persistence.AuthState, error) {
+	c.mu.Lock()
+	cached, ok := c.states[id]
+	c.mu.Unlock()
+	if ok && time.Now().Before(cached.expiresAt) {
+		return cached.state, nil
+	}
+
+	state, err := c.table.GetAuthState(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.states[id] = cachedAuthState{state: state, expiresAt: time.Now().Add(c.ttl)}
+	c.mu.Unlock()
+	return state, nil
+}
+
+// Invalidate drops the cached state so the next request reads it from the db
+func (c *AuthStateCache) Invalidate(id int32) {
+	c.mu.Lock()
+	delete(c.states, id)
+	c.mu.Unlock()
+}
@@ -0,0 +1,121 @@
+package auth
+
+import (
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	grantTypeTokenExchange = "urn:ietf:params:oauth:grant-type:token-exchange"
+	tokenTypeJWT           = "urn:ietf:params:oauth:token-type:jwt"
+	tokenTypeAccessToken   = "urn:ietf:params:oauth:token-type:access_token"
+)
+
+// TokenExchange lets a client's backend trade a user's Zuul session token for one made
+// for the client (RFC 8693 token exchange), authenticating with its client secret
+type TokenExchange struct {
+	authenticator *Authenticator
+	issuer        *TokenIssuer
+	clients       *ClientRegistry
+}
+
+func NewTokenExchange(authenticator *Authenticator, issuer *TokenIssuer, clients *ClientRegistry) *TokenExchange {
+	return &TokenExchange{
+		authenticator: authenticator,
+		issuer:        issuer,
+		clients:       clients,
+	}
+}
+
+func oauthError(w http.ResponseWriter, status int, code, description string) {
+	writeJSON(w, status, map[string]string{"error": code, "error_description": description})
+}
+
+// narrowScopes keeps the scopes within the subject token's, so an exchange can't widen
+// what a token is limited to. Unscoped subjects allow any scopes.
+func narrowScopes(scopes, subjectScopes []string) []string {
+	if len(subjectScopes) == 0 {
+		return scopes
+	}
+	if len(scopes) == 0 {
+		return subjectScopes
+	}
+	narrowed := []string{}
+	for _, scope := range scopes {
+		org, _, _ := strings.Cut(scope, "/")
+		if slices.Contains(subjectScopes, scope) || slices.Contains(subjectScopes, org) {
+			narrowed = append(narrowed, scope)
+		}
+	}
+	return narrowed
+}
+
+// HandleToken serves the token endpoint. Clients authenticate with basic auth or
+// client_id and client_secret form fields.
+func (te *TokenExchange) HandleToken(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	clientID, secret, ok := r.BasicAuth()
+	if !ok {
+		clientID, secret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	}
+	client, ok := te.clients.Authenticate(clientID, secret)
+	if !ok {
+		log.Printf("Failed token exchange for client %q: bad credentials", clientID)
+		w.Header().Set("WWW-Authenticate", `Basic realm="zuul"`)
+		oauthError(w, http.StatusUnauthorized, "invalid_client", "Unknown client or bad secret")
+		return
+	}
+
+	if r.PostFormValue("grant_type") != grantTypeTokenExchange {
+		oauthError(w, http.StatusBadRequest, "unsupported_grant_type", "Only token exchange is supported")
+		return
+	}
+	if tokenType := r.PostFormValue("subject_token_type"); tokenType != tokenTypeJWT && tokenType != tokenTypeAccessToken {
+		oauthError(w, http.StatusBadRequest, "invalid_request", "subject_token_type must be a jwt or access token")
+		return
+	}
+	claims, err := te.authenticator.Verify(r.Context(), r.PostFormValue("subject_token"))
+	if err != nil {
+		log.Printf("Failed token exchange for client %s: %v", client.ClientID, err)
+		oauthError(w, http.StatusBadRequest, "invalid_grant", "Invalid subject token")
+		return
+	}
+	// Only sessions are exchanged. Tokens already made for a client, or limited to a
+	// path, must not be turned into anything else.
+	if !claims.ForService("", "/") {
+		log.Printf("Failed token exchange for client %s: subject token of user %d is not a session", client.ClientID, claims.UserID)
+		oauthError(w, http.StatusBadRequest, "invalid_grant", "Subject token must be a session token")
+		return
+	}
+
+	scopes, ok := grantScopes(client, strings.Fields(r.PostFormValue("scope")))
+	if ok {
+		requested := scopes
+		scopes = narrowScopes(scopes, claims.Scopes())
+		ok = len(requested) == 0 || len(scopes) > 0
+	}
+	if !ok {
+		oauthError(w, http.StatusBadRequest, "invalid_scope", "Scope not allowed")
+		return
+	}
+
+	tokenString, expiresAt, err := te.issuer.Issue(forClient(*claims, client, scopes))
+	if err != nil {
+		log.Printf("Failed to generate token: %v", err)
+		oauthError(w, http.StatusInternalServerError, "server_error", "Failed to generate token")
+		return
+	}
+	log.Printf("Exchanged token of user %d for client %s", claims.UserID, client.ClientID)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token":      tokenString,
+		"issued_token_type": tokenTypeJWT,
+		"token_type":        "Bearer",
+		"expires_in":        int(time.Until(expiresAt).Seconds()),
+		"scope":             strings.Join(scopes, " "),
+	})
+}
@@ -0,0 +1,118 @@
+package auth
+
+import (
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/verifier"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// TokenIssuer signs the tokens handed out in the auth_token cookie
+type TokenIssuer struct {
+	privateKey *rsa.PrivateKey
+	keyID      string
+	lifetime   time.Duration
+}
+
+func NewTokenIssuer(privateKeyString string, lifetime time.Duration) *TokenIssuer {
+	privateKey, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(privateKeyString))
+	if err != nil {
+		log.Fatalf("Failed to parse private key: %v", err)
+	}
+	return &TokenIssuer{
+		privateKey: privateKey,
+		keyID:      verifier.KeyID(&privateKey.PublicKey),
+		lifetime:   lifetime,
+	}
+}
+
+// CheckKeyPair reports an error unless both keys are loaded and the authenticator's
+// public key is the issuer's, so issued tokens will verify
+func CheckKeyPair(issuer *TokenIssuer, authenticator *Authenticator) error {
+	if issuer.privateKey == nil || authenticator.publicKey == nil {
+		return errors.New("keys not loaded")
+	}
+	if !issuer.privateKey.PublicKey.Equal(authenticator.publicKey) {
+		return errors.New("PUBLIC_KEY does not match PRIVATE_KEY")
+	}
+	return nil
+}
+
+// Issue signs the claims as of now. Unless set, the token expires after the issuer's
+// lifetime and auth_time (when the user logged in with GitHub) is now; renewed tokens
+// carry auth_time forward so sessions can't be extended forever.
+func (ti *TokenIssuer) Issue(claims verifier.Claims) (string, time.Time, error) {
+	now := time.Now()
+	claims.IssuedAt = jwt.NewNumericDate(now)
+	if claims.ExpiresAt == nil {
+		claims.ExpiresAt = jwt.NewNumericDate(now.Add(ti.lifetime))
+	}
+	if claims.AuthTime == nil {
+		claims.AuthTime = jwt.NewNumericDate(now)
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, &claims)
+	token.Header["kid"] = ti.keyID
+	tokenString, err := token.SignedString(ti.privateKey)
+	return tokenString, claims.ExpiresAt.Time, err
+}
+
+// signState signs short-lived server state handed to the browser, such as a WebAuthn
+// ceremony. State claims must not include user_id, so they can never pass as a token.
+func (ti *TokenIssuer) signState(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = ti.keyID
+	return token.SignedString(ti.privateKey)
+}
+
+// parseState verifies state produced by signState
+func (ti *TokenIssuer) parseState(tokenString string, claims jwt.Claims) error {
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		return &ti.privateKey.PublicKey, nil
+	}, jwt.WithValidMethods([]string{"RS256"}), jwt.WithExpirationRequired())
+	return err
+}
+
+// SetCookie hands the token to the browser, expiring the cookie along with the token
+func SetCookie(w http.ResponseWriter, tokenString string, expiresAt time.Time) {
+	cookie := &http.Cookie{
+		Name:     "auth_token",
+		Value:    "ghsso_" + tokenString,
+		Secure:   true,
+		SameSite: http.SameSiteNoneMode,
+		Path:     "/",
+		MaxAge:   int(time.Until(expiresAt).Seconds()),
+	}
+	http.SetCookie(w, cookie)
+}
+
+// ClearCookie has the browser drop the token, e.g. once the account is deleted
+func ClearCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "auth_token",
+		Secure:   true,
+		SameSite: http.SameSiteNoneMode,
+		Path:     "/",
+		MaxAge:   -1,
+	})
+}
+
+// HandleJWKS publishes the public key so other services can verify tokens
+func HandleJWKS(publicKeyString string) func(w http.ResponseWriter, r *http.Request) {
+	publicKey, err := jwt.ParseRSAPublicKeyFromPEM([]byte(publicKeyString))
+	if err != nil {
+		log.Fatalf("Failed to parse public key: %v", err)
+	}
+	jwks := verifier.JWKS{Keys: []verifier.JWK{verifier.NewJWK(publicKey)}}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		json.NewEncoder(w).Encode(jwks)
+	}
+}
@@ -0,0 +1,415 @@
+package auth
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence"
+	"github.com/coopstools-homebrew/I-am-zuul/src/verifier"
+)
+
+const (
+	totpPeriod        = 30
+	recoveryCodeCount = 10
+	// Failed codes allowed per user within failureWindow before codes are refused
+	maxFailures   = 5
+	failureWindow = 5 * time.Minute
+)
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TOTPTable stores encrypted totp secrets and hashed recovery codes
+type TOTPTable interface {
+	SaveTOTPSecret(ctx context.Context, userID int32, secret []byte) (bool, error)
+	GetTOTPSecret(ctx context.Context, userID int32) (*persistence.TOTPSecret, error)
+	UseTOTPStep(ctx context.Context, userID int32, step int64) (bool, error)
+	DeleteTOTPSecret(ctx context.Context, userID int32) error
+	ReplaceRecoveryCodes(ctx context.Context, userID int32, codeHashes [][]byte) error
+	UseRecoveryCode(ctx context.Context, userID int32, codeHash []byte) (bool, error)
+}
+
+// secretBox encrypts totp secrets at rest with AES-GCM
+type secretBox struct {
+	aead cipher.AEAD
+}
+
+func newSecretBox(encodedKey string) (*secretBox, error) {
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return nil, fmt.Errorf("encryption key must be base64: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("encryption key must be 32 bytes, got %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &secretBox{aead: aead}, nil
+}
+
+// seal returns the nonce followed by the ciphertext
+func (b *secretBox) seal(plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return b.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func (b *secretBox) open(sealed []byte) ([]byte, error) {
+	if len(sealed) < b.aead.NonceSize() {
+		return nil, errors.New("sealed secret too short")
+	}
+	nonce, ciphertext := sealed[:b.aead.NonceSize()], sealed[b.aead.NonceSize():]
+	return b.aead.Open(nil, nonce, ciphertext, nil)
+}
+
+// rateLimiter refuses keys with too many recent events, such as wrong codes from a user
+// so six digit codes can't be guessed
+type rateLimiter[K comparable] struct {
+	max    int
+	window time.Duration
+
+	mu     sync.Mutex
+	events map[K][]time.Time
+}
+
+func newRateLimiter[K comparable](max int, window time.Duration) *rateLimiter[K] {
+	return &rateLimiter[K]{max: max, window: window, events: map[K][]time.Time{}}
+}
+
+func (l *rateLimiter[K]) recent(key K) []time.Time {
+	cutoff := time.Now().Add(-l.window)
+	recent := []time.Time{}
+	for _, at := range l.events[key] {
+		if at.After(cutoff) {
+			recent = append(recent, at)
+		}
+	}
+	if len(recent) == 0 {
+		delete(l.events, key)
+	} else {
+		l.events[key] = recent
+	}
+	return recent
+}
+
+func (l *rateLimiter[K]) allowed(key K) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.recent(key)) < l.max
+}
+
+func (l *rateLimiter[K]) record(key K) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events[key] = append(l.recent(key), time.Now())
+}
+
+// TOTPHandler enrolls authenticator apps and lets users step up with a code or a
+// recovery code. Every handler runs after the auth middleware.
+type TOTPHandler struct {
+	table           TOTPTable
+	box             *secretBox
+	issuer          *TokenIssuer
+	permissionTable PermissionTable
+	factors         SecondFactors
+	// Shown in authenticator apps next to the account
+	issuerName string
+	limiter    *rateLimiter[int32]
+}
+
+// NewTOTPHandler creates the handler. encryptionKey is 32 base64 encoded bytes, and
+// factors must cover all of a user's second factors.
+func NewTOTPHandler(encryptionKey, issuerName string, issuer *TokenIssuer, table TOTPTable, permissionTable PermissionTable, factors SecondFactors) (*TOTPHandler, error) {
+	box, err := newSecretBox(encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	return &TOTPHandler{
+		table:           table,
+		box:             box,
+		issuer:          issuer,
+		permissionTable: permissionTable,
+		factors:         factors,
+		issuerName:      issuerName,
+		limiter:         newRateLimiter[int32](maxFailures, failureWindow),
+	}, nil
+}
+
+type codeRequest struct {
+	Code string `json:"code"`
+}
+
+func readCode(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var body codeRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Code == "" {
+		http.Error(w, "Bad Request - Missing code", http.StatusBadRequest)
+		return "", false
+	}
+	return strings.TrimSpace(body.Code), true
+}
+
+// checkCode validates a code against the user's secret, accepting one period of clock
+// drift either way. Each time step is accepted only once.
+func (h *TOTPHandler) checkCode(ctx context.Context, userID int32, secret *persistence.TOTPSecret, code string) (bool, error) {
+	plaintext, err := h.box.open(secret.Secret)
+	if err != nil {
+		return false, err
+	}
+
+	now := time.Now()
+	for _, drift := range []int{0, -1, 1} {
+		at := now.Add(time.Duration(drift*totpPeriod) * time.Second)
+		valid, err := totp.ValidateCustom(code, string(plaintext), at, totp.ValidateOpts{
+			Period:    totpPeriod,
+			Digits:    otp.DigitsSix,
+			Algorithm: otp.AlgorithmSHA1,
+		})
+		if err != nil || !valid {
+			continue
+		}
+		return h.table.UseTOTPStep(ctx, userID, at.Unix()/totpPeriod)
+	}
+	return false, nil
+}
+
+// verifyCode handles a submitted code for the caller, answering the request on failure
+func (h *TOTPHandler) verifyCode(w http.ResponseWriter, r *http.Request, wantConfirmed bool) (*verifier.Claims, bool) {
+	claims, ok := verifier.FromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+	code, ok := readCode(w, r)
+	if !ok {
+		return nil, false
+	}
+	if !h.limiter.allowed(claims.UserID) {
+		http.Error(w, "Too many failed codes, try again later", http.StatusTooManyRequests)
+		return nil, false
+	}
+
+	secret, err := h.table.GetTOTPSecret(r.Context(), claims.UserID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && secret.Confirmed != wantConfirmed) {
+		http.Error(w, "Not Found - No authenticator app to verify", http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("Failed to get totp secret: %v", err)
+		http.Error(w, "Failed to get totp secret", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	valid, err := h.checkCode(r.Context(), claims.UserID, secret, code)
+	if err != nil {
+		log.Printf("Failed to check totp code for user %d: %v", claims.UserID, err)
+		http.Error(w, "Failed to check code", http.StatusInternalServerError)
+		return nil, false
+	}
+	if !valid {
+		h.limiter.record(claims.UserID)
+		log.Printf("Invalid totp code for user %d", claims.UserID)
+		http.Error(w, "Unauthorized - Invalid code", http.StatusUnauthorized)
+		return nil, false
+	}
+	return claims, true
+}
+
+func hashRecoveryCode(code string) []byte {
+	normalized := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	hash := sha256.Sum256([]byte(normalized))
+	return hash[:]
+}
+
+// newRecoveryCodes stores a fresh set of recovery codes, returning them in the only form
+// the user will ever see them
+func (h *TOTPHandler) newRecoveryCodes(ctx context.Context, userID int32) ([]string, error) {
+	codes := []string{}
+	hashes := [][]byte{}
+	for i := 0; i < recoveryCodeCount; i++ {
+		raw := make([]byte, 10)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(base32NoPadding.EncodeToString(raw))
+		code = code[:8] + "-" + code[8:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, h.table.ReplaceRecoveryCodes(ctx, userID, hashes)
+}
+
+// HandleEnroll creates an unconfirmed secret and returns it with its otpauth://
+// provisioning uri, for display as a QR code
+func (h *TOTPHandler) HandleEnroll(w http.ResponseWriter, r *http.Request) {
+	claims, ok := verifier.FromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !mayChangeFactors(w, r, h.factors, claims) {
+		return
+	}
+
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      h.issuerName,
+		AccountName: claims.Username,
+		Period:      totpPeriod,
+		Digits:      otp.DigitsSix,
+		Algorithm:   otp.AlgorithmSHA1,
+	})
+	if err != nil {
+		log.Printf("Failed to generate totp secret: %v", err)
+		http.Error(w, "Failed to generate secret", http.StatusInternalServerError)
+		return
+	}
+	sealed, err := h.box.seal([]byte(key.Secret()))
+	if err != nil {
+		log.Printf("Failed to encrypt totp secret: %v", err)
+		http.Error(w, "Failed to generate secret", http.StatusInternalServerError)
+		return
+	}
+
+	saved, err := h.table.SaveTOTPSecret(r.Context(), claims.UserID, sealed)
+	if err != nil {
+		log.Printf("Failed to save totp secret: %v", err)
+		http.Error(w, "Failed to save secret", http.StatusInternalServerError)
+		return
+	}
+	if !saved {
+		http.Error(w, "Conflict - An authenticator app is already enrolled", http.StatusConflict)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, map[string]string{"secret": key.Secret(), "uri": key.URL()})
+}
+
+// HandleConfirm checks the first code from the app, completing enrollment. The response
+// carries the user's recovery codes, and their token is stepped up.
+func (h *TOTPHandler) HandleConfirm(w http.ResponseWriter, r *http.Request) {
+	claims, ok := h.verifyCode(w, r, false)
+	if !ok {
+		return
+	}
+
+	codes, err := h.newRecoveryCodes(r.Context(), claims.UserID)
+	if err != nil {
+		log.Printf("Failed to create recovery codes: %v", err)
+		http.Error(w, "Failed to create recovery codes", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("User %d enrolled an authenticator app", claims.UserID)
+
+	if stepUp(r.Context(), w, h.issuer, h.permissionTable, claims, verifier.AMROTP) {
+		writeJSON(w, http.StatusOK, map[string][]string{"recovery_codes": codes})
+	}
+}
+
+// HandleVerify steps the caller up with a code from their app
+func (h *TOTPHandler) HandleVerify(w http.ResponseWriter, r *http.Request) {
+	claims, ok := h.verifyCode(w, r, true)
+	if !ok {
+		return
+	}
+	if stepUp(r.Context(), w, h.issuer, h.permissionTable, claims, verifier.AMROTP) {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// HandleRecover steps the caller up with one of their recovery codes, using it up
+func (h *TOTPHandler) HandleRecover(w http.ResponseWriter, r *http.Request) {
+	claims, ok := verifier.FromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	code, ok := readCode(w, r)
+	if !ok {
+		return
+	}
+	if !h.limiter.allowed(claims.UserID) {
+		http.Error(w, "Too many failed codes, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	used, err := h.table.UseRecoveryCode(r.Context(), claims.UserID, hashRecoveryCode(code))
+	if err != nil {
+		log.Printf("Failed to use recovery code: %v", err)
+		http.Error(w, "Failed to check code", http.StatusInternalServerError)
+		return
+	}
+	if !used {
+		h.limiter.record(claims.UserID)
+		log.Printf("Invalid recovery code for user %d", claims.UserID)
+		http.Error(w, "Unauthorized - Invalid code", http.StatusUnauthorized)
+		return
+	}
+
+	log.Printf("User %d used a recovery code", claims.UserID)
+	if stepUp(r.Context(), w, h.issuer, h.permissionTable, claims, verifier.AMRRecoveryCode) {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// HandleRegenerateRecoveryCodes replaces the caller's recovery codes
+func (h *TOTPHandler) HandleRegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	claims, ok := verifier.FromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !usedSecondFactor(claims) {
+		http.Error(w, "Forbidden - Use a second factor first", http.StatusForbidden)
+		return
+	}
+
+	codes, err := h.newRecoveryCodes(r.Context(), claims.UserID)
+	if err != nil {
+		log.Printf("Failed to create recovery codes: %v", err)
+		http.Error(w, "Failed to create recovery codes", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string][]string{"recovery_codes": codes})
+}
+
+// HandleDisable removes the caller's authenticator app and recovery codes
+func (h *TOTPHandler) HandleDisable(w http.ResponseWriter, r *http.Request) {
+	claims, ok := verifier.FromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !mayChangeFactors(w, r, h.factors, claims) {
+		return
+	}
+
+	if err := h.table.DeleteTOTPSecret(r.Context(), claims.UserID); err != nil {
+		log.Printf("Failed to delete totp secret: %v", err)
+		http.Error(w, "Failed to delete secret", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
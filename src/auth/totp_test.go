@@ -0,0 +1,173 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"database/sql"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pquerna/otp/totp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence"
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence/memory"
+	"github.com/coopstools-homebrew/I-am-zuul/src/verifier"
+)
+
+const testEncryptionKey = "enV1bC1kZXYtbWZhLWVuY3J5cHRpb24ta2V5LTAwMDA="
+
+type fakeTOTPTable struct {
+	secrets       map[int32]*persistence.TOTPSecret
+	recoveryCodes map[int32]map[string]bool
+}
+
+func (f *fakeTOTPTable) SaveTOTPSecret(ctx context.Context, userID int32, secret []byte) (bool, error) {
+	if existing, ok := f.secrets[userID]; ok && existing.Confirmed {
+		return false, nil
+	}
+	f.secrets[userID] = &persistence.TOTPSecret{UserID: userID, Secret: secret}
+	return true, nil
+}
+
+func (f *fakeTOTPTable) GetTOTPSecret(ctx context.Context, userID int32) (*persistence.TOTPSecret, error) {
+	secret, ok := f.secrets[userID]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return secret, nil
+}
+
+func (f *fakeTOTPTable) UseTOTPStep(ctx context.Context, userID int32, step int64) (bool, error) {
+	secret := f.secrets[userID]
+	if step <= secret.LastUsedStep {
+		return false, nil
+	}
+	secret.LastUsedStep = step
+	secret.Confirmed = true
+	return true, nil
+}
+
+func (f *fakeTOTPTable) DeleteTOTPSecret(ctx context.Context, userID int32) error {
+	delete(f.secrets, userID)
+	delete(f.recoveryCodes, userID)
+	return nil
+}
+
+func (f *fakeTOTPTable) ReplaceRecoveryCodes(ctx context.Context, userID int32, codeHashes [][]byte) error {
+	f.recoveryCodes[userID] = map[string]bool{}
+	for _, hash := range codeHashes {
+		f.recoveryCodes[userID][string(hash)] = true
+	}
+	return nil
+}
+
+func (f *fakeTOTPTable) UseRecoveryCode(ctx context.Context, userID int32, codeHash []byte) (bool, error) {
+	if !f.recoveryCodes[userID][string(codeHash)] {
+		return false, nil
+	}
+	delete(f.recoveryCodes[userID], string(codeHash))
+	return true, nil
+}
+
+func (f *fakeTOTPTable) HasSecondFactor(ctx context.Context, userID int32) (bool, error) {
+	secret, ok := f.secrets[userID]
+	return ok && secret.Confirmed, nil
+}
+
+func TestTOTPStepUp(t *testing.T) {
+	privateKey, _ := newTestKey(t)
+	privateKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
+	issuer := NewTokenIssuer(string(privateKeyPEM), time.Hour)
+	ctx := context.Background()
+	store := memory.NewStore()
+	require.NoError(t, store.UpdateUser(ctx, &persistence.UserInfo{ID: 1001, LoginName: "octo-admin"}))
+	require.NoError(t, store.GrantPermission(ctx, 1001, "coopstools", "admin"))
+	table := &fakeTOTPTable{secrets: map[int32]*persistence.TOTPSecret{}, recoveryCodes: map[int32]map[string]bool{}}
+	handler, err := NewTOTPHandler(testEncryptionKey, "Zuul", issuer, table, store, table)
+	require.NoError(t, err)
+
+	githubOnly := &verifier.Claims{UserID: 1001, Username: "octo-admin", Path: "/", AMR: []string{verifier.AMRGitHub},
+		RegisteredClaims: jwt.RegisteredClaims{IssuedAt: jwt.NewNumericDate(time.Now()), ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))}}
+	serve := func(handle http.HandlerFunc, claims *verifier.Claims, code string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(codeRequest{Code: code})
+		req := httptest.NewRequest("POST", "/mfa/totp", bytes.NewReader(body))
+		req = req.WithContext(verifier.NewContext(req.Context(), claims))
+		rec := httptest.NewRecorder()
+		handle(rec, req)
+		return rec
+	}
+
+	var secret, confirmCode string
+	var recoveryCodes []string
+	t.Run("Test enrolling", func(t *testing.T) {
+		rec := serve(handler.HandleEnroll, githubOnly, "")
+		require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+		var body struct {
+			Secret string `json:"secret"`
+			URI    string `json:"uri"`
+		}
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&body))
+		secret = body.Secret
+		assert.Contains(t, body.URI, "otpauth://totp/Zuul:octo-admin")
+		assert.NotContains(t, string(table.secrets[1001].Secret), secret, "secret should be stored encrypted")
+
+		rec = serve(handler.HandleVerify, githubOnly, "000000")
+		assert.Equal(t, http.StatusNotFound, rec.Code, "an unconfirmed secret cannot be used to step up")
+	})
+
+	t.Run("Test confirming the first code", func(t *testing.T) {
+		var err error
+		confirmCode, err = totp.GenerateCode(secret, time.Now())
+		require.NoError(t, err)
+		rec := serve(handler.HandleConfirm, githubOnly, confirmCode)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		var body struct {
+			RecoveryCodes []string `json:"recovery_codes"`
+		}
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&body))
+		recoveryCodes = body.RecoveryCodes
+		assert.Len(t, recoveryCodes, recoveryCodeCount)
+
+		claims := authCookieClaims(t, rec.Result(), privateKey)
+		assert.True(t, claims.HasPermission("coopstools", "admin"))
+		assert.Equal(t, []string{verifier.AMRGitHub, verifier.AMROTP}, claims.AMR)
+	})
+
+	t.Run("Test a code cannot be replayed", func(t *testing.T) {
+		rec := serve(handler.HandleVerify, githubOnly, confirmCode)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	})
+
+	t.Run("Test enrolling again needs a step up", func(t *testing.T) {
+		rec := serve(handler.HandleEnroll, githubOnly, "")
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+	})
+
+	t.Run("Test a recovery code is used once", func(t *testing.T) {
+		rec := serve(handler.HandleRecover, githubOnly, recoveryCodes[0])
+		require.Equal(t, http.StatusNoContent, rec.Code, rec.Body.String())
+		claims := authCookieClaims(t, rec.Result(), privateKey)
+		assert.Equal(t, []string{verifier.AMRGitHub, verifier.AMRRecoveryCode}, claims.AMR)
+
+		rec = serve(handler.HandleRecover, githubOnly, recoveryCodes[0])
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	})
+
+	t.Run("Test failed codes are rate limited", func(t *testing.T) {
+		for i := 0; i < maxFailures; i++ {
+			serve(handler.HandleVerify, githubOnly, "000000")
+		}
+		code, err := totp.GenerateCode(secret, time.Now().Add(totpPeriod*time.Second))
+		require.NoError(t, err)
+		rec := serve(handler.HandleVerify, githubOnly, code)
+		assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	})
+}
@@ -0,0 +1,379 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/config"
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence"
+	"github.com/coopstools-homebrew/I-am-zuul/src/verifier"
+)
+
+const (
+	webAuthnSessionCookie = "webauthn_session"
+	webAuthnSessionPath   = "/mfa/webauthn"
+	ceremonyTimeout       = 5 * time.Minute
+
+	ceremonyRegistration = "registration"
+	ceremonyLogin        = "login"
+)
+
+// WebAuthnCredentialTable stores users' registered authenticators
+type WebAuthnCredentialTable interface {
+	AddCredential(ctx context.Context, credential *persistence.WebAuthnCredential) error
+	GetCredentials(ctx context.Context, userID int32) ([]*persistence.WebAuthnCredential, error)
+	UpdateCredential(ctx context.Context, userID int32, id, credential []byte) error
+	DeleteCredential(ctx context.Context, userID int32, id []byte) error
+}
+
+// WebAuthnHandler registers security keys and platform authenticators, and lets users
+// step up to their privileged permissions by using one. Every handler runs after the
+// auth middleware.
+type WebAuthnHandler struct {
+	webAuthn        *webauthn.WebAuthn
+	issuer          *TokenIssuer
+	credentials     WebAuthnCredentialTable
+	permissionTable PermissionTable
+	factors         SecondFactors
+}
+
+// NewWebAuthnHandler creates the handler; factors must cover all of a user's second
+// factors, not only WebAuthn credentials
+func NewWebAuthnHandler(config *config.Config, issuer *TokenIssuer, credentials WebAuthnCredentialTable, permissionTable PermissionTable, factors SecondFactors) (*WebAuthnHandler, error) {
+	webAuthn, err := webauthn.New(&webauthn.Config{
+		RPID:          config.WebAuthnRPID,
+		RPDisplayName: config.WebAuthnRPDisplayName,
+		RPOrigins:     config.WebAuthnRPOrigins,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &WebAuthnHandler{
+		webAuthn:        webAuthn,
+		issuer:          issuer,
+		credentials:     credentials,
+		permissionTable: permissionTable,
+		factors:         factors,
+	}, nil
+}
+
+// webAuthnUser adapts the caller to the webauthn library
+type webAuthnUser struct {
+	claims      *verifier.Claims
+	credentials []webauthn.Credential
+}
+
+func (u *webAuthnUser) WebAuthnID() []byte {
+	return []byte(strconv.Itoa(int(u.claims.UserID)))
+}
+
+func (u *webAuthnUser) WebAuthnName() string {
+	return u.claims.Username
+}
+
+func (u *webAuthnUser) WebAuthnDisplayName() string {
+	return u.claims.Username
+}
+
+func (u *webAuthnUser) WebAuthnIcon() string {
+	return ""
+}
+
+func (u *webAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+	return u.credentials
+}
+
+// credentialResponse describes a registered credential to its owner; the id is base64url
+// encoded as in the delete route
+type credentialResponse struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+func newCredentialResponse(credential *persistence.WebAuthnCredential) *credentialResponse {
+	return &credentialResponse{
+		ID:         base64.RawURLEncoding.EncodeToString(credential.ID),
+		Name:       credential.Name,
+		CreatedAt:  credential.CreatedAt,
+		LastUsedAt: credential.LastUsedAt,
+	}
+}
+
+// ceremonyClaims carry the library's session data between the begin and finish calls
+type ceremonyClaims struct {
+	Ceremony string               `json:"ceremony"`
+	Session  webauthn.SessionData `json:"session"`
+	jwt.RegisteredClaims
+}
+
+func (h *WebAuthnHandler) loadUser(ctx context.Context, claims *verifier.Claims) (*webAuthnUser, error) {
+	stored, err := h.credentials.GetCredentials(ctx, claims.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	user := &webAuthnUser{claims: claims}
+	for _, s := range stored {
+		var credential webauthn.Credential
+		if err := json.Unmarshal(s.Credential, &credential); err != nil {
+			return nil, err
+		}
+		user.credentials = append(user.credentials, credential)
+	}
+	return user, nil
+}
+
+// callerWithCredentials loads the authenticated caller. Changing credentials is subject
+// to mayChangeFactors.
+func (h *WebAuthnHandler) callerWithCredentials(w http.ResponseWriter, r *http.Request, changing bool) (*webAuthnUser, bool) {
+	claims, ok := verifier.FromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+	if changing && !mayChangeFactors(w, r, h.factors, claims) {
+		return nil, false
+	}
+
+	user, err := h.loadUser(r.Context(), claims)
+	if err != nil {
+		log.Printf("Failed to get webauthn credentials: %v", err)
+		http.Error(w, "Failed to get credentials", http.StatusInternalServerError)
+		return nil, false
+	}
+	return user, true
+}
+
+func (h *WebAuthnHandler) startCeremony(w http.ResponseWriter, user *webAuthnUser, ceremony string, session *webauthn.SessionData, options interface{}) {
+	now := time.Now()
+	state, err := h.issuer.signState(&ceremonyClaims{
+		Ceremony: ceremony,
+		Session:  *session,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   strconv.Itoa(int(user.claims.UserID)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ceremonyTimeout)),
+		},
+	})
+	if err != nil {
+		log.Printf("Failed to sign webauthn session: %v", err)
+		http.Error(w, "Failed to start ceremony", http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     webAuthnSessionCookie,
+		Value:    state,
+		Path:     webAuthnSessionPath,
+		MaxAge:   int(ceremonyTimeout.Seconds()),
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	writeJSON(w, http.StatusOK, options)
+}
+
+// finishCeremony returns the session data saved by startCeremony, and clears it
+func (h *WebAuthnHandler) finishCeremony(w http.ResponseWriter, r *http.Request, user *webAuthnUser, ceremony string) (*webauthn.SessionData, bool) {
+	http.SetCookie(w, &http.Cookie{Name: webAuthnSessionCookie, Path: webAuthnSessionPath, MaxAge: -1})
+
+	cookie, err := r.Cookie(webAuthnSessionCookie)
+	if err != nil {
+		http.Error(w, "Bad Request - No ceremony in progress", http.StatusBadRequest)
+		return nil, false
+	}
+	claims := &ceremonyClaims{}
+	err = h.issuer.parseState(cookie.Value, claims)
+	if err != nil || claims.Ceremony != ceremony || claims.Subject != strconv.Itoa(int(user.claims.UserID)) {
+		log.Printf("Invalid webauthn session for user %d: %v", user.claims.UserID, err)
+		http.Error(w, "Bad Request - Invalid ceremony", http.StatusBadRequest)
+		return nil, false
+	}
+	return &claims.Session, true
+}
+
+// HandleBeginRegistration returns the options for navigator.credentials.create
+func (h *WebAuthnHandler) HandleBeginRegistration(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.callerWithCredentials(w, r, true)
+	if !ok {
+		return
+	}
+
+	exclusions := []protocol.CredentialDescriptor{}
+	for _, credential := range user.credentials {
+		exclusions = append(exclusions, credential.Descriptor())
+	}
+	options, session, err := h.webAuthn.BeginRegistration(user, webauthn.WithExclusions(exclusions))
+	if err != nil {
+		log.Printf("Failed to begin webauthn registration: %v", err)
+		http.Error(w, "Failed to begin registration", http.StatusInternalServerError)
+		return
+	}
+	h.startCeremony(w, user, ceremonyRegistration, session, options)
+}
+
+// HandleFinishRegistration stores the credential created by the browser. The optional
+// name query parameter labels it for the user.
+func (h *WebAuthnHandler) HandleFinishRegistration(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.callerWithCredentials(w, r, true)
+	if !ok {
+		return
+	}
+	session, ok := h.finishCeremony(w, r, user, ceremonyRegistration)
+	if !ok {
+		return
+	}
+
+	credential, err := h.webAuthn.FinishRegistration(user, *session, r)
+	if err != nil {
+		log.Printf("Failed to register webauthn credential for user %d: %v", user.claims.UserID, err)
+		http.Error(w, "Bad Request - Invalid credential", http.StatusBadRequest)
+		return
+	}
+
+	encoded, err := json.Marshal(credential)
+	if err != nil {
+		log.Printf("Failed to encode webauthn credential: %v", err)
+		http.Error(w, "Failed to save credential", http.StatusInternalServerError)
+		return
+	}
+	stored := &persistence.WebAuthnCredential{
+		ID:         credential.ID,
+		UserID:     user.claims.UserID,
+		Name:       r.URL.Query().Get("name"),
+		Credential: encoded,
+		CreatedAt:  time.Now(),
+	}
+	if err := h.credentials.AddCredential(r.Context(), stored); err != nil {
+		log.Printf("Failed to save webauthn credential: %v", err)
+		http.Error(w, "Failed to save credential", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User %d registered webauthn credential %q", user.claims.UserID, stored.Name)
+	writeJSON(w, http.StatusCreated, newCredentialResponse(stored))
+}
+
+// HandleBeginLogin returns the options for navigator.credentials.get
+func (h *WebAuthnHandler) HandleBeginLogin(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.callerWithCredentials(w, r, false)
+	if !ok {
+		return
+	}
+	if len(user.credentials) == 0 {
+		http.Error(w, "Not Found - No credentials registered", http.StatusNotFound)
+		return
+	}
+
+	options, session, err := h.webAuthn.BeginLogin(user)
+	if err != nil {
+		log.Printf("Failed to begin webauthn login: %v", err)
+		http.Error(w, "Failed to begin login", http.StatusInternalServerError)
+		return
+	}
+	h.startCeremony(w, user, ceremonyLogin, session, options)
+}
+
+// HandleFinishLogin checks the assertion and re-issues the caller's token with their
+// privileged permissions
+func (h *WebAuthnHandler) HandleFinishLogin(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.callerWithCredentials(w, r, false)
+	if !ok {
+		return
+	}
+	session, ok := h.finishCeremony(w, r, user, ceremonyLogin)
+	if !ok {
+		return
+	}
+
+	credential, err := h.webAuthn.FinishLogin(user, *session, r)
+	if err != nil {
+		log.Printf("Failed webauthn assertion for user %d: %v", user.claims.UserID, err)
+		http.Error(w, "Unauthorized - Invalid assertion", http.StatusUnauthorized)
+		return
+	}
+	if credential.Authenticator.CloneWarning {
+		log.Printf("Possible cloned authenticator for user %d", user.claims.UserID)
+		http.Error(w, "Forbidden - Authenticator may be cloned", http.StatusForbidden)
+		return
+	}
+
+	encoded, err := json.Marshal(credential)
+	if err == nil {
+		err = h.credentials.UpdateCredential(r.Context(), user.claims.UserID, credential.ID, encoded)
+	}
+	if err != nil {
+		log.Printf("Failed to update webauthn credential: %v", err)
+		http.Error(w, "Failed to update credential", http.StatusInternalServerError)
+		return
+	}
+
+	if stepUp(r.Context(), w, h.issuer, h.permissionTable, user.claims, verifier.AMRWebAuthn) {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// HandleListCredentials lists the caller's registered credentials
+func (h *WebAuthnHandler) HandleListCredentials(w http.ResponseWriter, r *http.Request) {
+	claims, ok := verifier.FromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	credentials, err := h.credentials.GetCredentials(r.Context(), claims.UserID)
+	if err != nil {
+		log.Printf("Failed to get webauthn credentials: %v", err)
+		http.Error(w, "Failed to get credentials", http.StatusInternalServerError)
+		return
+	}
+	response := []*credentialResponse{}
+	for _, credential := range credentials {
+		response = append(response, newCredentialResponse(credential))
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// HandleDeleteCredential removes one of the caller's credentials, identified by its
+// base64url id
+func (h *WebAuthnHandler) HandleDeleteCredential(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.callerWithCredentials(w, r, true)
+	if !ok {
+		return
+	}
+	id, err := base64.RawURLEncoding.DecodeString(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Bad Request - Invalid credential id", http.StatusBadRequest)
+		return
+	}
+
+	err = h.credentials.DeleteCredential(r.Context(), user.claims.UserID, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to delete webauthn credential: %v", err)
+		http.Error(w, "Failed to delete credential", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
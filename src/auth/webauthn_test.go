@@ -0,0 +1,249 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/config"
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence"
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence/memory"
+	"github.com/coopstools-homebrew/I-am-zuul/src/verifier"
+)
+
+const testOrigin = "https://zuul.example.com"
+
+type fakeWebAuthnTable map[int32][]*persistence.WebAuthnCredential
+
+func (f fakeWebAuthnTable) AddCredential(ctx context.Context, credential *persistence.WebAuthnCredential) error {
+	f[credential.UserID] = append(f[credential.UserID], credential)
+	return nil
+}
+
+func (f fakeWebAuthnTable) GetCredentials(ctx context.Context, userID int32) ([]*persistence.WebAuthnCredential, error) {
+	return f[userID], nil
+}
+
+func (f fakeWebAuthnTable) UpdateCredential(ctx context.Context, userID int32, id, credential []byte) error {
+	for _, c := range f[userID] {
+		if bytes.Equal(c.ID, id) {
+			c.Credential = credential
+		}
+	}
+	return nil
+}
+
+func (f fakeWebAuthnTable) DeleteCredential(ctx context.Context, userID int32, id []byte) error {
+	return nil
+}
+
+func (f fakeWebAuthnTable) HasSecondFactor(ctx context.Context, userID int32) (bool, error) {
+	return len(f[userID]) > 0, nil
+}
+
+// softAuthenticator plays the part of a security key, with "none" attestation
+type softAuthenticator struct {
+	t         *testing.T
+	key       *ecdsa.PrivateKey
+	id        []byte
+	signCount uint32
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	return &softAuthenticator{t: t, key: key, id: []byte("soft-key-1")}
+}
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func (a *softAuthenticator) authData(flags byte, attested []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte("zuul.example.com"))
+	data := append(rpIDHash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	return append(data, attested...)
+}
+
+func (a *softAuthenticator) clientData(ceremony, challenge string) []byte {
+	data, _ := json.Marshal(map[string]string{"type": ceremony, "challenge": challenge, "origin": testOrigin})
+	return data
+}
+
+func (a *softAuthenticator) create(challenge string) []byte {
+	publicKey, err := cbor.Marshal(map[int]interface{}{
+		1: 2, 3: -7, -1: 1,
+		-2: a.key.PublicKey.X.FillBytes(make([]byte, 32)),
+		-3: a.key.PublicKey.Y.FillBytes(make([]byte, 32)),
+	})
+	require.NoError(a.t, err)
+	attested := append(make([]byte, 16), byte(0), byte(len(a.id)))
+	attested = append(append(attested, a.id...), publicKey...)
+
+	attestation, err := cbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": a.authData(0x45, attested),
+	})
+	require.NoError(a.t, err)
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"id": b64(a.id), "rawId": b64(a.id), "type": "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    b64(a.clientData("webauthn.create", challenge)),
+			"attestationObject": b64(attestation),
+		},
+	})
+	return body
+}
+
+func (a *softAuthenticator) get(challenge string) []byte {
+	a.signCount++
+	authData := a.authData(0x05, nil)
+	clientData := a.clientData("webauthn.get", challenge)
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(authData, clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	require.NoError(a.t, err)
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"id": b64(a.id), "rawId": b64(a.id), "type": "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    b64(clientData),
+			"authenticatorData": b64(authData),
+			"signature":         b64(signature),
+		},
+	})
+	return body
+}
+
+func TestWebAuthnStepUp(t *testing.T) {
+	privateKey, _ := newTestKey(t)
+	privateKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
+	issuer := NewTokenIssuer(string(privateKeyPEM), time.Hour)
+	ctx := context.Background()
+	store := memory.NewStore()
+	require.NoError(t, store.UpdateUser(ctx, &persistence.UserInfo{ID: 1001, LoginName: "octo-admin"}))
+	require.NoError(t, store.GrantPermission(ctx, 1001, "coopstools", "admin"))
+	table := fakeWebAuthnTable{}
+	handler, err := NewWebAuthnHandler(&config.Config{
+		WebAuthnRPID:          "zuul.example.com",
+		WebAuthnRPOrigins:     []string{testOrigin},
+		WebAuthnRPDisplayName: "Zuul",
+	}, issuer, table, store, table)
+	require.NoError(t, err)
+
+	githubOnly := &verifier.Claims{UserID: 1001, Username: "octo-admin", Path: "/", AMR: []string{verifier.AMRGitHub},
+		RegisteredClaims: jwt.RegisteredClaims{IssuedAt: jwt.NewNumericDate(time.Now()), ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))}}
+	authenticator := newSoftAuthenticator(t)
+
+	// serve calls the handler as the given caller, sending along the ceremony cookie
+	serve := func(handle http.HandlerFunc, claims *verifier.Claims, body []byte, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/mfa/webauthn/", bytes.NewReader(body))
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		req = req.WithContext(verifier.NewContext(req.Context(), claims))
+		rec := httptest.NewRecorder()
+		handle(rec, req)
+		return rec
+	}
+	begin := func(handle http.HandlerFunc, claims *verifier.Claims) (string, []*http.Cookie) {
+		rec := serve(handle, claims, nil, nil)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		var options struct {
+			PublicKey struct {
+				Challenge string `json:"challenge"`
+			} `json:"publicKey"`
+		}
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&options))
+		return options.PublicKey.Challenge, rec.Result().Cookies()
+	}
+
+	t.Run("Test registering a credential", func(t *testing.T) {
+		challenge, cookies := begin(handler.HandleBeginRegistration, githubOnly)
+		rec := serve(handler.HandleFinishRegistration, githubOnly, authenticator.create(challenge), cookies)
+		require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+		require.Len(t, table[1001], 1)
+	})
+
+	t.Run("Test finishing without a ceremony", func(t *testing.T) {
+		rec := serve(handler.HandleFinishLogin, githubOnly, authenticator.get("challenge"), nil)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+
+	t.Run("Test registering another credential needs a step up", func(t *testing.T) {
+		rec := serve(handler.HandleBeginRegistration, githubOnly, nil, nil)
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+	})
+
+	t.Run("Test a ceremony cookie is not accepted for another ceremony", func(t *testing.T) {
+		_, cookies := begin(handler.HandleBeginLogin, githubOnly)
+		rec := serve(handler.HandleFinishRegistration, &verifier.Claims{UserID: 1001, AMR: []string{verifier.AMRWebAuthn}}, nil, cookies)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+
+	t.Run("Test stepping up", func(t *testing.T) {
+		challenge, cookies := begin(handler.HandleBeginLogin, githubOnly)
+		rec := serve(handler.HandleFinishLogin, githubOnly, authenticator.get(challenge), cookies)
+		require.Equal(t, http.StatusNoContent, rec.Code, rec.Body.String())
+
+		resp := rec.Result()
+		claims := authCookieClaims(t, resp, privateKey)
+		assert.True(t, claims.HasPermission("coopstools", "admin"))
+		assert.Equal(t, []string{verifier.AMRGitHub, verifier.AMRWebAuthn}, claims.AMR)
+		assert.Equal(t, "octo-admin", claims.Username)
+	})
+
+	t.Run("Test refusing a possibly cloned authenticator", func(t *testing.T) {
+		challenge, cookies := begin(handler.HandleBeginLogin, githubOnly)
+		// The stored sign count is 1, so a count that goes backwards means a copy of the key
+		authenticator.signCount = 0
+		rec := serve(handler.HandleFinishLogin, githubOnly, authenticator.get(challenge), cookies)
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+	})
+}
+
+type fakeOrgPolicyTable []string
+
+func (f fakeOrgPolicyTable) GetOrgsRequiring2FA(ctx context.Context) ([]string, error) {
+	return f, nil
+}
+
+func TestMFAPolicy(t *testing.T) {
+	policy := MFAPolicy{Privileged: []string{"admin"}}
+
+	granted, withheld, err := policy.split(context.Background(), map[string]string{"coopstools": "admin", "coopstools/devs": "write"})
+	require.NoError(t, err)
+	assert.True(t, withheld)
+	assert.Equal(t, map[string]string{"coopstools/devs": "write"}, granted)
+
+	granted, withheld, err = policy.split(context.Background(), map[string]string{"coopstools": "read"})
+	require.NoError(t, err)
+	assert.False(t, withheld)
+	assert.Equal(t, map[string]string{"coopstools": "read"}, granted)
+
+	policy.OrgPolicies = fakeOrgPolicyTable{"strict"}
+	granted, withheld, err = policy.split(context.Background(), map[string]string{"strict/devs": "read", "coopstools": "read"})
+	require.NoError(t, err)
+	assert.True(t, withheld)
+	assert.Equal(t, map[string]string{"coopstools": "read"}, granted)
+}
@@ -1,13 +1,37 @@
 package config
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
+// AccessRule sets what a caller needs to reach matching requests behind Zuul.
+// An empty Host or Methods matches any.
+type AccessRule struct {
+	Host       string   `json:"host"`
+	PathPrefix string   `json:"path_prefix"`
+	Methods    []string `json:"methods"`
+	// Matching requests need no token at all
+	Public     bool   `json:"public"`
+	OrgID      string `json:"org_id"`
+	Permission string `json:"permission"`
+}
+
+// ProxyRoute sends matching requests to an upstream once they pass the access rule
+type ProxyRoute struct {
+	AccessRule
+	Upstream string `json:"upstream"`
+	// Remove the path prefix before forwarding
+	StripPrefix bool `json:"strip_prefix"`
+}
+
 type Config struct {
 	Port string
 
@@ -16,9 +40,16 @@ type Config struct {
 	LoremIpsumBranch      string
 	LoremIpsumPath        string
 
-	GitHubClientID     string
-	GitHubClientSecret string
-	GitHubCallbackURL  string
+	GitHubClientID      string
+	GitHubClientSecret  string
+	GitHubCallbackURL   string
+	GitHubWebhookSecret string
+	// Where users are sent after a successful login
+	GitHubRedirectURI string
+	// Overridable so the OAuth flow can run against a fake GitHub
+	GitHubBaseURL      string
+	GitHubAPIURL       string
+	GitHubOrganization string
 	PrivateKey         string
 	PublicKey          string
 
@@ -26,8 +57,76 @@ type Config struct {
 	DatabaseName     string
 	DatabaseUser     string
 	DatabasePassword string
+	// How long to wait for another instance to finish migrating the db on startup
+	MigrationLockTimeout time.Duration
+	// Whether the server migrates the db on startup; if not, run `zuul migrate up` first
+	AutoMigrate bool
+	// Whether requests come through a proxy that appends the client's address to
+	// X-Forwarded-For, such as Heroku's router
+	TrustForwardedFor bool
+	// How long each /readyz check may take
+	HealthCheckTimeout time.Duration
+	// Whether /readyz reports if GitHub is reachable, and how long that result is cached
+	HealthCheckGitHub    bool
+	HealthGitHubCacheTTL time.Duration
+	// Postgres connection pool; zero keeps the driver's default
+	DBMaxConns          int32
+	DBMaxConnIdleTime   time.Duration
+	DBHealthCheckPeriod time.Duration
+
+	AllowedOrigins       []string
+	CORSAllowedHeaders   []string
+	CORSExposedHeaders   []string
+	CORSAllowCredentials bool
+	CORSMaxAge           time.Duration
+
+	// Where the forward-auth endpoint sends unauthenticated users
+	LoginURL string
+	// Requirements for requests checked by the forward-auth endpoint
+	AccessRules []AccessRule
+
+	// Routes served by the gatekeeper proxy, and the secret signing its identity headers
+	ProxyRoutes        []ProxyRoute
+	ProxySigningSecret string
 
-	AllowedOrigins []string
+	// How long the auth middleware may rely on a cached user status
+	AuthStateCacheTTL time.Duration
+	// How long registered clients are cached before being read from the db again
+	ClientCacheTTL time.Duration
+
+	// How long an issued token is valid
+	SessionLifetime time.Duration
+	// Fraction of a token's lifetime after which the middleware renews it; 0 disables renewal
+	SessionRenewAfter float64
+	// Time after a GitHub login beyond which sessions are no longer renewed
+	SessionMaxAge time.Duration
+
+	// Relying party settings for WebAuthn; WebAuthn is disabled without an RP ID
+	WebAuthnRPID          string
+	WebAuthnRPOrigins     []string
+	WebAuthnRPDisplayName string
+	// Base64 encoded 32 byte key encrypting totp secrets; totp is disabled without it
+	MFAEncryptionKey string
+	// Shown next to the account in authenticator apps
+	TOTPIssuer string
+	// Permissions (on any org) only put in tokens once the user has used a second factor
+	MFAPrivilegedPermissions []string
+	// Where users with a second factor are sent after GitHub to use it
+	MFAChallengeURL string
+
+	// Full url of the emailed login link's page; email login is disabled without it
+	MagicLinkURL string
+	// Orgs (or org/teams) tokens from email logins are limited to
+	MagicLinkScopes []string
+	// "smtp" sends mail through the SMTP_* server, "log" writes it to MAIL_LOG_FILE or the log.
+	// Required with MagicLinkURL, so links aren't quietly logged instead of sent.
+	Mailer       string
+	SMTPHost     string
+	SMTPPort     string
+	SMTPUsername string
+	SMTPPassword string
+	MailFrom     string
+	MailLogFile  string
 }
 
 func LoadConfig() (*Config, error) {
@@ -41,32 +140,187 @@ func LoadConfig() (*Config, error) {
 		return nil, err
 	}
 
+	authStateCacheTTL, err := loadDuration("AUTH_STATE_CACHE_TTL", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	database, err := LoadDatabaseConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	clientCacheTTL, err := loadDuration("CLIENT_CACHE_TTL", time.Minute)
+	if err != nil {
+		return nil, err
+	}
+
+	magicLinkScopes := loadList("MAGIC_LINK_SCOPES")
+	if len(magicLinkScopes) == 0 {
+		magicLinkScopes = []string{"guest"}
+	}
+
+	if os.Getenv("MAGIC_LINK_URL") != "" && os.Getenv("MAILER") == "" {
+		return nil, fmt.Errorf("MAGIC_LINK_URL needs MAILER set to smtp, or to log for local development")
+	}
+
+	allowedOrigins := loadList("ALLOWED_ORIGINS")
+	corsAllowCredentials := os.Getenv("CORS_ALLOW_CREDENTIALS") != "false"
+	if corsAllowCredentials && slices.Contains(allowedOrigins, "*") {
+		return nil, fmt.Errorf("ALLOWED_ORIGINS can't be * with CORS_ALLOW_CREDENTIALS; list the origins or set CORS_ALLOW_CREDENTIALS=false")
+	}
+
+	corsMaxAge, err := loadDuration("CORS_MAX_AGE", 10*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+
+	corsAllowedHeaders := loadList("CORS_ALLOWED_HEADERS")
+	if len(corsAllowedHeaders) == 0 {
+		corsAllowedHeaders = []string{"Content-Type"}
+	}
+
+	sessionLifetime, err := loadDuration("SESSION_LIFETIME", 2*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+
+	sessionRenewAfter, err := loadFloat("SESSION_RENEW_AFTER", 0)
+	if err != nil {
+		return nil, err
+	}
+	if sessionRenewAfter < 0 || sessionRenewAfter >= 1 {
+		return nil, fmt.Errorf("SESSION_RENEW_AFTER must be in [0, 1)")
+	}
+
+	sessionMaxAge, err := loadDuration("SESSION_MAX_AGE", 12*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+
+	healthCheckTimeout, err := loadDuration("HEALTH_CHECK_TIMEOUT", 2*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	healthGitHubCacheTTL, err := loadDuration("HEALTH_GITHUB_CACHE_TTL", 5*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+
+	var accessRules []AccessRule
+	if path := os.Getenv("ACCESS_RULES_FILE"); path != "" {
+		err = loadJSONFile(path, &accessRules)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load ACCESS_RULES_FILE: %w", err)
+		}
+	}
+
+	var proxyRoutes []ProxyRoute
+	if path := os.Getenv("PROXY_ROUTES_FILE"); path != "" {
+		err = loadJSONFile(path, &proxyRoutes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load PROXY_ROUTES_FILE: %w", err)
+		}
+	}
+
 	var once sync.Once
 	var config *Config
 
 	once.Do(func() {
 		config = &Config{
-			LoremIpsumAccessToken: os.Getenv("LOREM_IPSUM_ACCESS_TOKEN"),
-			LoremIpsumRepo:        os.Getenv("LOREM_IPSUM_REPO"),
-			LoremIpsumBranch:      os.Getenv("LOREM_IPSUM_BRANCH"),
-			LoremIpsumPath:        os.Getenv("LOREM_IPSUM_PATH"),
-			GitHubClientID:        os.Getenv("GITHUB_CLIENT_ID"),
-			GitHubClientSecret:    os.Getenv("GITHUB_CLIENT_SECRET"),
-			GitHubCallbackURL:     os.Getenv("GITHUB_CALLBACK_URL"),
-			PrivateKey:            privateKey,
-			PublicKey:             publicKey,
-			AllowedOrigins:        strings.Split(os.Getenv("ALLOWED_ORIGINS"), ","),
-			Port:                  os.Getenv("PORT"),
-			DatabaseURL:           os.Getenv("DATABASE_URL"),
-			DatabaseName:          os.Getenv("DATABASE_NAME"),
-			DatabaseUser:          os.Getenv("DATABASE_USER"),
-			DatabasePassword:      os.Getenv("DATABASE_PASSWORD"),
+			LoremIpsumAccessToken:    os.Getenv("LOREM_IPSUM_ACCESS_TOKEN"),
+			LoremIpsumRepo:           os.Getenv("LOREM_IPSUM_REPO"),
+			LoremIpsumBranch:         os.Getenv("LOREM_IPSUM_BRANCH"),
+			LoremIpsumPath:           os.Getenv("LOREM_IPSUM_PATH"),
+			GitHubClientID:           os.Getenv("GITHUB_CLIENT_ID"),
+			GitHubClientSecret:       os.Getenv("GITHUB_CLIENT_SECRET"),
+			GitHubCallbackURL:        os.Getenv("GITHUB_CALLBACK_URL"),
+			GitHubRedirectURI:        os.Getenv("GITHUB_REDIRECT_URI"),
+			GitHubBaseURL:            loadURL("GITHUB_BASE_URL", "https://github.com"),
+			GitHubAPIURL:             loadURL("GITHUB_API_URL", "https://api.github.com"),
+			GitHubWebhookSecret:      os.Getenv("GITHUB_WEBHOOK_SECRET"),
+			GitHubOrganization:       os.Getenv("GITHUB_ORGANIZATION"),
+			PrivateKey:               privateKey,
+			PublicKey:                publicKey,
+			AllowedOrigins:           allowedOrigins,
+			CORSAllowedHeaders:       corsAllowedHeaders,
+			CORSExposedHeaders:       loadList("CORS_EXPOSED_HEADERS"),
+			CORSAllowCredentials:     corsAllowCredentials,
+			CORSMaxAge:               corsMaxAge,
+			Port:                     os.Getenv("PORT"),
+			DatabaseURL:              database.DatabaseURL,
+			DatabaseName:             os.Getenv("DATABASE_NAME"),
+			DatabaseUser:             os.Getenv("DATABASE_USER"),
+			DatabasePassword:         os.Getenv("DATABASE_PASSWORD"),
+			MigrationLockTimeout:     database.MigrationLockTimeout,
+			AutoMigrate:              os.Getenv("AUTO_MIGRATE") != "false",
+			TrustForwardedFor:        os.Getenv("TRUST_FORWARDED_FOR") == "true",
+			HealthCheckTimeout:       healthCheckTimeout,
+			HealthCheckGitHub:        os.Getenv("HEALTH_CHECK_GITHUB") == "true",
+			HealthGitHubCacheTTL:     healthGitHubCacheTTL,
+			DBMaxConns:               database.DBMaxConns,
+			DBMaxConnIdleTime:        database.DBMaxConnIdleTime,
+			DBHealthCheckPeriod:      database.DBHealthCheckPeriod,
+			LoginURL:                 getEnvOrDefault("LOGIN_URL", "/login"),
+			AccessRules:              accessRules,
+			ProxyRoutes:              proxyRoutes,
+			ProxySigningSecret:       os.Getenv("PROXY_SIGNING_SECRET"),
+			AuthStateCacheTTL:        authStateCacheTTL,
+			ClientCacheTTL:           clientCacheTTL,
+			SessionLifetime:          sessionLifetime,
+			SessionRenewAfter:        sessionRenewAfter,
+			SessionMaxAge:            sessionMaxAge,
+			WebAuthnRPID:             os.Getenv("WEBAUTHN_RP_ID"),
+			WebAuthnRPOrigins:        loadList("WEBAUTHN_RP_ORIGINS"),
+			WebAuthnRPDisplayName:    getEnvOrDefault("WEBAUTHN_RP_DISPLAY_NAME", "I Am Zuul"),
+			MFAEncryptionKey:         os.Getenv("MFA_ENCRYPTION_KEY"),
+			TOTPIssuer:               getEnvOrDefault("TOTP_ISSUER", "I Am Zuul"),
+			MFAPrivilegedPermissions: loadList("MFA_PRIVILEGED_PERMISSIONS"),
+			MFAChallengeURL:          getEnvOrDefault("MFA_CHALLENGE_URL", "/mfa"),
+			MagicLinkURL:             os.Getenv("MAGIC_LINK_URL"),
+			MagicLinkScopes:          magicLinkScopes,
+			Mailer:                   os.Getenv("MAILER"),
+			SMTPHost:                 os.Getenv("SMTP_HOST"),
+			SMTPPort:                 getEnvOrDefault("SMTP_PORT", "587"),
+			SMTPUsername:             os.Getenv("SMTP_USERNAME"),
+			SMTPPassword:             os.Getenv("SMTP_PASSWORD"),
+			MailFrom:                 os.Getenv("MAIL_FROM"),
+			MailLogFile:              os.Getenv("MAIL_LOG_FILE"),
 		}
 	})
 
 	return config, err
 }
 
+// LoadDatabaseConfig loads only what's needed to reach and migrate the db, for commands
+// that run without the service's keys
+func LoadDatabaseConfig() (*Config, error) {
+	migrationLockTimeout, err := loadDuration("MIGRATION_LOCK_TIMEOUT", time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	maxConns, err := strconv.ParseInt(getEnvOrDefault("DB_MAX_CONNS", "0"), 10, 32)
+	if err != nil || maxConns < 0 {
+		return nil, fmt.Errorf("DB_MAX_CONNS must be a non-negative number; 0 keeps the pgx default")
+	}
+	maxConnIdleTime, err := loadDuration("DB_MAX_CONN_IDLE_TIME", 0)
+	if err != nil {
+		return nil, err
+	}
+	healthCheckPeriod, err := loadDuration("DB_HEALTH_CHECK_PERIOD", 0)
+	if err != nil {
+		return nil, err
+	}
+	return &Config{
+		DatabaseURL:          os.Getenv("DATABASE_URL"),
+		MigrationLockTimeout: migrationLockTimeout,
+		DBMaxConns:           int32(maxConns),
+		DBMaxConnIdleTime:    maxConnIdleTime,
+		DBHealthCheckPeriod:  healthCheckPeriod,
+	}, nil
+}
+
 func loadKeyOrFile(keyName, keyFileName string) (string, error) {
 	key := os.Getenv(keyName)
 	if key != "" {
@@ -87,3 +341,62 @@ func loadKeyOrFile(keyName, keyFileName string) (string, error) {
 
 	return string(bytekey), nil
 }
+
+func loadDuration(name string, defaultValue time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s is not a valid duration: %w", name, err)
+	}
+	return duration, nil
+}
+
+func loadFloat(name string, defaultValue float64) (float64, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s is not a valid number: %w", name, err)
+	}
+	return number, nil
+}
+
+// loadList splits a comma separated variable, dropping blank entries
+func loadList(name string) []string {
+	list := []string{}
+	for _, item := range strings.Split(os.Getenv(name), ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func getEnvOrDefault(name, defaultValue string) string {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
+
+// loadURL loads a base url that paths are appended to, without its trailing slash
+func loadURL(name, defaultValue string) string {
+	return strings.TrimSuffix(getEnvOrDefault(name, defaultValue), "/")
+}
+
+func loadJSONFile(path string, target interface{}) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, target)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/fakegithub"
+)
+
+// setUpDevEnvironment points the server at an embedded fake GitHub and fills in any
+// config needed to run the login flow offline. Anything already set in the environment wins.
+func setUpDevEnvironment() {
+	setDefaultEnv("PORT", "8080")
+	setDefaultEnv("FAKE_GITHUB_PORT", "9090")
+	port := os.Getenv("PORT")
+	fakeGitHubURL := "http://localhost:" + os.Getenv("FAKE_GITHUB_PORT")
+
+	setDefaultEnv("GITHUB_CLIENT_ID", "zuul-dev")
+	setDefaultEnv("GITHUB_CLIENT_SECRET", "zuul-dev-secret")
+	setDefaultEnv("GITHUB_BASE_URL", fakeGitHubURL)
+	setDefaultEnv("GITHUB_API_URL", fakeGitHubURL)
+	setDefaultEnv("GITHUB_CALLBACK_URL", "http://localhost:"+port+"/callback")
+	setDefaultEnv("GITHUB_REDIRECT_URI", "http://localhost:"+port+"/data")
+	// A SQLite file in the working directory, so nothing else has to run and logins persist
+	setDefaultEnv("DATABASE_URL", "sqlite://zuul-dev.db")
+	setDefaultEnv("WEBAUTHN_RP_ID", "localhost")
+	setDefaultEnv("WEBAUTHN_RP_ORIGINS", "http://localhost:"+port)
+	setDefaultEnv("MAGIC_LINK_URL", "http://localhost:"+port+"/login/email/verify")
+	setDefaultEnv("MAILER", "log")
+	// A fixed key, so enrolled authenticator apps survive restarts of the dev server
+	setDefaultEnv("MFA_ENCRYPTION_KEY", "enV1bC1kZXYtbWZhLWVuY3J5cHRpb24ta2V5LTAwMDA=")
+
+	if os.Getenv("PRIVATE_KEY") == "" && os.Getenv("PRIVATE_KEY_FILE") == "" {
+		privateKey, publicKey := generateDevKeys()
+		os.Setenv("PRIVATE_KEY", privateKey)
+		os.Setenv("PUBLIC_KEY", publicKey)
+		log.Println("Generated a throwaway key pair for dev mode")
+	}
+
+	users := fakegithub.DefaultUsers
+	if fixtures := os.Getenv("FAKE_GITHUB_FIXTURES"); fixtures != "" {
+		var err error
+		users, err = fakegithub.LoadUsers(fixtures)
+		if err != nil {
+			log.Fatalf("Failed to load fake github fixtures: %v", err)
+		}
+	}
+
+	fakeGitHub := fakegithub.NewServer(users, os.Getenv("GITHUB_CALLBACK_URL"))
+	go func() {
+		log.Println("Fake GitHub starting on " + fakeGitHubURL)
+		log.Fatal(http.ListenAndServe(":"+os.Getenv("FAKE_GITHUB_PORT"), fakeGitHub))
+	}()
+	log.Println("Dev mode: log in at http://localhost:" + port + "/login")
+}
+
+func setDefaultEnv(name, value string) {
+	if os.Getenv(name) == "" {
+		os.Setenv(name, value)
+	}
+}
+
+func generateDevKeys() (string, string) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		log.Fatalf("Failed to generate key: %v", err)
+	}
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		log.Fatalf("Failed to marshal public key: %v", err)
+	}
+
+	privatePEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
+	publicPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKeyBytes})
+	return string(privatePEM), string(publicPEM)
+}
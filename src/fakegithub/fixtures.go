@@ -0,0 +1,56 @@
+package fakegithub
+
+import (
+	"encoding/json"
+	"os"
+)
+
+type Email struct {
+	Email      string `json:"email"`
+	Primary    bool   `json:"primary"`
+	Verified   bool   `json:"verified"`
+	Visibility string `json:"visibility"`
+}
+
+// User is a fake GitHub account. Email is the public email returned by /user and may be
+// empty, in which case clients have to fall back to /user/emails like they would on GitHub.
+type User struct {
+	ID        int32    `json:"id"`
+	Login     string   `json:"login"`
+	AvatarURL string   `json:"avatar_url"`
+	Email     string   `json:"email"`
+	Emails    []Email  `json:"emails"`
+	Orgs      []string `json:"orgs"`
+}
+
+// DefaultUsers are served when no fixture file is given
+var DefaultUsers = []User{
+	{
+		ID:        1001,
+		Login:     "octo-admin",
+		AvatarURL: "https://avatars.githubusercontent.com/u/583231",
+		Email:     "admin@example.com",
+		Emails:    []Email{{Email: "admin@example.com", Primary: true, Verified: true, Visibility: "public"}},
+		Orgs:      []string{"coopstools-homebrew"},
+	},
+	{
+		ID:        1002,
+		Login:     "private-email",
+		AvatarURL: "https://avatars.githubusercontent.com/u/9919",
+		Emails:    []Email{{Email: "hidden@example.com", Primary: true, Verified: true, Visibility: "private"}},
+	},
+}
+
+// LoadUsers reads a json array of users from a fixture file
+func LoadUsers(path string) ([]User, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var users []User
+	if err := json.Unmarshal(content, &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
@@ -0,0 +1,42 @@
+package fakegithub
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadUsers(t *testing.T) {
+	dir := t.TempDir()
+
+	t.Run("Test loading a fixture file", func(t *testing.T) {
+		path := filepath.Join(dir, "users.json")
+		require.NoError(t, os.WriteFile(path, []byte(`[
+			{"id": 7, "login": "fixture", "email": "fixture@example.com", "orgs": ["acme"],
+			 "emails": [{"email": "fixture@example.com", "primary": true, "verified": true}]}
+		]`), 0600))
+
+		users, err := LoadUsers(path)
+		require.NoError(t, err)
+		assert.Equal(t, []User{{
+			ID:     7,
+			Login:  "fixture",
+			Email:  "fixture@example.com",
+			Emails: []Email{{Email: "fixture@example.com", Primary: true, Verified: true}},
+			Orgs:   []string{"acme"},
+		}}, users)
+	})
+
+	t.Run("Test bad fixture files", func(t *testing.T) {
+		_, err := LoadUsers(filepath.Join(dir, "missing.json"))
+		assert.Error(t, err)
+
+		path := filepath.Join(dir, "broken.json")
+		require.NoError(t, os.WriteFile(path, []byte(`{"login": "not a list"}`), 0600))
+		_, err = LoadUsers(path)
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,226 @@
+// Package fakegithub imitates the parts of GitHub's OAuth flow and REST api that Zuul
+// uses, so the login flow can run offline and in end-to-end tests.
+package fakegithub
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+)
+
+type Server struct {
+	// Where the authorize page sends users when the request has no redirect_uri
+	CallbackURL string
+
+	users map[string]*User
+	mux   *http.ServeMux
+
+	mu     sync.Mutex
+	codes  map[string]string
+	tokens map[string]string
+}
+
+func NewServer(users []User, callbackURL string) *Server {
+	s := &Server{
+		CallbackURL: callbackURL,
+		users:       map[string]*User{},
+		mux:         http.NewServeMux(),
+		codes:       map[string]string{},
+		tokens:      map[string]string{},
+	}
+	for i := range users {
+		s.users[users[i].Login] = &users[i]
+	}
+
+	s.mux.HandleFunc("GET /login/oauth/authorize", s.handleAuthorize)
+	s.mux.HandleFunc("POST /login/oauth/access_token", s.handleAccessToken)
+	s.mux.HandleFunc("GET /user", s.handleUser)
+	s.mux.HandleFunc("GET /user/emails", s.handleUserEmails)
+	s.mux.HandleFunc("GET /user/orgs", s.handleUserOrgs)
+	s.mux.HandleFunc("GET /orgs/{org}/members/{username}", s.handleOrgMember)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Printf("fake github: %s %s", r.Method, r.URL.Path)
+	s.mux.ServeHTTP(w, r)
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func writeJSON(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(data)
+}
+
+var authorizePage = template.Must(template.New("authorize").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Fake GitHub</title></head>
+<body>
+<h1>Sign in to fake GitHub</h1>
+<ul>
+{{range .Users}}<li><a href="{{$.BaseURL}}&login={{.Login}}">{{.Login}}</a> ({{.ID}})</li>
+{{end}}</ul>
+</body>
+</html>
+`))
+
+// handleAuthorize lists the fake users; choosing one (or passing login directly) redirects
+// back to the client with a one-time code
+func (s *Server) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	login := query.Get("login")
+	if login == "" {
+		users := []*User{}
+		for _, user := range s.users {
+			users = append(users, user)
+		}
+		slices.SortFunc(users, func(a, b *User) int { return strings.Compare(a.Login, b.Login) })
+
+		w.Header().Set("Content-Type", "text/html")
+		authorizePage.Execute(w, map[string]interface{}{
+			"BaseURL": r.URL.Path + "?" + query.Encode(),
+			"Users":   users,
+		})
+		return
+	}
+
+	if _, ok := s.users[login]; !ok {
+		http.Error(w, "Unknown user", http.StatusNotFound)
+		return
+	}
+
+	redirectURI := query.Get("redirect_uri")
+	if redirectURI == "" {
+		redirectURI = s.CallbackURL
+	}
+	redirect, err := url.Parse(redirectURI)
+	if err != nil {
+		http.Error(w, "Invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	code := randomString()
+	s.mu.Lock()
+	s.codes[code] = login
+	s.mu.Unlock()
+
+	params := redirect.Query()
+	params.Set("code", code)
+	if state := query.Get("state"); state != "" {
+		params.Set("state", state)
+	}
+	redirect.RawQuery = params.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (s *Server) handleAccessToken(w http.ResponseWriter, r *http.Request) {
+	code := r.FormValue("code")
+
+	s.mu.Lock()
+	login, ok := s.codes[code]
+	delete(s.codes, code)
+	token := randomString()
+	if ok {
+		s.tokens[token] = login
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		// GitHub reports a bad code with a 200 and an error body
+		writeJSON(w, map[string]string{"error": "bad_verification_code"})
+		return
+	}
+	writeJSON(w, map[string]string{
+		"access_token": "gho_" + token,
+		"token_type":   "bearer",
+		"scope":        "read:user,user:email,read:org",
+	})
+}
+
+// authenticate resolves the bearer token to a fake user, writing a 401 if it can't
+func (s *Server) authenticate(w http.ResponseWriter, r *http.Request) *User {
+	authorization := r.Header.Get("Authorization")
+	_, token, _ := strings.Cut(authorization, " ")
+	token = strings.TrimPrefix(token, "gho_")
+
+	s.mu.Lock()
+	login, ok := s.tokens[token]
+	s.mu.Unlock()
+	if !ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Bad credentials"})
+		return nil
+	}
+	return s.users[login]
+}
+
+func (s *Server) handleUser(w http.ResponseWriter, r *http.Request) {
+	user := s.authenticate(w, r)
+	if user == nil {
+		return
+	}
+
+	var email interface{}
+	if user.Email != "" {
+		email = user.Email
+	}
+	writeJSON(w, map[string]interface{}{
+		"id":         user.ID,
+		"login":      user.Login,
+		"avatar_url": user.AvatarURL,
+		"email":      email,
+		"type":       "User",
+	})
+}
+
+func (s *Server) handleUserEmails(w http.ResponseWriter, r *http.Request) {
+	user := s.authenticate(w, r)
+	if user == nil {
+		return
+	}
+
+	emails := user.Emails
+	if emails == nil {
+		emails = []Email{}
+	}
+	writeJSON(w, emails)
+}
+
+func (s *Server) handleUserOrgs(w http.ResponseWriter, r *http.Request) {
+	user := s.authenticate(w, r)
+	if user == nil {
+		return
+	}
+
+	orgs := []map[string]interface{}{}
+	for _, org := range user.Orgs {
+		orgs = append(orgs, map[string]interface{}{"login": org})
+	}
+	writeJSON(w, orgs)
+}
+
+func (s *Server) handleOrgMember(w http.ResponseWriter, r *http.Request) {
+	if s.authenticate(w, r) == nil {
+		return
+	}
+
+	user, ok := s.users[r.PathValue("username")]
+	if ok && slices.Contains(user.Orgs, r.PathValue("org")) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.WriteHeader(http.StatusNotFound)
+}
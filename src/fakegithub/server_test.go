@@ -0,0 +1,142 @@
+package fakegithub
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer(t *testing.T) {
+	server := httptest.NewServer(NewServer(DefaultUsers, "https://zuul.example.com/callback"))
+	defer server.Close()
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	// authorize picks the user and returns the redirect back to the client
+	authorize := func(t *testing.T, query string) *url.URL {
+		resp, err := client.Get(server.URL + "/login/oauth/authorize?" + query)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusFound, resp.StatusCode)
+		redirect, err := url.Parse(resp.Header.Get("Location"))
+		require.NoError(t, err)
+		return redirect
+	}
+
+	exchange := func(t *testing.T, code string) map[string]string {
+		resp, err := client.PostForm(server.URL+"/login/oauth/access_token", url.Values{"code": {code}})
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var body map[string]string
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		return body
+	}
+
+	get := func(t *testing.T, path, token string, target any) int {
+		req, err := http.NewRequest("GET", server.URL+path, nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		if target != nil && resp.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(target))
+		}
+		return resp.StatusCode
+	}
+
+	login := func(t *testing.T, login string) string {
+		code := authorize(t, "login="+login).Query().Get("code")
+		return exchange(t, code)["access_token"]
+	}
+
+	t.Run("Test the authorize page lists the users", func(t *testing.T) {
+		resp, err := client.Get(server.URL + "/login/oauth/authorize?client_id=zuul&state=abc")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		content, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		page := string(content)
+		assert.Contains(t, page, "octo-admin")
+		assert.Less(t, strings.Index(page, "octo-admin"), strings.Index(page, "private-email"), "users are sorted by login")
+		assert.Contains(t, page, "state=abc&login=octo-admin")
+	})
+
+	t.Run("Test choosing a user redirects with a code and the state", func(t *testing.T) {
+		redirect := authorize(t, "login=octo-admin&state=abc&redirect_uri="+url.QueryEscape("https://app.example.com/callback?from=test"))
+		assert.Equal(t, "app.example.com", redirect.Host)
+		assert.Equal(t, "test", redirect.Query().Get("from"))
+		assert.Equal(t, "abc", redirect.Query().Get("state"))
+		assert.NotEmpty(t, redirect.Query().Get("code"))
+
+		redirect = authorize(t, "login=octo-admin")
+		assert.Equal(t, "https://zuul.example.com/callback", redirect.Scheme+"://"+redirect.Host+redirect.Path)
+		assert.False(t, redirect.Query().Has("state"))
+	})
+
+	t.Run("Test unknown users are refused", func(t *testing.T) {
+		resp, err := client.Get(server.URL + "/login/oauth/authorize?login=nobody")
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("Test codes work once", func(t *testing.T) {
+		code := authorize(t, "login=octo-admin").Query().Get("code")
+		body := exchange(t, code)
+		assert.True(t, strings.HasPrefix(body["access_token"], "gho_"))
+		assert.Equal(t, "bearer", body["token_type"])
+
+		assert.Equal(t, map[string]string{"error": "bad_verification_code"}, exchange(t, code))
+	})
+
+	t.Run("Test the api serves the user's profile", func(t *testing.T) {
+		token := login(t, "octo-admin")
+
+		var user map[string]any
+		require.Equal(t, http.StatusOK, get(t, "/user", token, &user))
+		assert.Equal(t, float64(1001), user["id"])
+		assert.Equal(t, "octo-admin", user["login"])
+		assert.Equal(t, "admin@example.com", user["email"])
+
+		var orgs []map[string]string
+		require.Equal(t, http.StatusOK, get(t, "/user/orgs", token, &orgs))
+		assert.Equal(t, []map[string]string{{"login": "coopstools-homebrew"}}, orgs)
+
+		assert.Equal(t, http.StatusNoContent, get(t, "/orgs/coopstools-homebrew/members/octo-admin", token, nil))
+		assert.Equal(t, http.StatusNotFound, get(t, "/orgs/coopstools-homebrew/members/private-email", token, nil))
+	})
+
+	t.Run("Test private emails are only listed by /user/emails", func(t *testing.T) {
+		token := login(t, "private-email")
+
+		var user map[string]any
+		require.Equal(t, http.StatusOK, get(t, "/user", token, &user))
+		assert.Contains(t, user, "email")
+		assert.Nil(t, user["email"])
+
+		var emails []Email
+		require.Equal(t, http.StatusOK, get(t, "/user/emails", token, &emails))
+		assert.Equal(t, []Email{{Email: "hidden@example.com", Primary: true, Verified: true, Visibility: "private"}}, emails)
+
+		var orgs []map[string]string
+		require.Equal(t, http.StatusOK, get(t, "/user/orgs", token, &orgs))
+		assert.Empty(t, orgs)
+	})
+
+	t.Run("Test bad tokens are refused", func(t *testing.T) {
+		for _, path := range []string{"/user", "/user/emails", "/user/orgs", "/orgs/coopstools-homebrew/members/octo-admin"} {
+			assert.Equal(t, http.StatusUnauthorized, get(t, path, "gho_unknown", nil), path)
+		}
+	})
+}
@@ -0,0 +1,143 @@
+package github
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence"
+)
+
+// GitHub caps webhook payloads at 25MB
+const maxWebhookPayload = 25 << 20
+
+type WebhookTable interface {
+	ApplyDelivery(ctx context.Context, delivery *persistence.WebhookDelivery) (bool, error)
+}
+
+// WebhookHandler receives GitHub org webhooks and revokes access when membership changes.
+// Grants scoped to a team are stored in org_permissions with an org_id of "<org>/<team-slug>".
+type WebhookHandler struct {
+	secret       []byte
+	webhookTable WebhookTable
+}
+
+func NewWebhookHandler(secret string, webhookTable WebhookTable) *WebhookHandler {
+	return &WebhookHandler{
+		secret:       []byte(secret),
+		webhookTable: webhookTable,
+	}
+}
+
+type webhookAccount struct {
+	ID    int32  `json:"id"`
+	Login string `json:"login"`
+}
+
+type webhookPayload struct {
+	Action     string `json:"action"`
+	Membership *struct {
+		User webhookAccount `json:"user"`
+	} `json:"membership"`
+	Member *webhookAccount `json:"member"`
+	Team   *struct {
+		Slug string `json:"slug"`
+	} `json:"team"`
+	Organization webhookAccount `json:"organization"`
+}
+
+// verifySignature checks the X-Hub-Signature-256 header against the raw request body
+func (wh *WebhookHandler) verifySignature(signature string, body []byte) bool {
+	hexDigest, found := strings.CutPrefix(signature, "sha256=")
+	if !found {
+		return false
+	}
+	digest, err := hex.DecodeString(hexDigest)
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, wh.secret)
+	mac.Write(body)
+	return hmac.Equal(digest, mac.Sum(nil))
+}
+
+// buildDelivery maps an event onto the access changes it implies. A nil delivery means the
+// event does not affect access.
+func buildDelivery(event string, payload *webhookPayload) *persistence.WebhookDelivery {
+	orgID := payload.Organization.Login
+	switch {
+	case event == "organization" && payload.Action == "member_removed" && payload.Membership != nil:
+		user := payload.Membership.User
+		return &persistence.WebhookDelivery{
+			RevokedUserOrgs: []persistence.OrgPermission{{UserID: user.ID, OrgID: orgID}},
+		}
+	case event == "membership" && payload.Action == "removed" && payload.Member != nil && payload.Team != nil:
+		return &persistence.WebhookDelivery{
+			RevokedPermissions: []persistence.OrgPermission{{UserID: payload.Member.ID, OrgID: orgID + "/" + payload.Team.Slug}},
+		}
+	case event == "team" && payload.Action == "deleted" && payload.Team != nil:
+		return &persistence.WebhookDelivery{
+			RevokedOrgs: []string{orgID + "/" + payload.Team.Slug},
+		}
+	}
+	return nil
+}
+
+func (wh *WebhookHandler) HandleWebhook(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookPayload))
+	if err != nil {
+		log.Printf("Failed to read webhook body: %v", err)
+		http.Error(w, "Failed to read body", http.StatusBadRequest)
+		return
+	}
+
+	if !wh.verifySignature(r.Header.Get("X-Hub-Signature-256"), body) {
+		log.Printf("Invalid webhook signature")
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	event := r.Header.Get("X-GitHub-Event")
+	deliveryID := r.Header.Get("X-GitHub-Delivery")
+	if event == "" || deliveryID == "" {
+		log.Printf("Webhook missing event or delivery id")
+		http.Error(w, "Missing event or delivery id", http.StatusBadRequest)
+		return
+	}
+
+	var payload webhookPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		log.Printf("Failed to decode webhook payload: %v", err)
+		http.Error(w, "Invalid payload", http.StatusBadRequest)
+		return
+	}
+
+	delivery := buildDelivery(event, &payload)
+	if delivery == nil {
+		log.Printf("Ignoring webhook %s: %s %s", deliveryID, event, payload.Action)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	delivery.ID = deliveryID
+	delivery.Event = event
+
+	applied, err := wh.webhookTable.ApplyDelivery(r.Context(), delivery)
+	if err != nil {
+		log.Printf("Failed to apply webhook %s: %v", deliveryID, err)
+		http.Error(w, "Failed to apply webhook", http.StatusInternalServerError)
+		return
+	}
+	if !applied {
+		log.Printf("Webhook %s already processed", deliveryID)
+	} else {
+		log.Printf("Applied webhook %s: %s %s", deliveryID, event, payload.Action)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,87 @@
+package github
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeWebhookTable struct {
+	deliveries map[string]*persistence.WebhookDelivery
+}
+
+func (f *fakeWebhookTable) ApplyDelivery(ctx context.Context, delivery *persistence.WebhookDelivery) (bool, error) {
+	if _, ok := f.deliveries[delivery.ID]; ok {
+		return false, nil
+	}
+	f.deliveries[delivery.ID] = delivery
+	return true, nil
+}
+
+func sign(secret, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func sendWebhook(handler *WebhookHandler, event, delivery, signature, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/webhooks/github", strings.NewReader(body))
+	req.Header.Set("X-GitHub-Event", event)
+	req.Header.Set("X-GitHub-Delivery", delivery)
+	req.Header.Set("X-Hub-Signature-256", signature)
+	rec := httptest.NewRecorder()
+	handler.HandleWebhook(rec, req)
+	return rec
+}
+
+func TestHandleWebhook(t *testing.T) {
+	table := &fakeWebhookTable{deliveries: map[string]*persistence.WebhookDelivery{}}
+	handler := NewWebhookHandler("shhh", table)
+
+	t.Run("Test rejecting a bad signature", func(t *testing.T) {
+		body := `{"action":"member_removed"}`
+		rec := sendWebhook(handler, "organization", "d0", sign("wrong", body), body)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+		assert.Empty(t, table.deliveries)
+	})
+
+	t.Run("Test removing an org member", func(t *testing.T) {
+		body := `{"action":"member_removed","membership":{"user":{"id":7,"login":"octo"}},"organization":{"login":"coopstools"}}`
+		rec := sendWebhook(handler, "organization", "d1", sign("shhh", body), body)
+		assert.Equal(t, http.StatusNoContent, rec.Code)
+		require.Contains(t, table.deliveries, "d1")
+		assert.Equal(t, []persistence.OrgPermission{{UserID: 7, OrgID: "coopstools"}}, table.deliveries["d1"].RevokedUserOrgs, "the org's teams go too")
+	})
+
+	t.Run("Test removing a team member", func(t *testing.T) {
+		body := `{"action":"removed","member":{"id":7},"team":{"slug":"admins"},"organization":{"login":"coopstools"}}`
+		rec := sendWebhook(handler, "membership", "d2", sign("shhh", body), body)
+		assert.Equal(t, http.StatusNoContent, rec.Code)
+		require.Contains(t, table.deliveries, "d2")
+		assert.Equal(t, []persistence.OrgPermission{{UserID: 7, OrgID: "coopstools/admins"}}, table.deliveries["d2"].RevokedPermissions)
+	})
+
+	t.Run("Test deleting a team", func(t *testing.T) {
+		body := `{"action":"deleted","team":{"slug":"admins"},"organization":{"login":"coopstools"}}`
+		rec := sendWebhook(handler, "team", "d3", sign("shhh", body), body)
+		assert.Equal(t, http.StatusNoContent, rec.Code)
+		require.Contains(t, table.deliveries, "d3")
+		assert.Equal(t, []string{"coopstools/admins"}, table.deliveries["d3"].RevokedOrgs)
+	})
+
+	t.Run("Test ignoring unrelated events", func(t *testing.T) {
+		body := `{"action":"member_added","membership":{"user":{"id":7}},"organization":{"login":"coopstools"}}`
+		rec := sendWebhook(handler, "organization", "d4", sign("shhh", body), body)
+		assert.Equal(t, http.StatusNoContent, rec.Code)
+		assert.NotContains(t, table.deliveries, "d4")
+	})
+}
@@ -0,0 +1,40 @@
+package grpcauth
+
+import (
+	"context"
+
+	"google.golang.org/grpc/credentials"
+)
+
+// TokenSource returns the token to attach to an outgoing call
+type TokenSource func(ctx context.Context) (string, error)
+
+// StaticToken always attaches the same token
+func StaticToken(token string) TokenSource {
+	return func(ctx context.Context) (string, error) {
+		return token, nil
+	}
+}
+
+type tokenCredentials struct {
+	source     TokenSource
+	requireTLS bool
+}
+
+// NewTokenCredentials attaches a Zuul token to every call made on a connection, for use
+// with grpc.WithPerRPCCredentials. Tokens should only travel over TLS outside of tests.
+func NewTokenCredentials(source TokenSource, requireTLS bool) credentials.PerRPCCredentials {
+	return &tokenCredentials{source: source, requireTLS: requireTLS}
+}
+
+func (c *tokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	token, err := c.source(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"authorization": "Bearer " + token}, nil
+}
+
+func (c *tokenCredentials) RequireTransportSecurity() bool {
+	return c.requireTLS
+}
@@ -0,0 +1,118 @@
+// Package grpcauth authenticates gRPC calls with Zuul tokens. The server interceptors
+// accept any verifier.TokenValidator: a verifier.Verifier in downstream services, or
+// Zuul's own auth.Authenticator, which applies the same checks as its http middleware.
+package grpcauth
+
+import (
+	"context"
+	"errors"
+	"log"
+	"slices"
+	"strings"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/verifier"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+type Permission struct {
+	OrgID      string
+	Permission string
+}
+
+// Policy controls which calls need what. Methods are full grpc method names,
+// e.g. "/zuul.Things/ListThings".
+type Policy struct {
+	// Permission required per method; methods not listed only need a valid token
+	RequiredPermissions map[string]Permission
+	// Methods that may be called without a token, such as health checks
+	PublicMethods []string
+	// If set, tokens must list this audience, as the tokens Zuul issues for a client do
+	Audience string
+	// Without an Audience, the path on Zuul that tokens must have been issued for, or be
+	// beneath; defaults to "/", the path of session tokens
+	Path string
+}
+
+// tokenFromMetadata reads the bearer token from the authorization metadata
+func tokenFromMetadata(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	for _, value := range md.Get("authorization") {
+		if scheme, token, found := strings.Cut(value, " "); found && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimPrefix(strings.TrimSpace(token), "ghsso_")
+		}
+	}
+	return ""
+}
+
+// authenticate returns a context carrying the caller's claims, or a grpc status error
+func authenticate(ctx context.Context, validator verifier.TokenValidator, policy *Policy, method string) (context.Context, error) {
+	if slices.Contains(policy.PublicMethods, method) {
+		return ctx, nil
+	}
+
+	claims, err := validator.Verify(ctx, tokenFromMetadata(ctx))
+	if errors.Is(err, verifier.ErrPermissionDenied) {
+		log.Printf("Permission denied for %s: %v", method, err)
+		return nil, status.Error(codes.PermissionDenied, "permission denied")
+	}
+	if errors.Is(err, verifier.ErrUnavailable) {
+		log.Printf("Failed to validate token for %s: %v", method, err)
+		return nil, status.Error(codes.Unavailable, "token validation unavailable")
+	}
+	if err != nil {
+		log.Printf("Unauthenticated call to %s: %v", method, err)
+		return nil, status.Error(codes.Unauthenticated, "invalid or missing token")
+	}
+	// Zuul's authenticator checks neither, and a downstream verifier may expect another
+	// audience than the policy
+	path := policy.Path
+	if path == "" {
+		path = "/"
+	}
+	if !claims.ForService(policy.Audience, path) {
+		log.Printf("Token of user %d for %s was not issued for this service", claims.UserID, method)
+		return nil, status.Error(codes.Unauthenticated, "token not issued for this service")
+	}
+
+	if required, ok := policy.RequiredPermissions[method]; ok && !claims.HasPermission(required.OrgID, required.Permission) {
+		log.Printf("User %d lacks %s on %s for %s", claims.UserID, required.Permission, required.OrgID, method)
+		return nil, status.Error(codes.PermissionDenied, "permission denied")
+	}
+	return verifier.NewContext(ctx, claims), nil
+}
+
+func UnaryServerInterceptor(validator verifier.TokenValidator, policy Policy) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := authenticate(ctx, validator, &policy, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// authenticatedStream swaps in the context carrying the caller's claims
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+func StreamServerInterceptor(validator verifier.TokenValidator, policy Policy) grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := authenticate(stream.Context(), validator, &policy, info.FullMethod)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &authenticatedStream{ServerStream: stream, ctx: ctx})
+	}
+}
@@ -0,0 +1,180 @@
+package grpcauth_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/grpcauth"
+	"github.com/coopstools-homebrew/I-am-zuul/src/verifier"
+	"github.com/coopstools-homebrew/I-am-zuul/src/verifier/verifiertest"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// claimsRecorder is a health server that remembers who called it
+type claimsRecorder struct {
+	*health.Server
+	claims *verifier.Claims
+}
+
+func (c *claimsRecorder) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	c.claims, _ = verifier.FromContext(ctx)
+	return c.Server.Check(ctx, req)
+}
+
+func (c *claimsRecorder) Watch(req *healthpb.HealthCheckRequest, stream healthpb.Health_WatchServer) error {
+	c.claims, _ = verifier.FromContext(stream.Context())
+	return status.Error(codes.Unimplemented, "done")
+}
+
+func startServer(t *testing.T, policy grpcauth.Policy) (*verifiertest.Issuer, *claimsRecorder, func(token string) healthpb.HealthClient) {
+	issuer := verifiertest.NewIssuer(t)
+	validator := issuer.Verifier()
+
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(grpcauth.UnaryServerInterceptor(validator, policy)),
+		grpc.StreamInterceptor(grpcauth.StreamServerInterceptor(validator, policy)),
+	)
+	recorder := &claimsRecorder{Server: health.NewServer()}
+	healthpb.RegisterHealthServer(server, recorder)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	dial := func(token string) healthpb.HealthClient {
+		options := []grpc.DialOption{
+			grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+		}
+		if token != "" {
+			options = append(options, grpc.WithPerRPCCredentials(grpcauth.NewTokenCredentials(grpcauth.StaticToken(token), false)))
+		}
+		conn, err := grpc.NewClient("passthrough:///bufnet", options...)
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		return healthpb.NewHealthClient(conn)
+	}
+	return issuer, recorder, dial
+}
+
+func TestUnaryInterceptor(t *testing.T) {
+	issuer, recorder, dial := startServer(t, grpcauth.Policy{})
+	ctx := context.Background()
+
+	t.Run("Test valid token", func(t *testing.T) {
+		client := dial(issuer.Token(verifier.Claims{UserID: 7, Username: "octo"}))
+		_, err := client.Check(ctx, &healthpb.HealthCheckRequest{})
+		require.NoError(t, err)
+		require.NotNil(t, recorder.claims)
+		assert.Equal(t, "octo", recorder.claims.Username)
+	})
+
+	t.Run("Test missing token", func(t *testing.T) {
+		_, err := dial("").Check(ctx, &healthpb.HealthCheckRequest{})
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	})
+
+	t.Run("Test invalid token", func(t *testing.T) {
+		_, err := dial("not-a-token").Check(ctx, &healthpb.HealthCheckRequest{})
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	})
+}
+
+func TestPolicy(t *testing.T) {
+	issuer, _, dial := startServer(t, grpcauth.Policy{
+		RequiredPermissions: map[string]grpcauth.Permission{
+			"/grpc.health.v1.Health/Check": {OrgID: "coopstools", Permission: "admin"},
+		},
+		PublicMethods: []string{"/grpc.health.v1.Health/Watch"},
+	})
+	ctx := context.Background()
+
+	t.Run("Test missing permission", func(t *testing.T) {
+		_, err := dial(issuer.Token(verifier.Claims{UserID: 7})).Check(ctx, &healthpb.HealthCheckRequest{})
+		assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	})
+
+	t.Run("Test held permission", func(t *testing.T) {
+		token := issuer.Token(verifier.Claims{UserID: 7, Permissions: map[string]string{"coopstools": "admin"}})
+		_, err := dial(token).Check(ctx, &healthpb.HealthCheckRequest{})
+		assert.NoError(t, err)
+	})
+
+	t.Run("Test public method", func(t *testing.T) {
+		stream, err := dial("").Watch(ctx, &healthpb.HealthCheckRequest{})
+		require.NoError(t, err)
+		_, err = stream.Recv()
+		assert.Equal(t, codes.Unimplemented, status.Code(err))
+	})
+}
+
+func TestStreamInterceptor(t *testing.T) {
+	issuer, recorder, dial := startServer(t, grpcauth.Policy{})
+	ctx := context.Background()
+
+	t.Run("Test valid token", func(t *testing.T) {
+		stream, err := dial(issuer.Token(verifier.Claims{UserID: 7, Username: "streamer"})).Watch(ctx, &healthpb.HealthCheckRequest{})
+		require.NoError(t, err)
+		_, err = stream.Recv()
+		assert.Equal(t, codes.Unimplemented, status.Code(err))
+		require.NotNil(t, recorder.claims)
+		assert.Equal(t, "streamer", recorder.claims.Username)
+	})
+
+	t.Run("Test missing token", func(t *testing.T) {
+		stream, err := dial("").Watch(ctx, &healthpb.HealthCheckRequest{})
+		require.NoError(t, err)
+		_, err = stream.Recv()
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	})
+}
+
+// fixedValidator stands in for Zuul's authenticator, which checks neither path nor
+// audience
+type fixedValidator struct {
+	claims *verifier.Claims
+	err    error
+}
+
+func (f fixedValidator) Verify(ctx context.Context, tokenString string) (*verifier.Claims, error) {
+	return f.claims, f.err
+}
+
+func intercept(validator verifier.TokenValidator, policy grpcauth.Policy) error {
+	interceptor := grpcauth.UnaryServerInterceptor(validator, policy)
+	_, err := interceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/x.Y/Z"}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, nil
+	})
+	return err
+}
+
+func TestSuspendedUserIsDenied(t *testing.T) {
+	assert.Equal(t, codes.PermissionDenied, status.Code(intercept(fixedValidator{err: verifier.ErrPermissionDenied}, grpcauth.Policy{})))
+}
+
+func TestUnavailableValidation(t *testing.T) {
+	err := fmt.Errorf("%w: db down", verifier.ErrUnavailable)
+	assert.Equal(t, codes.Unavailable, status.Code(intercept(fixedValidator{err: err}, grpcauth.Policy{})))
+}
+
+func TestTokensForOtherServices(t *testing.T) {
+	session := &verifier.Claims{UserID: 1, Path: "/"}
+	restricted := &verifier.Claims{UserID: 1, Path: "/nowhere"}
+	forResume := &verifier.Claims{UserID: 1, Path: "/", RegisteredClaims: jwt.RegisteredClaims{Audience: jwt.ClaimStrings{"resume"}}}
+
+	assert.NoError(t, intercept(fixedValidator{claims: session}, grpcauth.Policy{}))
+	assert.Equal(t, codes.Unauthenticated, status.Code(intercept(fixedValidator{claims: restricted}, grpcauth.Policy{})))
+	assert.Equal(t, codes.Unauthenticated, status.Code(intercept(fixedValidator{claims: forResume}, grpcauth.Policy{})))
+	assert.NoError(t, intercept(fixedValidator{claims: forResume}, grpcauth.Policy{Audience: "resume"}))
+	assert.Equal(t, codes.Unauthenticated, status.Code(intercept(fixedValidator{claims: session}, grpcauth.Policy{Audience: "resume"})))
+}
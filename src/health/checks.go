@@ -0,0 +1,74 @@
+package health
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// SchemaVersions reports the db's schema version and the newest one the build embeds;
+// persistence.Migrator implements it
+type SchemaVersions interface {
+	CurrentVersion() (int, error)
+	LatestVersion() (int, error)
+}
+
+func schemaVersions(schema SchemaVersions) (int, int, error) {
+	latest, err := schema.LatestVersion()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read migrations: %w", err)
+	}
+	current, err := schema.CurrentVersion()
+	if err != nil {
+		return 0, latest, fmt.Errorf("failed to get schema version: %w", err)
+	}
+	return current, latest, nil
+}
+
+// Database checks that a connection to the db can be made
+func Database(db *sql.DB) Check {
+	return Check{Name: "database", Run: db.PingContext}
+}
+
+// Migrations checks that the db is on the newest migration the build embeds. Behind or
+// ahead, the queries may not match the schema.
+func Migrations(schema SchemaVersions) Check {
+	return Check{Name: "migrations", Run: func(ctx context.Context) error {
+		current, latest, err := schemaVersions(schema)
+		if err != nil {
+			return err
+		}
+		if current != latest {
+			return fmt.Errorf("db is on version %d, expected %d", current, latest)
+		}
+		return nil
+	}}
+}
+
+// Keys runs the check of the signing and verification keys, such as
+// auth.CheckKeyPair
+func Keys(check func() error) Check {
+	return Check{Name: "keys", Run: func(ctx context.Context) error { return check() }}
+}
+
+// Reachable checks that the url answers without a server error. It is optional, and
+// results are cached for ttl so probes don't run into the remote's rate limits.
+func Reachable(name, url string, ttl time.Duration) Check {
+	return Check{Name: name, Optional: true, CacheTTL: ttl, Run: func(ctx context.Context) error {
+		request, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+		if err != nil {
+			return err
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			return err
+		}
+		response.Body.Close()
+		if response.StatusCode >= 500 {
+			return fmt.Errorf("%s answered %s", url, response.Status)
+		}
+		return nil
+	}}
+}
@@ -0,0 +1,212 @@
+// Package health serves the liveness, readiness and version endpoints probed by the
+// platform and load balancers
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+const (
+	StatusOK   = "ok"
+	StatusFail = "fail"
+)
+
+// Commit is the build's git commit. Builds without vcs info can set it with
+// -ldflags "-X github.com/coopstools-homebrew/I-am-zuul/src/health.Commit=<sha>".
+var Commit string
+
+// Check is one thing the service needs to serve requests
+type Check struct {
+	Name string
+	Run  func(ctx context.Context) error
+	// Failures are reported without making the service unready
+	Optional bool
+	// How long a result is reused; zero runs the check on every probe
+	CacheTTL time.Duration
+}
+
+// Result is the outcome of a check
+type Result struct {
+	Status    string    `json:"status"`
+	LatencyMS float64   `json:"latency_ms"`
+	Error     string    `json:"error,omitempty"`
+	Optional  bool      `json:"optional,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// Report is the body of every endpoint: the overall status and each check's result
+type Report struct {
+	Status string             `json:"status"`
+	Checks map[string]*Result `json:"checks"`
+}
+
+// cachedCheck holds a check's last result. The lock is held while the check runs, so
+// concurrent probes share one run.
+type cachedCheck struct {
+	Check
+	mu        sync.Mutex
+	last      *Result
+	expiresAt time.Time
+}
+
+// Checker runs the readiness checks
+type Checker struct {
+	checks  []*cachedCheck
+	timeout time.Duration
+}
+
+// NewChecker creates a checker giving each check up to timeout to finish
+func NewChecker(timeout time.Duration, checks ...Check) *Checker {
+	checker := &Checker{timeout: timeout}
+	for _, check := range checks {
+		checker.checks = append(checker.checks, &cachedCheck{Check: check})
+	}
+	return checker
+}
+
+// Run runs the checks concurrently. The report fails if any required check does.
+func (c *Checker) Run(ctx context.Context) *Report {
+	results := make([]*Result, len(c.checks))
+	var wg sync.WaitGroup
+	for i, check := range c.checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = check.result(ctx, c.timeout)
+		}()
+	}
+	wg.Wait()
+
+	report := &Report{Status: StatusOK, Checks: map[string]*Result{}}
+	for i, check := range c.checks {
+		report.Checks[check.Name] = results[i]
+		if results[i].Status != StatusOK && !check.Optional {
+			report.Status = StatusFail
+		}
+	}
+	return report
+}
+
+func (c *cachedCheck) result(ctx context.Context, timeout time.Duration) *Result {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.last != nil && time.Now().Before(c.expiresAt) {
+		return c.last
+	}
+
+	c.last = run(ctx, timeout, c.Check)
+	c.expiresAt = time.Now().Add(c.CacheTTL)
+	return c.last
+}
+
+// run times the check. Checks that ignore their context are abandoned at the timeout.
+func run(ctx context.Context, timeout time.Duration, check Check) *Result {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- check.Run(ctx) }()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	result := &Result{
+		Status:    StatusOK,
+		LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+		Optional:  check.Optional,
+		CheckedAt: start,
+	}
+	if err != nil {
+		result.Status = StatusFail
+		result.Error = err.Error()
+	}
+	return result
+}
+
+func writeReport(w http.ResponseWriter, report any, ok bool) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// HandleLive answers as long as the process can serve requests at all; it checks
+// nothing, so a db outage doesn't get every instance restarted
+func HandleLive(w http.ResponseWriter, r *http.Request) {
+	writeReport(w, &Report{Status: StatusOK, Checks: map[string]*Result{}}, true)
+}
+
+// HandleReady runs the checks, answering 503 unless every required one passes
+func (c *Checker) HandleReady(w http.ResponseWriter, r *http.Request) {
+	report := c.Run(r.Context())
+	writeReport(w, report, report.Status == StatusOK)
+}
+
+// Version describes the running build and the schema it expects
+type Version struct {
+	Report
+	Commit    string `json:"commit"`
+	Modified  bool   `json:"modified,omitempty"`
+	BuildTime string `json:"build_time,omitempty"`
+	GoVersion string `json:"go_version"`
+	// -1 when the db can't be read
+	SchemaVersion       int `json:"schema_version"`
+	LatestSchemaVersion int `json:"latest_schema_version"`
+}
+
+// HandleVersion reports the build and the db's schema version. The schema lookup is
+// reported as the "schema" check.
+func HandleVersion(schema SchemaVersions, timeout time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Buffered, so a lookup finishing after the timeout doesn't block
+		versions := make(chan [2]int, 1)
+		result := run(r.Context(), timeout, Check{Name: "schema", Run: func(ctx context.Context) error {
+			current, latest, err := schemaVersions(schema)
+			versions <- [2]int{current, latest}
+			return err
+		}})
+
+		version := buildVersion()
+		version.SchemaVersion = -1
+		if result.Status == StatusOK {
+			found := <-versions
+			version.SchemaVersion, version.LatestSchemaVersion = found[0], found[1]
+		}
+		version.Status = result.Status
+		version.Checks = map[string]*Result{"schema": result}
+		writeReport(w, version, true)
+	}
+}
+
+func buildVersion() *Version {
+	version := &Version{Commit: Commit, GoVersion: runtime.Version()}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return version
+	}
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			if version.Commit == "" {
+				version.Commit = setting.Value
+			}
+		case "vcs.modified":
+			version.Modified = setting.Value == "true"
+		case "vcs.time":
+			version.BuildTime = setting.Value
+		}
+	}
+	return version
+}
@@ -0,0 +1,132 @@
+package health_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/health"
+)
+
+func ok(ctx context.Context) error { return nil }
+
+type fakeSchema struct {
+	current, latest int
+	err             error
+}
+
+func (f fakeSchema) CurrentVersion() (int, error) { return f.current, f.err }
+func (f fakeSchema) LatestVersion() (int, error)  { return f.latest, nil }
+
+func getReport(t *testing.T, handler http.HandlerFunc, path string, report any) int {
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+	assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+	require.NoError(t, json.NewDecoder(recorder.Body).Decode(report))
+	return recorder.Code
+}
+
+func TestLive(t *testing.T) {
+	var report health.Report
+	assert.Equal(t, http.StatusOK, getReport(t, health.HandleLive, "/healthz", &report))
+	assert.Equal(t, health.StatusOK, report.Status)
+}
+
+func TestReady(t *testing.T) {
+	t.Run("Test passing checks", func(t *testing.T) {
+		checker := health.NewChecker(time.Second,
+			health.Check{Name: "database", Run: ok},
+			health.Migrations(fakeSchema{current: 8, latest: 8}),
+		)
+		var report health.Report
+		assert.Equal(t, http.StatusOK, getReport(t, checker.HandleReady, "/readyz", &report))
+		assert.Equal(t, health.StatusOK, report.Status)
+		require.Len(t, report.Checks, 2)
+		assert.Equal(t, health.StatusOK, report.Checks["migrations"].Status)
+		assert.GreaterOrEqual(t, report.Checks["database"].LatencyMS, 0.0)
+	})
+
+	t.Run("Test a failing check makes the service unready", func(t *testing.T) {
+		checker := health.NewChecker(time.Second,
+			health.Check{Name: "database", Run: ok},
+			health.Migrations(fakeSchema{current: 7, latest: 8}),
+		)
+		var report health.Report
+		assert.Equal(t, http.StatusServiceUnavailable, getReport(t, checker.HandleReady, "/readyz", &report))
+		assert.Equal(t, health.StatusFail, report.Status)
+		assert.Equal(t, health.StatusOK, report.Checks["database"].Status)
+		assert.Equal(t, "db is on version 7, expected 8", report.Checks["migrations"].Error)
+	})
+
+	t.Run("Test optional checks are reported without failing", func(t *testing.T) {
+		checker := health.NewChecker(time.Second, health.Check{
+			Name:     "github",
+			Optional: true,
+			Run:      func(ctx context.Context) error { return errors.New("unreachable") },
+		})
+		var report health.Report
+		assert.Equal(t, http.StatusOK, getReport(t, checker.HandleReady, "/readyz", &report))
+		assert.Equal(t, health.StatusFail, report.Checks["github"].Status)
+		assert.True(t, report.Checks["github"].Optional)
+	})
+
+	t.Run("Test slow checks time out", func(t *testing.T) {
+		checker := health.NewChecker(10*time.Millisecond, health.Check{
+			Name: "stuck",
+			Run:  func(ctx context.Context) error { time.Sleep(time.Second); return nil },
+		})
+		report := checker.Run(context.Background())
+		assert.Equal(t, health.StatusFail, report.Status)
+		assert.Equal(t, context.DeadlineExceeded.Error(), report.Checks["stuck"].Error)
+	})
+
+	t.Run("Test results are cached", func(t *testing.T) {
+		var runs atomic.Int32
+		count := func(ctx context.Context) error { runs.Add(1); return nil }
+		checker := health.NewChecker(time.Second,
+			health.Check{Name: "cached", CacheTTL: time.Hour, Run: count},
+			health.Check{Name: "uncached", Run: count},
+		)
+		checker.Run(context.Background())
+		checker.Run(context.Background())
+		assert.Equal(t, int32(3), runs.Load())
+	})
+}
+
+func TestReachable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/down" {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer server.Close()
+
+	report := health.NewChecker(time.Second,
+		health.Reachable("up", server.URL, time.Minute),
+		health.Reachable("down", server.URL+"/down", time.Minute),
+	).Run(context.Background())
+	assert.Equal(t, health.StatusOK, report.Checks["up"].Status)
+	assert.Equal(t, health.StatusFail, report.Checks["down"].Status)
+	assert.Equal(t, health.StatusOK, report.Status, "reachability is optional")
+}
+
+func TestVersion(t *testing.T) {
+	var version health.Version
+	assert.Equal(t, http.StatusOK, getReport(t, health.HandleVersion(fakeSchema{current: 7, latest: 8}, time.Second), "/version", &version))
+	assert.Equal(t, 7, version.SchemaVersion)
+	assert.Equal(t, 8, version.LatestSchemaVersion)
+	assert.NotEmpty(t, version.GoVersion)
+	assert.Equal(t, health.StatusOK, version.Checks["schema"].Status)
+
+	assert.Equal(t, http.StatusOK, getReport(t, health.HandleVersion(fakeSchema{err: errors.New("db down")}, time.Second), "/version", &version))
+	assert.Equal(t, -1, version.SchemaVersion)
+	assert.Equal(t, health.StatusFail, version.Status)
+}
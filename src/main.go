@@ -1,18 +1,21 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"log"
 	"net/http"
 	"os"
 
-	_ "github.com/lib/pq"
-
+	"github.com/coopstools-homebrew/I-am-zuul/src/admin"
 	"github.com/coopstools-homebrew/I-am-zuul/src/auth"
 	"github.com/coopstools-homebrew/I-am-zuul/src/config"
 	"github.com/coopstools-homebrew/I-am-zuul/src/github"
+	"github.com/coopstools-homebrew/I-am-zuul/src/health"
+	"github.com/coopstools-homebrew/I-am-zuul/src/mailer"
 	"github.com/coopstools-homebrew/I-am-zuul/src/persistence"
+	"github.com/coopstools-homebrew/I-am-zuul/src/proxy"
 	"github.com/coopstools-homebrew/I-am-zuul/src/utils"
 )
 
@@ -24,13 +27,13 @@ type DummyData struct {
 }
 
 type UserTable interface {
-	GetUserByID(id int32) (*persistence.UserInfo, error)
+	GetUserByID(ctx context.Context, id int32) (*persistence.UserInfo, error)
 }
 
 func getDummyData(userTable UserTable) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		userID := r.Context().Value(utils.UserIDKey).(int32)
-		user, err := userTable.GetUserByID(userID)
+		user, err := userTable.GetUserByID(r.Context(), userID)
 		if err != nil {
 			log.Printf("Failed to get user: %v", err)
 			http.Error(w, "Failed to get user", http.StatusInternalServerError)
@@ -51,41 +54,285 @@ func getDummyData(userTable UserTable) func(w http.ResponseWriter, r *http.Reque
 }
 
 func main() {
-	if os.Getenv("GITHUB_CLIENT_ID") == "" || os.Getenv("GITHUB_CLIENT_SECRET") == "" {
-		log.Fatal("GITHUB_CLIENT_ID and GITHUB_CLIENT_SECRET must be set")
+	mode := ""
+	if len(os.Args) > 1 {
+		mode = os.Args[1]
+	}
+	switch mode {
+	case "dev":
+		setUpDevEnvironment()
+		runServer()
+	case "proxy":
+		runProxy()
+	case "migrate":
+		runMigrate(os.Args[2:])
+	default:
+		runServer()
+	}
+}
+
+// poolConfig sizes the Postgres connection pool
+func poolConfig(config *config.Config) persistence.PoolConfig {
+	return persistence.PoolConfig{
+		MaxConns:          config.DBMaxConns,
+		MaxConnIdleTime:   config.DBMaxConnIdleTime,
+		HealthCheckPeriod: config.DBHealthCheckPeriod,
+	}
+}
+
+func openDatabase(config *config.Config) *sql.DB {
+	db, err := persistence.Open(config.DatabaseURL, poolConfig(config))
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+	if !config.AutoMigrate {
+		warnPendingMigrations(db)
+		return db
+	}
+	err = persistence.Migrate(db, config.MigrationLockTimeout)
+	if err != nil {
+		log.Fatalf("Failed to initialize database: %v", err)
+	}
+	return db
+}
+
+// newAuthMiddleware builds the middleware shared by the api and the gatekeeper proxy
+func newAuthMiddleware(config *config.Config, authStateCache *auth.AuthStateCache, tokenIssuer *auth.TokenIssuer) (*auth.Authenticator, func(http.HandlerFunc) http.HandlerFunc) {
+	var sessionRenewal *auth.SessionRenewal
+	if config.SessionRenewAfter > 0 {
+		sessionRenewal = &auth.SessionRenewal{
+			Issuer:     tokenIssuer,
+			RenewAfter: config.SessionRenewAfter,
+			MaxAge:     config.SessionMaxAge,
+		}
 	}
+	authenticator := auth.NewAuthenticator(config.PublicKey, authStateCache)
+	return authenticator, auth.NewMiddleware(authenticator, sessionRenewal)
+}
 
+// newReadinessChecker lists what /readyz checks: the db, its schema version and the keys,
+// plus whether GitHub is reachable if HEALTH_CHECK_GITHUB is set
+func newReadinessChecker(config *config.Config, db *sql.DB, migrator *persistence.Migrator, tokenIssuer *auth.TokenIssuer, authenticator *auth.Authenticator) *health.Checker {
+	checks := []health.Check{
+		health.Database(db),
+		health.Migrations(migrator),
+		health.Keys(func() error { return auth.CheckKeyPair(tokenIssuer, authenticator) }),
+	}
+	if config.HealthCheckGitHub {
+		checks = append(checks, health.Reachable("github", config.GitHubAPIURL, config.HealthGitHubCacheTTL))
+	}
+	return health.NewChecker(config.HealthCheckTimeout, checks...)
+}
+
+// newMailer picks how login links are delivered
+func newMailer(config *config.Config) auth.Mailer {
+	switch config.Mailer {
+	case "smtp":
+		if config.SMTPHost == "" || config.MailFrom == "" {
+			log.Fatal("MAILER=smtp needs SMTP_HOST and MAIL_FROM")
+		}
+		return mailer.NewSMTPMailer(config.SMTPHost, config.SMTPPort, config.SMTPUsername, config.SMTPPassword, config.MailFrom)
+	case "log":
+		if config.MailLogFile == "" {
+			return mailer.NewLogMailer(log.Writer())
+		}
+		file, err := os.OpenFile(config.MailLogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			log.Fatalf("Failed to open MAIL_LOG_FILE: %v", err)
+		}
+		return mailer.NewLogMailer(file)
+	default:
+		log.Fatalf("Unknown MAILER %q; use smtp or log", config.Mailer)
+		return nil
+	}
+}
+
+// runProxy puts the routes in PROXY_ROUTES_FILE behind Zuul's auth
+func runProxy() {
 	config, err := config.LoadConfig()
 	if err != nil {
 		log.Fatalf("Failed to load config: %v", err)
 	}
+	if len(config.ProxyRoutes) == 0 {
+		log.Fatal("PROXY_ROUTES_FILE must list at least one route")
+	}
 
-	db, err := sql.Open("postgres", config.DatabaseURL)
+	db := openDatabase(config)
+	defer db.Close()
+
+	authStateCache := auth.NewAuthStateCache(persistence.NewUserTable(db), config.AuthStateCacheTTL)
+	tokenIssuer := auth.NewTokenIssuer(config.PrivateKey, config.SessionLifetime)
+	_, authMiddleware := newAuthMiddleware(config, authStateCache, tokenIssuer)
+
+	gatekeeper, err := proxy.NewGatekeeper(config.ProxyRoutes, authMiddleware, config.ProxySigningSecret)
 	if err != nil {
-		log.Fatalf("Failed to open database: %v", err)
+		log.Fatalf("Failed to set up proxy: %v", err)
 	}
-	defer db.Close()
-	err = persistence.Migrate(db)
+	log.Println("Proxy starting on :" + config.Port)
+	log.Fatal(http.ListenAndServe(":"+config.Port, gatekeeper))
+}
+
+func runServer() {
+	if os.Getenv("GITHUB_CLIENT_ID") == "" || os.Getenv("GITHUB_CLIENT_SECRET") == "" {
+		log.Fatal("GITHUB_CLIENT_ID and GITHUB_CLIENT_SECRET must be set")
+	}
+
+	config, err := config.LoadConfig()
 	if err != nil {
-		log.Fatalf("Failed to initialize database: %v", err)
+		log.Fatalf("Failed to load config: %v", err)
 	}
 
-	userTable := persistence.NewUserTable(db)
+	db := openDatabase(config)
+	defer db.Close()
+
+	var userTable persistence.UserStore = persistence.NewUserTable(db)
 	loremIpsumAppender := github.NewLoremIpsumAppender(config.LoremIpsumAccessToken)
 
-	authMiddleware := auth.NewMiddleware(config.PublicKey)
-	corsMiddleware := auth.NewCORSMiddleware(config.AllowedOrigins...)
+	var permissionTable persistence.PermissionStore = persistence.NewPermissionTable(db)
+	webhookTable := persistence.NewWebhookTable(db)
+
+	authStateCache := auth.NewAuthStateCache(userTable, config.AuthStateCacheTTL)
+	tokenIssuer := auth.NewTokenIssuer(config.PrivateKey, config.SessionLifetime)
+	authenticator, authMiddleware := newAuthMiddleware(config, authStateCache, tokenIssuer)
+	// Requests naming no client are for the service's own front end
+	clientTable := persistence.NewClientTable(db)
+	clientRegistry := auth.NewClientRegistry(clientTable, &persistence.Client{
+		Name:           "default",
+		RedirectURIs:   []string{config.GitHubRedirectURI},
+		AllowedOrigins: config.AllowedOrigins,
+		TokenPath:      "/",
+	}, config.ClientCacheTTL)
+	corsPolicy := auth.CORSPolicy{
+		AllowedOrigins:   config.AllowedOrigins,
+		AllowedHeaders:   config.CORSAllowedHeaders,
+		ExposedHeaders:   config.CORSExposedHeaders,
+		AllowCredentials: config.CORSAllowCredentials,
+		MaxAge:           config.CORSMaxAge,
+		OriginSource:     clientRegistry,
+	}
+	dataCORSMiddleware := auth.NewCORSMiddleware(corsPolicy.WithMethods("GET"))
 
-	dummyDataRetriever := corsMiddleware(authMiddleware(getDummyData(userTable)))
-	githubCallback := auth.NewGitHubCallback(config.PrivateKey, userTable)
+	dummyDataRetriever := dataCORSMiddleware(authMiddleware(getDummyData(userTable)))
+	githubCallback := auth.NewGitHubCallback(config, tokenIssuer, userTable, permissionTable, clientRegistry)
 	appendLoremIpsum := github.HandleAppendLoremIpsum(config, loremIpsumAppender)
 	generateLoremIpsum := github.HandleGenerateLoremIpsum(config, loremIpsumAppender)
 
-	http.HandleFunc("GET /generate-jwt", githubCallback.HandleGenerateJWT)
+	migrator, err := persistence.NewMigrator(db, config.MigrationLockTimeout)
+	if err != nil {
+		log.Fatalf("Failed to create migrator: %v", err)
+	}
+	http.HandleFunc("GET /healthz", health.HandleLive)
+	http.HandleFunc("GET /readyz", newReadinessChecker(config, db, migrator, tokenIssuer, authenticator).HandleReady)
+	http.HandleFunc("GET /version", health.HandleVersion(migrator, config.HealthCheckTimeout))
+
+	forwardAuth := auth.NewForwardAuth(authenticator, auth.NewAccessPolicy(config.AccessRules), config.LoginURL)
+	// Envoy appends the original path, and uses the original method
+	http.HandleFunc("/auth/verify", forwardAuth.HandleVerify)
+	http.HandleFunc("/auth/verify/", forwardAuth.HandleVerify)
+	http.HandleFunc("GET /.well-known/jwks.json", auth.HandleJWKS(config.PublicKey))
+	http.HandleFunc("GET /login", githubCallback.HandleLogin)
 	http.HandleFunc("GET /callback", githubCallback.HandleGitHubCallback)
+	http.HandleFunc("POST /oauth/token", auth.NewTokenExchange(authenticator, tokenIssuer, clientRegistry).HandleToken)
+	accountTable := persistence.NewAccountTable(db)
+	accountHandler := auth.NewAccountHandler(accountTable, authStateCache)
+	http.HandleFunc("GET /me/export", authMiddleware(accountHandler.HandleExport))
+	http.HandleFunc("POST /me/delete", authMiddleware(accountHandler.HandleDelete))
 	http.HandleFunc("/data", dummyDataRetriever)
 	http.HandleFunc("POST /lorem-ipsum", appendLoremIpsum)
 	http.HandleFunc("GET /lorem-ipsum", generateLoremIpsum)
+	if config.GitHubWebhookSecret != "" {
+		webhookHandler := github.NewWebhookHandler(config.GitHubWebhookSecret, webhookTable)
+		http.HandleFunc("POST /webhooks/github", webhookHandler.HandleWebhook)
+	} else {
+		log.Println("GITHUB_WEBHOOK_SECRET not set; github webhooks disabled")
+	}
+	mfaTable := persistence.NewMFATable(db)
+	orgPolicyTable := persistence.NewOrgPolicyTable(db)
+	secondFactorsEnabled := false
+	if config.WebAuthnRPID != "" {
+		webAuthnHandler, err := auth.NewWebAuthnHandler(config, tokenIssuer, persistence.NewWebAuthnTable(db), permissionTable, mfaTable)
+		if err != nil {
+			log.Fatalf("Failed to set up webauthn: %v", err)
+		}
+		http.HandleFunc("POST /mfa/webauthn/register/begin", authMiddleware(webAuthnHandler.HandleBeginRegistration))
+		http.HandleFunc("POST /mfa/webauthn/register/finish", authMiddleware(webAuthnHandler.HandleFinishRegistration))
+		http.HandleFunc("POST /mfa/webauthn/login/begin", authMiddleware(webAuthnHandler.HandleBeginLogin))
+		http.HandleFunc("POST /mfa/webauthn/login/finish", authMiddleware(webAuthnHandler.HandleFinishLogin))
+		http.HandleFunc("GET /mfa/webauthn/credentials", authMiddleware(webAuthnHandler.HandleListCredentials))
+		http.HandleFunc("DELETE /mfa/webauthn/credentials/{id}", authMiddleware(webAuthnHandler.HandleDeleteCredential))
+		secondFactorsEnabled = true
+	} else {
+		log.Println("WEBAUTHN_RP_ID not set; webauthn disabled")
+	}
+	if config.MFAEncryptionKey != "" {
+		totpHandler, err := auth.NewTOTPHandler(config.MFAEncryptionKey, config.TOTPIssuer, tokenIssuer, mfaTable, permissionTable, mfaTable)
+		if err != nil {
+			log.Fatalf("Failed to set up totp: %v", err)
+		}
+		http.HandleFunc("POST /mfa/totp/enroll", authMiddleware(totpHandler.HandleEnroll))
+		http.HandleFunc("POST /mfa/totp/confirm", authMiddleware(totpHandler.HandleConfirm))
+		http.HandleFunc("POST /mfa/totp/verify", authMiddleware(totpHandler.HandleVerify))
+		http.HandleFunc("DELETE /mfa/totp", authMiddleware(totpHandler.HandleDisable))
+		http.HandleFunc("POST /mfa/recovery", authMiddleware(totpHandler.HandleRecover))
+		http.HandleFunc("POST /mfa/recovery-codes", authMiddleware(totpHandler.HandleRegenerateRecoveryCodes))
+		secondFactorsEnabled = true
+	} else {
+		log.Println("MFA_ENCRYPTION_KEY not set; totp disabled")
+	}
+	mfaPolicy := auth.MFAPolicy{
+		Privileged:  config.MFAPrivilegedPermissions,
+		OrgPolicies: orgPolicyTable,
+	}
+	if secondFactorsEnabled {
+		githubCallback.RequireSecondFactor(mfaPolicy, mfaTable)
+		http.HandleFunc("GET /mfa", auth.HandleChallengePage(clientRegistry))
+	} else if len(config.MFAPrivilegedPermissions) > 0 {
+		log.Fatal("MFA_PRIVILEGED_PERMISSIONS needs a second factor; set WEBAUTHN_RP_ID or MFA_ENCRYPTION_KEY")
+	}
+	if config.MagicLinkURL != "" {
+		magicLinkLogin := auth.NewMagicLinkLogin(config, tokenIssuer, persistence.NewMagicLinkTable(db), userTable, permissionTable, clientRegistry, newMailer(config))
+		if secondFactorsEnabled {
+			magicLinkLogin.RequireSecondFactor(mfaPolicy, mfaTable)
+		}
+		// Front ends on other origins post the email, so the request needs CORS
+		requestMagicLink := auth.NewCORSMiddleware(corsPolicy.WithMethods("POST"))(magicLinkLogin.HandleRequest)
+		http.HandleFunc("POST /login/email", requestMagicLink)
+		http.HandleFunc("OPTIONS /login/email", requestMagicLink)
+		http.HandleFunc("GET /login/email/verify", magicLinkLogin.HandleConfirmPage)
+		http.HandleFunc("POST /login/email/verify", magicLinkLogin.HandleVerify)
+	} else {
+		log.Println("MAGIC_LINK_URL not set; email login disabled")
+	}
+	if config.GitHubOrganization != "" {
+		adminMiddleware := auth.NewPermissionMiddleware(config.GitHubOrganization, "admin")
+		requireAdmin := func(next http.HandlerFunc) http.HandlerFunc {
+			return authMiddleware(adminMiddleware(next))
+		}
+		userAdmin := admin.NewUserAdmin(userTable, authStateCache)
+		http.HandleFunc("GET /admin/users/{id}/status", requireAdmin(userAdmin.HandleGetUserStatus))
+		http.HandleFunc("PUT /admin/users/{id}/status", requireAdmin(userAdmin.HandleSetUserStatus))
+		http.HandleFunc("GET /admin/users/inactive", requireAdmin(userAdmin.HandleGetInactiveUsers))
+		http.HandleFunc("GET /admin/users/{id}/logins", requireAdmin(userAdmin.HandleGetLoginHistory))
+		accountAdmin := admin.NewAccountAdmin(accountTable, authStateCache)
+		http.HandleFunc("GET /admin/users/{id}/export", requireAdmin(accountAdmin.HandleExportUser))
+		http.HandleFunc("POST /admin/users/{id}/delete", requireAdmin(accountAdmin.HandleDeleteUser))
+		permissionAdmin := admin.NewPermissionAdmin(permissionTable, authStateCache)
+		http.HandleFunc("GET /admin/permissions", requireAdmin(permissionAdmin.HandleFindPermissions))
+		http.HandleFunc("GET /admin/users/{id}/permissions", requireAdmin(permissionAdmin.HandleGetUserPermissions))
+		http.HandleFunc("PUT /admin/users/{id}/permissions/{org...}", requireAdmin(permissionAdmin.HandleGrantPermission))
+		http.HandleFunc("DELETE /admin/users/{id}/permissions/{org...}", requireAdmin(permissionAdmin.HandleRevokePermission))
+		mfaAdmin := admin.NewMFAAdmin(mfaTable, orgPolicyTable, authStateCache)
+		http.HandleFunc("DELETE /admin/users/{id}/mfa", requireAdmin(mfaAdmin.HandleResetSecondFactors))
+		http.HandleFunc("GET /admin/orgs/{org}/policy", requireAdmin(mfaAdmin.HandleGetOrgPolicy))
+		http.HandleFunc("PUT /admin/orgs/{org}/policy", requireAdmin(mfaAdmin.HandleSetOrgPolicy))
+		clientAdmin := admin.NewClientAdmin(clientTable, clientRegistry)
+		http.HandleFunc("GET /admin/clients", requireAdmin(clientAdmin.HandleGetClients))
+		http.HandleFunc("PUT /admin/clients/{id}", requireAdmin(clientAdmin.HandleSaveClient))
+		http.HandleFunc("POST /admin/clients/{id}/secret", requireAdmin(clientAdmin.HandleRotateSecret))
+		http.HandleFunc("DELETE /admin/clients/{id}", requireAdmin(clientAdmin.HandleDeleteClient))
+	} else {
+		log.Println("GITHUB_ORGANIZATION not set; admin api disabled")
+	}
 	log.Println("Server starting on :" + config.Port)
 	log.Fatal(http.ListenAndServe(":"+config.Port, nil))
 }
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/config"
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence"
+)
+
+const migrateUsage = `usage: zuul migrate [--dry-run] [--force] <command>
+
+commands:
+  status           list applied and pending migrations, and recorded failures
+  up               apply every pending migration
+  down N           revert the last N migrations
+  to V             migrate up or down to version V
+  clear V          forget the failure recorded for version V, once the db is fixed
+  new NAME [DIR]   create the next NNN_NAME.up.sql and .down.sql in DIR
+                   (default src/persistence/migrations), and in DIR/sqlite
+                   if it exists
+
+flags:
+`
+
+// runMigrate inspects and moves the db schema, for deploys that set AUTO_MIGRATE=false
+// or need to roll back
+func runMigrate(args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "print the SQL that would run instead of running it")
+	force := flags.Bool("force", false, "revert migrations without a down script by only removing their version")
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), migrateUsage)
+		flags.PrintDefaults()
+	}
+	// Flags may come before or after the command
+	flagArgs, commandArgs := []string{}, []string{}
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "-") {
+			flagArgs = append(flagArgs, arg)
+		} else {
+			commandArgs = append(commandArgs, arg)
+		}
+	}
+	flags.Parse(flagArgs)
+	if len(commandArgs) == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	command := commandArgs[0]
+
+	if command == "new" {
+		if len(commandArgs) < 2 {
+			log.Fatal("usage: zuul migrate new NAME [DIR]")
+		}
+		dir := "src/persistence/migrations"
+		if len(commandArgs) > 2 {
+			dir = commandArgs[2]
+		}
+		dirs := []string{dir}
+		// Every dialect needs the same versions
+		if info, err := os.Stat(filepath.Join(dir, "sqlite")); err == nil && info.IsDir() {
+			dirs = append(dirs, filepath.Join(dir, "sqlite"))
+		}
+		for _, dir := range dirs {
+			up, down, err := persistence.NewMigrationFiles(dir, commandArgs[1])
+			if err != nil {
+				log.Fatalf("Failed to create migration: %v", err)
+			}
+			fmt.Printf("created %s\ncreated %s\n", up, down)
+		}
+		return
+	}
+
+	config, err := config.LoadDatabaseConfig()
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+	db, err := persistence.Open(config.DatabaseURL, poolConfig(config))
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	migrator, err := persistence.NewMigrator(db, config.MigrationLockTimeout)
+	if err != nil {
+		log.Fatalf("Failed to create migrator: %v", err)
+	}
+
+	switch command {
+	case "status":
+		printMigrationStatus(migrator)
+		return
+	case "clear":
+		version := migrateArg(commandArgs, "V")
+		err = migrator.ClearFailure(version)
+		if err == sql.ErrNoRows {
+			log.Fatalf("No failure is recorded for version %d", version)
+		}
+		if err != nil {
+			log.Fatalf("Failed to clear failure: %v", err)
+		}
+		fmt.Printf("cleared the failure of version %d\n", version)
+		return
+	}
+
+	target, err := migrateTarget(migrator, command, commandArgs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *dryRun {
+		steps, err := migrator.Plan(target, *force)
+		if err != nil {
+			log.Fatalf("Failed to plan migrations: %v", err)
+		}
+		if len(steps) == 0 {
+			fmt.Printf("-- already on version %d --\n", target)
+		}
+		for _, step := range steps {
+			if step.Filename == "" {
+				fmt.Printf("-- version %d %s: no down script, only the version is removed --\n\n", step.Version, step.Direction)
+				continue
+			}
+			fmt.Printf("-- version %d %s: %s --\n%s\n", step.Version, step.Direction, step.Filename, step.SQL)
+		}
+		return
+	}
+
+	err = migrator.MigrateTo(target, *force)
+	if err != nil {
+		log.Fatalf("Failed to migrate: %v", err)
+	}
+	fmt.Printf("db is on version %d\n", target)
+}
+
+// migrateTarget works out the version the up, down and to commands move to
+func migrateTarget(migrator *persistence.Migrator, command string, args []string) (int, error) {
+	switch command {
+	case "up":
+		return migrator.LatestVersion()
+	case "to":
+		return migrateArg(args, "V"), nil
+	case "down":
+		steps := migrateArg(args, "N")
+		current, err := migrator.CurrentVersion()
+		if err != nil {
+			return 0, err
+		}
+		if steps < 1 || steps > current {
+			return 0, fmt.Errorf("can't revert %d migrations from version %d", steps, current)
+		}
+		return current - steps, nil
+	}
+	return 0, fmt.Errorf("unknown command %q, see zuul migrate --help", command)
+}
+
+func migrateArg(args []string, name string) int {
+	if len(args) < 2 {
+		log.Fatalf("usage: zuul migrate %s %s", args[0], name)
+	}
+	value, err := strconv.Atoi(args[1])
+	if err != nil {
+		log.Fatalf("%s must be a number: %v", name, err)
+	}
+	return value
+}
+
+func printMigrationStatus(migrator *persistence.Migrator) {
+	versions, failures, err := migrator.Status()
+	if err != nil {
+		log.Fatalf("Failed to get migration status: %v", err)
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "VERSION\tFILE\tAPPLIED\tREVERSIBLE")
+	for _, version := range versions {
+		applied := "pending"
+		if version.AppliedAt != nil {
+			applied = version.AppliedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(table, "%d\t%s\t%s\t%t\n", version.Version, version.Filename, applied, version.Reversible)
+	}
+	table.Flush()
+
+	for _, failure := range failures {
+		fmt.Printf("\nversion %d (%s %s) failed at %s after %d statements:\n  %s\n",
+			failure.Version, failure.Direction, failure.Filename, failure.FailedAt.Format(time.RFC3339), failure.StatementsApplied, failure.Error)
+	}
+}
+
+// warnPendingMigrations logs what the server is starting without, when it doesn't
+// migrate on its own
+func warnPendingMigrations(db *sql.DB) {
+	migrator, err := persistence.NewMigrator(db, 0)
+	if err != nil {
+		log.Printf("AUTO_MIGRATE=false; failed to check migrations: %v", err)
+		return
+	}
+	current, err := migrator.CurrentVersion()
+	if err != nil {
+		log.Printf("AUTO_MIGRATE=false; failed to check migrations: %v", err)
+		return
+	}
+	latest, err := migrator.LatestVersion()
+	if err != nil {
+		log.Printf("AUTO_MIGRATE=false; failed to check migrations: %v", err)
+		return
+	}
+	if current < latest {
+		log.Printf("AUTO_MIGRATE=false and the db is on version %d of %d; run `zuul migrate up`", current, latest)
+		return
+	}
+	log.Printf("AUTO_MIGRATE=false; db is on version %d", current)
+}
@@ -0,0 +1,157 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence/queries"
+)
+
+// UserExport is everything stored about a user, as handed to them on request
+type UserExport struct {
+	User        *UserActivity    `json:"user"`
+	Permissions []*OrgPermission `json:"permissions"`
+	Logins      []*LoginEvent    `json:"logins"`
+	// The keys' names and use; the public keys themselves are left out
+	SecurityKeys           []*SecurityKey `json:"security_keys"`
+	TOTPEnrolled           bool           `json:"totp_enrolled"`
+	RecoveryCodesRemaining int            `json:"recovery_codes_remaining"`
+	ExportedAt             time.Time      `json:"exported_at"`
+}
+
+type SecurityKey struct {
+	Name       string     `json:"name"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+// AccountTable exports and deletes a user's data across the tables holding it
+type AccountTable struct {
+	db *dialectDB
+}
+
+func NewAccountTable(db *sql.DB) *AccountTable {
+	return &AccountTable{db: newDialectDB(db)}
+}
+
+// ExportUser collects the user's data, returning sql.ErrNoRows if the user does not
+// exist. It is read in one transaction, so the parts agree with each other.
+func (at *AccountTable) ExportUser(ctx context.Context, id int32) (*UserExport, error) {
+	tx, err := at.db.BeginTx(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "error beginning transaction")
+	}
+	defer tx.Rollback()
+
+	user, err := scanUserActivity(tx.QueryRowContext(ctx, queries.GET_USER_ACTIVITY, id))
+	if err != nil {
+		return nil, err
+	}
+	export := &UserExport{User: user, ExportedAt: time.Now().UTC()}
+
+	rows, err := tx.QueryContext(ctx, queries.GET_USER_PERMISSIONS, id)
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting permissions")
+	}
+	if export.Permissions, err = scanPermissions(rows); err != nil {
+		return nil, errors.Wrap(err, "error reading permissions")
+	}
+
+	if export.Logins, err = exportLogins(ctx, tx, id); err != nil {
+		return nil, err
+	}
+	if export.SecurityKeys, err = exportSecurityKeys(ctx, tx, id); err != nil {
+		return nil, err
+	}
+
+	err = tx.QueryRowContext(ctx, queries.GET_SECOND_FACTOR_SUMMARY, id).Scan(&export.TOTPEnrolled, &export.RecoveryCodesRemaining)
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting second factors")
+	}
+	return export, nil
+}
+
+func exportLogins(ctx context.Context, tx *dialectTx, id int32) ([]*LoginEvent, error) {
+	rows, err := tx.QueryContext(ctx, queries.GET_LOGIN_EVENTS, id, math.MaxInt32)
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting login events")
+	}
+	defer rows.Close()
+
+	events := []*LoginEvent{}
+	for rows.Next() {
+		var event LoginEvent
+		if err := rows.Scan(&event.UserID, &event.At, &event.IP, &event.UserAgent, &event.Provider); err != nil {
+			return nil, errors.Wrap(err, "error reading login event")
+		}
+		events = append(events, &event)
+	}
+	return events, errors.Wrap(rows.Err(), "error reading login events")
+}
+
+func exportSecurityKeys(ctx context.Context, tx *dialectTx, id int32) ([]*SecurityKey, error) {
+	rows, err := tx.QueryContext(ctx, queries.GET_WEBAUTHN_CREDENTIALS, id)
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting webauthn credentials")
+	}
+	defer rows.Close()
+
+	keys := []*SecurityKey{}
+	for rows.Next() {
+		var key SecurityKey
+		var credentialID, credential []byte
+		var userID int32
+		var lastUsedAt sql.NullTime
+		if err := rows.Scan(&credentialID, &userID, &key.Name, &credential, &key.CreatedAt, &lastUsedAt); err != nil {
+			return nil, errors.Wrap(err, "error reading webauthn credential")
+		}
+		key.LastUsedAt = nullTime(lastUsedAt)
+		keys = append(keys, &key)
+	}
+	return keys, errors.Wrap(rows.Err(), "error reading webauthn credentials")
+}
+
+// DeleteUser erases the user's data, returning sql.ErrNoRows if the user does not
+// exist. Their permissions, second factors, login history and pending magic links are
+// deleted, and their tokens revoked. The user row is kept, anonymized and marked
+// deleted, so the id can't log in again and old tokens stay revoked.
+func (at *AccountTable) DeleteUser(ctx context.Context, id int32, reason string) error {
+	tx, err := at.db.BeginTx(ctx)
+	if err != nil {
+		return errors.Wrap(err, "error beginning transaction")
+	}
+	defer tx.Rollback()
+
+	var email string
+	if err = tx.QueryRowContext(ctx, queries.GET_USER_EMAIL_FOR_UPDATE, id).Scan(&email); err != nil {
+		return err
+	}
+
+	for _, query := range []string{
+		queries.DELETE_USER_PERMISSIONS,
+		queries.DELETE_TOTP_SECRET,
+		queries.DELETE_RECOVERY_CODES,
+		queries.DELETE_WEBAUTHN_CREDENTIALS_FOR_USER,
+		queries.DELETE_LOGIN_EVENTS,
+	} {
+		if _, err = tx.ExecContext(ctx, query, id); err != nil {
+			return errors.Wrap(err, "error deleting user data")
+		}
+	}
+	if email != "" {
+		if _, err = tx.ExecContext(ctx, queries.DELETE_MAGIC_LINKS_FOR_EMAIL, email); err != nil {
+			return errors.Wrap(err, "error deleting magic links")
+		}
+	}
+
+	placeholder := fmt.Sprintf("deleted-%d", id)
+	if _, err = tx.ExecContext(ctx, queries.ANONYMIZE_USER, id, placeholder, reason); err != nil {
+		return errors.Wrap(err, "error anonymizing user")
+	}
+	return errors.Wrap(tx.Commit(), "error committing transaction")
+}
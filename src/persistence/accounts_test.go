@@ -0,0 +1,97 @@
+package persistence_test
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence"
+)
+
+func TestAccountTable(t *testing.T) {
+	requirePostgres(t)
+	testAccountTable(t, testDB)
+}
+
+func TestSQLiteAccountTable(t *testing.T) {
+	testAccountTable(t, openSQLite(t))
+}
+
+func testAccountTable(t *testing.T, db *sql.DB) {
+	ctx := context.Background()
+	userTable := persistence.NewUserTable(db)
+	mfaTable := persistence.NewMFATable(db)
+	accountTable := persistence.NewAccountTable(db)
+
+	user := &persistence.UserInfo{ID: 60, LoginName: "leaving", AvatarURL: "https://github.com/l.png", Email: "leaving@example.com"}
+	require.NoError(t, userTable.UpdateUser(ctx, user))
+	deleteUsersOnCleanup(t, db, 60)
+	require.NoError(t, persistence.NewPermissionTable(db).GrantPermission(ctx, 60, "exported", "write"))
+	require.NoError(t, userTable.RecordLogin(ctx, &persistence.LoginEvent{UserID: 60, IP: "192.0.2.60", UserAgent: "browser", Provider: "github"}))
+	require.NoError(t, persistence.NewWebAuthnTable(db).AddCredential(ctx, &persistence.WebAuthnCredential{
+		ID: []byte("key"), UserID: 60, Name: "yubikey", Credential: []byte(`{"secret":"material"}`),
+	}))
+	_, err := mfaTable.SaveTOTPSecret(ctx, 60, []byte("secret"))
+	require.NoError(t, err)
+	_, err = mfaTable.UseTOTPStep(ctx, 60, 1)
+	require.NoError(t, err)
+	require.NoError(t, mfaTable.ReplaceRecoveryCodes(ctx, 60, [][]byte{[]byte("a"), []byte("b")}))
+	require.NoError(t, persistence.NewMagicLinkTable(db).AddMagicLink(ctx, &persistence.MagicLink{
+		TokenHash: []byte("leaving"), Email: "Leaving@example.com", ExpiresAt: time.Now().Add(time.Minute),
+	}))
+
+	t.Run("Test exporting a user", func(t *testing.T) {
+		export, err := accountTable.ExportUser(ctx, 60)
+		require.NoError(t, err, "Failed to export user")
+		assert.Equal(t, *user, export.User.UserInfo)
+		assert.Equal(t, persistence.UserStatusActive, export.User.Status)
+		assert.Equal(t, 1, export.User.LoginCount)
+		assert.Equal(t, []*persistence.OrgPermission{{UserID: 60, OrgID: "exported", Permission: "write"}}, export.Permissions)
+		require.Len(t, export.Logins, 1)
+		assert.Equal(t, "192.0.2.60", export.Logins[0].IP)
+		require.Len(t, export.SecurityKeys, 1)
+		assert.Equal(t, "yubikey", export.SecurityKeys[0].Name)
+		assert.True(t, export.TOTPEnrolled)
+		assert.Equal(t, 2, export.RecoveryCodesRemaining)
+
+		_, err = accountTable.ExportUser(ctx, 69)
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+	})
+
+	t.Run("Test deleting a user", func(t *testing.T) {
+		require.NoError(t, accountTable.DeleteUser(ctx, 60, "requested by user"), "Failed to delete user")
+
+		export, err := accountTable.ExportUser(ctx, 60)
+		require.NoError(t, err, "The anonymized user should remain")
+		assert.Equal(t, persistence.UserInfo{ID: 60, LoginName: "deleted-60", Email: "deleted-60"}, export.User.UserInfo)
+		assert.Equal(t, persistence.UserStatusDeleted, export.User.Status)
+		assert.Zero(t, export.User.LoginCount)
+		assert.Nil(t, export.User.LastLoginAt)
+		assert.Empty(t, export.Permissions)
+		assert.Empty(t, export.Logins)
+		assert.Empty(t, export.SecurityKeys)
+		assert.False(t, export.TOTPEnrolled)
+		assert.Zero(t, export.RecoveryCodesRemaining)
+
+		state, err := userTable.GetAuthState(ctx, 60)
+		require.NoError(t, err)
+		assert.NotNil(t, state.TokensNotBefore)
+		status, err := userTable.GetUserStatus(ctx, 60)
+		require.NoError(t, err)
+		assert.Equal(t, "requested by user", status.Reason)
+
+		_, err = persistence.NewMagicLinkTable(db).UseMagicLink(ctx, []byte("leaving"))
+		assert.ErrorIs(t, err, sql.ErrNoRows, "pending links should be deleted")
+
+		require.NoError(t, userTable.UpdateUser(ctx, user), "Logging in again should be harmless")
+		again, err := userTable.GetUserByID(ctx, 60)
+		require.NoError(t, err)
+		assert.Equal(t, "deleted-60", again.LoginName)
+
+		assert.ErrorIs(t, accountTable.DeleteUser(ctx, 69, ""), sql.ErrNoRows)
+	})
+}
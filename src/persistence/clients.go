@@ -0,0 +1,107 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence/queries"
+)
+
+// Client is a relying-party application that logs users in through Zuul
+type Client struct {
+	ClientID   string `json:"client_id"`
+	Name       string `json:"name"`
+	SecretHash []byte `json:"-"`
+	// Where users may be sent after logging in for the client
+	RedirectURIs []string `json:"redirect_uris"`
+	// Origins allowed to call Zuul cross-origin, in the forms CORS policies accept
+	AllowedOrigins []string `json:"allowed_origins"`
+	// Orgs (or org/teams) whose permissions the client's tokens may carry; empty allows all
+	AllowedScopes []string `json:"allowed_scopes"`
+	// Zero uses the default session lifetime
+	TokenLifetimeSeconds int32      `json:"token_lifetime_seconds"`
+	TokenPath            string     `json:"token_path"`
+	Audience             string     `json:"audience"`
+	CreatedAt            *time.Time `json:"created_at"`
+	UpdatedAt            *time.Time `json:"updated_at"`
+}
+
+type ClientTable struct {
+	db *dialectDB
+}
+
+func NewClientTable(db *sql.DB) *ClientTable {
+	return &ClientTable{db: newDialectDB(db)}
+}
+
+func (ct *ClientTable) GetClients(ctx context.Context) ([]*Client, error) {
+	rows, err := ct.db.QueryContext(ctx, queries.GET_CLIENTS)
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting clients")
+	}
+	defer rows.Close()
+
+	clients := []*Client{}
+	for rows.Next() {
+		var client Client
+		var createdAt, updatedAt sql.NullTime
+		err := rows.Scan(&client.ClientID, &client.Name, &client.SecretHash,
+			ct.db.dialect.array(&client.RedirectURIs), ct.db.dialect.array(&client.AllowedOrigins), ct.db.dialect.array(&client.AllowedScopes),
+			&client.TokenLifetimeSeconds, &client.TokenPath, &client.Audience, &createdAt, &updatedAt)
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading client")
+		}
+		if createdAt.Valid {
+			client.CreatedAt = &createdAt.Time
+		}
+		if updatedAt.Valid {
+			client.UpdatedAt = &updatedAt.Time
+		}
+		clients = append(clients, &client)
+	}
+	return clients, rows.Err()
+}
+
+// SaveClient creates or updates a client, leaving any secret it already has in place
+func (ct *ClientTable) SaveClient(ctx context.Context, client *Client) error {
+	_, err := ct.db.ExecContext(ctx, queries.SAVE_CLIENT, client.ClientID, client.Name,
+		ct.db.dialect.array(client.RedirectURIs), ct.db.dialect.array(client.AllowedOrigins), ct.db.dialect.array(client.AllowedScopes),
+		client.TokenLifetimeSeconds, client.TokenPath, client.Audience)
+	return errors.Wrap(err, "error saving client")
+}
+
+// SetClientSecret replaces the client's secret hash, returning sql.ErrNoRows if there is
+// no such client
+func (ct *ClientTable) SetClientSecret(ctx context.Context, clientID string, secretHash []byte) error {
+	result, err := ct.db.ExecContext(ctx, queries.SET_CLIENT_SECRET, clientID, secretHash)
+	if err != nil {
+		return errors.Wrap(err, "error setting client secret")
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteClient returns sql.ErrNoRows if there is no such client
+func (ct *ClientTable) DeleteClient(ctx context.Context, clientID string) error {
+	result, err := ct.db.ExecContext(ctx, queries.DELETE_CLIENT, clientID)
+	if err != nil {
+		return errors.Wrap(err, "error deleting client")
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
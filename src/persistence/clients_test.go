@@ -0,0 +1,55 @@
+package persistence_test
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientTable(t *testing.T) {
+	requirePostgres(t)
+	ctx := context.Background()
+	clientTable := persistence.NewClientTable(testDB)
+
+	t.Run("Test saving a client", func(t *testing.T) {
+		err := clientTable.SaveClient(ctx, &persistence.Client{
+			ClientID:             "resume",
+			Name:                 "Resume",
+			RedirectURIs:         []string{"https://resume.example.com/data"},
+			AllowedOrigins:       []string{"https://resume.example.com"},
+			AllowedScopes:        []string{"coopstools"},
+			TokenLifetimeSeconds: 600,
+			TokenPath:            "/",
+			Audience:             "resume",
+		})
+		require.NoError(t, err, "Failed to save client")
+
+		err = clientTable.SetClientSecret(ctx, "resume", []byte("hash"))
+		require.NoError(t, err, "Failed to set secret")
+
+		// Saving again keeps the secret
+		err = clientTable.SaveClient(ctx, &persistence.Client{ClientID: "resume", Name: "Resume site", TokenPath: "/"})
+		require.NoError(t, err, "Failed to update client")
+
+		clients, err := clientTable.GetClients(ctx)
+		require.NoError(t, err, "Failed to get clients")
+		require.Len(t, clients, 1)
+		assert.Equal(t, "Resume site", clients[0].Name)
+		assert.Equal(t, []byte("hash"), clients[0].SecretHash)
+		assert.Empty(t, clients[0].RedirectURIs)
+	})
+
+	t.Run("Test missing clients", func(t *testing.T) {
+		err := clientTable.SetClientSecret(ctx, "nobody", []byte("hash"))
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+
+		err = clientTable.DeleteClient(ctx, "resume")
+		require.NoError(t, err, "Failed to delete client")
+		err = clientTable.DeleteClient(ctx, "resume")
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+	})
+}
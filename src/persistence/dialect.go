@@ -0,0 +1,277 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/pkg/errors"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// Dialect is the SQL flavour of a db. Queries are written for Postgres and rewritten for
+// SQLite, which has its own migrations.
+type Dialect string
+
+const (
+	Postgres Dialect = "postgres"
+	SQLite   Dialect = "sqlite"
+)
+
+// PoolConfig sizes the Postgres connection pool. Zero values keep pgx's defaults.
+type PoolConfig struct {
+	MaxConns int32
+	// Idle connections are closed after this long
+	MaxConnIdleTime time.Duration
+	// How often idle connections are checked, so broken ones are replaced before use
+	HealthCheckPeriod time.Duration
+}
+
+// Open opens the db at the url, picking the backend from its scheme: postgres:// or
+// postgresql:// for Postgres, and sqlite://path or file:path for SQLite
+func Open(databaseURL string, pool PoolConfig) (*sql.DB, error) {
+	scheme, rest, _ := strings.Cut(databaseURL, ":")
+	switch strings.ToLower(scheme) {
+	case "postgres", "postgresql":
+		return openPostgres(databaseURL, pool)
+	case "sqlite", "file":
+		dsn, err := sqliteDSN(strings.TrimPrefix(rest, "//"))
+		if err != nil {
+			return nil, err
+		}
+		db, err := sql.Open("sqlite", dsn)
+		if err != nil {
+			return nil, err
+		}
+		// SQLite takes one writer at a time, and each connection to :memory: is its own db
+		db.SetMaxOpenConns(1)
+		return db, nil
+	}
+	return nil, errors.Errorf("DATABASE_URL should start with postgres://, postgresql://, sqlite:// or file:, not %q", scheme)
+}
+
+// openPostgres connects through a pgx pool. pgx prepares each query once per connection
+// and caches the statement, unless the url sets another default_query_exec_mode (e.g.
+// simple_protocol behind a transaction pooling pgbouncer).
+func openPostgres(databaseURL string, poolConfig PoolConfig) (*sql.DB, error) {
+	config, err := pgxpool.ParseConfig(databaseURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid DATABASE_URL")
+	}
+	if poolConfig.MaxConns > 0 {
+		config.MaxConns = poolConfig.MaxConns
+	}
+	if poolConfig.MaxConnIdleTime > 0 {
+		config.MaxConnIdleTime = poolConfig.MaxConnIdleTime
+	}
+	if poolConfig.HealthCheckPeriod > 0 {
+		config.HealthCheckPeriod = poolConfig.HealthCheckPeriod
+	}
+	pool, err := pgxpool.NewWithConfig(context.Background(), config)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating connection pool")
+	}
+
+	db := sql.OpenDB(poolConnector{Connector: stdlib.GetPoolConnector(pool), pool: pool})
+	// Idle connections stay in the pool, where the health check sees them
+	db.SetMaxIdleConns(0)
+	return db, nil
+}
+
+// poolConnector closes the pool along with the sql.DB
+type poolConnector struct {
+	driver.Connector
+	pool *pgxpool.Pool
+}
+
+func (c poolConnector) Close() error {
+	c.pool.Close()
+	return nil
+}
+
+// sqliteDSN enforces foreign keys, like Postgres, stores times in a format that compares
+// correctly with CURRENT_TIMESTAMP, and uses a write-ahead log
+func sqliteDSN(path string) (string, error) {
+	path, query, _ := strings.Cut(path, "?")
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return "", errors.Wrap(err, "invalid sqlite parameters")
+	}
+	params.Add("_pragma", "foreign_keys(1)")
+	params.Add("_pragma", "busy_timeout(5000)")
+	// Every login writes, and WAL commits without syncing the whole journal each time
+	params.Add("_pragma", "journal_mode(WAL)")
+	params.Add("_pragma", "synchronous(NORMAL)")
+	params.Set("_time_format", "sqlite")
+	return "file:" + path + "?" + params.Encode(), nil
+}
+
+// DialectOf reports which backend the db was opened for
+func DialectOf(db *sql.DB) Dialect {
+	if _, ok := db.Driver().(*sqlite.Driver); ok {
+		return SQLite
+	}
+	return Postgres
+}
+
+// The Postgres features used by the queries, and their SQLite equivalents. Arrays are
+// passed to SQLite as json.
+var sqliteRewrites = strings.NewReplacer(
+	"NOW() - INTERVAL '1 day'", "datetime('now', '-1 day')",
+	"NOW()", "CURRENT_TIMESTAMP",
+	"= ANY($1)", "IN (SELECT value FROM json_each($1))",
+	"nextval('email_user_ids')", "(SELECT next_id FROM email_user_ids)",
+	// Transactions take the whole db anyway
+	"FOR UPDATE", "",
+)
+
+// query rewrites a Postgres query for the dialect
+func (d Dialect) query(query string) string {
+	if d == SQLite {
+		return sqliteRewrites.Replace(query)
+	}
+	return query
+}
+
+// args converts times to UTC on SQLite, which compares times as text
+func (d Dialect) args(args []any) []any {
+	if d != SQLite {
+		return args
+	}
+	for i, arg := range args {
+		if t, ok := arg.(time.Time); ok {
+			args[i] = t.UTC()
+		}
+	}
+	return args
+}
+
+// array wraps a slice, or a pointer to one, so it can be passed to or scanned from a query
+func (d Dialect) array(a any) interface {
+	driver.Valuer
+	sql.Scanner
+} {
+	if d == SQLite {
+		return jsonArray{a}
+	}
+	return pgArray{a}
+}
+
+// isForeignKeyViolation matches Postgres' foreign_key_violation code, or SQLite's equivalent
+func (d Dialect) isForeignKeyViolation(err error) bool {
+	if d == SQLite {
+		var sqliteErr *sqlite.Error
+		return errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_FOREIGNKEY
+	}
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23503"
+}
+
+// isUndefinedTable matches Postgres' undefined_table code, or SQLite's equivalent
+func (d Dialect) isUndefinedTable(err error) bool {
+	if d == SQLite {
+		var sqliteErr *sqlite.Error
+		return errors.As(err, &sqliteErr) && strings.Contains(sqliteErr.Error(), "no such table")
+	}
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "42P01"
+}
+
+// pgArray passes slices straight to pgx, which encodes them as arrays, and decodes the
+// text form database/sql gets for array columns
+type pgArray struct {
+	a any
+}
+
+func (p pgArray) Value() (driver.Value, error) {
+	return p.a, nil
+}
+
+func (p pgArray) Scan(src any) error {
+	// Maps cache scan plans, so they aren't shared between goroutines
+	return pgtype.NewMap().SQLScanner(p.a).Scan(src)
+}
+
+// jsonArray stores a slice as a json array in a text column
+type jsonArray struct {
+	a any
+}
+
+func (j jsonArray) Value() (driver.Value, error) {
+	encoded, err := json.Marshal(j.a)
+	return string(encoded), err
+}
+
+func (j jsonArray) Scan(src any) error {
+	switch src := src.(type) {
+	case string:
+		return json.Unmarshal([]byte(src), j.a)
+	case []byte:
+		return json.Unmarshal(src, j.a)
+	}
+	return errors.Errorf("cannot scan %T into an array", src)
+}
+
+// dialectDB runs queries written for Postgres against a db of either dialect
+type dialectDB struct {
+	db      *sql.DB
+	dialect Dialect
+}
+
+func newDialectDB(db *sql.DB) *dialectDB {
+	return &dialectDB{db: db, dialect: DialectOf(db)}
+}
+
+func (d *dialectDB) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return d.db.ExecContext(ctx, d.dialect.query(query), d.dialect.args(args)...)
+}
+
+func (d *dialectDB) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	return d.db.QueryContext(ctx, d.dialect.query(query), d.dialect.args(args)...)
+}
+
+func (d *dialectDB) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	return d.db.QueryRowContext(ctx, d.dialect.query(query), d.dialect.args(args)...)
+}
+
+func (d *dialectDB) BeginTx(ctx context.Context) (*dialectTx, error) {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &dialectTx{tx: tx, dialect: d.dialect}, nil
+}
+
+type dialectTx struct {
+	tx      *sql.Tx
+	dialect Dialect
+}
+
+func (t *dialectTx) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return t.tx.ExecContext(ctx, t.dialect.query(query), t.dialect.args(args)...)
+}
+
+func (t *dialectTx) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	return t.tx.QueryContext(ctx, t.dialect.query(query), t.dialect.args(args)...)
+}
+
+func (t *dialectTx) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	return t.tx.QueryRowContext(ctx, t.dialect.query(query), t.dialect.args(args)...)
+}
+
+func (t *dialectTx) Commit() error {
+	return t.tx.Commit()
+}
+
+func (t *dialectTx) Rollback() error {
+	return t.tx.Rollback()
+}
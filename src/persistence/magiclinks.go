@@ -0,0 +1,52 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence/queries"
+)
+
+// MagicLink is a pending email login, along with the client login it completes
+type MagicLink struct {
+	TokenHash   []byte
+	Email       string
+	ClientID    string
+	RedirectURI string
+	Scopes      []string
+	ExpiresAt   time.Time
+}
+
+type MagicLinkTable struct {
+	db *dialectDB
+}
+
+func NewMagicLinkTable(db *sql.DB) *MagicLinkTable {
+	return &MagicLinkTable{db: newDialectDB(db)}
+}
+
+// AddMagicLink stores the link, clearing out links that expired a while ago
+func (mt *MagicLinkTable) AddMagicLink(ctx context.Context, link *MagicLink) error {
+	if _, err := mt.db.ExecContext(ctx, queries.DELETE_EXPIRED_MAGIC_LINKS); err != nil {
+		return errors.Wrap(err, "error deleting expired magic links")
+	}
+	_, err := mt.db.ExecContext(ctx, queries.ADD_MAGIC_LINK, link.TokenHash, link.Email, link.ClientID, link.RedirectURI, mt.db.dialect.array(link.Scopes), link.ExpiresAt)
+	return errors.Wrap(err, "error adding magic link")
+}
+
+// UseMagicLink marks the link used and returns it, or returns sql.ErrNoRows if there is
+// no such link or it was used or has expired
+func (mt *MagicLinkTable) UseMagicLink(ctx context.Context, tokenHash []byte) (*MagicLink, error) {
+	link := MagicLink{TokenHash: tokenHash}
+	err := mt.db.QueryRowContext(ctx, queries.USE_MAGIC_LINK, tokenHash).Scan(&link.Email, &link.ClientID, &link.RedirectURI, mt.db.dialect.array(&link.Scopes), &link.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, err
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "error using magic link")
+	}
+	return &link, nil
+}
@@ -0,0 +1,63 @@
+package persistence_test
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMagicLinkTable(t *testing.T) {
+	requirePostgres(t)
+	ctx := context.Background()
+	linkTable := persistence.NewMagicLinkTable(testDB)
+	userTable := persistence.NewUserTable(testDB)
+
+	t.Run("Test a link is used once", func(t *testing.T) {
+		err := linkTable.AddMagicLink(ctx, &persistence.MagicLink{
+			TokenHash:   []byte("hash"),
+			Email:       "reviewer@example.com",
+			RedirectURI: "https://ui.example.com",
+			Scopes:      []string{"guest"},
+			ExpiresAt:   time.Now().Add(time.Minute),
+		})
+		require.NoError(t, err, "Failed to add link")
+
+		link, err := linkTable.UseMagicLink(ctx, []byte("hash"))
+		require.NoError(t, err, "Failed to use link")
+		assert.Equal(t, "reviewer@example.com", link.Email)
+		assert.Equal(t, []string{"guest"}, link.Scopes)
+
+		_, err = linkTable.UseMagicLink(ctx, []byte("hash"))
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+	})
+
+	t.Run("Test an expired link is refused", func(t *testing.T) {
+		err := linkTable.AddMagicLink(ctx, &persistence.MagicLink{
+			TokenHash:   []byte("old"),
+			Email:       "reviewer@example.com",
+			RedirectURI: "https://ui.example.com",
+			ExpiresAt:   time.Now().Add(-time.Minute),
+		})
+		require.NoError(t, err, "Failed to add link")
+
+		_, err = linkTable.UseMagicLink(ctx, []byte("old"))
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+	})
+
+	t.Run("Test email users are added once", func(t *testing.T) {
+		deleteEmailUserOnCleanup(t, testDB, "reviewer@example.com")
+		user, err := userTable.GetOrAddEmailUser(ctx, "reviewer@example.com")
+		require.NoError(t, err, "Failed to add email user")
+		assert.Less(t, user.ID, int32(0))
+		assert.Equal(t, "reviewer@example.com", user.LoginName)
+
+		again, err := userTable.GetOrAddEmailUser(ctx, "reviewer@example.com")
+		require.NoError(t, err, "Failed to get email user")
+		assert.Equal(t, user.ID, again.ID)
+	})
+}
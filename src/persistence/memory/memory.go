@@ -0,0 +1,328 @@
+// Package memory keeps users and permissions in memory, behaving like the Postgres
+// tables, for tests and throwaway local runs
+package memory
+
+import (
+	"context"
+	"database/sql"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence"
+)
+
+type user struct {
+	info        persistence.UserInfo
+	provider    string
+	auth        persistence.AuthState
+	status      persistence.UserStatus
+	createdAt   time.Time
+	updatedAt   time.Time
+	lastLoginAt *time.Time
+	loginCount  int
+	// Oldest first
+	logins []*persistence.LoginEvent
+}
+
+// Store implements both persistence.UserStore and persistence.PermissionStore, since
+// grants refer to users
+type Store struct {
+	mu          sync.Mutex
+	users       map[int32]*user
+	permissions map[int32]map[string]string
+	// Email users count down from -1, like the email_user_ids sequence
+	nextEmailID int32
+}
+
+var (
+	_ persistence.UserStore       = (*Store)(nil)
+	_ persistence.PermissionStore = (*Store)(nil)
+)
+
+func NewStore() *Store {
+	return &Store{
+		users:       map[int32]*user{},
+		permissions: map[int32]map[string]string{},
+		nextEmailID: -1,
+	}
+}
+
+func (s *Store) UpdateUser(ctx context.Context, info *persistence.UserInfo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.users[info.ID]; ok {
+		// Deleted users keep their anonymized profile
+		if existing.info != *info && existing.status.Status != persistence.UserStatusDeleted {
+			existing.info = *info
+			existing.updatedAt = time.Now()
+		}
+		return nil
+	}
+	s.users[info.ID] = newUser(*info, "github")
+	return nil
+}
+
+func newUser(info persistence.UserInfo, provider string) *user {
+	now := time.Now()
+	return &user{
+		info:      info,
+		provider:  provider,
+		auth:      persistence.AuthState{Status: persistence.UserStatusActive},
+		status:    persistence.UserStatus{Status: persistence.UserStatusActive},
+		createdAt: now,
+		updatedAt: now,
+	}
+}
+
+func (s *Store) GetUserByID(ctx context.Context, id int32) (*persistence.UserInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, ok := s.users[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	info := existing.info
+	return &info, nil
+}
+
+func (s *Store) GetOrAddEmailUser(ctx context.Context, email string) (*persistence.UserInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.users {
+		if existing.provider == "email" && strings.EqualFold(existing.info.Email, email) {
+			info := existing.info
+			return &info, nil
+		}
+	}
+	info := persistence.UserInfo{ID: s.nextEmailID, LoginName: email, Email: email}
+	s.nextEmailID--
+	s.users[info.ID] = newUser(info, "email")
+	return &info, nil
+}
+
+// GetAllUsers returns the users ordered by id
+func (s *Store) GetAllUsers(ctx context.Context) ([]*persistence.UserInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	users := []*persistence.UserInfo{}
+	for _, existing := range s.users {
+		info := existing.info
+		users = append(users, &info)
+	}
+	slices.SortFunc(users, func(a, b *persistence.UserInfo) int { return int(a.ID) - int(b.ID) })
+	return users, nil
+}
+
+func (s *Store) GetAuthState(ctx context.Context, id int32) (*persistence.AuthState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, ok := s.users[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	state := existing.auth
+	return &state, nil
+}
+
+func (s *Store) GetUserStatus(ctx context.Context, id int32) (*persistence.UserStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, ok := s.users[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	status := existing.status
+	return &status, nil
+}
+
+func (s *Store) SetUserStatus(ctx context.Context, id int32, status, reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, ok := s.users[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	now := time.Now()
+	existing.status = persistence.UserStatus{Status: status, Reason: reason, ChangedAt: &now}
+	existing.auth.Status = status
+	if status != persistence.UserStatusActive {
+		s.revokeTokens(id)
+	}
+	return nil
+}
+
+func (s *Store) RecordLogin(ctx context.Context, event *persistence.LoginEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, ok := s.users[event.UserID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	recorded := *event
+	recorded.At = time.Now()
+	existing.lastLoginAt = &recorded.At
+	existing.loginCount++
+	existing.logins = append(existing.logins, &recorded)
+	return nil
+}
+
+// GetLoginEvents returns the user's most recent logins, newest first
+func (s *Store) GetLoginEvents(ctx context.Context, userID int32, limit int) ([]*persistence.LoginEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	events := []*persistence.LoginEvent{}
+	if existing, ok := s.users[userID]; ok {
+		for i := len(existing.logins) - 1; i >= 0 && len(events) < limit; i-- {
+			event := *existing.logins[i]
+			events = append(events, &event)
+		}
+	}
+	return events, nil
+}
+
+// GetInactiveUsers returns the users who haven't logged in since the time, those who
+// never logged in first
+func (s *Store) GetInactiveUsers(ctx context.Context, since time.Time) ([]*persistence.UserActivity, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	users := []*persistence.UserActivity{}
+	for _, existing := range s.users {
+		lastActive := existing.createdAt
+		if existing.lastLoginAt != nil {
+			lastActive = *existing.lastLoginAt
+		}
+		if !lastActive.Before(since) {
+			continue
+		}
+		createdAt, updatedAt := existing.createdAt, existing.updatedAt
+		activity := &persistence.UserActivity{
+			UserInfo:   existing.info,
+			Provider:   existing.provider,
+			Status:     existing.status.Status,
+			CreatedAt:  &createdAt,
+			UpdatedAt:  &updatedAt,
+			LoginCount: existing.loginCount,
+		}
+		if existing.lastLoginAt != nil {
+			lastLoginAt := *existing.lastLoginAt
+			activity.LastLoginAt = &lastLoginAt
+		}
+		users = append(users, activity)
+	}
+	slices.SortFunc(users, func(a, b *persistence.UserActivity) int {
+		switch {
+		case a.LastLoginAt == nil && b.LastLoginAt == nil:
+			return int(a.ID) - int(b.ID)
+		case a.LastLoginAt == nil:
+			return -1
+		case b.LastLoginAt == nil:
+			return 1
+		}
+		if c := a.LastLoginAt.Compare(*b.LastLoginAt); c != 0 {
+			return c
+		}
+		return int(a.ID) - int(b.ID)
+	})
+	return users, nil
+}
+
+// revokeTokens must be called with the lock held
+func (s *Store) revokeTokens(id int32) {
+	if existing, ok := s.users[id]; ok {
+		// Kept to the second, like a token's iat
+		now := time.Now().Truncate(time.Second)
+		existing.auth.TokensNotBefore = &now
+	}
+}
+
+// permissionsFor lists a user's grants ordered by org; the lock must be held
+func (s *Store) permissionsFor(userID int32) []*persistence.OrgPermission {
+	permissions := []*persistence.OrgPermission{}
+	for orgID, permission := range s.permissions[userID] {
+		permissions = append(permissions, &persistence.OrgPermission{UserID: userID, OrgID: orgID, Permission: permission})
+	}
+	slices.SortFunc(permissions, func(a, b *persistence.OrgPermission) int { return strings.Compare(a.OrgID, b.OrgID) })
+	return permissions
+}
+
+func (s *Store) GetUserPermissions(ctx context.Context, userID int32) ([]*persistence.OrgPermission, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.permissionsFor(userID), nil
+}
+
+// GetOrgPermissions lists every grant on the org, ordered by user id
+func (s *Store) GetOrgPermissions(ctx context.Context, orgID string) ([]*persistence.OrgPermission, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	permissions := []*persistence.OrgPermission{}
+	for userID, grants := range s.permissions {
+		if permission, ok := grants[orgID]; ok {
+			permissions = append(permissions, &persistence.OrgPermission{UserID: userID, OrgID: orgID, Permission: permission})
+		}
+	}
+	slices.SortFunc(permissions, func(a, b *persistence.OrgPermission) int { return int(a.UserID) - int(b.UserID) })
+	return permissions, nil
+}
+
+func (s *Store) GetPermissionsForUsers(ctx context.Context, userIDs []int32) ([]*persistence.UserPermission, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	permissions := []*persistence.UserPermission{}
+	for _, userID := range userIDs {
+		existing, ok := s.users[userID]
+		if !ok {
+			continue
+		}
+		for _, permission := range s.permissionsFor(userID) {
+			permissions = append(permissions, &persistence.UserPermission{OrgPermission: *permission, LoginName: existing.info.LoginName})
+		}
+	}
+	return permissions, nil
+}
+
+func (s *Store) GrantPermission(ctx context.Context, userID int32, orgID, permission string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[userID]; !ok {
+		return sql.ErrNoRows
+	}
+	grants, ok := s.permissions[userID]
+	if !ok {
+		grants = map[string]string{}
+		s.permissions[userID] = grants
+	}
+	if previous, ok := grants[orgID]; ok && previous != permission {
+		s.revokeTokens(userID)
+	}
+	grants[orgID] = permission
+	return nil
+}
+
+func (s *Store) RevokePermission(ctx context.Context, userID int32, orgID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.permissions[userID][orgID]; !ok {
+		return sql.ErrNoRows
+	}
+	delete(s.permissions[userID], orgID)
+	s.revokeTokens(userID)
+	return nil
+}
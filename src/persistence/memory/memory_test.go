@@ -0,0 +1,13 @@
+package memory_test
+
+import (
+	"testing"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence/memory"
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence/storetest"
+)
+
+func TestMemoryStore(t *testing.T) {
+	store := memory.NewStore()
+	storetest.Run(t, store, store)
+}
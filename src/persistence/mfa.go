@@ -0,0 +1,144 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/pkg/errors"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence/queries"
+)
+
+// TOTPSecret is a user's encrypted totp secret
+type TOTPSecret struct {
+	UserID    int32
+	Secret    []byte
+	Confirmed bool
+	// The time step of the last accepted code
+	LastUsedStep int64
+}
+
+// MFATable stores second factors other than WebAuthn credentials, and answers questions
+// about all of a user's second factors
+type MFATable struct {
+	db *dialectDB
+}
+
+func NewMFATable(db *sql.DB) *MFATable {
+	return &MFATable{db: newDialectDB(db)}
+}
+
+// SaveTOTPSecret stores an unconfirmed secret, replacing any earlier unconfirmed one. It
+// returns false if the user already has a confirmed secret.
+func (mt *MFATable) SaveTOTPSecret(ctx context.Context, userID int32, secret []byte) (bool, error) {
+	result, err := mt.db.ExecContext(ctx, queries.SAVE_TOTP_SECRET, userID, secret)
+	if err != nil {
+		return false, errors.Wrap(err, "error saving totp secret")
+	}
+	saved, err := result.RowsAffected()
+	if err != nil {
+		return false, errors.Wrap(err, "error checking saved totp secret")
+	}
+	return saved > 0, nil
+}
+
+// GetTOTPSecret returns sql.ErrNoRows if the user has no secret
+func (mt *MFATable) GetTOTPSecret(ctx context.Context, userID int32) (*TOTPSecret, error) {
+	var secret TOTPSecret
+	err := mt.db.QueryRowContext(ctx, queries.GET_TOTP_SECRET, userID).Scan(&secret.UserID, &secret.Secret, &secret.Confirmed, &secret.LastUsedStep)
+	if err != nil {
+		return nil, err
+	}
+	return &secret, nil
+}
+
+// UseTOTPStep records that a code for the time step was accepted, confirming the secret.
+// It returns false if a code for this or a later step was already used.
+func (mt *MFATable) UseTOTPStep(ctx context.Context, userID int32, step int64) (bool, error) {
+	result, err := mt.db.ExecContext(ctx, queries.USE_TOTP_STEP, userID, step)
+	if err != nil {
+		return false, errors.Wrap(err, "error using totp step")
+	}
+	used, err := result.RowsAffected()
+	if err != nil {
+		return false, errors.Wrap(err, "error checking totp step")
+	}
+	return used > 0, nil
+}
+
+// DeleteTOTPSecret removes the user's secret along with their recovery codes
+func (mt *MFATable) DeleteTOTPSecret(ctx context.Context, userID int32) error {
+	tx, err := mt.db.BeginTx(ctx)
+	if err != nil {
+		return errors.Wrap(err, "error beginning transaction")
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.ExecContext(ctx, queries.DELETE_TOTP_SECRET, userID); err != nil {
+		return errors.Wrap(err, "error deleting totp secret")
+	}
+	if _, err = tx.ExecContext(ctx, queries.DELETE_RECOVERY_CODES, userID); err != nil {
+		return errors.Wrap(err, "error deleting recovery codes")
+	}
+	return errors.Wrap(tx.Commit(), "error committing transaction")
+}
+
+// ReplaceRecoveryCodes swaps the user's recovery codes for the given hashes
+func (mt *MFATable) ReplaceRecoveryCodes(ctx context.Context, userID int32, codeHashes [][]byte) error {
+	tx, err := mt.db.BeginTx(ctx)
+	if err != nil {
+		return errors.Wrap(err, "error beginning transaction")
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.ExecContext(ctx, queries.DELETE_RECOVERY_CODES, userID); err != nil {
+		return errors.Wrap(err, "error deleting recovery codes")
+	}
+	for _, hash := range codeHashes {
+		if _, err = tx.ExecContext(ctx, queries.ADD_RECOVERY_CODE, userID, hash); err != nil {
+			return errors.Wrap(err, "error adding recovery code")
+		}
+	}
+	return errors.Wrap(tx.Commit(), "error committing transaction")
+}
+
+// UseRecoveryCode marks the code as used, returning false if it is unknown or was
+// already used
+func (mt *MFATable) UseRecoveryCode(ctx context.Context, userID int32, codeHash []byte) (bool, error) {
+	result, err := mt.db.ExecContext(ctx, queries.USE_RECOVERY_CODE, userID, codeHash)
+	if err != nil {
+		return false, errors.Wrap(err, "error using recovery code")
+	}
+	used, err := result.RowsAffected()
+	if err != nil {
+		return false, errors.Wrap(err, "error checking recovery code")
+	}
+	return used > 0, nil
+}
+
+// HasSecondFactor reports whether the user has a confirmed totp secret or a WebAuthn credential
+func (mt *MFATable) HasSecondFactor(ctx context.Context, userID int32) (bool, error) {
+	var enrolled bool
+	err := mt.db.QueryRowContext(ctx, queries.HAS_SECOND_FACTOR, userID).Scan(&enrolled)
+	return enrolled, errors.Wrap(err, "error checking second factors")
+}
+
+// ResetSecondFactors removes all of the user's second factors and invalidates their
+// tokens, so sessions that used a removed factor end too
+func (mt *MFATable) ResetSecondFactors(ctx context.Context, userID int32) error {
+	tx, err := mt.db.BeginTx(ctx)
+	if err != nil {
+		return errors.Wrap(err, "error beginning transaction")
+	}
+	defer tx.Rollback()
+
+	for _, query := range []string{queries.DELETE_TOTP_SECRET, queries.DELETE_RECOVERY_CODES, queries.DELETE_WEBAUTHN_CREDENTIALS_FOR_USER} {
+		if _, err = tx.ExecContext(ctx, query, userID); err != nil {
+			return errors.Wrap(err, "error deleting second factors")
+		}
+	}
+	if _, err = tx.ExecContext(ctx, queries.REVOKE_USER_TOKENS, mt.db.dialect.array([]int32{userID})); err != nil {
+		return errors.Wrap(err, "error revoking user tokens")
+	}
+	return errors.Wrap(tx.Commit(), "error committing transaction")
+}
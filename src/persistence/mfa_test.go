@@ -0,0 +1,104 @@
+package persistence_test
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMFATable(t *testing.T) {
+	requirePostgres(t)
+	ctx := context.Background()
+	userTable := persistence.NewUserTable(testDB)
+	mfaTable := persistence.NewMFATable(testDB)
+
+	addTestUser(t, testDB, &persistence.UserInfo{ID: 36, LoginName: "careful", AvatarURL: "", Email: ""})
+
+	t.Run("Test enrolling totp", func(t *testing.T) {
+		saved, err := mfaTable.SaveTOTPSecret(ctx, 36, []byte("first"))
+		require.NoError(t, err, "Failed to save secret")
+		assert.True(t, saved)
+
+		enrolled, err := mfaTable.HasSecondFactor(ctx, 36)
+		require.NoError(t, err)
+		assert.False(t, enrolled, "Unconfirmed secrets are not a second factor")
+
+		used, err := mfaTable.UseTOTPStep(ctx, 36, 100)
+		require.NoError(t, err, "Failed to use step")
+		assert.True(t, used)
+
+		enrolled, err = mfaTable.HasSecondFactor(ctx, 36)
+		require.NoError(t, err)
+		assert.True(t, enrolled)
+	})
+
+	t.Run("Test a confirmed secret is not replaced", func(t *testing.T) {
+		saved, err := mfaTable.SaveTOTPSecret(ctx, 36, []byte("second"))
+		require.NoError(t, err, "Failed to save secret")
+		assert.False(t, saved)
+
+		secret, err := mfaTable.GetTOTPSecret(ctx, 36)
+		require.NoError(t, err, "Failed to get secret")
+		assert.Equal(t, []byte("first"), secret.Secret)
+		assert.True(t, secret.Confirmed)
+	})
+
+	t.Run("Test a time step is only used once", func(t *testing.T) {
+		used, err := mfaTable.UseTOTPStep(ctx, 36, 100)
+		require.NoError(t, err)
+		assert.False(t, used)
+	})
+
+	t.Run("Test recovery codes are used once", func(t *testing.T) {
+		err := mfaTable.ReplaceRecoveryCodes(ctx, 36, [][]byte{[]byte("a"), []byte("b")})
+		require.NoError(t, err, "Failed to add codes")
+
+		used, err := mfaTable.UseRecoveryCode(ctx, 36, []byte("a"))
+		require.NoError(t, err)
+		assert.True(t, used)
+		used, err = mfaTable.UseRecoveryCode(ctx, 36, []byte("a"))
+		require.NoError(t, err)
+		assert.False(t, used)
+	})
+
+	t.Run("Test resetting second factors", func(t *testing.T) {
+		err := mfaTable.ResetSecondFactors(ctx, 36)
+		require.NoError(t, err, "Failed to reset")
+
+		_, err = mfaTable.GetTOTPSecret(ctx, 36)
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+		used, err := mfaTable.UseRecoveryCode(ctx, 36, []byte("b"))
+		require.NoError(t, err)
+		assert.False(t, used)
+
+		state, err := userTable.GetAuthState(ctx, 36)
+		require.NoError(t, err)
+		assert.NotNil(t, state.TokensNotBefore)
+	})
+}
+
+func TestOrgPolicyTable(t *testing.T) {
+	requirePostgres(t)
+	ctx := context.Background()
+	orgPolicyTable := persistence.NewOrgPolicyTable(testDB)
+
+	policy, err := orgPolicyTable.GetOrgPolicy(ctx, "relaxed")
+	require.NoError(t, err, "Failed to get default policy")
+	assert.False(t, policy.Require2FA)
+
+	err = orgPolicyTable.SetOrgPolicy(ctx, &persistence.OrgPolicy{OrgID: "strict", Require2FA: true})
+	require.NoError(t, err, "Failed to set policy")
+
+	policy, err = orgPolicyTable.GetOrgPolicy(ctx, "strict")
+	require.NoError(t, err, "Failed to get policy")
+	assert.True(t, policy.Require2FA)
+	assert.NotNil(t, policy.UpdatedAt)
+
+	orgIDs, err := orgPolicyTable.GetOrgsRequiring2FA(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"strict"}, orgIDs)
+}
@@ -1,10 +1,17 @@
 package persistence
 
 import (
+	"context"
+	"crypto/sha256"
 	"database/sql"
+	"database/sql/driver"
 	"embed"
+	"encoding/hex"
+	"fmt"
 	"io"
 	"log"
+	"path"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -14,112 +21,531 @@ import (
 	"github.com/coopstools-homebrew/I-am-zuul/src/persistence/queries"
 )
 
-//go:embed migrations/*.sql
+//go:embed migrations/*.sql migrations/sqlite/*.sql
 var migrations embed.FS
 
-// Migrator handles database migrations
+// ErrIrreversible is returned when reverting a migration that has no down script,
+// unless the revert is forced
+var ErrIrreversible = fmt.Errorf("migration is irreversible")
+
+// ErrMigrationMismatch is returned when migrations applied to the db no longer match the
+// embedded files, e.g. because an applied file was edited or removed
+var ErrMigrationMismatch = fmt.Errorf("applied migrations do not match the migration files")
+
+// ErrMigrationLockTimeout is returned when another process held the migration lock for
+// longer than the migrator was willing to wait
+var ErrMigrationLockTimeout = fmt.Errorf("timed out waiting for the migration lock")
+
+const (
+	// Arbitrary, but shared by every Zuul process migrating the same db
+	migrationLockKey    int64 = 0x7a75756c
+	lockPollInterval          = 500 * time.Millisecond
+	lockWaitLogInterval       = 10 * time.Second
+)
+
+// ErrPartialMigration is returned while a migration run outside a transaction has
+// stopped part way. Its completed statements remain applied, so the db has to be fixed by
+// hand and the failure cleared before migrating again.
+var ErrPartialMigration = fmt.Errorf("a migration was partially applied")
+
+// A line marking a script that can't run in a transaction, e.g. for CREATE INDEX
+// CONCURRENTLY. Its statements run one at a time, so it should be safe to rerun.
+const noTransactionDirective = "-- zuul:no-transaction --"
+
+var migrationName = regexp.MustCompile(`^(\d+)_\w+\.(up|down)\.sql$`)
+
+// migration holds the scripts for one version. Down is empty for migrations that can't
+// be reverted.
+type migration struct {
+	Name     string
+	Up       string
+	Down     string
+	Checksum string
+}
+
+// MigrationFailure records where a migration stopped
+type MigrationFailure struct {
+	Version   int    `json:"version"`
+	Direction string `json:"direction"`
+	Filename  string `json:"filename"`
+	// Statements of a script run outside a transaction that completed before the failure
+	StatementsApplied int       `json:"statements_applied"`
+	Error             string    `json:"error"`
+	FailedAt          time.Time `json:"failed_at"`
+}
+
+// Migrator handles database migrations, using the migrations for the db's dialect.
+// Migrators in different processes take turns through a Postgres advisory lock, so only
+// one migrates at a time; SQLite dbs are expected to belong to a single process.
 type Migrator struct {
-	db *sql.DB
+	db          *sql.DB
+	dialect     Dialect
+	lockTimeout time.Duration
 }
 
-// NewMigrator creates a new Migrator instance
-func NewMigrator(db *sql.DB) (*Migrator, error) {
-	return &Migrator{db: db}, nil
+// NewMigrator creates a new Migrator instance that waits up to lockTimeout for other
+// processes to finish migrating
+func NewMigrator(db *sql.DB, lockTimeout time.Duration) (*Migrator, error) {
+	return &Migrator{db: db, dialect: DialectOf(db), lockTimeout: lockTimeout}, nil
 }
 
-// getMigrations returns the ordered list of migration script filenames
-func (m *Migrator) getMigrations() ([]string, error) {
-	entries, err := migrations.ReadDir("migrations")
+// migrationsDir is where the embedded migrations for the db's dialect are
+func (m *Migrator) migrationsDir() string {
+	if m.dialect == SQLite {
+		return "migrations/sqlite"
+	}
+	return "migrations"
+}
+
+// lock takes the migration lock on a dedicated connection, polling until the timeout.
+// Closing the returned connection without unlocking would leave the lock held, so use
+// unlock.
+func (m *Migrator) lock(ctx context.Context) (*sql.Conn, error) {
+	conn, err := m.db.Conn(ctx)
 	if err != nil {
-		return nil, errors.Wrap(err, "error reading migrations directory")
+		return nil, errors.Wrap(err, "error getting connection for the migration lock")
+	}
+
+	start := time.Now()
+	lastLog := start
+	for {
+		var acquired bool
+		err = conn.QueryRowContext(ctx, queries.TRY_MIGRATION_LOCK, migrationLockKey).Scan(&acquired)
+		if err != nil {
+			conn.Close()
+			return nil, errors.Wrap(err, "error taking the migration lock")
+		}
+		if acquired {
+			if waited := time.Since(start); waited >= lockPollInterval {
+				log.Printf("took the migration lock after %s", waited.Round(time.Millisecond))
+			}
+			return conn, nil
+		}
+
+		if time.Since(start) >= m.lockTimeout {
+			conn.Close()
+			return nil, errors.Wrapf(ErrMigrationLockTimeout, "waited %s", m.lockTimeout)
+		}
+		if start == lastLog || time.Since(lastLog) >= lockWaitLogInterval {
+			log.Printf("another process is migrating the db; waiting up to %s for it to finish", m.lockTimeout)
+			lastLog = time.Now()
+		}
+		time.Sleep(lockPollInterval)
 	}
+}
+
+func (m *Migrator) unlock(conn *sql.Conn) {
+	defer conn.Close()
+	var released bool
+	err := conn.QueryRowContext(context.Background(), queries.RELEASE_MIGRATION_LOCK, migrationLockKey).Scan(&released)
+	if err != nil || !released {
+		// The lock goes with the session, so discard the connection rather than return it to the pool
+		log.Printf("failed to release the migration lock (released: %t): %v", released, err)
+		conn.Raw(func(driverConn any) error { return driver.ErrBadConn })
+	}
+}
 
-	// Pre-allocate the array to the number of migrations
-	migrationFiles := make([]string, len(entries))
+// getMigrations returns the migration scripts indexed by version. Scripts are named
+// NNN_name.up.sql and NNN_name.down.sql; malformed names, duplicate versions and gaps
+// are errors.
+func (m *Migrator) getMigrations() ([]migration, error) {
+	dir := m.migrationsDir()
+	entries, err := migrations.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading migrations directory")
+	}
 
+	problems := []string{}
+	byVersion := map[int]migration{}
+	latest := 0
 	for _, entry := range entries {
-		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".sql") {
-			// Get everything before the first underscore
-			parts := strings.Split(entry.Name(), "_")
-			if len(parts) < 2 {
-				continue // Skip files without underscore
-			}
+		// The migrations of other dialects
+		if entry.IsDir() {
+			continue
+		}
+		match := migrationName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			problems = append(problems, fmt.Sprintf("%s is not named NNN_name.up.sql or NNN_name.down.sql", entry.Name()))
+			continue
+		}
+		version, err := strconv.Atoi(match[1])
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s has an invalid version: %v", entry.Name(), err))
+			continue
+		}
 
-			// Convert prefix to integer
-			prefix, err := strconv.Atoi(parts[0])
-			if err != nil {
-				return nil, err
-			}
+		scripts := byVersion[version]
+		script := &scripts.Up
+		if match[2] == "down" {
+			script = &scripts.Down
+		}
+		if *script != "" {
+			problems = append(problems, fmt.Sprintf("version %d has two %s scripts: %s and %s", version, match[2], path.Base(*script), entry.Name()))
+			continue
+		}
+		*script = dir + "/" + entry.Name()
+		byVersion[version] = scripts
+		latest = max(latest, version)
+	}
 
-			// Store filename at index matching its prefix
-			migrationFiles[prefix] = "migrations/" + entry.Name()
+	// Store scripts at the index matching their version
+	migrationFiles := make([]migration, latest+1)
+	for version := range migrationFiles {
+		scripts, ok := byVersion[version]
+		if !ok || scripts.Up == "" {
+			problems = append(problems, fmt.Sprintf("version %d has no up script", version))
+			continue
 		}
+		if scripts.Down != "" && strings.TrimSuffix(scripts.Down, ".down.sql") != strings.TrimSuffix(scripts.Up, ".up.sql") {
+			problems = append(problems, fmt.Sprintf("version %d scripts are named differently: %s and %s", version, path.Base(scripts.Up), path.Base(scripts.Down)))
+			continue
+		}
+		content, err := readMigration(scripts.Up)
+		if err != nil {
+			return nil, err
+		}
+		checksum := sha256.Sum256([]byte(content))
+		scripts.Name = path.Base(scripts.Up)
+		scripts.Checksum = hex.EncodeToString(checksum[:])
+		migrationFiles[version] = scripts
 	}
 
+	if len(problems) > 0 {
+		return nil, errors.Errorf("invalid migration files:\n  %s", strings.Join(problems, "\n  "))
+	}
 	return migrationFiles, nil
 }
 
+func readMigration(name string) (string, error) {
+	file, err := migrations.Open(name)
+	if err != nil {
+		return "", errors.Wrap(err, "error opening migration file")
+	}
+	defer file.Close()
+	content, err := io.ReadAll(file)
+	if err != nil {
+		return "", errors.Wrap(err, "error reading migration content")
+	}
+	return string(content), nil
+}
+
 // initAndGetVersion ensures the version tracking table exists and returns current version
 func (m *Migrator) initAndGetVersion(initialMigration string) (int, error) {
 	// Always run the init script first since it's idempotent
-	initialMigrationFile, err := migrations.Open(initialMigration)
+	initialMigrationContent, err := readMigration(initialMigration)
 	if err != nil {
-		return 0, errors.Wrap(err, "error opening initial migration file")
+		return 0, errors.Wrap(err, "error loading initial migration")
 	}
-	initialMigrationContent, err := io.ReadAll(initialMigrationFile)
+	_, err = m.db.Exec(initialMigrationContent)
 	if err != nil {
-		return 0, errors.Wrap(err, "error reading initial migration content")
+		return 0, errors.Wrapf(err, "error executing initial migration:\n\n%s\n\n", initialMigrationContent)
 	}
-	_, err = m.db.Exec(string(initialMigrationContent))
+
+	// Get current version
+	var currentVersion int
+	err = m.db.QueryRow(queries.GET_VERSION).Scan(&currentVersion)
 	if err != nil {
-		return 0, errors.Wrapf(err, "error executing initial migration:\n\n%s\n\n", string(initialMigrationContent))
+		return 0, errors.Wrap(err, "error getting current version")
 	}
 
-	// Get current version
-	stmt, err := m.db.Prepare(queries.GET_VERSION)
+	return currentVersion, nil
+}
+
+// MigrateTo applies or reverts migrations until the db is on the target version. Reverting
+// a migration without a down script fails with ErrIrreversible, before anything is
+// changed, unless force is set; forcing only removes the version so the schema is left as
+// it is.
+func (m *Migrator) MigrateTo(target int, force bool) error {
+	migrationFiles, err := m.getMigrations()
 	if err != nil {
-		return 0, errors.Wrap(err, "Failed to prepare version query")
+		return errors.Wrap(err, "error getting migrations")
+	}
+	if target < 0 || target >= len(migrationFiles) {
+		return errors.Errorf("version %d does not exist; the latest is %d", target, len(migrationFiles)-1)
 	}
-	defer stmt.Close()
 
-	var currentVersion int
-	err = stmt.QueryRow().Scan(&currentVersion)
+	// The version is only read once the lock is held, so a migrator that waited sees the
+	// migrations applied by the process it waited for. A SQLite db has a single
+	// connection, which the lock would hold on to.
+	if m.dialect == Postgres {
+		conn, err := m.lock(context.Background())
+		if err != nil {
+			return err
+		}
+		defer m.unlock(conn)
+	}
+
+	currentVersion, err := m.initAndGetVersion(migrationFiles[0].Up)
 	if err != nil {
-		return 0, errors.Wrap(err, "error getting current version")
+		return errors.Wrap(err, "error initializing and getting version")
+	}
+	err = m.verifyApplied(migrationFiles)
+	if err != nil {
+		return err
+	}
+	err = m.checkFailures()
+	if err != nil {
+		return err
 	}
 
-	return currentVersion, nil
+	if target < currentVersion {
+		err = m.revertMigrations(currentVersion, target, migrationFiles, force)
+	} else {
+		err = m.applyMigrations(currentVersion, target, migrationFiles)
+	}
+	if err != nil {
+		return err
+	}
+	return m.logVersions()
+}
+
+// verifyApplied checks every applied version against its embedded file, listing all
+// differences in the returned error. Versions applied before checksums were recorded
+// take the current file's.
+func (m *Migrator) verifyApplied(migrationFiles []migration) error {
+	rows, err := m.db.Query(queries.GET_APPLIED_MIGRATIONS)
+	if err != nil {
+		return errors.Wrap(err, "error getting applied migrations")
+	}
+	defer rows.Close()
+
+	problems := []string{}
+	backfill := []int{}
+	for rows.Next() {
+		var version int
+		var filename, checksum string
+		err = rows.Scan(&version, &filename, &checksum)
+		if err != nil {
+			return errors.Wrap(err, "error scanning applied migration")
+		}
+		if version >= len(migrationFiles) {
+			problems = append(problems, fmt.Sprintf("version %d (%s) is applied, but its file is missing", version, filename))
+			continue
+		}
+		// The init script runs on every startup, so changes to it always apply
+		if version == 0 {
+			continue
+		}
+		expected := migrationFiles[version]
+		if checksum == "" {
+			backfill = append(backfill, version)
+			continue
+		}
+		if filename != expected.Name || checksum != expected.Checksum {
+			problems = append(problems, fmt.Sprintf("version %d was applied from %s (sha256 %s), but the file is now %s (sha256 %s)",
+				version, filename, checksum, expected.Name, expected.Checksum))
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return errors.Wrap(err, "error reading applied migrations")
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%w:\n  %s", ErrMigrationMismatch, strings.Join(problems, "\n  "))
+	}
+
+	for _, version := range backfill {
+		_, err = m.db.Exec(queries.BACKFILL_VERSION_CHECKSUM, version, migrationFiles[version].Name, migrationFiles[version].Checksum)
+		if err != nil {
+			return errors.Wrap(err, "error recording checksum")
+		}
+		log.Printf("recorded checksum of version %d", version)
+	}
+	return nil
+}
+
+// Failures lists where earlier migration runs stopped
+func (m *Migrator) Failures() ([]*MigrationFailure, error) {
+	rows, err := m.db.Query(queries.GET_MIGRATION_FAILURES)
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting migration failures")
+	}
+	defer rows.Close()
+
+	failures := []*MigrationFailure{}
+	for rows.Next() {
+		var failure MigrationFailure
+		err = rows.Scan(&failure.Version, &failure.Direction, &failure.Filename, &failure.StatementsApplied, &failure.Error, &failure.FailedAt)
+		if err != nil {
+			return nil, errors.Wrap(err, "error scanning migration failure")
+		}
+		failures = append(failures, &failure)
+	}
+	return failures, errors.Wrap(rows.Err(), "error reading migration failures")
+}
+
+// ClearFailure forgets the failure recorded for the version, once an operator has fixed
+// what it left behind. It returns sql.ErrNoRows if none was recorded.
+func (m *Migrator) ClearFailure(version int) error {
+	result, err := m.db.Exec(queries.CLEAR_MIGRATION_FAILURE, version)
+	if err != nil {
+		return errors.Wrap(err, "error clearing migration failure")
+	}
+	cleared, err := result.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "error checking cleared migration failure")
+	}
+	if cleared == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
 }
 
-// applyMigrations applies any pending migrations in order
-func (m *Migrator) applyMigrations(currentVersion int, migrationFiles []string) error {
-	if currentVersion >= len(migrationFiles)-1 {
+// checkFailures refuses to migrate past a partially applied migration. Failures inside
+// a transaction left nothing behind, so those migrations are simply retried.
+func (m *Migrator) checkFailures() error {
+	failures, err := m.Failures()
+	if err != nil {
+		return err
+	}
+	partial := []string{}
+	for _, failure := range failures {
+		description := fmt.Sprintf("version %d (%s %s) failed at %s after %d statements: %s",
+			failure.Version, failure.Direction, failure.Filename, failure.FailedAt.Format(time.RFC3339), failure.StatementsApplied, failure.Error)
+		if failure.StatementsApplied == 0 {
+			log.Printf("retrying %s", description)
+			continue
+		}
+		partial = append(partial, description)
+	}
+	if len(partial) > 0 {
+		return fmt.Errorf("%w; fix the db, then clear the failure:\n  %s", ErrPartialMigration, strings.Join(partial, "\n  "))
+	}
+	return nil
+}
+
+// hasNoTransactionDirective reports whether the script's leading comments include the
+// noTransactionDirective
+func hasNoTransactionDirective(content string) bool {
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == noTransactionDirective {
+			return true
+		}
+		if line != "" && !strings.HasPrefix(line, "--") {
+			return false
+		}
+	}
+	return false
+}
+
+// splitStatements splits a script on semicolons outside of quotes, comments and dollar
+// quoted bodies, so its statements can run one at a time
+func splitStatements(content string) []string {
+	statements := []string{}
+	start := 0
+	for i := 0; i < len(content); i++ {
+		switch {
+		case content[i] == '\'' || content[i] == '"':
+			end := strings.IndexByte(content[i+1:], content[i])
+			if end < 0 {
+				i = len(content)
+			} else {
+				i += end + 1
+			}
+		case strings.HasPrefix(content[i:], "--"):
+			end := strings.IndexByte(content[i:], '\n')
+			if end < 0 {
+				i = len(content)
+			} else {
+				i += end
+			}
+		case strings.HasPrefix(content[i:], "/*"):
+			end := strings.Index(content[i+2:], "*/")
+			if end < 0 {
+				i = len(content)
+			} else {
+				i += end + 3
+			}
+		case content[i] == '$':
+			tag := dollarQuoteTag.FindString(content[i:])
+			if tag == "" {
+				continue
+			}
+			end := strings.Index(content[i+len(tag):], tag)
+			if end < 0 {
+				i = len(content)
+			} else {
+				i += len(tag) + end + len(tag) - 1
+			}
+		case content[i] == ';':
+			statements = appendStatement(statements, content[start:i])
+			start = i + 1
+		}
+	}
+	return appendStatement(statements, content[min(start, len(content)):])
+}
+
+var dollarQuoteTag = regexp.MustCompile(`^\$[A-Za-z_]*\$`)
+
+// appendStatement skips blank statements and ones that are only comments
+func appendStatement(statements []string, statement string) []string {
+	for _, line := range strings.Split(statement, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "--") {
+			return append(statements, strings.TrimSpace(statement))
+		}
+	}
+	return statements
+}
+
+// applyMigrations applies any pending migrations up to the target in order, each in its
+// own transaction along with its version
+func (m *Migrator) applyMigrations(currentVersion, target int, migrationFiles []migration) error {
+	if currentVersion >= target {
 		log.Printf("db is on version %d, no migrations to apply", currentVersion)
 		return nil
 	}
 	log.Printf("db is on version %d, applying migrations", currentVersion)
-	// Execute migration within transaction
-	tx, err := m.db.Begin()
+	for version := currentVersion + 1; version <= target; version++ {
+		scripts := migrationFiles[version]
+		log.Printf("applying migration to version %d: %s", version, scripts.Up)
+		err := m.runStep(version, "up", scripts.Up, queries.INSERT_VERSION, version, scripts.Name, scripts.Checksum)
+		if err != nil {
+			return errors.Wrapf(err, "error applying version %d", version)
+		}
+		log.Printf("migrated to version %d", version)
+	}
+	return nil
+}
+
+// revertMigrations runs the down scripts from the current version back to the target,
+// removing each version in the same transaction as its script
+func (m *Migrator) revertMigrations(currentVersion, target int, migrationFiles []migration, force bool) error {
+	err := checkReversible(currentVersion, target, migrationFiles, force)
 	if err != nil {
-		return errors.Wrap(err, "error beginning transaction")
+		return err
 	}
-	for version, migration := range migrationFiles {
-		if version <= currentVersion {
-			continue
+	log.Printf("db is on version %d, reverting migrations to version %d", currentVersion, target)
+
+	for version := currentVersion; version > target; version-- {
+		scripts := migrationFiles[version]
+		if scripts.Down == "" {
+			log.Printf("forcing version %d off without reverting %s; its schema changes remain", version, scripts.Up)
+		} else {
+			log.Printf("reverting migration of version %d: %s", version, scripts.Down)
 		}
-		err = m.runSingleMigration(tx, version, migration)
+		err := m.runStep(version, "down", scripts.Down, queries.DELETE_VERSION, version)
 		if err != nil {
-			tx.Rollback()
-			return errors.Wrap(err, "error running single migration")
+			return errors.Wrapf(err, "error reverting version %d", version)
 		}
+		log.Printf("reverted version %d", version)
 	}
+	return nil
+}
 
-	err = tx.Commit()
-	if err != nil {
-		return errors.Wrap(err, "error committing transaction")
+// checkReversible fails with ErrIrreversible if reverting to the target passes a version
+// without a down script, unless forced
+func checkReversible(currentVersion, target int, migrationFiles []migration, force bool) error {
+	for version := currentVersion; version > target; version-- {
+		if migrationFiles[version].Down == "" && !force {
+			return errors.Wrapf(ErrIrreversible, "cannot revert version %d", version)
+		}
 	}
+	return nil
+}
 
-	// Get all versions and log them
+// logVersions logs every version applied to the db
+func (m *Migrator) logVersions() error {
 	rows, err := m.db.Query(queries.GET_VERSIONS)
 	if err != nil {
 		return errors.Wrap(err, "error getting versions")
@@ -138,59 +564,103 @@ func (m *Migrator) applyMigrations(currentVersion int, migrationFiles []string)
 		log.Printf("version %d, created at %s", version.Version, version.CreatedAt)
 	}
 
-	return nil
+	return rows.Err()
 }
 
-func (m *Migrator) runSingleMigration(tx *sql.Tx, version int, migration string) error {
-	if migration == "" {
-		log.Printf("version %d not found: skipping", version)
-		return nil
+// runStep runs one migration script, if any, and then the query tracking its version.
+// Scripts run in a transaction with the tracking query unless they carry the
+// noTransactionDirective. Failures are recorded in migration_failures.
+func (m *Migrator) runStep(version int, direction, script, trackQuery string, trackArgs ...any) error {
+	content := ""
+	if script != "" {
+		var err error
+		content, err = readMigration(script)
+		if err != nil {
+			return err
+		}
+	}
+	// Scripts keeping a dialect level with the others may hold only comments, which some
+	// drivers refuse to run
+	if len(splitStatements(content)) == 0 {
+		content = ""
 	}
 
-	log.Printf("applying migration to version %d: %s", version, migration)
+	if hasNoTransactionDirective(content) {
+		statements := splitStatements(content)
+		for i, statement := range statements {
+			_, err := m.db.Exec(statement)
+			if err != nil {
+				m.recordFailure(version, direction, script, i, err)
+				return errors.Wrapf(err, "error executing statement %d of %d outside a transaction", i+1, len(statements))
+			}
+		}
+		// Only the tracking is left to do
+		err := m.track(version, "", trackQuery, trackArgs...)
+		if err != nil {
+			m.recordFailure(version, direction, script, len(statements), err)
+		}
+		return err
+	}
 
-	migrationFile, err := migrations.Open(migration)
+	err := m.track(version, content, trackQuery, trackArgs...)
 	if err != nil {
-		return errors.Wrap(err, "error opening migration file")
+		m.recordFailure(version, direction, script, 0, err)
+		return err
 	}
-	migrationContent, err := io.ReadAll(migrationFile)
+	return nil
+}
+
+// track runs the script, if any, along with the tracking query in one transaction, also
+// clearing any failure recorded for the version
+func (m *Migrator) track(version int, content, trackQuery string, trackArgs ...any) error {
+	tx, err := m.db.Begin()
 	if err != nil {
-		return errors.Wrap(err, "error reading migration content")
+		return errors.Wrap(err, "error beginning transaction")
 	}
+	defer tx.Rollback()
 
-	_, err = tx.Exec(string(migrationContent))
-	if err != nil {
-		return errors.Wrap(err, "error executing migration")
+	if content != "" {
+		if _, err = tx.Exec(content); err != nil {
+			return errors.Wrap(err, "error executing migration")
+		}
+	}
+	if _, err = tx.Exec(trackQuery, trackArgs...); err != nil {
+		return errors.Wrap(err, "error updating version")
 	}
+	if _, err = tx.Exec(queries.CLEAR_MIGRATION_FAILURE, version); err != nil {
+		return errors.Wrap(err, "error clearing migration failure")
+	}
+	return errors.Wrap(tx.Commit(), "error committing transaction")
+}
 
-	// Update version
-	_, err = tx.Exec(queries.INSERT_VERSION, version)
+// recordFailure notes where a migration stopped. statementsApplied is only non-zero for
+// scripts run outside a transaction, whose completed statements stay applied.
+func (m *Migrator) recordFailure(version int, direction, script string, statementsApplied int, cause error) {
+	filename := ""
+	if script != "" {
+		filename = path.Base(script)
+	}
+	_, err := m.db.Exec(queries.RECORD_MIGRATION_FAILURE, version, direction, filename, statementsApplied, cause.Error())
 	if err != nil {
-		return errors.Wrap(err, "error updating version")
+		log.Printf("failed to record the failure of version %d: %v", version, err)
 	}
-	log.Printf("migrated to version %d", version)
-	return nil
 }
 
-// Migrate runs all pending migrations
-func Migrate(db *sql.DB) error {
+// Migrate runs all pending migrations, waiting up to lockTimeout for other processes
+// migrating the same db
+func Migrate(db *sql.DB, lockTimeout time.Duration) error {
 	log.Printf("migrating database")
-	migrator, err := NewMigrator(db)
+	migrator, err := NewMigrator(db, lockTimeout)
 	if err != nil {
 		return errors.Wrap(err, "error creating migrator")
 	}
 
-	migrations, err := migrator.getMigrations()
+	latest, err := migrator.LatestVersion()
 	if err != nil {
 		return errors.Wrap(err, "error getting migrations")
 	}
 
-	currentVersion, err := migrator.initAndGetVersion(migrations[0])
-	if err != nil {
-		return errors.Wrap(err, "error initializing and getting version")
-	}
-
-	err = migrator.applyMigrations(currentVersion, migrations)
+	err = migrator.MigrateTo(latest, false)
 	if err != nil {
 		return errors.Wrap(err, "error applying migrations")
 	}
@@ -0,0 +1,75 @@
+package persistence
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence/queries"
+)
+
+func TestSplitStatements(t *testing.T) {
+	script := `-- add an index without locking the table --
+-- zuul:no-transaction --
+CREATE INDEX CONCURRENTLY IF NOT EXISTS a ON b (c);
+INSERT INTO t VALUES ('x;y', "we;ird");
+/* block; comment */ SELECT 1;
+CREATE FUNCTION f() RETURNS int AS $body$ SELECT 1; $body$ LANGUAGE sql;
+-- trailing; comment --
+`
+	assert.True(t, hasNoTransactionDirective(script))
+	assert.False(t, hasNoTransactionDirective("SELECT 1;\n-- zuul:no-transaction --"), "the directive only counts in the leading comments")
+
+	statements := splitStatements(script)
+	assert.Len(t, statements, 4)
+	assert.Contains(t, statements[0], "CREATE INDEX CONCURRENTLY")
+	assert.Equal(t, `INSERT INTO t VALUES ('x;y', "we;ird")`, statements[1])
+	assert.Equal(t, "/* block; comment */ SELECT 1", statements[2])
+	assert.Equal(t, "CREATE FUNCTION f() RETURNS int AS $body$ SELECT 1; $body$ LANGUAGE sql", statements[3])
+}
+
+func TestDialectMigrationsMatch(t *testing.T) {
+	postgres, err := (&Migrator{dialect: Postgres}).getMigrations()
+	assert.NoError(t, err)
+	sqlite, err := (&Migrator{dialect: SQLite}).getMigrations()
+	assert.NoError(t, err)
+
+	assert.Equal(t, len(postgres), len(sqlite), "every dialect needs the same versions")
+	for version := range min(len(postgres), len(sqlite)) {
+		assert.Equal(t, postgres[version].Name, sqlite[version].Name)
+		assert.Equal(t, postgres[version].Down != "", sqlite[version].Down != "", "version %d should be reversible in both dialects or neither", version)
+	}
+}
+
+func TestEmptyMigrationScripts(t *testing.T) {
+	db, err := Open("sqlite://"+filepath.Join(t.TempDir(), "zuul.db"), PoolConfig{})
+	require.NoError(t, err)
+	defer db.Close()
+	migrator, err := NewMigrator(db, time.Minute)
+	require.NoError(t, err)
+	require.NoError(t, migrator.MigrateTo(9, false))
+
+	// The postgres scripts for version 10 hold only comments
+	script := "migrations/010_sqlite_email_user_counter.up.sql"
+	content, err := readMigration(script)
+	require.NoError(t, err)
+	require.Empty(t, splitStatements(content))
+
+	err = migrator.runStep(10, "up", script, queries.INSERT_VERSION, 10, "010_sqlite_email_user_counter.up.sql", "checksum")
+	require.NoError(t, err)
+	version, err := migrator.CurrentVersion()
+	assert.NoError(t, err)
+	assert.Equal(t, 10, version)
+
+	err = migrator.runStep(10, "down", "migrations/010_sqlite_email_user_counter.down.sql", queries.DELETE_VERSION, 10)
+	require.NoError(t, err)
+	version, err = migrator.CurrentVersion()
+	assert.NoError(t, err)
+	assert.Equal(t, 9, version)
+	failures, err := migrator.Failures()
+	assert.NoError(t, err)
+	assert.Empty(t, failures)
+}
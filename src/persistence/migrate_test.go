@@ -5,7 +5,9 @@ import (
 	"database/sql"
 	"fmt"
 	"os"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/coopstools-homebrew/I-am-zuul/src/config"
 	"github.com/coopstools-homebrew/I-am-zuul/src/persistence"
@@ -13,7 +15,7 @@ import (
 	"github.com/docker/go-connections/nat"
 	"github.com/stretchr/testify/assert"
 
-	_ "github.com/lib/pq"
+	_ "github.com/jackc/pgx/v5/stdlib"
 	"github.com/testcontainers/testcontainers-go"
 	"github.com/testcontainers/testcontainers-go/wait"
 )
@@ -23,9 +25,15 @@ var (
 	testConfig *config.Config
 )
 
+// The Postgres tests need docker to start the database. Without docker they are skipped,
+// so the SQLite and other tests still run.
 func TestMain(m *testing.M) {
 	// Set up the test environment
 	ctx := context.Background()
+	if err := dockerHealth(ctx); err != nil {
+		fmt.Printf("Skipping the Postgres tests, docker isn't available: %v\n", err)
+		os.Exit(m.Run())
+	}
 
 	// Start PostgreSQL container
 	pgContainer, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
@@ -37,7 +45,7 @@ func TestMain(m *testing.M) {
 				"POSTGRES_PASSWORD": "test",
 				"POSTGRES_DB":       "test",
 			},
-			WaitingFor: wait.ForSQL("5432/tcp", "postgres", func(host string, port nat.Port) string {
+			WaitingFor: wait.ForSQL("5432/tcp", "pgx", func(host string, port nat.Port) string {
 				return fmt.Sprintf("postgres://test:test@%s:%s/test?sslmode=disable", host, port.Port())
 			}),
 		},
@@ -69,7 +77,7 @@ func TestMain(m *testing.M) {
 	}
 
 	// Connect to the test database
-	testDB, err = sql.Open("postgres", testConfig.DatabaseURL)
+	testDB, err = persistence.Open(testConfig.DatabaseURL, persistence.PoolConfig{})
 	if err != nil {
 		fmt.Printf("Failed to connect to test database: %v\n", err)
 		os.Exit(1)
@@ -77,7 +85,7 @@ func TestMain(m *testing.M) {
 	defer testDB.Close()
 
 	// Run migrations
-	err = persistence.Migrate(testDB)
+	err = persistence.Migrate(testDB, time.Minute)
 	if err != nil {
 		fmt.Printf("Failed to run migrations: %v\n", err)
 		os.Exit(1)
@@ -89,7 +97,31 @@ func TestMain(m *testing.M) {
 	os.Exit(code)
 }
 
+// dockerHealth checks the docker daemon can be reached. testcontainers panics when there
+// is no docker host to connect to.
+func dockerHealth(ctx context.Context) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	provider, err := testcontainers.ProviderDocker.GetProvider()
+	if err != nil {
+		return err
+	}
+	return provider.Health(ctx)
+}
+
+// requirePostgres skips the test when TestMain couldn't start Postgres
+func requirePostgres(t testing.TB) {
+	t.Helper()
+	if testDB == nil {
+		t.Skip("Postgres needs docker")
+	}
+}
+
 func TestCurrentVersion(t *testing.T) {
+	requirePostgres(t)
 	stmt, err := testDB.Prepare(queries.GET_VERSION)
 	if err != nil {
 		t.Fatalf("Failed to prepare version query: %v", err)
@@ -101,13 +133,227 @@ func TestCurrentVersion(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to get version: %v", err)
 	}
-	assert.Equal(t, 2, version)
+	assert.Equal(t, 10, version)
 }
 
 // An error occured in production, wherein the same migrations were applied multiple times.
 // This test ensures that the migration code only runs migrations newer than the current version.
 func TestMultipleMigrations(t *testing.T) {
+	requirePostgres(t)
 	// As the db set ran the migrations once already, we need only call migrations once to verify they are idempotent.
-	err := persistence.Migrate(testDB)
+	err := persistence.Migrate(testDB, time.Minute)
+	assert.NoError(t, err)
+}
+
+func TestMigrateTo(t *testing.T) {
+	requirePostgres(t)
+	migrator, err := persistence.NewMigrator(testDB, time.Minute)
+	assert.NoError(t, err)
+
+	t.Run("Test reverting and reapplying migrations", func(t *testing.T) {
+		err := migrator.MigrateTo(6, false)
+		assert.NoError(t, err)
+
+		var exists bool
+		err = testDB.QueryRow(`SELECT to_regclass('clients') IS NOT NULL`).Scan(&exists)
+		assert.NoError(t, err)
+		assert.False(t, exists, "expected clients to be dropped")
+
+		err = migrator.MigrateTo(10, false)
+		assert.NoError(t, err)
+		err = testDB.QueryRow(`SELECT to_regclass('clients') IS NOT NULL`).Scan(&exists)
+		assert.NoError(t, err)
+		assert.True(t, exists)
+	})
+
+	t.Run("Test irreversible migrations are refused", func(t *testing.T) {
+		err := migrator.MigrateTo(0, false)
+		assert.ErrorIs(t, err, persistence.ErrIrreversible)
+
+		// Nothing was reverted before the refusal
+		TestCurrentVersion(t)
+	})
+
+	t.Run("Test refusing unknown versions", func(t *testing.T) {
+		assert.Error(t, migrator.MigrateTo(99, false))
+		assert.Error(t, migrator.MigrateTo(-1, false))
+	})
+}
+
+func TestMigrationChecksums(t *testing.T) {
+	requirePostgres(t)
+	var filename, checksum string
+	err := testDB.QueryRow(`SELECT filename, checksum FROM version_tracking WHERE version = 3`).Scan(&filename, &checksum)
+	assert.NoError(t, err)
+	assert.Equal(t, "003_add_webhook_deliveries.up.sql", filename)
+	assert.Len(t, checksum, 64)
+
+	t.Run("Test edited migrations are reported", func(t *testing.T) {
+		_, err := testDB.Exec(`UPDATE version_tracking SET checksum = 'edited' WHERE version = 3`)
+		assert.NoError(t, err)
+		defer testDB.Exec(`UPDATE version_tracking SET checksum = $1 WHERE version = 3`, checksum)
+
+		err = persistence.Migrate(testDB, time.Minute)
+		assert.ErrorIs(t, err, persistence.ErrMigrationMismatch)
+		assert.Contains(t, err.Error(), "version 3 was applied from 003_add_webhook_deliveries.up.sql (sha256 edited)")
+	})
+
+	t.Run("Test missing migrations are reported", func(t *testing.T) {
+		_, err := testDB.Exec(`INSERT INTO version_tracking (version, filename, checksum) VALUES (99, '099_gone.up.sql', 'gone')`)
+		assert.NoError(t, err)
+		defer testDB.Exec(`DELETE FROM version_tracking WHERE version = 99`)
+
+		err = persistence.Migrate(testDB, time.Minute)
+		assert.ErrorIs(t, err, persistence.ErrMigrationMismatch)
+		assert.Contains(t, err.Error(), "version 99 (099_gone.up.sql) is applied, but its file is missing")
+	})
+}
+
+// Several dynos start at once, each migrating the db
+func TestConcurrentMigrations(t *testing.T) {
+	requirePostgres(t)
+	migrator, err := persistence.NewMigrator(testDB, time.Minute)
 	assert.NoError(t, err)
+	err = migrator.MigrateTo(5, false)
+	assert.NoError(t, err)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- persistence.Migrate(testDB, time.Minute)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+
+	var count int
+	err = testDB.QueryRow(`SELECT COUNT(*) FROM version_tracking`).Scan(&count)
+	assert.NoError(t, err)
+	assert.Equal(t, 10, count, "expected each version to be applied once")
+	TestCurrentVersion(t)
+}
+
+func TestMigrationLockTimeout(t *testing.T) {
+	requirePostgres(t)
+	conn, err := testDB.Conn(context.Background())
+	assert.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.ExecContext(context.Background(), `SELECT pg_advisory_lock(0x7a75756c)`)
+	assert.NoError(t, err)
+	defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock(0x7a75756c)`)
+
+	start := time.Now()
+	err = persistence.Migrate(testDB, 2*time.Second)
+	assert.ErrorIs(t, err, persistence.ErrMigrationLockTimeout)
+	assert.GreaterOrEqual(t, time.Since(start), 2*time.Second)
+}
+
+func TestMigrationFailures(t *testing.T) {
+	requirePostgres(t)
+	migrator, err := persistence.NewMigrator(testDB, time.Minute)
+	assert.NoError(t, err)
+
+	t.Run("Test partially applied migrations block migrating", func(t *testing.T) {
+		_, err := testDB.Exec(`INSERT INTO migration_failures (version, direction, filename, statements_applied, error) 
+			VALUES (8, 'up', '008_add_magic_links.up.sql', 2, 'boom')`)
+		assert.NoError(t, err)
+
+		err = migrator.MigrateTo(8, false)
+		assert.ErrorIs(t, err, persistence.ErrPartialMigration)
+		assert.Contains(t, err.Error(), "version 8 (up 008_add_magic_links.up.sql)")
+
+		failures, err := migrator.Failures()
+		assert.NoError(t, err)
+		assert.Len(t, failures, 1)
+		assert.Equal(t, 2, failures[0].StatementsApplied)
+
+		assert.NoError(t, migrator.ClearFailure(8))
+		assert.ErrorIs(t, migrator.ClearFailure(8), sql.ErrNoRows)
+		assert.NoError(t, migrator.MigrateTo(10, false))
+	})
+
+	t.Run("Test failures in a transaction are retried and cleared", func(t *testing.T) {
+		// Make reapplying version 8 fail, leaving nothing behind
+		assert.NoError(t, migrator.MigrateTo(7, false))
+		_, err := testDB.Exec(`CREATE TABLE magic_links (token_hash BYTEA)`)
+		assert.NoError(t, err)
+
+		err = migrator.MigrateTo(8, false)
+		assert.Error(t, err)
+		failures, err := migrator.Failures()
+		assert.NoError(t, err)
+		assert.Len(t, failures, 1)
+		assert.Equal(t, 0, failures[0].StatementsApplied)
+
+		var version int
+		err = testDB.QueryRow(queries.GET_VERSION).Scan(&version)
+		assert.NoError(t, err)
+		assert.Equal(t, 7, version, "the failed migration should have been rolled back")
+
+		_, err = testDB.Exec(`DROP TABLE magic_links`)
+		assert.NoError(t, err)
+		assert.NoError(t, migrator.MigrateTo(10, false))
+		failures, err = migrator.Failures()
+		assert.NoError(t, err)
+		assert.Empty(t, failures)
+	})
+}
+
+func TestMigrationStatus(t *testing.T) {
+	requirePostgres(t)
+	migrator, err := persistence.NewMigrator(testDB, time.Minute)
+	assert.NoError(t, err)
+
+	t.Run("Test listing applied migrations", func(t *testing.T) {
+		versions, failures, err := migrator.Status()
+		assert.NoError(t, err)
+		assert.Empty(t, failures)
+		assert.Len(t, versions, 11)
+		assert.Equal(t, "001_add_users.up.sql", versions[1].Filename)
+		assert.False(t, versions[1].Reversible)
+		assert.True(t, versions[9].Reversible)
+		assert.NotNil(t, versions[9].AppliedAt)
+	})
+
+	t.Run("Test planning without migrating", func(t *testing.T) {
+		steps, err := migrator.Plan(6, false)
+		assert.NoError(t, err)
+		assert.Len(t, steps, 4)
+		assert.Equal(t, "010_sqlite_email_user_counter.down.sql", steps[0].Filename)
+		assert.Equal(t, "009_add_login_tracking.down.sql", steps[1].Filename)
+		assert.Contains(t, steps[1].SQL, "DROP TABLE login_events")
+		TestCurrentVersion(t)
+
+		_, err = migrator.Plan(0, false)
+		assert.ErrorIs(t, err, persistence.ErrIrreversible)
+		steps, err = migrator.Plan(10, false)
+		assert.NoError(t, err)
+		assert.Empty(t, steps)
+	})
+}
+
+func TestNewMigrationFiles(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(dir+"/007_add_clients.up.sql", []byte(""), 0644))
+
+	up, down, err := persistence.NewMigrationFiles(dir, "add_login_history")
+	assert.NoError(t, err)
+	assert.Equal(t, dir+"/008_add_login_history.up.sql", up)
+	assert.Equal(t, dir+"/008_add_login_history.down.sql", down)
+
+	// Down scripts fail until they're written
+	content, err := os.ReadFile(down)
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), "undo 008_add_login_history")
+	_, err = openSQLite(t).Exec(string(content))
+	assert.ErrorContains(t, err, "down_migration_not_written")
+
+	_, _, err = persistence.NewMigrationFiles(dir, "Add Login History")
+	assert.Error(t, err)
 }
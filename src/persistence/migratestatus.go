@@ -0,0 +1,202 @@
+package persistence
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence/queries"
+)
+
+// MigrationVersion describes one migration and whether it is applied
+type MigrationVersion struct {
+	Version    int        `json:"version"`
+	Filename   string     `json:"filename"`
+	Reversible bool       `json:"reversible"`
+	AppliedAt  *time.Time `json:"applied_at"`
+}
+
+// MigrationStep is a script MigrateTo would run
+type MigrationStep struct {
+	Version   int
+	Direction string
+	// Empty when a forced revert only removes the version
+	Filename string
+	SQL      string
+}
+
+var migrationNamePart = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+// LatestVersion returns the version of the newest migration file
+func (m *Migrator) LatestVersion() (int, error) {
+	migrationFiles, err := m.getMigrations()
+	if err != nil {
+		return 0, err
+	}
+	return len(migrationFiles) - 1, nil
+}
+
+// CurrentVersion returns the version the db is on, or -1 if it was never migrated
+func (m *Migrator) CurrentVersion() (int, error) {
+	var version int
+	err := m.db.QueryRow(queries.GET_VERSION).Scan(&version)
+	if m.dialect.isUndefinedTable(err) {
+		return -1, nil
+	}
+	if err != nil {
+		return 0, errors.Wrap(err, "error getting current version")
+	}
+	return version, nil
+}
+
+// Status lists every migration, with when it was applied, and the recorded failures.
+// Unlike MigrateTo it changes nothing, even on a db that was never migrated.
+func (m *Migrator) Status() ([]*MigrationVersion, []*MigrationFailure, error) {
+	migrationFiles, err := m.getMigrations()
+	if err != nil {
+		return nil, nil, err
+	}
+	versions := make([]*MigrationVersion, len(migrationFiles))
+	for version, scripts := range migrationFiles {
+		versions[version] = &MigrationVersion{Version: version, Filename: scripts.Name, Reversible: scripts.Down != ""}
+	}
+
+	currentVersion, err := m.CurrentVersion()
+	if err != nil || currentVersion < 0 {
+		return versions, []*MigrationFailure{}, err
+	}
+
+	rows, err := m.db.Query(queries.GET_VERSIONS)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "error getting versions")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		err = rows.Scan(&version, &appliedAt)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "error scanning version")
+		}
+		if version < len(versions) {
+			versions[version].AppliedAt = &appliedAt
+		} else {
+			versions = append(versions, &MigrationVersion{Version: version, Filename: "(missing)", AppliedAt: &appliedAt})
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, nil, errors.Wrap(err, "error reading versions")
+	}
+
+	failures, err := m.Failures()
+	return versions, failures, err
+}
+
+// Plan returns the scripts MigrateTo would run to reach the target, without running them
+// or taking the lock
+func (m *Migrator) Plan(target int, force bool) ([]*MigrationStep, error) {
+	migrationFiles, err := m.getMigrations()
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting migrations")
+	}
+	if target < 0 || target >= len(migrationFiles) {
+		return nil, errors.Errorf("version %d does not exist; the latest is %d", target, len(migrationFiles)-1)
+	}
+	currentVersion, err := m.CurrentVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	steps := []*MigrationStep{}
+	if target < currentVersion {
+		err = checkReversible(currentVersion, target, migrationFiles, force)
+		if err != nil {
+			return nil, err
+		}
+		for version := currentVersion; version > target; version-- {
+			step := &MigrationStep{Version: version, Direction: "down"}
+			if script := migrationFiles[version].Down; script != "" {
+				step.Filename = filepath.Base(script)
+				if step.SQL, err = readMigration(script); err != nil {
+					return nil, err
+				}
+			}
+			steps = append(steps, step)
+		}
+		return steps, nil
+	}
+
+	for version := currentVersion + 1; version <= target; version++ {
+		step := &MigrationStep{Version: version, Direction: "up", Filename: migrationFiles[version].Name}
+		if step.SQL, err = readMigration(migrationFiles[version].Up); err != nil {
+			return nil, err
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+// NewMigrationFiles creates the up and down scripts for the next version in dir, which
+// should be the source migrations directory, and returns their paths.
+//
+// Every dialect has to have the same versions, with the same names, so a migration added
+// for one dialect needs files in the others too. Where it has nothing to do, its scripts
+// hold only comments, and its name should say which dialect it is for, like
+// 010_sqlite_email_user_counter.
+func NewMigrationFiles(dir, name string) (string, string, error) {
+	if !migrationNamePart.MatchString(name) {
+		return "", "", errors.Errorf("migration name %q should be lower case letters, digits and underscores", name)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", "", errors.Wrap(err, "error reading migrations directory")
+	}
+	next := 0
+	for _, entry := range entries {
+		match := migrationName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			continue
+		}
+		version, err := strconv.Atoi(match[1])
+		if err != nil {
+			return "", "", errors.Wrapf(err, "invalid version in %s", entry.Name())
+		}
+		next = max(next, version+1)
+	}
+
+	base := filepath.Join(dir, fmt.Sprintf("%03d_%s", next, name))
+	up, down := base+".up.sql", base+".down.sql"
+	err = writeNewFile(up, fmt.Sprintf("-- %s --\n", name))
+	if err != nil {
+		return "", "", err
+	}
+	err = writeNewFile(down, fmt.Sprintf(downTemplate, next, name))
+	if err != nil {
+		os.Remove(up)
+		return "", "", err
+	}
+	return up, down, nil
+}
+
+// downTemplate fails until it's replaced, so a down script committed unedited can't mark
+// its version reverted without undoing anything. It queries a missing table since that
+// fails in every dialect.
+const downTemplate = `-- undo %03d_%s; delete this file if it can't be undone --
+-- this fails until it's replaced by the statements undoing the up script --
+SELECT * FROM down_migration_not_written;
+`
+
+func writeNewFile(path, content string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return errors.Wrap(err, "error creating migration file")
+	}
+	defer file.Close()
+	_, err = file.WriteString(content)
+	return errors.Wrap(err, "error writing migration file")
+}
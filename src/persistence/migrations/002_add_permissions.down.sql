@@ -0,0 +1,2 @@
+-- drop every org permission grant --
+DROP TABLE org_permissions;
@@ -0,0 +1,9 @@
+-- record processed github webhook deliveries so redeliveries are ignored --
+CREATE TABLE webhook_deliveries (
+    delivery_id VARCHAR(255) PRIMARY KEY,
+    event VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- tokens issued before this time are rejected by the auth middleware --
+ALTER TABLE users ADD COLUMN tokens_not_before TIMESTAMPTZ;
@@ -0,0 +1,5 @@
+-- suspended and deleted users become able to sign in again --
+ALTER TABLE users DROP CONSTRAINT users_status_check;
+ALTER TABLE users DROP COLUMN status_changed_at;
+ALTER TABLE users DROP COLUMN status_reason;
+ALTER TABLE users DROP COLUMN status;
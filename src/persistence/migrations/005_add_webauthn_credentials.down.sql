@@ -0,0 +1,2 @@
+-- drop every registered webauthn credential --
+DROP TABLE webauthn_credentials;
@@ -0,0 +1,11 @@
+-- webauthn credentials (security keys, platform authenticators) used as a second factor --
+CREATE TABLE webauthn_credentials (
+    id BYTEA PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id),
+    name VARCHAR(255) NOT NULL DEFAULT '',
+    credential JSONB NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    last_used_at TIMESTAMPTZ
+);
+
+CREATE INDEX webauthn_credentials_user_id_idx ON webauthn_credentials (user_id);
@@ -0,0 +1,17 @@
+-- relying-party applications that log users in through Zuul --
+CREATE TABLE clients (
+    client_id VARCHAR(255) PRIMARY KEY,
+    name VARCHAR(255) NOT NULL DEFAULT '',
+    -- sha-256 of the client secret; clients without one can't exchange tokens --
+    secret_hash BYTEA,
+    redirect_uris TEXT[] NOT NULL DEFAULT '{}',
+    allowed_origins TEXT[] NOT NULL DEFAULT '{}',
+    -- orgs (or org/teams) whose permissions the client's tokens may carry; empty allows all --
+    allowed_scopes TEXT[] NOT NULL DEFAULT '{}',
+    -- zero uses the service's SESSION_LIFETIME --
+    token_lifetime_seconds INT NOT NULL DEFAULT 0,
+    token_path VARCHAR(255) NOT NULL DEFAULT '/',
+    audience VARCHAR(255) NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
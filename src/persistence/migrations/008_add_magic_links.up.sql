@@ -0,0 +1,16 @@
+-- users who log in by email get negative ids, so they never collide with github ids --
+CREATE SEQUENCE email_user_ids AS INT INCREMENT BY -1 MAXVALUE -1 START WITH -1;
+ALTER TABLE users ADD COLUMN provider VARCHAR(32) NOT NULL DEFAULT 'github';
+CREATE UNIQUE INDEX users_email_login_idx ON users (LOWER(email)) WHERE provider = 'email';
+
+-- single-use login links, stored as sha-256 hashes of the token sent by email --
+CREATE TABLE magic_links (
+    token_hash BYTEA PRIMARY KEY,
+    email VARCHAR(255) NOT NULL,
+    client_id VARCHAR(255) NOT NULL DEFAULT '',
+    redirect_uri TEXT NOT NULL,
+    scopes TEXT[] NOT NULL DEFAULT '{}',
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,20 @@
+-- when a user's profile last changed, and when and how often they log in --
+ALTER TABLE users ADD COLUMN updated_at TIMESTAMPTZ;
+UPDATE users SET updated_at = created_at;
+ALTER TABLE users ALTER COLUMN updated_at SET DEFAULT CURRENT_TIMESTAMP;
+ALTER TABLE users ADD COLUMN last_login_at TIMESTAMPTZ;
+ALTER TABLE users ADD COLUMN login_count INT NOT NULL DEFAULT 0;
+
+CREATE INDEX users_last_login_at_idx ON users (last_login_at);
+
+-- every login, newest first per user --
+CREATE TABLE login_events (
+    id BIGSERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id),
+    logged_in_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    ip VARCHAR(64) NOT NULL DEFAULT '',
+    user_agent TEXT NOT NULL DEFAULT '',
+    provider VARCHAR(32) NOT NULL
+);
+
+CREATE INDEX login_events_user_id_idx ON login_events (user_id, logged_in_at DESC);
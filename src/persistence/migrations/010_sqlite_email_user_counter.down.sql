@@ -0,0 +1 @@
+-- no-op on postgres; see the up script --
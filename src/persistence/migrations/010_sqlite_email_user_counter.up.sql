@@ -0,0 +1,2 @@
+-- no-op on postgres, which takes email user ids from the email_user_ids sequence; only --
+-- sqlite needs this counter. kept so both dialects share their version numbers --
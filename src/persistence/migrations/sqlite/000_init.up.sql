@@ -0,0 +1,26 @@
+-- initialize the database with version tracking table --
+CREATE TABLE IF NOT EXISTS version_tracking (
+    version INTEGER PRIMARY KEY,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    -- the file and sha-256 of each applied migration, so edited or missing files are noticed --
+    filename VARCHAR(255) NOT NULL DEFAULT '',
+    checksum VARCHAR(64) NOT NULL DEFAULT ''
+);
+
+-- insert the initial version if it doesn't exist --
+INSERT INTO version_tracking (version)
+SELECT 0
+WHERE NOT EXISTS (
+    SELECT 1 FROM version_tracking WHERE version = 0
+);
+
+-- where the last failed run of each migration stopped, until it succeeds or is cleared --
+CREATE TABLE IF NOT EXISTS migration_failures (
+    version INTEGER PRIMARY KEY,
+    direction VARCHAR(8) NOT NULL,
+    filename VARCHAR(255) NOT NULL,
+    -- statements of a script run outside a transaction that completed before the failure --
+    statements_applied INTEGER NOT NULL DEFAULT 0,
+    error TEXT NOT NULL,
+    failed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
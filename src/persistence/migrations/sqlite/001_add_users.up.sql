@@ -0,0 +1,10 @@
+-- after initialization, migrations should not be idempotent --
+
+-- add users table using the github id as the primary key --
+CREATE TABLE users (
+    id INTEGER PRIMARY KEY,
+    login_name VARCHAR(255) NOT NULL,
+    avatar_url VARCHAR(255) NOT NULL,
+    email VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,8 @@
+-- add table to grant users permissions to orgs --
+CREATE TABLE org_permissions (
+    user_id INTEGER NOT NULL REFERENCES users(id),
+    org_id VARCHAR(255) NOT NULL,
+    permission VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, org_id)
+);
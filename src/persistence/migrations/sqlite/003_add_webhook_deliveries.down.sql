@@ -0,0 +1,3 @@
+-- forget processed webhook deliveries and token revocations --
+DROP TABLE webhook_deliveries;
+ALTER TABLE users DROP COLUMN tokens_not_before;
@@ -0,0 +1,5 @@
+-- track whether a user may sign in: active, suspended or deleted --
+-- sqlite can't add constraints to existing tables, so the check goes on the column --
+ALTER TABLE users ADD COLUMN status VARCHAR(32) NOT NULL DEFAULT 'active' CHECK (status IN ('active', 'suspended', 'deleted'));
+ALTER TABLE users ADD COLUMN status_reason TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN status_changed_at TIMESTAMP;
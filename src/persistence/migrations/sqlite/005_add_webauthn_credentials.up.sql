@@ -0,0 +1,12 @@
+-- webauthn credentials (security keys, platform authenticators) used as a second factor --
+CREATE TABLE webauthn_credentials (
+    id BLOB PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id),
+    name VARCHAR(255) NOT NULL DEFAULT '',
+    -- json, as produced by the auth package --
+    credential BLOB NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_used_at TIMESTAMP
+);
+
+CREATE INDEX webauthn_credentials_user_id_idx ON webauthn_credentials (user_id);
@@ -0,0 +1,4 @@
+-- drop totp secrets, recovery codes and org policies --
+DROP TABLE org_policies;
+DROP TABLE recovery_codes;
+DROP TABLE totp_secrets;
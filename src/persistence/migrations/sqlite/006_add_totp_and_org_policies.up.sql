@@ -0,0 +1,24 @@
+-- totp secrets, encrypted by the service; unconfirmed until the first code is verified --
+CREATE TABLE totp_secrets (
+    user_id INTEGER PRIMARY KEY REFERENCES users(id),
+    secret BLOB NOT NULL,
+    confirmed BOOLEAN NOT NULL DEFAULT FALSE,
+    -- the last time step a code was accepted for, so codes can't be replayed --
+    last_used_step BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- one-time recovery codes, stored as sha-256 hashes --
+CREATE TABLE recovery_codes (
+    user_id INTEGER NOT NULL REFERENCES users(id),
+    code_hash BLOB NOT NULL,
+    used_at TIMESTAMP,
+    PRIMARY KEY (user_id, code_hash)
+);
+
+-- per-org requirements applied to the org's permissions (including its org/team grants) --
+CREATE TABLE org_policies (
+    org_id VARCHAR(255) PRIMARY KEY,
+    require_2fa BOOLEAN NOT NULL DEFAULT FALSE,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,2 @@
+-- drop every registered client --
+DROP TABLE clients;
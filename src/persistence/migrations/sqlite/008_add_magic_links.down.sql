@@ -0,0 +1,12 @@
+-- drop pending login links --
+DROP TABLE magic_links;
+
+-- email users can't exist without the provider column, so they are removed with everything referencing them --
+DELETE FROM org_permissions WHERE user_id IN (SELECT id FROM users WHERE provider = 'email');
+DELETE FROM webauthn_credentials WHERE user_id IN (SELECT id FROM users WHERE provider = 'email');
+DELETE FROM recovery_codes WHERE user_id IN (SELECT id FROM users WHERE provider = 'email');
+DELETE FROM totp_secrets WHERE user_id IN (SELECT id FROM users WHERE provider = 'email');
+DELETE FROM users WHERE provider = 'email';
+
+DROP INDEX users_email_login_idx;
+ALTER TABLE users DROP COLUMN provider;
@@ -0,0 +1,16 @@
+-- users who log in by email get negative ids, so they never collide with github ids --
+-- sqlite has no sequences; new email users take one less than the lowest id --
+ALTER TABLE users ADD COLUMN provider VARCHAR(32) NOT NULL DEFAULT 'github';
+CREATE UNIQUE INDEX users_email_login_idx ON users (LOWER(email)) WHERE provider = 'email';
+
+-- single-use login links, stored as sha-256 hashes of the token sent by email --
+CREATE TABLE magic_links (
+    token_hash BLOB PRIMARY KEY,
+    email VARCHAR(255) NOT NULL,
+    client_id VARCHAR(255) NOT NULL DEFAULT '',
+    redirect_uri TEXT NOT NULL,
+    scopes TEXT NOT NULL DEFAULT '[]',
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
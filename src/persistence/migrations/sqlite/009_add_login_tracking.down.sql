@@ -0,0 +1,7 @@
+-- drop the login history --
+DROP TABLE login_events;
+
+DROP INDEX users_last_login_at_idx;
+ALTER TABLE users DROP COLUMN login_count;
+ALTER TABLE users DROP COLUMN last_login_at;
+ALTER TABLE users DROP COLUMN updated_at;
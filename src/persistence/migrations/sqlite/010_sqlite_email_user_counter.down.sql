@@ -0,0 +1,3 @@
+-- new email users go back to taking one less than the lowest id --
+DROP TRIGGER take_email_user_id;
+DROP TABLE email_user_ids;
@@ -0,0 +1,12 @@
+-- sqlite has no sequences; email users take their ids from this counter, which starts below --
+-- the lowest id so far and is moved past each new email user by the inserting statement --
+CREATE TABLE email_user_ids (
+    id INTEGER PRIMARY KEY CHECK (id = 1),
+    next_id INT NOT NULL
+);
+INSERT INTO email_user_ids (id, next_id) SELECT 1, MIN(COALESCE(MIN(id), 0), 0) - 1 FROM users;
+
+CREATE TRIGGER take_email_user_id AFTER INSERT ON users WHEN NEW.provider = 'email'
+BEGIN
+    UPDATE email_user_ids SET next_id = MIN(next_id, NEW.id) - 1;
+END;
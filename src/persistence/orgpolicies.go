@@ -0,0 +1,68 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence/queries"
+)
+
+// OrgPolicy holds requirements applied to an org's permissions, including grants on its
+// "<org>/<team>" ids
+type OrgPolicy struct {
+	OrgID      string     `json:"org_id"`
+	Require2FA bool       `json:"require_2fa"`
+	UpdatedAt  *time.Time `json:"updated_at"`
+}
+
+type OrgPolicyTable struct {
+	db *dialectDB
+}
+
+func NewOrgPolicyTable(db *sql.DB) *OrgPolicyTable {
+	return &OrgPolicyTable{db: newDialectDB(db)}
+}
+
+// GetOrgPolicy returns the org's policy, or the default policy if none was set
+func (ot *OrgPolicyTable) GetOrgPolicy(ctx context.Context, orgID string) (*OrgPolicy, error) {
+	var policy OrgPolicy
+	var updatedAt sql.NullTime
+	err := ot.db.QueryRowContext(ctx, queries.GET_ORG_POLICY, orgID).Scan(&policy.OrgID, &policy.Require2FA, &updatedAt)
+	if err == sql.ErrNoRows {
+		return &OrgPolicy{OrgID: orgID}, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting org policy")
+	}
+	if updatedAt.Valid {
+		policy.UpdatedAt = &updatedAt.Time
+	}
+	return &policy, nil
+}
+
+func (ot *OrgPolicyTable) SetOrgPolicy(ctx context.Context, policy *OrgPolicy) error {
+	_, err := ot.db.ExecContext(ctx, queries.SET_ORG_POLICY, policy.OrgID, policy.Require2FA)
+	return errors.Wrap(err, "error setting org policy")
+}
+
+// GetOrgsRequiring2FA lists the orgs whose permissions need a second factor
+func (ot *OrgPolicyTable) GetOrgsRequiring2FA(ctx context.Context) ([]string, error) {
+	rows, err := ot.db.QueryContext(ctx, queries.GET_ORGS_REQUIRING_2FA)
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting org policies")
+	}
+	defer rows.Close()
+
+	orgIDs := []string{}
+	for rows.Next() {
+		var orgID string
+		if err := rows.Scan(&orgID); err != nil {
+			return nil, errors.Wrap(err, "error reading org policy")
+		}
+		orgIDs = append(orgIDs, orgID)
+	}
+	return orgIDs, rows.Err()
+}
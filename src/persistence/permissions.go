@@ -0,0 +1,142 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/pkg/errors"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence/queries"
+)
+
+type OrgPermission struct {
+	UserID     int32  `json:"user_id"`
+	OrgID      string `json:"org_id"`
+	Permission string `json:"permission"`
+}
+
+// UserPermission is a grant along with the login of the user holding it
+type UserPermission struct {
+	OrgPermission
+	LoginName string `json:"login"`
+}
+
+type PermissionTable struct {
+	db *dialectDB
+}
+
+func NewPermissionTable(db *sql.DB) *PermissionTable {
+	return &PermissionTable{db: newDialectDB(db)}
+}
+
+func scanPermissions(rows *sql.Rows) ([]*OrgPermission, error) {
+	defer rows.Close()
+
+	permissions := []*OrgPermission{}
+	for rows.Next() {
+		var permission OrgPermission
+		err := rows.Scan(&permission.UserID, &permission.OrgID, &permission.Permission)
+		if err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, &permission)
+	}
+	return permissions, rows.Err()
+}
+
+func (pt *PermissionTable) GetUserPermissions(ctx context.Context, userID int32) ([]*OrgPermission, error) {
+	rows, err := pt.db.QueryContext(ctx, queries.GET_USER_PERMISSIONS, userID)
+	if err != nil {
+		return nil, err
+	}
+	return scanPermissions(rows)
+}
+
+// GetOrgPermissions lists every grant on the org (or org/team)
+func (pt *PermissionTable) GetOrgPermissions(ctx context.Context, orgID string) ([]*OrgPermission, error) {
+	rows, err := pt.db.QueryContext(ctx, queries.GET_ORG_PERMISSIONS, orgID)
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting org permissions")
+	}
+	permissions, err := scanPermissions(rows)
+	return permissions, errors.Wrap(err, "error reading org permissions")
+}
+
+// GetPermissionsForUsers looks up the grants of several users at once
+func (pt *PermissionTable) GetPermissionsForUsers(ctx context.Context, userIDs []int32) ([]*UserPermission, error) {
+	rows, err := pt.db.QueryContext(ctx, queries.GET_ALL_USER_PERMISSIONS, pt.db.dialect.array(userIDs))
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting user permissions")
+	}
+	defer rows.Close()
+
+	permissions := []*UserPermission{}
+	for rows.Next() {
+		var permission UserPermission
+		err := rows.Scan(&permission.UserID, &permission.OrgID, &permission.Permission, &permission.LoginName)
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading user permissions")
+		}
+		permissions = append(permissions, &permission)
+	}
+	return permissions, errors.Wrap(rows.Err(), "error reading user permissions")
+}
+
+// GrantPermission gives the user the permission on the org, replacing any they had there.
+// Replacing a grant invalidates the user's tokens, since it may take access away. It
+// returns sql.ErrNoRows if the user does not exist.
+func (pt *PermissionTable) GrantPermission(ctx context.Context, userID int32, orgID, permission string) error {
+	tx, err := pt.db.BeginTx(ctx)
+	if err != nil {
+		return errors.Wrap(err, "error beginning transaction")
+	}
+	defer tx.Rollback()
+
+	var previous string
+	err = tx.QueryRowContext(ctx, queries.GET_ORG_PERMISSION_FOR_UPDATE, userID, orgID).Scan(&previous)
+	if err != nil && err != sql.ErrNoRows {
+		return errors.Wrap(err, "error getting current permission")
+	}
+
+	_, err = tx.ExecContext(ctx, queries.ADD_OR_UPDATE_ORG_PERMISSION, userID, orgID, permission)
+	if pt.db.dialect.isForeignKeyViolation(err) {
+		return sql.ErrNoRows
+	}
+	if err != nil {
+		return errors.Wrap(err, "error granting permission")
+	}
+
+	if previous != "" && previous != permission {
+		if _, err = tx.ExecContext(ctx, queries.REVOKE_USER_TOKENS, pt.db.dialect.array([]int32{userID})); err != nil {
+			return errors.Wrap(err, "error revoking user tokens")
+		}
+	}
+	return errors.Wrap(tx.Commit(), "error committing transaction")
+}
+
+// RevokePermission removes the user's grant on the org and invalidates their tokens. It
+// returns sql.ErrNoRows if there was no such grant.
+func (pt *PermissionTable) RevokePermission(ctx context.Context, userID int32, orgID string) error {
+	tx, err := pt.db.BeginTx(ctx)
+	if err != nil {
+		return errors.Wrap(err, "error beginning transaction")
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, queries.DELETE_ORG_PERMISSION, userID, orgID)
+	if err != nil {
+		return errors.Wrap(err, "error revoking permission")
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "error checking revoked permission")
+	}
+	if deleted == 0 {
+		return sql.ErrNoRows
+	}
+
+	if _, err = tx.ExecContext(ctx, queries.REVOKE_USER_TOKENS, pt.db.dialect.array([]int32{userID})); err != nil {
+		return errors.Wrap(err, "error revoking user tokens")
+	}
+	return errors.Wrap(tx.Commit(), "error committing transaction")
+}
@@ -0,0 +1,87 @@
+package persistence_test
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPermissionTable(t *testing.T) {
+	requirePostgres(t)
+	ctx := context.Background()
+	userTable := persistence.NewUserTable(testDB)
+	permissionTable := persistence.NewPermissionTable(testDB)
+
+	for _, user := range []persistence.UserInfo{{ID: 38, LoginName: "granted"}, {ID: 39, LoginName: "also_granted"}} {
+		addTestUser(t, testDB, &user)
+	}
+
+	t.Run("Test granting permissions", func(t *testing.T) {
+		require.NoError(t, permissionTable.GrantPermission(ctx, 38, "coopstools", "read"))
+		require.NoError(t, permissionTable.GrantPermission(ctx, 38, "coopstools/ops", "write"))
+		require.NoError(t, permissionTable.GrantPermission(ctx, 39, "coopstools", "admin"))
+
+		permissions, err := permissionTable.GetUserPermissions(ctx, 38)
+		require.NoError(t, err, "Failed to get user permissions")
+		assert.ElementsMatch(t, []*persistence.OrgPermission{
+			{UserID: 38, OrgID: "coopstools", Permission: "read"},
+			{UserID: 38, OrgID: "coopstools/ops", Permission: "write"},
+		}, permissions)
+
+		permissions, err = permissionTable.GetOrgPermissions(ctx, "coopstools")
+		require.NoError(t, err, "Failed to get org permissions")
+		assert.Equal(t, []*persistence.OrgPermission{
+			{UserID: 38, OrgID: "coopstools", Permission: "read"},
+			{UserID: 39, OrgID: "coopstools", Permission: "admin"},
+		}, permissions)
+
+		state, err := userTable.GetAuthState(ctx, 38)
+		require.NoError(t, err, "Failed to get auth state")
+		assert.Nil(t, state.TokensNotBefore, "new grants shouldn't end sessions")
+	})
+
+	t.Run("Test looking up several users", func(t *testing.T) {
+		permissions, err := permissionTable.GetPermissionsForUsers(ctx, []int32{38, 39, 404})
+		require.NoError(t, err, "Failed to get permissions")
+		assert.Len(t, permissions, 3)
+		for _, permission := range permissions {
+			if permission.UserID == 39 {
+				assert.Equal(t, "also_granted", permission.LoginName)
+			}
+		}
+	})
+
+	t.Run("Test replacing a grant revokes tokens", func(t *testing.T) {
+		require.NoError(t, permissionTable.GrantPermission(ctx, 39, "coopstools", "read"))
+
+		permissions, err := permissionTable.GetUserPermissions(ctx, 39)
+		require.NoError(t, err, "Failed to get user permissions")
+		assert.Equal(t, []*persistence.OrgPermission{{UserID: 39, OrgID: "coopstools", Permission: "read"}}, permissions)
+
+		state, err := userTable.GetAuthState(ctx, 39)
+		require.NoError(t, err, "Failed to get auth state")
+		assert.NotNil(t, state.TokensNotBefore)
+	})
+
+	t.Run("Test revoking a grant", func(t *testing.T) {
+		require.NoError(t, permissionTable.RevokePermission(ctx, 38, "coopstools/ops"))
+
+		permissions, err := permissionTable.GetOrgPermissions(ctx, "coopstools/ops")
+		require.NoError(t, err, "Failed to get org permissions")
+		assert.Empty(t, permissions)
+
+		state, err := userTable.GetAuthState(ctx, 38)
+		require.NoError(t, err, "Failed to get auth state")
+		assert.NotNil(t, state.TokensNotBefore)
+
+		assert.ErrorIs(t, permissionTable.RevokePermission(ctx, 38, "coopstools/ops"), sql.ErrNoRows)
+	})
+
+	t.Run("Test granting to a missing user", func(t *testing.T) {
+		assert.ErrorIs(t, permissionTable.GrantPermission(ctx, 404, "coopstools", "read"), sql.ErrNoRows)
+	})
+}
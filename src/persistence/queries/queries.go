@@ -11,16 +11,60 @@ const (
 		ORDER BY version DESC
 	`
 
+	GET_MIGRATION_FAILURES = `
+		SELECT version, direction, filename, statements_applied, error, failed_at 
+		FROM migration_failures ORDER BY version
+	`
+
+	RECORD_MIGRATION_FAILURE = `
+		INSERT INTO migration_failures (version, direction, filename, statements_applied, error) 
+		VALUES ($1, $2, $3, $4, $5) 
+		ON CONFLICT (version) 
+		DO UPDATE SET direction = $2, filename = $3, statements_applied = $4, error = $5, failed_at = CURRENT_TIMESTAMP
+	`
+
+	CLEAR_MIGRATION_FAILURE = `
+		DELETE FROM migration_failures WHERE version = $1
+	`
+
+	// Session level, so the lock outlives the transactions of a migration run
+	TRY_MIGRATION_LOCK = `
+		SELECT pg_try_advisory_lock($1)
+	`
+
+	RELEASE_MIGRATION_LOCK = `
+		SELECT pg_advisory_unlock($1)
+	`
+
+	GET_APPLIED_MIGRATIONS = `
+		SELECT version, filename, checksum FROM version_tracking 
+		ORDER BY version
+	`
+
 	INSERT_VERSION = `
-		INSERT INTO version_tracking (version) 
-		VALUES ($1)
+		INSERT INTO version_tracking (version, filename, checksum) 
+		VALUES ($1, $2, $3)
+	`
+
+	// Fills in versions applied before checksums were recorded
+	BACKFILL_VERSION_CHECKSUM = `
+		UPDATE version_tracking SET filename = $2, checksum = $3 
+		WHERE version = $1 AND checksum = ''
 	`
 
+	DELETE_VERSION = `
+		DELETE FROM version_tracking WHERE version = $1
+	`
+
+	// updated_at only moves when the profile changes. Deleted users keep their
+	// anonymized profile.
 	ADD_OR_UPDATE_USER = `
-		INSERT INTO users (id, login_name, avatar_url, email) 
-		VALUES ($1, $2, $3, $4) 
+		INSERT INTO users (id, login_name, avatar_url, email, updated_at) 
+		VALUES ($1, $2, $3, $4, NOW()) 
 		ON CONFLICT (id) 
-		DO UPDATE SET login_name = $2, avatar_url = $3, email = $4
+		DO UPDATE SET login_name = $2, avatar_url = $3, email = $4, updated_at = NOW() 
+		WHERE users.status <> 'deleted' 
+		AND (users.login_name <> $2 OR users.avatar_url <> $3 OR users.email <> $4)
 	`
 
 	GET_USER_BY_ID = `
@@ -31,6 +75,77 @@ const (
 		SELECT id, login_name, avatar_url, email FROM users
 	`
 
+	RECORD_LOGIN = `
+		UPDATE users SET last_login_at = NOW(), login_count = login_count + 1 WHERE id = $1
+	`
+
+	ADD_LOGIN_EVENT = `
+		INSERT INTO login_events (user_id, ip, user_agent, provider) VALUES ($1, $2, $3, $4)
+	`
+
+	GET_LOGIN_EVENTS = `
+		SELECT user_id, logged_in_at, ip, user_agent, provider FROM login_events 
+		WHERE user_id = $1 
+		ORDER BY logged_in_at DESC, id DESC 
+		LIMIT $2
+	`
+
+	GET_USER_ACTIVITY = `
+		SELECT id, login_name, avatar_url, email, provider, status, created_at, updated_at, last_login_at, login_count 
+		FROM users WHERE id = $1
+	`
+
+	// Users who never logged in count from when they were added
+	GET_INACTIVE_USERS = `
+		SELECT id, login_name, avatar_url, email, provider, status, created_at, updated_at, last_login_at, login_count 
+		FROM users 
+		WHERE COALESCE(last_login_at, created_at) < $1 
+		ORDER BY last_login_at NULLS FIRST, id
+	`
+
+	GET_USER_AUTH_STATE = `
+		SELECT tokens_not_before, status FROM users WHERE id = $1
+	`
+
+	GET_USER_STATUS = `
+		SELECT status, status_reason, status_changed_at FROM users WHERE id = $1
+	`
+
+	// Leaving 'active' revokes the user's tokens, so reactivating them doesn't bring back
+	// the ones issued before
+	SET_USER_STATUS = `
+		UPDATE users SET status = $2, status_reason = $3, status_changed_at = NOW(), 
+			tokens_not_before = CASE WHEN $2 <> 'active' THEN NOW() ELSE tokens_not_before END 
+		WHERE id = $1
+	`
+
+	// Keeps the row as a tombstone, so the id isn't reused and a returning GitHub user
+	// stays deleted. The placeholder login and email are passed in as $2.
+	ANONYMIZE_USER = `
+		UPDATE users SET login_name = $2, avatar_url = '', email = $2, 
+			status = 'deleted', status_reason = $3, status_changed_at = NOW(), 
+			tokens_not_before = NOW(), updated_at = NOW(), last_login_at = NULL, login_count = 0 
+		WHERE id = $1
+	`
+
+	// Locks the user while their data is deleted
+	GET_USER_EMAIL_FOR_UPDATE = `
+		SELECT email FROM users WHERE id = $1
+		FOR UPDATE
+	`
+
+	DELETE_LOGIN_EVENTS = `
+		DELETE FROM login_events WHERE user_id = $1
+	`
+
+	DELETE_USER_PERMISSIONS = `
+		DELETE FROM org_permissions WHERE user_id = $1
+	`
+
+	REVOKE_USER_TOKENS = `
+		UPDATE users SET tokens_not_before = NOW() WHERE id = ANY($1)
+	`
+
 	// Given a list of user ids, return a list of permissions for each user with their login_name
 	GET_ALL_USER_PERMISSIONS = `
 		SELECT user_id, org_id, permission, login_name FROM org_permissions 
@@ -38,10 +153,184 @@ const (
 		WHERE user_id = ANY($1)
 	`
 
+	GET_USER_PERMISSIONS = `
+		SELECT user_id, org_id, permission FROM org_permissions WHERE user_id = $1
+	`
+
+	GET_ORG_PERMISSIONS = `
+		SELECT user_id, org_id, permission FROM org_permissions WHERE org_id = $1
+		ORDER BY user_id
+	`
+
+	// Locks the grant so a concurrent change can't slip between reading and replacing it
+	GET_ORG_PERMISSION_FOR_UPDATE = `
+		SELECT permission FROM org_permissions WHERE user_id = $1 AND org_id = $2
+		FOR UPDATE
+	`
+
 	ADD_OR_UPDATE_ORG_PERMISSION = `
 		INSERT INTO org_permissions (user_id, org_id, permission) 
 		VALUES ($1, $2, $3) 
 		ON CONFLICT (user_id, org_id) 
 		DO UPDATE SET permission = $3
 	 `
+
+	DELETE_ORG_PERMISSION = `
+		DELETE FROM org_permissions WHERE user_id = $1 AND org_id = $2
+	`
+
+	// Remove a user's permissions on an org and on its teams
+	DELETE_USER_ORG_PERMISSIONS = `
+		DELETE FROM org_permissions WHERE user_id = $1 AND (org_id = $2 OR org_id LIKE $2 || '/%')
+	`
+
+	// Remove every permission granted for an org, returning the affected users
+	DELETE_ORG_PERMISSIONS_FOR_ORG = `
+		DELETE FROM org_permissions WHERE org_id = $1
+		RETURNING user_id
+	`
+
+	// Inserts nothing if the delivery was already recorded
+	RECORD_WEBHOOK_DELIVERY = `
+		INSERT INTO webhook_deliveries (delivery_id, event) 
+		VALUES ($1, $2) 
+		ON CONFLICT (delivery_id) DO NOTHING
+	`
+
+	ADD_WEBAUTHN_CREDENTIAL = `
+		INSERT INTO webauthn_credentials (id, user_id, name, credential) 
+		VALUES ($1, $2, $3, $4)
+	`
+
+	GET_WEBAUTHN_CREDENTIALS = `
+		SELECT id, user_id, name, credential, created_at, last_used_at FROM webauthn_credentials 
+		WHERE user_id = $1 
+		ORDER BY created_at
+	`
+
+	// Stores the credential's new sign count after a successful assertion
+	UPDATE_WEBAUTHN_CREDENTIAL = `
+		UPDATE webauthn_credentials SET credential = $3, last_used_at = NOW() 
+		WHERE user_id = $1 AND id = $2
+	`
+
+	DELETE_WEBAUTHN_CREDENTIAL = `
+		DELETE FROM webauthn_credentials WHERE user_id = $1 AND id = $2
+	`
+
+	DELETE_WEBAUTHN_CREDENTIALS_FOR_USER = `
+		DELETE FROM webauthn_credentials WHERE user_id = $1
+	`
+
+	// Stores a new unconfirmed secret, unless the user already has a confirmed one
+	SAVE_TOTP_SECRET = `
+		INSERT INTO totp_secrets (user_id, secret) 
+		VALUES ($1, $2) 
+		ON CONFLICT (user_id) 
+		DO UPDATE SET secret = $2, confirmed = FALSE, last_used_step = 0, created_at = NOW() 
+		WHERE totp_secrets.confirmed = FALSE
+	`
+
+	GET_TOTP_SECRET = `
+		SELECT user_id, secret, confirmed, last_used_step FROM totp_secrets WHERE user_id = $1
+	`
+
+	// Accepts a code's time step only once, confirming the secret on first use
+	USE_TOTP_STEP = `
+		UPDATE totp_secrets SET last_used_step = $2, confirmed = TRUE 
+		WHERE user_id = $1 AND last_used_step < $2
+	`
+
+	DELETE_TOTP_SECRET = `
+		DELETE FROM totp_secrets WHERE user_id = $1
+	`
+
+	DELETE_RECOVERY_CODES = `
+		DELETE FROM recovery_codes WHERE user_id = $1
+	`
+
+	ADD_RECOVERY_CODE = `
+		INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)
+	`
+
+	USE_RECOVERY_CODE = `
+		UPDATE recovery_codes SET used_at = NOW() 
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL
+	`
+
+	HAS_SECOND_FACTOR = `
+		SELECT EXISTS (SELECT 1 FROM totp_secrets WHERE user_id = $1 AND confirmed) 
+		OR EXISTS (SELECT 1 FROM webauthn_credentials WHERE user_id = $1)
+	`
+
+	// Whether the user confirmed a totp secret, and how many recovery codes they have left
+	GET_SECOND_FACTOR_SUMMARY = `
+		SELECT EXISTS (SELECT 1 FROM totp_secrets WHERE user_id = $1 AND confirmed), 
+			(SELECT COUNT(*) FROM recovery_codes WHERE user_id = $1 AND used_at IS NULL)
+	`
+
+	GET_ORG_POLICY = `
+		SELECT org_id, require_2fa, updated_at FROM org_policies WHERE org_id = $1
+	`
+
+	SET_ORG_POLICY = `
+		INSERT INTO org_policies (org_id, require_2fa) 
+		VALUES ($1, $2) 
+		ON CONFLICT (org_id) 
+		DO UPDATE SET require_2fa = $2, updated_at = NOW()
+	`
+
+	GET_ORGS_REQUIRING_2FA = `
+		SELECT org_id FROM org_policies WHERE require_2fa
+	`
+
+	GET_CLIENTS = `
+		SELECT client_id, name, secret_hash, redirect_uris, allowed_origins, allowed_scopes, 
+			token_lifetime_seconds, token_path, audience, created_at, updated_at 
+		FROM clients ORDER BY client_id
+	`
+
+	SAVE_CLIENT = `
+		INSERT INTO clients (client_id, name, redirect_uris, allowed_origins, allowed_scopes, token_lifetime_seconds, token_path, audience) 
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8) 
+		ON CONFLICT (client_id) 
+		DO UPDATE SET name = $2, redirect_uris = $3, allowed_origins = $4, allowed_scopes = $5, 
+			token_lifetime_seconds = $6, token_path = $7, audience = $8, updated_at = NOW()
+	`
+
+	SET_CLIENT_SECRET = `
+		UPDATE clients SET secret_hash = $2, updated_at = NOW() WHERE client_id = $1
+	`
+
+	DELETE_CLIENT = `
+		DELETE FROM clients WHERE client_id = $1
+	`
+
+	// Email users are keyed by their lowercased email
+	GET_OR_ADD_EMAIL_USER = `
+		INSERT INTO users (id, login_name, avatar_url, email, provider, updated_at) 
+		VALUES (nextval('email_user_ids'), $1, '', $1, 'email', NOW()) 
+		ON CONFLICT (LOWER(email)) WHERE provider = 'email' 
+		DO UPDATE SET email = users.email 
+		RETURNING id, login_name, avatar_url, email
+	`
+
+	ADD_MAGIC_LINK = `
+		INSERT INTO magic_links (token_hash, email, client_id, redirect_uri, scopes, expires_at) 
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`
+
+	DELETE_MAGIC_LINKS_FOR_EMAIL = `
+		DELETE FROM magic_links WHERE LOWER(email) = LOWER($1)
+	`
+
+	DELETE_EXPIRED_MAGIC_LINKS = `
+		DELETE FROM magic_links WHERE expires_at < NOW() - INTERVAL '1 day'
+	`
+
+	USE_MAGIC_LINK = `
+		UPDATE magic_links SET used_at = NOW() 
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > NOW() 
+		RETURNING email, client_id, redirect_uri, scopes, expires_at
+	`
 )
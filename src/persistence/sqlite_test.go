@@ -0,0 +1,187 @@
+package persistence_test
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence"
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence/storetest"
+)
+
+func openSQLite(t testing.TB) *sql.DB {
+	db, err := persistence.Open("sqlite://"+filepath.Join(t.TempDir(), "zuul.db"), persistence.PoolConfig{})
+	require.NoError(t, err, "Failed to open sqlite db")
+	t.Cleanup(func() { db.Close() })
+	require.Equal(t, persistence.SQLite, persistence.DialectOf(db))
+
+	require.NoError(t, persistence.Migrate(db, time.Minute), "Failed to migrate sqlite db")
+	return db
+}
+
+func TestSQLiteStore(t *testing.T) {
+	db := openSQLite(t)
+	storetest.Run(t, persistence.NewUserTable(db), persistence.NewPermissionTable(db))
+}
+
+func TestSQLiteMigrations(t *testing.T) {
+	ctx := context.Background()
+	db := openSQLite(t)
+	migrator, err := persistence.NewMigrator(db, time.Minute)
+	require.NoError(t, err)
+
+	current, err := migrator.CurrentVersion()
+	require.NoError(t, err)
+	latest, err := migrator.LatestVersion()
+	require.NoError(t, err)
+	assert.Equal(t, 10, current)
+	assert.Equal(t, 10, latest)
+
+	// Reverting keeps what the irreversible migrations created
+	require.NoError(t, persistence.NewUserTable(db).UpdateUser(ctx, &persistence.UserInfo{ID: 1, LoginName: "kept"}))
+	require.NoError(t, migrator.MigrateTo(1, false))
+	var count int
+	require.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM users`).Scan(&count))
+	assert.Equal(t, 1, count)
+
+	require.NoError(t, migrator.MigrateTo(10, false))
+	require.NoError(t, persistence.Migrate(db, time.Minute), "Migrating again should change nothing")
+
+	_, err = persistence.Open("mysql://localhost/zuul", persistence.PoolConfig{})
+	assert.Error(t, err, "unknown schemes should be refused")
+}
+
+// Email users' ids come from a counter, so they start at -1 and aren't reused once deleted
+func TestSQLiteEmailUserIDs(t *testing.T) {
+	ctx := context.Background()
+	db := openSQLite(t)
+	userTable := persistence.NewUserTable(db)
+
+	first, err := userTable.GetOrAddEmailUser(ctx, "first@example.com")
+	require.NoError(t, err, "Failed to add email user")
+	assert.Equal(t, int32(-1), first.ID)
+
+	_, err = db.Exec(`DELETE FROM users WHERE id = $1`, first.ID)
+	require.NoError(t, err)
+	second, err := userTable.GetOrAddEmailUser(ctx, "second@example.com")
+	require.NoError(t, err, "Failed to add email user")
+	assert.Equal(t, int32(-2), second.ID)
+
+	again, err := userTable.GetOrAddEmailUser(ctx, "Second@Example.com")
+	require.NoError(t, err)
+	assert.Equal(t, second.ID, again.ID)
+	third, err := userTable.GetOrAddEmailUser(ctx, "third@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, int32(-3), third.ID, "finding an existing user shouldn't use up an id")
+}
+
+func BenchmarkSQLiteLogin(b *testing.B) {
+	db := openSQLite(b)
+	storetest.BenchmarkLogin(b, persistence.NewUserTable(db), persistence.NewPermissionTable(db))
+}
+
+// The Postgres specific parts of the queries, like arrays and NOW(), are rewritten for
+// SQLite
+func TestSQLiteTables(t *testing.T) {
+	ctx := context.Background()
+	db := openSQLite(t)
+	userTable := persistence.NewUserTable(db)
+	require.NoError(t, userTable.UpdateUser(ctx, &persistence.UserInfo{ID: 40, LoginName: "lite"}))
+
+	t.Run("Test clients keep their lists", func(t *testing.T) {
+		clientTable := persistence.NewClientTable(db)
+		err := clientTable.SaveClient(ctx, &persistence.Client{
+			ClientID:     "resume",
+			RedirectURIs: []string{"https://resume.example.com/data"},
+			TokenPath:    "/",
+		})
+		require.NoError(t, err, "Failed to save client")
+		require.NoError(t, clientTable.SetClientSecret(ctx, "resume", []byte("hash")))
+
+		clients, err := clientTable.GetClients(ctx)
+		require.NoError(t, err, "Failed to get clients")
+		require.Len(t, clients, 1)
+		assert.Equal(t, []string{"https://resume.example.com/data"}, clients[0].RedirectURIs)
+		assert.Empty(t, clients[0].AllowedScopes)
+		assert.Equal(t, []byte("hash"), clients[0].SecretHash)
+		assert.NotNil(t, clients[0].UpdatedAt)
+	})
+
+	t.Run("Test magic links expire", func(t *testing.T) {
+		linkTable := persistence.NewMagicLinkTable(db)
+		for _, link := range []*persistence.MagicLink{
+			{TokenHash: []byte("fresh"), Email: "lite@example.com", Scopes: []string{"guest"}, ExpiresAt: time.Now().Add(time.Minute)},
+			{TokenHash: []byte("stale"), Email: "lite@example.com", ExpiresAt: time.Now().Add(-time.Minute)},
+		} {
+			require.NoError(t, linkTable.AddMagicLink(ctx, link), "Failed to add link")
+		}
+
+		link, err := linkTable.UseMagicLink(ctx, []byte("fresh"))
+		require.NoError(t, err, "Failed to use link")
+		assert.Equal(t, []string{"guest"}, link.Scopes)
+		_, err = linkTable.UseMagicLink(ctx, []byte("fresh"))
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+		_, err = linkTable.UseMagicLink(ctx, []byte("stale"))
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+	})
+
+	t.Run("Test totp secrets", func(t *testing.T) {
+		mfaTable := persistence.NewMFATable(db)
+		saved, err := mfaTable.SaveTOTPSecret(ctx, 40, []byte("secret"))
+		require.NoError(t, err, "Failed to save secret")
+		assert.True(t, saved)
+
+		used, err := mfaTable.UseTOTPStep(ctx, 40, 100)
+		require.NoError(t, err)
+		assert.True(t, used)
+		used, err = mfaTable.UseTOTPStep(ctx, 40, 100)
+		require.NoError(t, err)
+		assert.False(t, used, "steps can't be replayed")
+
+		saved, err = mfaTable.SaveTOTPSecret(ctx, 40, []byte("replacement"))
+		require.NoError(t, err)
+		assert.False(t, saved, "confirmed secrets are kept")
+		enrolled, err := mfaTable.HasSecondFactor(ctx, 40)
+		require.NoError(t, err)
+		assert.True(t, enrolled)
+	})
+
+	t.Run("Test webhook deliveries revoke tokens", func(t *testing.T) {
+		require.NoError(t, persistence.NewPermissionTable(db).GrantPermission(ctx, 40, "lite", "read"))
+		webhookTable := persistence.NewWebhookTable(db)
+		delivery := &persistence.WebhookDelivery{ID: "lite-1", Event: "organization", RevokedOrgs: []string{"lite"}}
+
+		applied, err := webhookTable.ApplyDelivery(ctx, delivery)
+		require.NoError(t, err, "Failed to apply delivery")
+		assert.True(t, applied)
+		applied, err = webhookTable.ApplyDelivery(ctx, delivery)
+		require.NoError(t, err)
+		assert.False(t, applied)
+
+		state, err := userTable.GetAuthState(ctx, 40)
+		require.NoError(t, err)
+		assert.NotNil(t, state.TokensNotBefore)
+	})
+
+	t.Run("Test removed members lose their team grants", func(t *testing.T) {
+		permissionTable := persistence.NewPermissionTable(db)
+		require.NoError(t, permissionTable.GrantPermission(ctx, 40, "crew", "read"))
+		require.NoError(t, permissionTable.GrantPermission(ctx, 40, "crew/deckhands", "write"))
+		require.NoError(t, permissionTable.GrantPermission(ctx, 40, "crewmates", "read"))
+
+		applied, err := persistence.NewWebhookTable(db).ApplyDelivery(ctx, &persistence.WebhookDelivery{
+			ID: "lite-2", Event: "organization", RevokedUserOrgs: []persistence.OrgPermission{{UserID: 40, OrgID: "crew"}},
+		})
+		require.NoError(t, err, "Failed to apply delivery")
+		assert.True(t, applied)
+
+		permissions, err := permissionTable.GetUserPermissions(ctx, 40)
+		require.NoError(t, err)
+		assert.Equal(t, []*persistence.OrgPermission{{UserID: 40, OrgID: "crewmates", Permission: "read"}}, permissions)
+	})
+}
@@ -0,0 +1,37 @@
+package persistence
+
+import (
+	"context"
+	"time"
+)
+
+// UserStore keeps users and the state the auth middleware checks. Missing users are
+// reported as sql.ErrNoRows by every backend. Methods take the caller's context, so
+// cancellations and deadlines reach the db.
+type UserStore interface {
+	UpdateUser(ctx context.Context, user *UserInfo) error
+	GetUserByID(ctx context.Context, id int32) (*UserInfo, error)
+	GetOrAddEmailUser(ctx context.Context, email string) (*UserInfo, error)
+	GetAllUsers(ctx context.Context) ([]*UserInfo, error)
+	GetAuthState(ctx context.Context, id int32) (*AuthState, error)
+	GetUserStatus(ctx context.Context, id int32) (*UserStatus, error)
+	SetUserStatus(ctx context.Context, id int32, status, reason string) error
+	RecordLogin(ctx context.Context, event *LoginEvent) error
+	GetLoginEvents(ctx context.Context, userID int32, limit int) ([]*LoginEvent, error)
+	GetInactiveUsers(ctx context.Context, since time.Time) ([]*UserActivity, error)
+}
+
+// PermissionStore keeps the permissions users hold on orgs (or org/teams). Replacing or
+// revoking a grant invalidates the user's tokens.
+type PermissionStore interface {
+	GetUserPermissions(ctx context.Context, userID int32) ([]*OrgPermission, error)
+	GetOrgPermissions(ctx context.Context, orgID string) ([]*OrgPermission, error)
+	GetPermissionsForUsers(ctx context.Context, userIDs []int32) ([]*UserPermission, error)
+	GrantPermission(ctx context.Context, userID int32, orgID, permission string) error
+	RevokePermission(ctx context.Context, userID int32, orgID string) error
+}
+
+var (
+	_ UserStore       = (*UserTable)(nil)
+	_ PermissionStore = (*PermissionTable)(nil)
+)
@@ -0,0 +1,32 @@
+package persistence_test
+
+import (
+	"testing"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence"
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence/storetest"
+)
+
+func TestPostgresStore(t *testing.T) {
+	requirePostgres(t)
+	deleteUsersOnCleanup(t, testDB, 5000, 5001, 5002, 5004, 5005)
+	deleteEmailUserOnCleanup(t, testDB, "conformance@example.com")
+	storetest.Run(t, persistence.NewUserTable(testDB), persistence.NewPermissionTable(testDB))
+}
+
+// Statements are prepared once per connection and cached. describe_exec asks Postgres to
+// describe every query again, roughly the round trips of preparing a statement per call.
+func BenchmarkPostgresLogin(b *testing.B) {
+	requirePostgres(b)
+	b.Run("cached statements", func(b *testing.B) {
+		storetest.BenchmarkLogin(b, persistence.NewUserTable(testDB), persistence.NewPermissionTable(testDB))
+	})
+	b.Run("describe every call", func(b *testing.B) {
+		db, err := persistence.Open(testConfig.DatabaseURL+"&default_query_exec_mode=describe_exec", persistence.PoolConfig{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer db.Close()
+		storetest.BenchmarkLogin(b, persistence.NewUserTable(db), persistence.NewPermissionTable(db))
+	})
+}
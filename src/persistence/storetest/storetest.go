@@ -0,0 +1,260 @@
+// Package storetest holds the tests every storage backend has to pass, so the in-memory
+// store used by handler tests behaves like the real ones
+package storetest
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence"
+)
+
+// Run tests the backend's user and permission stores. It only touches users 5000 to 5002,
+// 5004 and 5005, the storetest org and one email user, so the stores may hold other data.
+func Run(t *testing.T, users persistence.UserStore, permissions persistence.PermissionStore) {
+	t.Run("Users", func(t *testing.T) { testUsers(t, users) })
+	t.Run("Logins", func(t *testing.T) { testLogins(t, users) })
+	t.Run("Permissions", func(t *testing.T) { testPermissions(t, users, permissions) })
+}
+
+// BenchmarkLogin runs the queries of a GitHub login: saving the user, checking their
+// status, loading their permissions and recording the login. It uses user 5003 and the
+// storetest_login org.
+func BenchmarkLogin(b *testing.B, users persistence.UserStore, permissions persistence.PermissionStore) {
+	ctx := context.Background()
+	user := &persistence.UserInfo{ID: 5003, LoginName: "benchmarked", AvatarURL: "https://github.com/c.png"}
+	require.NoError(b, users.UpdateUser(ctx, user))
+	require.NoError(b, permissions.GrantPermission(ctx, user.ID, "storetest_login", "read"))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := users.UpdateUser(ctx, user); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := users.GetAuthState(ctx, user.ID); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := permissions.GetUserPermissions(ctx, user.ID); err != nil {
+			b.Fatal(err)
+		}
+		if err := users.RecordLogin(ctx, &persistence.LoginEvent{UserID: user.ID, IP: "192.0.2.1", Provider: "github"}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func testUsers(t *testing.T, users persistence.UserStore) {
+	ctx := context.Background()
+	t.Run("Test adding and updating a user", func(t *testing.T) {
+		require.NoError(t, users.UpdateUser(ctx, &persistence.UserInfo{ID: 5000, LoginName: "conformer", AvatarURL: "https://github.com/a.png", Email: "a@example.com"}))
+		require.NoError(t, users.UpdateUser(ctx, &persistence.UserInfo{ID: 5000, LoginName: "conformer", AvatarURL: "https://github.com/b.png", Email: "b@example.com"}))
+
+		user, err := users.GetUserByID(ctx, 5000)
+		require.NoError(t, err)
+		assert.Equal(t, &persistence.UserInfo{ID: 5000, LoginName: "conformer", AvatarURL: "https://github.com/b.png", Email: "b@example.com"}, user)
+
+		all, err := users.GetAllUsers(ctx)
+		require.NoError(t, err)
+		assert.Contains(t, all, user)
+
+		_, err = users.GetUserByID(ctx, 5999)
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+	})
+
+	t.Run("Test new users are active", func(t *testing.T) {
+		state, err := users.GetAuthState(ctx, 5000)
+		require.NoError(t, err)
+		assert.Equal(t, persistence.UserStatusActive, state.Status)
+		assert.Nil(t, state.TokensNotBefore)
+
+		_, err = users.GetAuthState(ctx, 5999)
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+	})
+
+	t.Run("Test changing a user's status", func(t *testing.T) {
+		require.NoError(t, users.SetUserStatus(ctx, 5000, persistence.UserStatusSuspended, "conformance"))
+
+		status, err := users.GetUserStatus(ctx, 5000)
+		require.NoError(t, err)
+		assert.Equal(t, persistence.UserStatusSuspended, status.Status)
+		assert.Equal(t, "conformance", status.Reason)
+		assert.NotNil(t, status.ChangedAt)
+		state, err := users.GetAuthState(ctx, 5000)
+		require.NoError(t, err)
+		assert.Equal(t, persistence.UserStatusSuspended, state.Status)
+
+		require.NotNil(t, state.TokensNotBefore, "suspending should revoke the user's tokens")
+		revokedAt := *state.TokensNotBefore
+
+		require.NoError(t, users.SetUserStatus(ctx, 5000, persistence.UserStatusActive, ""))
+		state, err = users.GetAuthState(ctx, 5000)
+		require.NoError(t, err)
+		assert.Equal(t, persistence.UserStatusActive, state.Status)
+		require.NotNil(t, state.TokensNotBefore, "reactivating should keep the old tokens revoked")
+		assert.True(t, revokedAt.Equal(*state.TokensNotBefore))
+		assert.ErrorIs(t, users.SetUserStatus(ctx, 5999, persistence.UserStatusActive, ""), sql.ErrNoRows)
+		_, err = users.GetUserStatus(ctx, 5999)
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+	})
+
+	t.Run("Test deleted users keep their profile", func(t *testing.T) {
+		require.NoError(t, users.UpdateUser(ctx, &persistence.UserInfo{ID: 5005, LoginName: "deleted-5005"}))
+		require.NoError(t, users.SetUserStatus(ctx, 5005, persistence.UserStatusDeleted, "conformance"))
+		require.NoError(t, users.UpdateUser(ctx, &persistence.UserInfo{ID: 5005, LoginName: "returning", Email: "back@example.com"}))
+
+		user, err := users.GetUserByID(ctx, 5005)
+		require.NoError(t, err)
+		assert.Equal(t, "deleted-5005", user.LoginName)
+		assert.Empty(t, user.Email)
+	})
+
+	t.Run("Test email users", func(t *testing.T) {
+		user, err := users.GetOrAddEmailUser(ctx, "conformance@example.com")
+		require.NoError(t, err)
+		assert.Less(t, user.ID, int32(0))
+		assert.Equal(t, "conformance@example.com", user.LoginName)
+		assert.Equal(t, "conformance@example.com", user.Email)
+
+		again, err := users.GetOrAddEmailUser(ctx, "Conformance@Example.com")
+		require.NoError(t, err)
+		assert.Equal(t, user.ID, again.ID, "emails should match regardless of case")
+
+		state, err := users.GetAuthState(ctx, user.ID)
+		require.NoError(t, err)
+		assert.Equal(t, persistence.UserStatusActive, state.Status)
+	})
+}
+
+func testLogins(t *testing.T, users persistence.UserStore) {
+	ctx := context.Background()
+	require.NoError(t, users.UpdateUser(ctx, &persistence.UserInfo{ID: 5004, LoginName: "returning"}))
+
+	t.Run("Test recording logins", func(t *testing.T) {
+		require.NoError(t, users.RecordLogin(ctx, &persistence.LoginEvent{UserID: 5004, IP: "192.0.2.1", UserAgent: "first", Provider: "github"}))
+		require.NoError(t, users.RecordLogin(ctx, &persistence.LoginEvent{UserID: 5004, IP: "192.0.2.2", UserAgent: "second", Provider: "github"}))
+
+		events, err := users.GetLoginEvents(ctx, 5004, 10)
+		require.NoError(t, err)
+		require.Len(t, events, 2)
+		assert.Equal(t, "second", events[0].UserAgent, "newest first")
+		assert.Equal(t, "192.0.2.2", events[0].IP)
+		assert.Equal(t, "github", events[0].Provider)
+		assert.False(t, events[0].At.IsZero())
+
+		events, err = users.GetLoginEvents(ctx, 5004, 1)
+		require.NoError(t, err)
+		require.Len(t, events, 1)
+		assert.Equal(t, "second", events[0].UserAgent)
+
+		events, err = users.GetLoginEvents(ctx, 5999, 10)
+		require.NoError(t, err)
+		assert.Empty(t, events)
+		assert.ErrorIs(t, users.RecordLogin(ctx, &persistence.LoginEvent{UserID: 5999, Provider: "github"}), sql.ErrNoRows)
+	})
+
+	t.Run("Test listing inactive users", func(t *testing.T) {
+		inactive, err := users.GetInactiveUsers(ctx, time.Now().Add(time.Hour))
+		require.NoError(t, err)
+		returning := findActivity(inactive, 5004)
+		require.NotNil(t, returning, "everyone is inactive since a time to come")
+		assert.Equal(t, 2, returning.LoginCount)
+		assert.NotNil(t, returning.LastLoginAt)
+		assert.NotNil(t, returning.UpdatedAt)
+		assert.Equal(t, persistence.UserStatusActive, returning.Status)
+		// Users who never logged in come first
+		assert.Nil(t, inactive[0].LastLoginAt)
+
+		inactive, err = users.GetInactiveUsers(ctx, time.Now().Add(-time.Hour))
+		require.NoError(t, err)
+		assert.Nil(t, findActivity(inactive, 5004))
+		assert.Nil(t, findActivity(inactive, 5000), "users count as active from when they were added")
+	})
+}
+
+func findActivity(users []*persistence.UserActivity, id int32) *persistence.UserActivity {
+	for _, user := range users {
+		if user.ID == id {
+			return user
+		}
+	}
+	return nil
+}
+
+func testPermissions(t *testing.T, users persistence.UserStore, permissions persistence.PermissionStore) {
+	ctx := context.Background()
+	for _, user := range []persistence.UserInfo{{ID: 5001, LoginName: "granted"}, {ID: 5002, LoginName: "also_granted"}} {
+		require.NoError(t, users.UpdateUser(ctx, &user))
+	}
+
+	t.Run("Test granting permissions", func(t *testing.T) {
+		require.NoError(t, permissions.GrantPermission(ctx, 5001, "storetest", "read"))
+		require.NoError(t, permissions.GrantPermission(ctx, 5001, "storetest/ops", "write"))
+		require.NoError(t, permissions.GrantPermission(ctx, 5002, "storetest", "admin"))
+		// Granting the same permission again changes nothing
+		require.NoError(t, permissions.GrantPermission(ctx, 5002, "storetest", "admin"))
+
+		granted, err := permissions.GetUserPermissions(ctx, 5001)
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []*persistence.OrgPermission{
+			{UserID: 5001, OrgID: "storetest", Permission: "read"},
+			{UserID: 5001, OrgID: "storetest/ops", Permission: "write"},
+		}, granted)
+
+		granted, err = permissions.GetOrgPermissions(ctx, "storetest")
+		require.NoError(t, err)
+		assert.Equal(t, []*persistence.OrgPermission{
+			{UserID: 5001, OrgID: "storetest", Permission: "read"},
+			{UserID: 5002, OrgID: "storetest", Permission: "admin"},
+		}, granted)
+
+		for _, userID := range []int32{5001, 5002} {
+			state, err := users.GetAuthState(ctx, userID)
+			require.NoError(t, err)
+			assert.Nil(t, state.TokensNotBefore, "new grants shouldn't end sessions")
+		}
+
+		assert.ErrorIs(t, permissions.GrantPermission(ctx, 5999, "storetest", "read"), sql.ErrNoRows)
+	})
+
+	t.Run("Test looking up several users", func(t *testing.T) {
+		granted, err := permissions.GetPermissionsForUsers(ctx, []int32{5001, 5002, 5999})
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []*persistence.UserPermission{
+			{OrgPermission: persistence.OrgPermission{UserID: 5001, OrgID: "storetest", Permission: "read"}, LoginName: "granted"},
+			{OrgPermission: persistence.OrgPermission{UserID: 5001, OrgID: "storetest/ops", Permission: "write"}, LoginName: "granted"},
+			{OrgPermission: persistence.OrgPermission{UserID: 5002, OrgID: "storetest", Permission: "admin"}, LoginName: "also_granted"},
+		}, granted)
+	})
+
+	t.Run("Test replacing a grant revokes tokens", func(t *testing.T) {
+		require.NoError(t, permissions.GrantPermission(ctx, 5002, "storetest", "read"))
+
+		granted, err := permissions.GetUserPermissions(ctx, 5002)
+		require.NoError(t, err)
+		assert.Equal(t, []*persistence.OrgPermission{{UserID: 5002, OrgID: "storetest", Permission: "read"}}, granted)
+
+		state, err := users.GetAuthState(ctx, 5002)
+		require.NoError(t, err)
+		require.NotNil(t, state.TokensNotBefore)
+		assert.Equal(t, state.TokensNotBefore.Truncate(time.Second), *state.TokensNotBefore, "revocations are kept to the second, like iat")
+	})
+
+	t.Run("Test revoking a grant", func(t *testing.T) {
+		require.NoError(t, permissions.RevokePermission(ctx, 5001, "storetest/ops"))
+
+		granted, err := permissions.GetOrgPermissions(ctx, "storetest/ops")
+		require.NoError(t, err)
+		assert.Empty(t, granted)
+
+		state, err := users.GetAuthState(ctx, 5001)
+		require.NoError(t, err)
+		assert.NotNil(t, state.TokensNotBefore)
+
+		assert.ErrorIs(t, permissions.RevokePermission(ctx, 5001, "storetest/ops"), sql.ErrNoRows)
+	})
+}
@@ -0,0 +1,51 @@
+package persistence_test
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence"
+)
+
+// addTestUser adds a user to the shared database and deletes it again, with everything
+// referring to it, when the test ends. Tests should use ids no other test uses.
+func addTestUser(t *testing.T, db *sql.DB, user *persistence.UserInfo) {
+	t.Helper()
+	require.NoError(t, persistence.NewUserTable(db).UpdateUser(context.Background(), user), "Failed to add user")
+	deleteUsersOnCleanup(t, db, user.ID)
+}
+
+// deleteUsersOnCleanup removes the users, and the rows referring to them, when the test ends
+func deleteUsersOnCleanup(t *testing.T, db *sql.DB, ids ...int32) {
+	t.Cleanup(func() {
+		deleteUsers(t, db, ids...)
+	})
+}
+
+// deleteEmailUserOnCleanup removes the user added for the email, if any, when the test ends
+func deleteEmailUserOnCleanup(t *testing.T, db *sql.DB, email string) {
+	t.Cleanup(func() {
+		var id int32
+		err := db.QueryRow("SELECT id FROM users WHERE provider = 'email' AND LOWER(email) = LOWER($1)", email).Scan(&id)
+		if err == sql.ErrNoRows {
+			return
+		}
+		require.NoError(t, err, "Failed to find email user")
+		deleteUsers(t, db, id)
+	})
+}
+
+func deleteUsers(t *testing.T, db *sql.DB, ids ...int32) {
+	for _, id := range ids {
+		for _, table := range []string{"org_permissions", "webauthn_credentials", "totp_secrets", "recovery_codes", "login_events"} {
+			_, err := db.Exec("DELETE FROM "+table+" WHERE user_id = $1", id)
+			assert.NoError(t, err, "Failed to clean up %s for user %d", table, id)
+		}
+		_, err := db.Exec("DELETE FROM users WHERE id = $1", id)
+		assert.NoError(t, err, "Failed to clean up user %d", id)
+	}
+}
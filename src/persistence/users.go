@@ -1,7 +1,11 @@
 package persistence
 
 import (
+	"context"
 	"database/sql"
+	"time"
+
+	"github.com/pkg/errors"
 
 	"github.com/coopstools-homebrew/I-am-zuul/src/persistence/queries"
 )
@@ -13,33 +17,86 @@ type UserInfo struct {
 	Email     string `json:"email"`
 }
 
+const (
+	UserStatusActive    = "active"
+	UserStatusSuspended = "suspended"
+	UserStatusDeleted   = "deleted"
+)
+
+// AuthState holds the per-user data the auth middleware checks on every request
+type AuthState struct {
+	// Tokens issued before or during this second are no longer valid. It is kept to whole
+	// seconds, the precision of a token's iat, so tokens issued in the second access was
+	// revoked are revoked too.
+	TokensNotBefore *time.Time
+	Status          string
+}
+
+type UserStatus struct {
+	Status    string     `json:"status"`
+	Reason    string     `json:"reason"`
+	ChangedAt *time.Time `json:"changed_at"`
+}
+
+func IsValidUserStatus(status string) bool {
+	return status == UserStatusActive || status == UserStatusSuspended || status == UserStatusDeleted
+}
+
+// LoginEvent is one login, recorded by the GitHub callback or email login
+type LoginEvent struct {
+	UserID    int32     `json:"user_id"`
+	At        time.Time `json:"at"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	// "github" or "email"
+	Provider string `json:"provider"`
+}
+
+// UserActivity is a user with when they were added, last changed and last logged in
+type UserActivity struct {
+	UserInfo
+	Provider    string     `json:"provider"`
+	Status      string     `json:"status"`
+	CreatedAt   *time.Time `json:"created_at"`
+	UpdatedAt   *time.Time `json:"updated_at"`
+	LastLoginAt *time.Time `json:"last_login_at"`
+	LoginCount  int        `json:"login_count"`
+}
+
 type UserTable struct {
-	db *sql.DB
+	db *dialectDB
 }
 
 func NewUserTable(db *sql.DB) *UserTable {
-	return &UserTable{db: db}
+	return &UserTable{db: newDialectDB(db)}
 }
 
-func (ut *UserTable) UpdateUser(user *UserInfo) error {
-	stmt, err := ut.db.Prepare(queries.ADD_OR_UPDATE_USER)
-	if err != nil {
-		return err
-	}
-	defer stmt.Close()
-	_, err = stmt.Exec(user.ID, user.LoginName, user.AvatarURL, user.Email)
+func (ut *UserTable) UpdateUser(ctx context.Context, user *UserInfo) error {
+	_, err := ut.db.ExecContext(ctx, queries.ADD_OR_UPDATE_USER, user.ID, user.LoginName, user.AvatarURL, user.Email)
 	return err
 }
 
-func (ut *UserTable) GetUserByID(id int32) (*UserInfo, error) {
-	row := ut.db.QueryRow(queries.GET_USER_BY_ID, id)
+func (ut *UserTable) GetUserByID(ctx context.Context, id int32) (*UserInfo, error) {
+	row := ut.db.QueryRowContext(ctx, queries.GET_USER_BY_ID, id)
 	var user UserInfo
 	err := row.Scan(&user.ID, &user.LoginName, &user.AvatarURL, &user.Email)
 	return &user, err
 }
 
-func (ut *UserTable) GetAllUsers() ([]*UserInfo, error) {
-	rows, err := ut.db.Query(queries.GET_ALL_USERS)
+// GetOrAddEmailUser returns the user who logs in with the email, adding them on their
+// first login. Their login name is the email, and their id is negative.
+func (ut *UserTable) GetOrAddEmailUser(ctx context.Context, email string) (*UserInfo, error) {
+	row := ut.db.QueryRowContext(ctx, queries.GET_OR_ADD_EMAIL_USER, email)
+	var user UserInfo
+	err := row.Scan(&user.ID, &user.LoginName, &user.AvatarURL, &user.Email)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (ut *UserTable) GetAllUsers(ctx context.Context) ([]*UserInfo, error) {
+	rows, err := ut.db.QueryContext(ctx, queries.GET_ALL_USERS)
 	if err != nil {
 		return nil, err
 	}
@@ -56,3 +113,140 @@ func (ut *UserTable) GetAllUsers() ([]*UserInfo, error) {
 	}
 	return users, nil
 }
+
+func (ut *UserTable) GetAuthState(ctx context.Context, id int32) (*AuthState, error) {
+	row := ut.db.QueryRowContext(ctx, queries.GET_USER_AUTH_STATE, id)
+	var notBefore sql.NullTime
+	var status string
+	err := row.Scan(&notBefore, &status)
+	if err != nil {
+		return nil, err
+	}
+
+	state := AuthState{Status: status}
+	if notBefore.Valid {
+		tokensNotBefore := notBefore.Time.Truncate(time.Second)
+		state.TokensNotBefore = &tokensNotBefore
+	}
+	return &state, nil
+}
+
+func (ut *UserTable) GetUserStatus(ctx context.Context, id int32) (*UserStatus, error) {
+	row := ut.db.QueryRowContext(ctx, queries.GET_USER_STATUS, id)
+	var status UserStatus
+	var changedAt sql.NullTime
+	err := row.Scan(&status.Status, &status.Reason, &changedAt)
+	if err != nil {
+		return nil, err
+	}
+	if changedAt.Valid {
+		status.ChangedAt = &changedAt.Time
+	}
+	return &status, nil
+}
+
+// SetUserStatus changes the user's status, returning sql.ErrNoRows if the user does not
+// exist. Any status but active revokes the user's tokens.
+func (ut *UserTable) SetUserStatus(ctx context.Context, id int32, status, reason string) error {
+	result, err := ut.db.ExecContext(ctx, queries.SET_USER_STATUS, id, status, reason)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// RecordLogin counts a login on the user and adds it to their history, returning
+// sql.ErrNoRows if the user does not exist. The event's time is set by the db.
+func (ut *UserTable) RecordLogin(ctx context.Context, event *LoginEvent) error {
+	tx, err := ut.db.BeginTx(ctx)
+	if err != nil {
+		return errors.Wrap(err, "error starting transaction")
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, queries.RECORD_LOGIN, event.UserID)
+	if err != nil {
+		return errors.Wrap(err, "error recording login")
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return sql.ErrNoRows
+	}
+	_, err = tx.ExecContext(ctx, queries.ADD_LOGIN_EVENT, event.UserID, event.IP, event.UserAgent, event.Provider)
+	if err != nil {
+		return errors.Wrap(err, "error adding login event")
+	}
+	return errors.Wrap(tx.Commit(), "error committing transaction")
+}
+
+// GetLoginEvents returns the user's most recent logins, newest first
+func (ut *UserTable) GetLoginEvents(ctx context.Context, userID int32, limit int) ([]*LoginEvent, error) {
+	rows, err := ut.db.QueryContext(ctx, queries.GET_LOGIN_EVENTS, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []*LoginEvent{}
+	for rows.Next() {
+		var event LoginEvent
+		err := rows.Scan(&event.UserID, &event.At, &event.IP, &event.UserAgent, &event.Provider)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, &event)
+	}
+	return events, rows.Err()
+}
+
+// GetInactiveUsers returns the users who haven't logged in since the time, those who
+// never logged in first. Users who never logged in count from when they were added.
+func (ut *UserTable) GetInactiveUsers(ctx context.Context, since time.Time) ([]*UserActivity, error) {
+	rows, err := ut.db.QueryContext(ctx, queries.GET_INACTIVE_USERS, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []*UserActivity{}
+	for rows.Next() {
+		user, err := scanUserActivity(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+// scanUserActivity reads a row of GET_USER_ACTIVITY or GET_INACTIVE_USERS
+func scanUserActivity(row interface{ Scan(dest ...any) error }) (*UserActivity, error) {
+	var user UserActivity
+	var createdAt, updatedAt, lastLoginAt sql.NullTime
+	err := row.Scan(&user.ID, &user.LoginName, &user.AvatarURL, &user.Email, &user.Provider, &user.Status,
+		&createdAt, &updatedAt, &lastLoginAt, &user.LoginCount)
+	if err != nil {
+		return nil, err
+	}
+	user.CreatedAt = nullTime(createdAt)
+	user.UpdatedAt = nullTime(updatedAt)
+	user.LastLoginAt = nullTime(lastLoginAt)
+	return &user, nil
+}
+
+func nullTime(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
@@ -1,6 +1,8 @@
 package persistence_test
 
 import (
+	"context"
+	"database/sql"
 	"testing"
 
 	"github.com/coopstools-homebrew/I-am-zuul/src/persistence"
@@ -9,6 +11,8 @@ import (
 )
 
 func TestUserTable(t *testing.T) {
+	requirePostgres(t)
+	ctx := context.Background()
 	userTable := persistence.NewUserTable(testDB)
 
 	t.Run("Test adding a user", func(t *testing.T) {
@@ -19,12 +23,12 @@ func TestUserTable(t *testing.T) {
 			Email:     "test@example.com",
 		}
 
-		err := userTable.UpdateUser(&user)
+		err := userTable.UpdateUser(ctx, &user)
 		require.NoError(t, err, "Failed to update user")
 	})
 
 	t.Run("Test getting a user", func(t *testing.T) {
-		user, err := userTable.GetUserByID(1)
+		user, err := userTable.GetUserByID(ctx, 1)
 		require.NoError(t, err, "Failed to get user")
 		require.Equal(t, user.ID, int32(1))
 		require.Equal(t, user.LoginName, "Imma_number_one")
@@ -39,14 +43,37 @@ func TestUserTable(t *testing.T) {
 			AvatarURL: "https://github.com/test2.png",
 			Email:     "test2@example.com",
 		}
-		err := userTable.UpdateUser(&user2)
+		err := userTable.UpdateUser(ctx, &user2)
 		require.NoError(t, err, "Failed to update user")
 
-		users, err := userTable.GetAllUsers()
+		users, err := userTable.GetAllUsers(ctx)
 		require.NoError(t, err, "Failed to get all users")
 		assert.Equal(t, len(users), 2)
 
 		assert.Equal(t, users[0].LoginName, "Imma_number_one")
 		assert.Equal(t, users[1].LoginName, "Imma_number_two")
 	})
+
+	t.Run("Test suspending a user", func(t *testing.T) {
+		state, err := userTable.GetAuthState(ctx, 1)
+		require.NoError(t, err, "Failed to get auth state")
+		assert.Equal(t, persistence.UserStatusActive, state.Status)
+
+		err = userTable.SetUserStatus(ctx, 1, persistence.UserStatusSuspended, "testing")
+		require.NoError(t, err, "Failed to set user status")
+
+		status, err := userTable.GetUserStatus(ctx, 1)
+		require.NoError(t, err, "Failed to get user status")
+		assert.Equal(t, persistence.UserStatusSuspended, status.Status)
+		assert.Equal(t, "testing", status.Reason)
+		assert.NotNil(t, status.ChangedAt)
+
+		err = userTable.SetUserStatus(ctx, 1, persistence.UserStatusActive, "")
+		require.NoError(t, err, "Failed to set user status")
+	})
+
+	t.Run("Test setting status of a missing user", func(t *testing.T) {
+		err := userTable.SetUserStatus(ctx, 404, persistence.UserStatusSuspended, "")
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+	})
 }
@@ -0,0 +1,81 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence/queries"
+)
+
+// WebAuthnCredential is a registered security key or platform authenticator. The
+// credential itself is stored as the json the auth package produces.
+type WebAuthnCredential struct {
+	ID         []byte
+	UserID     int32
+	Name       string
+	Credential []byte
+	CreatedAt  time.Time
+	LastUsedAt *time.Time
+}
+
+type WebAuthnTable struct {
+	db *dialectDB
+}
+
+func NewWebAuthnTable(db *sql.DB) *WebAuthnTable {
+	return &WebAuthnTable{db: newDialectDB(db)}
+}
+
+func (wt *WebAuthnTable) AddCredential(ctx context.Context, credential *WebAuthnCredential) error {
+	_, err := wt.db.ExecContext(ctx, queries.ADD_WEBAUTHN_CREDENTIAL, credential.ID, credential.UserID, credential.Name, credential.Credential)
+	return errors.Wrap(err, "error adding webauthn credential")
+}
+
+func (wt *WebAuthnTable) GetCredentials(ctx context.Context, userID int32) ([]*WebAuthnCredential, error) {
+	rows, err := wt.db.QueryContext(ctx, queries.GET_WEBAUTHN_CREDENTIALS, userID)
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting webauthn credentials")
+	}
+	defer rows.Close()
+
+	credentials := []*WebAuthnCredential{}
+	for rows.Next() {
+		var credential WebAuthnCredential
+		var lastUsedAt sql.NullTime
+		err := rows.Scan(&credential.ID, &credential.UserID, &credential.Name, &credential.Credential, &credential.CreatedAt, &lastUsedAt)
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading webauthn credential")
+		}
+		if lastUsedAt.Valid {
+			credential.LastUsedAt = &lastUsedAt.Time
+		}
+		credentials = append(credentials, &credential)
+	}
+	return credentials, rows.Err()
+}
+
+// UpdateCredential replaces the stored credential json and marks the credential as used
+func (wt *WebAuthnTable) UpdateCredential(ctx context.Context, userID int32, id, credential []byte) error {
+	_, err := wt.db.ExecContext(ctx, queries.UPDATE_WEBAUTHN_CREDENTIAL, userID, id, credential)
+	return errors.Wrap(err, "error updating webauthn credential")
+}
+
+// DeleteCredential removes one of the user's credentials, returning sql.ErrNoRows if
+// they have no such credential
+func (wt *WebAuthnTable) DeleteCredential(ctx context.Context, userID int32, id []byte) error {
+	result, err := wt.db.ExecContext(ctx, queries.DELETE_WEBAUTHN_CREDENTIAL, userID, id)
+	if err != nil {
+		return errors.Wrap(err, "error deleting webauthn credential")
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package persistence_test
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebAuthnTable(t *testing.T) {
+	requirePostgres(t)
+	ctx := context.Background()
+	webAuthnTable := persistence.NewWebAuthnTable(testDB)
+
+	addTestUser(t, testDB, &persistence.UserInfo{ID: 20, LoginName: "keyholder", AvatarURL: "", Email: ""})
+
+	t.Run("Test adding and getting credentials", func(t *testing.T) {
+		err := webAuthnTable.AddCredential(ctx, &persistence.WebAuthnCredential{
+			ID:         []byte{1, 2, 3},
+			UserID:     20,
+			Name:       "yubikey",
+			Credential: []byte(`{"sign_count": 0}`),
+		})
+		require.NoError(t, err, "Failed to add credential")
+
+		credentials, err := webAuthnTable.GetCredentials(ctx, 20)
+		require.NoError(t, err, "Failed to get credentials")
+		require.Len(t, credentials, 1)
+		assert.Equal(t, []byte{1, 2, 3}, credentials[0].ID)
+		assert.Equal(t, "yubikey", credentials[0].Name)
+		assert.Nil(t, credentials[0].LastUsedAt)
+	})
+
+	t.Run("Test updating a credential", func(t *testing.T) {
+		err := webAuthnTable.UpdateCredential(ctx, 20, []byte{1, 2, 3}, []byte(`{"sign_count": 1}`))
+		require.NoError(t, err, "Failed to update credential")
+
+		credentials, err := webAuthnTable.GetCredentials(ctx, 20)
+		require.NoError(t, err, "Failed to get credentials")
+		assert.JSONEq(t, `{"sign_count": 1}`, string(credentials[0].Credential))
+		assert.NotNil(t, credentials[0].LastUsedAt)
+	})
+
+	t.Run("Test deleting a credential", func(t *testing.T) {
+		err := webAuthnTable.DeleteCredential(ctx, 20, []byte{1, 2, 3})
+		require.NoError(t, err, "Failed to delete credential")
+
+		err = webAuthnTable.DeleteCredential(ctx, 20, []byte{1, 2, 3})
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+	})
+}
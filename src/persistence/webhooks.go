@@ -0,0 +1,112 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/pkg/errors"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence/queries"
+)
+
+// WebhookDelivery describes the access changes caused by a single GitHub webhook delivery
+type WebhookDelivery struct {
+	ID    string
+	Event string
+
+	// Individual grants to remove
+	RevokedPermissions []OrgPermission
+	// Users removed from an org, who lose their grants on it and on its teams ("<org>/<team>")
+	RevokedUserOrgs []OrgPermission
+	// Orgs (or org/team slugs) for which every grant is removed
+	RevokedOrgs []string
+	// Users whose existing tokens are invalidated, in addition to those losing a permission
+	RevokedUsers []int32
+}
+
+type WebhookTable struct {
+	db *dialectDB
+}
+
+func NewWebhookTable(db *sql.DB) *WebhookTable {
+	return &WebhookTable{db: newDialectDB(db)}
+}
+
+// ApplyDelivery records the delivery and applies its changes in a single transaction.
+// It returns false, without changing anything, if the delivery was already processed.
+func (wt *WebhookTable) ApplyDelivery(ctx context.Context, delivery *WebhookDelivery) (bool, error) {
+	tx, err := wt.db.BeginTx(ctx)
+	if err != nil {
+		return false, errors.Wrap(err, "error beginning transaction")
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, queries.RECORD_WEBHOOK_DELIVERY, delivery.ID, delivery.Event)
+	if err != nil {
+		return false, errors.Wrap(err, "error recording delivery")
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return false, errors.Wrap(err, "error checking recorded delivery")
+	}
+	if inserted == 0 {
+		return false, nil
+	}
+
+	revokedUsers := append([]int32{}, delivery.RevokedUsers...)
+	for _, permission := range delivery.RevokedPermissions {
+		_, err = tx.ExecContext(ctx, queries.DELETE_ORG_PERMISSION, permission.UserID, permission.OrgID)
+		if err != nil {
+			return false, errors.Wrapf(err, "error revoking permission for user %d on %s", permission.UserID, permission.OrgID)
+		}
+		revokedUsers = append(revokedUsers, permission.UserID)
+	}
+
+	for _, removed := range delivery.RevokedUserOrgs {
+		_, err = tx.ExecContext(ctx, queries.DELETE_USER_ORG_PERMISSIONS, removed.UserID, removed.OrgID)
+		if err != nil {
+			return false, errors.Wrapf(err, "error revoking permissions for user %d on %s and its teams", removed.UserID, removed.OrgID)
+		}
+		revokedUsers = append(revokedUsers, removed.UserID)
+	}
+
+	for _, orgID := range delivery.RevokedOrgs {
+		userIDs, err := deleteOrgPermissions(ctx, tx, orgID)
+		if err != nil {
+			return false, errors.Wrapf(err, "error revoking permissions on %s", orgID)
+		}
+		revokedUsers = append(revokedUsers, userIDs...)
+	}
+
+	if len(revokedUsers) > 0 {
+		_, err = tx.ExecContext(ctx, queries.REVOKE_USER_TOKENS, wt.db.dialect.array(revokedUsers))
+		if err != nil {
+			return false, errors.Wrap(err, "error revoking user tokens")
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return false, errors.Wrap(err, "error committing transaction")
+	}
+	return true, nil
+}
+
+func deleteOrgPermissions(ctx context.Context, tx *dialectTx, orgID string) ([]int32, error) {
+	rows, err := tx.QueryContext(ctx, queries.DELETE_ORG_PERMISSIONS_FOR_ORG, orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	userIDs := []int32{}
+	for rows.Next() {
+		var userID int32
+		err := rows.Scan(&userID)
+		if err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, userID)
+	}
+	return userIDs, rows.Err()
+}
@@ -0,0 +1,49 @@
+package persistence_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/persistence"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookTable(t *testing.T) {
+	requirePostgres(t)
+	ctx := context.Background()
+	userTable := persistence.NewUserTable(testDB)
+	webhookTable := persistence.NewWebhookTable(testDB)
+
+	addTestUser(t, testDB, &persistence.UserInfo{ID: 10, LoginName: "leaving", AvatarURL: "", Email: ""})
+	_, err := testDB.Exec(`INSERT INTO org_permissions (user_id, org_id, permission) 
+		VALUES (10, 'coopstools', 'read'), (10, 'coopstools/admins', 'admin'), (10, 'coopstoolsfans', 'read')`)
+	require.NoError(t, err, "Failed to add permissions")
+
+	// The member leaves the org, losing its teams' grants too
+	delivery := &persistence.WebhookDelivery{
+		ID:              "delivery-1",
+		Event:           "organization",
+		RevokedUserOrgs: []persistence.OrgPermission{{UserID: 10, OrgID: "coopstools"}},
+	}
+
+	t.Run("Test applying a delivery", func(t *testing.T) {
+		applied, err := webhookTable.ApplyDelivery(ctx, delivery)
+		require.NoError(t, err, "Failed to apply delivery")
+		assert.True(t, applied)
+
+		permissions, err := persistence.NewPermissionTable(testDB).GetUserPermissions(ctx, 10)
+		require.NoError(t, err)
+		assert.Equal(t, []*persistence.OrgPermission{{UserID: 10, OrgID: "coopstoolsfans", Permission: "read"}}, permissions)
+
+		state, err := userTable.GetAuthState(ctx, 10)
+		require.NoError(t, err, "Failed to get auth state")
+		assert.NotNil(t, state.TokensNotBefore)
+	})
+
+	t.Run("Test redelivery is ignored", func(t *testing.T) {
+		applied, err := webhookTable.ApplyDelivery(ctx, delivery)
+		require.NoError(t, err, "Failed to apply delivery")
+		assert.False(t, applied)
+	})
+}
@@ -0,0 +1,119 @@
+// Package proxy lets Zuul stand in front of other services as an authenticating
+// reverse proxy.
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/auth"
+	"github.com/coopstools-homebrew/I-am-zuul/src/config"
+	"github.com/coopstools-homebrew/I-am-zuul/src/verifier"
+)
+
+type route struct {
+	config.ProxyRoute
+	handler http.HandlerFunc
+}
+
+// Gatekeeper authenticates requests with the auth middleware and forwards those allowed
+// by the matching route to its upstream
+type Gatekeeper struct {
+	policy *auth.AccessPolicy
+	routes []*route
+}
+
+func NewGatekeeper(routes []config.ProxyRoute, authMiddleware func(http.HandlerFunc) http.HandlerFunc, signingSecret string) (*Gatekeeper, error) {
+	if signingSecret == "" {
+		return nil, fmt.Errorf("a signing secret is required")
+	}
+
+	g := &Gatekeeper{}
+	rules := []config.AccessRule{}
+	for _, r := range routes {
+		upstream, err := url.Parse(r.Upstream)
+		if err != nil || upstream.Scheme == "" || upstream.Host == "" {
+			return nil, fmt.Errorf("invalid upstream %q for %s", r.Upstream, r.PathPrefix)
+		}
+
+		rt := &route{ProxyRoute: r}
+		reverseProxy := &httputil.ReverseProxy{
+			Rewrite: rt.rewrite(upstream, []byte(signingSecret)),
+			// Flush immediately so streamed responses aren't buffered
+			FlushInterval: -1,
+		}
+		if r.Public {
+			rt.handler = reverseProxy.ServeHTTP
+		} else {
+			rt.handler = authMiddleware(rt.authorize(reverseProxy))
+		}
+
+		g.routes = append(g.routes, rt)
+		rules = append(rules, r.AccessRule)
+	}
+	g.policy = auth.NewAccessPolicy(rules)
+	return g, nil
+}
+
+func (g *Gatekeeper) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	i := g.policy.MatchIndex(r.Host, r.Method, r.URL.Path)
+	if i < 0 {
+		http.NotFound(w, r)
+		return
+	}
+	g.routes[i].handler(w, r)
+}
+
+// authorize checks the route's permission requirement against the caller's claims
+func (rt *route) authorize(next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := verifier.FromContext(r.Context())
+		if !ok || !auth.Allows(&rt.AccessRule, claims) {
+			log.Printf("Gatekeeper refused %s %s", r.Method, r.URL.Path)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+func (rt *route) rewrite(upstream *url.URL, secret []byte) func(*httputil.ProxyRequest) {
+	return func(pr *httputil.ProxyRequest) {
+		if rt.StripPrefix {
+			pr.Out.URL.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(pr.Out.URL.Path, rt.PathPrefix), "/")
+			pr.Out.URL.RawPath = ""
+		}
+		pr.SetURL(upstream)
+		pr.SetXForwarded()
+
+		// Upstreams get signed identity headers instead of the caller's Zuul token
+		for _, name := range identityHeaders {
+			pr.Out.Header.Del(name)
+		}
+		removeAuthToken(pr.Out)
+
+		if claims, ok := verifier.FromContext(pr.In.Context()); ok {
+			auth.SetIdentityHeaders(pr.Out.Header, claims)
+			signIdentity(pr.Out.Header, secret)
+		}
+	}
+}
+
+// removeAuthToken drops the auth_token cookie and any bearer token from the outgoing request
+func removeAuthToken(r *http.Request) {
+	if scheme, _, _ := strings.Cut(r.Header.Get("Authorization"), " "); strings.EqualFold(scheme, "Bearer") {
+		r.Header.Del("Authorization")
+	}
+
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, cookie := range cookies {
+		if cookie.Name != "auth_token" {
+			r.AddCookie(cookie)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/config"
+	"github.com/coopstools-homebrew/I-am-zuul/src/verifier"
+	"github.com/coopstools-homebrew/I-am-zuul/src/verifier/verifiertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testSecret = "shared-secret"
+
+func TestGatekeeper(t *testing.T) {
+	var received *http.Request
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	defer upstream.Close()
+
+	issuer := verifiertest.NewIssuer(t)
+	gatekeeper, err := NewGatekeeper([]config.ProxyRoute{
+		{AccessRule: config.AccessRule{PathPrefix: "/app"}, Upstream: upstream.URL, StripPrefix: true},
+		{AccessRule: config.AccessRule{PathPrefix: "/admin", OrgID: "coopstools", Permission: "admin"}, Upstream: upstream.URL},
+		{AccessRule: config.AccessRule{PathPrefix: "/public", Public: true}, Upstream: upstream.URL},
+	}, issuer.Verifier().Middleware, testSecret)
+	require.NoError(t, err)
+	server := httptest.NewServer(gatekeeper)
+	defer server.Close()
+
+	claims := verifier.Claims{UserID: 7, Username: "octocat", Permissions: map[string]string{"coopstools": "read"}}
+	get := func(path string, modify func(*http.Request)) *http.Response {
+		received = nil
+		req, _ := http.NewRequest("GET", server.URL+path, nil)
+		if modify != nil {
+			modify(req)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	t.Run("Test authenticated request is forwarded with signed identity", func(t *testing.T) {
+		resp := get("/app/things", func(req *http.Request) {
+			req.AddCookie(issuer.Cookie(claims))
+			req.AddCookie(&http.Cookie{Name: "theme", Value: "dark"})
+			req.Header.Set("X-Zuul-Permissions", "coopstools:admin")
+		})
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		body, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, "/things", string(body))
+
+		require.NotNil(t, received)
+		_, err := received.Cookie("auth_token")
+		assert.ErrorIs(t, err, http.ErrNoCookie)
+		theme, err := received.Cookie("theme")
+		require.NoError(t, err)
+		assert.Equal(t, "dark", theme.Value)
+		assert.Equal(t, "7", received.Header.Get("X-Zuul-User"))
+		assert.Equal(t, "octocat", received.Header.Get("X-Zuul-Login"))
+		assert.Equal(t, "coopstools:read", received.Header.Get("X-Zuul-Permissions"))
+		assert.NoError(t, VerifyIdentity(received.Header, []byte(testSecret), time.Minute))
+		assert.Error(t, VerifyIdentity(received.Header, []byte("other-secret"), time.Minute))
+	})
+
+	t.Run("Test bearer token is not forwarded", func(t *testing.T) {
+		resp := get("/app", func(req *http.Request) {
+			req.Header.Set("Authorization", "Bearer "+issuer.Token(claims))
+		})
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Empty(t, received.Header.Get("Authorization"))
+	})
+
+	t.Run("Test unauthenticated request is refused", func(t *testing.T) {
+		resp := get("/app", nil)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		assert.Nil(t, received)
+	})
+
+	t.Run("Test missing permission is refused", func(t *testing.T) {
+		resp := get("/admin", func(req *http.Request) { req.AddCookie(issuer.Cookie(claims)) })
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+		assert.Nil(t, received)
+	})
+
+	t.Run("Test public route strips spoofed identity", func(t *testing.T) {
+		resp := get("/public/page", func(req *http.Request) { req.Header.Set("X-Zuul-User", "1") })
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Empty(t, received.Header.Get("X-Zuul-User"))
+		assert.Equal(t, "/public/page", received.URL.Path)
+	})
+
+	t.Run("Test unmatched path", func(t *testing.T) {
+		resp := get("/elsewhere", nil)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+}
+
+func TestGatekeeperStreamsAndUpgrades(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") == "websocket" {
+			conn, rw, err := http.NewResponseController(w).Hijack()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+			rw.Flush()
+			line, _ := rw.ReadString('\n')
+			rw.WriteString("echo " + line)
+			rw.Flush()
+			return
+		}
+		fmt.Fprintln(w, "first")
+		http.NewResponseController(w).Flush()
+		<-release
+		fmt.Fprintln(w, "second")
+	}))
+	defer upstream.Close()
+
+	issuer := verifiertest.NewIssuer(t)
+	gatekeeper, err := NewGatekeeper([]config.ProxyRoute{
+		{AccessRule: config.AccessRule{PathPrefix: "/"}, Upstream: upstream.URL},
+	}, issuer.Verifier().Middleware, testSecret)
+	require.NoError(t, err)
+	server := httptest.NewServer(gatekeeper)
+	defer server.Close()
+	cookie := issuer.Cookie(verifier.Claims{UserID: 7, Username: "octocat"})
+
+	t.Run("Test streamed response is flushed", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", server.URL+"/events", nil)
+		req.AddCookie(cookie)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		reader := bufio.NewReader(resp.Body)
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "first\n", line)
+		close(release)
+		line, err = reader.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "second\n", line)
+	})
+
+	t.Run("Test websocket upgrade", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", server.URL+"/socket", nil)
+		req.AddCookie(cookie)
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+
+		conn, ok := resp.Body.(io.ReadWriteCloser)
+		require.True(t, ok)
+		_, err = io.WriteString(conn, "hello\n")
+		require.NoError(t, err)
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "echo hello\n", line)
+	})
+}
@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var identityHeaders = []string{"X-Zuul-User", "X-Zuul-Login", "X-Zuul-Permissions", "X-Zuul-Timestamp", "X-Zuul-Signature"}
+
+func identitySignature(header http.Header, secret []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strings.Join([]string{
+		header.Get("X-Zuul-User"),
+		header.Get("X-Zuul-Login"),
+		header.Get("X-Zuul-Permissions"),
+		header.Get("X-Zuul-Timestamp"),
+	}, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signIdentity timestamps and signs the identity headers so upstreams can tell they
+// came from the gatekeeper
+func signIdentity(header http.Header, secret []byte) {
+	header.Set("X-Zuul-Timestamp", strconv.FormatInt(time.Now().Unix(), 10))
+	header.Set("X-Zuul-Signature", identitySignature(header, secret))
+}
+
+// VerifyIdentity lets upstreams check the identity headers were signed with the shared
+// secret within maxAge
+func VerifyIdentity(header http.Header, secret []byte, maxAge time.Duration) error {
+	expected := identitySignature(header, secret)
+	if !hmac.Equal([]byte(expected), []byte(header.Get("X-Zuul-Signature"))) {
+		return errors.New("invalid identity signature")
+	}
+
+	timestamp, err := strconv.ParseInt(header.Get("X-Zuul-Timestamp"), 10, 64)
+	if err != nil {
+		return errors.New("invalid identity timestamp")
+	}
+	if time.Since(time.Unix(timestamp, 0)) > maxAge {
+		return errors.New("identity headers expired")
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package verifier
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Claims are the contents of a token issued by Zuul
+type Claims struct {
+	UserID   int32  `json:"user_id"`
+	Username string `json:"username"`
+	// Path on Zuul the token was issued for, e.g. "/" for sessions
+	Path string `json:"path"`
+	// The caller's permission in each org (or org/team) they have been granted access to
+	Permissions map[string]string `json:"permissions,omitempty"`
+	// When the user last logged in with GitHub
+	AuthTime *jwt.NumericDate `json:"auth_time,omitempty"`
+	// Authentication methods used for this session, e.g. ["github", "webauthn"] or ["email"]
+	AMR []string `json:"amr,omitempty"`
+	// Space separated orgs (or org/teams) the token is limited to; empty means all
+	Scope string `json:"scope,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// Values of the amr claim
+const (
+	AMRGitHub       = "github"
+	AMREmail        = "email"
+	AMRWebAuthn     = "webauthn"
+	AMROTP          = "otp"
+	AMRRecoveryCode = "recovery_code"
+)
+
+// HasAMR reports whether the session used the authentication method
+func (c *Claims) HasAMR(method string) bool {
+	return slices.Contains(c.AMR, method)
+}
+
+// PathInScope reports whether a token issued for the scope path may be used for the
+// request path: either the same path or one beneath it
+func PathInScope(scope, requestPath string) bool {
+	if scope == "" {
+		return false
+	}
+	if scope == requestPath || scope == "/" {
+		return true
+	}
+	return strings.HasPrefix(requestPath, strings.TrimSuffix(scope, "/")+"/")
+}
+
+// ForService reports whether the token was issued for a service: made for its audience
+// if it has one, or otherwise a token without an audience issued for the service's path
+// on Zuul (sessions, issued for "/", cover every path)
+func (c *Claims) ForService(audience, path string) bool {
+	if audience != "" {
+		return slices.Contains(c.Audience, audience)
+	}
+	return len(c.Audience) == 0 && PathInScope(c.Path, path)
+}
+
+// Scopes lists the orgs the token is limited to, if it is limited
+func (c *Claims) Scopes() []string {
+	return strings.Fields(c.Scope)
+}
+
+// HasPermission reports whether the caller holds the permission on the org
+func (c *Claims) HasPermission(orgID, permission string) bool {
+	return c.Permissions[orgID] == permission
+}
+
+// Validate is called by the jwt parser after the registered claims have been checked
+func (c *Claims) Validate() error {
+	if c.UserID == 0 {
+		return errors.New("token has no user_id")
+	}
+	if c.IssuedAt == nil || c.ExpiresAt == nil {
+		return errors.New("token must have iat and exp")
+	}
+	return nil
+}
+
+const cookiePrefix = "ghsso_"
+
+// TokenFromRequest returns the raw token from the auth_token cookie or an
+// "Authorization: Bearer" header, or an empty string if there is none
+func TokenFromRequest(r *http.Request) string {
+	if scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " "); found && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimPrefix(strings.TrimSpace(token), cookiePrefix)
+	}
+	cookie, err := r.Cookie("auth_token")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimPrefix(cookie.Value, cookiePrefix)
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying the caller's claims
+func NewContext(ctx context.Context, claims *Claims) context.Context {
+	return context.WithValue(ctx, contextKey{}, claims)
+}
+
+// FromContext returns the claims of the authenticated caller, if any
+func FromContext(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(contextKey{}).(*Claims)
+	return claims, ok
+}
@@ -0,0 +1,65 @@
+package verifier
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"math/big"
+)
+
+// JWK is an RSA public key in JSON Web Key form
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+func encodeInt(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// KeyID is the RFC 7638 thumbprint of the key, used as the kid of tokens it signs
+func KeyID(publicKey *rsa.PublicKey) string {
+	n := encodeInt(publicKey.N.Bytes())
+	e := encodeInt(big.NewInt(int64(publicKey.E)).Bytes())
+	// Members in lexicographic order, no whitespace
+	thumbprint := sha256.Sum256([]byte(`{"e":"` + e + `","kty":"RSA","n":"` + n + `"}`))
+	return base64.RawURLEncoding.EncodeToString(thumbprint[:])
+}
+
+func NewJWK(publicKey *rsa.PublicKey) JWK {
+	return JWK{
+		Kty: "RSA",
+		Kid: KeyID(publicKey),
+		Use: "sig",
+		Alg: "RS256",
+		N:   encodeInt(publicKey.N.Bytes()),
+		E:   encodeInt(big.NewInt(int64(publicKey.E)).Bytes()),
+	}
+}
+
+func (k JWK) PublicKey() (*rsa.PublicKey, error) {
+	if k.Kty != "RSA" {
+		return nil, errors.New("unsupported key type " + k.Kty)
+	}
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, err
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(new(big.Int).SetBytes(e).Int64()),
+	}, nil
+}
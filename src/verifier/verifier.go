@@ -0,0 +1,212 @@
+// Package verifier validates Zuul tokens in downstream services. It fetches Zuul's
+// signing keys from its JWKS endpoint, so services only need to know where Zuul lives.
+//
+//	v := verifier.New("https://zuul.example.com/.well-known/jwks.json", nil)
+//	http.HandleFunc("/things", v.Middleware(func(w http.ResponseWriter, r *http.Request) {
+//		claims, _ := verifier.FromContext(r.Context())
+//		...
+//	}))
+//
+// Only the signature and the token's own claims are checked. Revocations and suspensions
+// recorded in Zuul's database take effect in downstream services when the token expires.
+//
+// Without an Audience, only Zuul's session tokens are accepted: tokens with no audience,
+// issued for "/" (or Options.Path). Tokens Zuul made for a client app, and tokens limited
+// to other paths on Zuul, are refused.
+package verifier
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	ErrNoToken    = errors.New("no token found")
+	ErrUnknownKey = errors.New("token signed by unknown key")
+	// The token was made for another client or path
+	ErrNotForService = errors.New("token not issued for this service")
+	// The caller is authenticated but not allowed in
+	ErrPermissionDenied = errors.New("permission denied")
+	// The token could not be checked, e.g. because the keys or the db can't be reached;
+	// the caller may retry
+	ErrUnavailable = errors.New("token validation unavailable")
+)
+
+// TokenValidator is implemented by Verifier and by Zuul's own authenticator, which also
+// checks revocations and suspensions
+type TokenValidator interface {
+	Verify(ctx context.Context, tokenString string) (*Claims, error)
+}
+
+type Options struct {
+	HTTPClient *http.Client
+	// How long fetched keys are used before they are fetched again; defaults to an hour
+	CacheTTL time.Duration
+	// Minimum time between fetches caused by tokens with an unknown kid; defaults to a minute
+	MinRefreshInterval time.Duration
+	// If set, tokens must list this audience, as the tokens Zuul issues for a client do
+	Audience string
+	// Without an Audience, the path on Zuul that tokens must have been issued for, or be
+	// beneath; defaults to "/", the path of session tokens
+	Path string
+}
+
+type Verifier struct {
+	jwksURL string
+	options Options
+	parser  *jwt.Parser
+
+	mu          sync.Mutex
+	keys        map[string]interface{}
+	lastRefresh time.Time
+}
+
+// New creates a verifier for tokens signed by the keys published at jwksURL. Options may be nil.
+func New(jwksURL string, options *Options) *Verifier {
+	v := &Verifier{jwksURL: jwksURL, keys: map[string]interface{}{}}
+	if options != nil {
+		v.options = *options
+	}
+	if v.options.HTTPClient == nil {
+		v.options.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	if v.options.CacheTTL == 0 {
+		v.options.CacheTTL = time.Hour
+	}
+	if v.options.MinRefreshInterval == 0 {
+		v.options.MinRefreshInterval = time.Minute
+	}
+	if v.options.Path == "" {
+		v.options.Path = "/"
+	}
+
+	v.parser = jwt.NewParser(jwt.WithValidMethods([]string{"RS256"}), jwt.WithIssuedAt())
+	return v
+}
+
+func (v *Verifier) fetchKeys(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", v.jwksURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := v.options.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("jwks endpoint returned %d", resp.StatusCode)
+	}
+
+	var jwks JWKS
+	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		return err
+	}
+
+	keys := map[string]interface{}{}
+	for _, jwk := range jwks.Keys {
+		key, err := jwk.PublicKey()
+		if err != nil {
+			log.Printf("Skipping jwk %s: %v", jwk.Kid, err)
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	v.keys = keys
+	v.lastRefresh = time.Now()
+	return nil
+}
+
+// key looks up the signing key, fetching the JWKS when the cache is stale or the kid is
+// unknown. Unknown kids trigger at most one fetch per MinRefreshInterval.
+func (v *Verifier) key(ctx context.Context, kid string) (interface{}, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	sinceRefresh := time.Since(v.lastRefresh)
+	key, known := v.keys[kid]
+	if known && sinceRefresh < v.options.CacheTTL {
+		return key, nil
+	}
+	if !known && sinceRefresh < v.options.MinRefreshInterval {
+		return nil, ErrUnknownKey
+	}
+
+	if err := v.fetchKeys(ctx); err != nil {
+		if known {
+			// Keep serving the stale key rather than failing every request
+			log.Printf("Failed to refresh jwks, using cached keys: %v", err)
+			return key, nil
+		}
+		return nil, fmt.Errorf("%w: error fetching jwks: %w", ErrUnavailable, err)
+	}
+
+	key, known = v.keys[kid]
+	if !known {
+		return nil, ErrUnknownKey
+	}
+	return key, nil
+}
+
+// Verify validates the token and returns its claims
+func (v *Verifier) Verify(ctx context.Context, tokenString string) (*Claims, error) {
+	if tokenString == "" {
+		return nil, ErrNoToken
+	}
+
+	claims := &Claims{}
+	_, err := v.parser.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return v.key(ctx, kid)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !claims.ForService(v.options.Audience, v.options.Path) {
+		return nil, ErrNotForService
+	}
+	return claims, nil
+}
+
+// Middleware rejects requests without a valid token and puts the caller's claims in the
+// request context
+func (v *Verifier) Middleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, err := v.Verify(r.Context(), TokenFromRequest(r))
+		if err != nil {
+			log.Printf("Invalid token: %v", err)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized - Invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), claims)))
+	}
+}
+
+// RequirePermission rejects callers without the permission on the org. It must run
+// after Middleware.
+func RequirePermission(orgID, permission string) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := FromContext(r.Context())
+			if !ok {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			if !claims.HasPermission(orgID, permission) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package verifier_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/coopstools-homebrew/I-am-zuul/src/verifier"
+	"github.com/coopstools-homebrew/I-am-zuul/src/verifier/verifiertest"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerify(t *testing.T) {
+	issuer := verifiertest.NewIssuer(t)
+	v := issuer.Verifier()
+	ctx := context.Background()
+
+	t.Run("Test valid token", func(t *testing.T) {
+		claims, err := v.Verify(ctx, issuer.Token(verifier.Claims{
+			UserID:      7,
+			Username:    "octo",
+			Permissions: map[string]string{"coopstools": "admin"},
+		}))
+		require.NoError(t, err)
+		assert.Equal(t, int32(7), claims.UserID)
+		assert.Equal(t, "octo", claims.Username)
+		assert.True(t, claims.HasPermission("coopstools", "admin"))
+		assert.False(t, claims.HasPermission("coopstools", "read"))
+	})
+
+	t.Run("Test expired token", func(t *testing.T) {
+		_, err := v.Verify(ctx, issuer.Token(verifier.Claims{
+			UserID: 7,
+			RegisteredClaims: jwt.RegisteredClaims{
+				IssuedAt:  jwt.NewNumericDate(time.Now().Add(-2 * time.Hour)),
+				ExpiresAt: jwt.NewNumericDate(time.Now().Add(-time.Hour)),
+			},
+		}))
+		assert.ErrorIs(t, err, jwt.ErrTokenExpired)
+	})
+
+	t.Run("Test token without user", func(t *testing.T) {
+		_, err := v.Verify(ctx, issuer.Token(verifier.Claims{Username: "nobody"}))
+		assert.Error(t, err)
+	})
+
+	t.Run("Test token from another issuer", func(t *testing.T) {
+		other := verifiertest.NewIssuer(t)
+		_, err := v.Verify(ctx, other.Token(verifier.Claims{UserID: 7}))
+		assert.ErrorIs(t, err, verifier.ErrUnknownKey)
+	})
+
+	t.Run("Test key rotation", func(t *testing.T) {
+		issuer.RotateKey()
+		_, err := v.Verify(ctx, issuer.Token(verifier.Claims{UserID: 7}))
+		assert.NoError(t, err)
+	})
+
+	t.Run("Test missing token", func(t *testing.T) {
+		_, err := v.Verify(ctx, "")
+		assert.ErrorIs(t, err, verifier.ErrNoToken)
+	})
+}
+
+func TestAudience(t *testing.T) {
+	issuer := verifiertest.NewIssuer(t)
+	v := verifier.New(issuer.JWKSURL(), &verifier.Options{Audience: "resume"})
+
+	_, err := v.Verify(context.Background(), issuer.Token(verifier.Claims{UserID: 7}))
+	assert.Error(t, err)
+
+	_, err = v.Verify(context.Background(), issuer.Token(verifier.Claims{
+		UserID:           7,
+		RegisteredClaims: jwt.RegisteredClaims{Audience: jwt.ClaimStrings{"resume"}},
+	}))
+	assert.NoError(t, err)
+}
+
+func TestPathAndAudience(t *testing.T) {
+	ctx := context.Background()
+	issuer := verifiertest.NewIssuer(t)
+	v := issuer.Verifier()
+
+	_, err := v.Verify(ctx, issuer.Token(verifier.Claims{UserID: 7, Path: "/nowhere"}))
+	assert.ErrorIs(t, err, verifier.ErrNotForService, "tokens limited to a path aren't sessions")
+	_, err = v.Verify(ctx, issuer.Token(verifier.Claims{
+		UserID:           7,
+		RegisteredClaims: jwt.RegisteredClaims{Audience: jwt.ClaimStrings{"resume"}},
+	}))
+	assert.ErrorIs(t, err, verifier.ErrNotForService, "tokens made for a client need a verifier expecting it")
+
+	scoped := verifier.New(issuer.JWKSURL(), &verifier.Options{Path: "/resume"})
+	_, err = scoped.Verify(ctx, issuer.Token(verifier.Claims{UserID: 7, Path: "/resume"}))
+	assert.NoError(t, err)
+	_, err = scoped.Verify(ctx, issuer.Token(verifier.Claims{UserID: 7}))
+	assert.NoError(t, err, "sessions cover every path")
+	_, err = scoped.Verify(ctx, issuer.Token(verifier.Claims{UserID: 7, Path: "/blog"}))
+	assert.ErrorIs(t, err, verifier.ErrNotForService)
+}
+
+func TestMiddleware(t *testing.T) {
+	issuer := verifiertest.NewIssuer(t)
+	v := issuer.Verifier()
+	handler := v.Middleware(verifier.RequirePermission("coopstools", "admin")(func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := verifier.FromContext(r.Context())
+		require.True(t, ok)
+		w.Write([]byte(claims.Username))
+	}))
+
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+	admin := verifier.Claims{UserID: 1, Username: "boss", Permissions: map[string]string{"coopstools": "admin"}}
+
+	t.Run("Test cookie", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(issuer.Cookie(admin))
+		rec := serve(req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "boss", rec.Body.String())
+	})
+
+	t.Run("Test bearer token", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+issuer.Token(admin))
+		assert.Equal(t, http.StatusOK, serve(req).Code)
+	})
+
+	t.Run("Test missing permission", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+issuer.Token(verifier.Claims{UserID: 2}))
+		assert.Equal(t, http.StatusForbidden, serve(req).Code)
+	})
+
+	t.Run("Test missing token", func(t *testing.T) {
+		rec := serve(httptest.NewRequest("GET", "/", nil))
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+		assert.Equal(t, "Bearer", rec.Header().Get("WWW-Authenticate"))
+	})
+}